@@ -25,11 +25,30 @@ import (
 	metadatasyncer "sigs.k8s.io/vsphere-csi-driver/pkg/syncer"
 )
 
+var (
+	enableLeaderElection   = flag.Bool("leader-election", false, "Enable leader election so that only one syncer replica updates CNS at a time.")
+	leaderElectionNS       = flag.String("leader-election-namespace", "", "Namespace of the leader election Lease. Defaults to the namespace of the pod.")
+	leaderElectionLease    = flag.String("leader-election-lease-name", metadatasyncer.DefaultLeaseName, "Name of the leader election Lease.")
+	leaderElectionDuration = flag.Duration("leader-election-lease-duration", metadatasyncer.DefaultLeaseDuration, "Duration standby replicas wait before forcing to acquire leadership.")
+	leaderElectionDeadline = flag.Duration("leader-election-renew-deadline", metadatasyncer.DefaultRenewDeadline, "Duration the leader retries refreshing leadership before giving it up.")
+	leaderElectionRetry    = flag.Duration("leader-election-retry-period", metadatasyncer.DefaultRetryPeriod, "Duration replicas wait between attempts to acquire or renew leadership.")
+	dryRun                 = flag.Bool("dry-run", false, "Log the CNS operations and publish the operations planned by full sync instead of performing them.")
+)
+
 // main is ignored when this package is built as a go plug-in.
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
 	metadataSyncer := metadatasyncer.NewInformer()
+	metadataSyncer.SetLeaderElectionConfig(metadatasyncer.LeaderElectionConfig{
+		Enabled:       *enableLeaderElection,
+		Namespace:     *leaderElectionNS,
+		LeaseName:     *leaderElectionLease,
+		LeaseDuration: *leaderElectionDuration,
+		RenewDeadline: *leaderElectionDeadline,
+		RetryPeriod:   *leaderElectionRetry,
+	})
+	metadataSyncer.SetDryRun(*dryRun)
 	if err := metadataSyncer.Init(); err != nil {
 		klog.Errorf("Error initializing Metadata Syncer")
 		os.Exit(1)
@@ -0,0 +1,275 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/ctl"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+const usage = `Usage: vsphere-csi-ctl [--config PATH] [--kubeconfig PATH] COMMAND [ARGS]
+
+Inspects and repairs the CNS volumes of the cluster.
+
+Commands:
+    volumes                 Lists the CNS volumes of the cluster ID and the
+                            PVs of the driver with their PVC, pods, datastore
+                            and attachments
+    show VOLUME             Shows a volume and the nodes whose VM has the
+                            disk attached in vCenter
+    diff VOLUME             Shows the differences between the CNS metadata
+                            of a volume and Kubernetes
+    resync VOLUME           Updates the CNS metadata of a volume from
+                            Kubernetes
+    detach [--force] VOLUME NODE
+                            Detaches a volume from the VM of a node. Refused
+                            while a running pod on the node uses the volume
+                            or a VolumeAttachment to the node exists, unless
+                            --force is set
+
+VOLUME is a CNS volume ID or a PV name.
+`
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	cfgPath := os.Getenv(cnsconfig.EnvCloudConfig)
+	if cfgPath == "" {
+		cfgPath = cnsconfig.DefaultCloudConfigPath
+	}
+	flag.StringVar(&cfgPath, "config", cfgPath, "Path of the config file")
+	kubeconfig := flag.String("kubeconfig", "", "Path of the kubeconfig file. Defaults to the in-cluster config")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	tool, err := newTool(ctx, cfgPath, *kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(run(ctx, tool, flag.Args(), os.Stdout))
+}
+
+// newTool connects to vCenter and Kubernetes.
+func newTool(ctx context.Context, cfgPath string, kubeconfig string) (*ctl.Tool, error) {
+	cfg, err := cnsconfig.GetCnsconfig(cfgPath)
+	if err != nil {
+		klog.Errorf("Failed to parse config. Err: %v", err)
+		return nil, err
+	}
+	vcconfig, err := cnsvsphere.GetVirtualCenterConfig(cfg)
+	if err != nil {
+		klog.Errorf("Failed to get VirtualCenterConfig. err=%v", err)
+		return nil, err
+	}
+	vc, err := cnsvsphere.GetVirtualCenterManager().RegisterVirtualCenter(vcconfig)
+	if err != nil {
+		klog.Errorf("Failed to register VirtualCenter. err=%v", err)
+		return nil, err
+	}
+	if err = vc.Connect(ctx); err != nil {
+		klog.Errorf("Failed to connect to VirtualCenter host: %q. err=%v", vcconfig.Host, err)
+		return nil, err
+	}
+	if err = vc.ConnectCNS(ctx); err != nil {
+		klog.Errorf("Failed to connect to CNS of VirtualCenter host: %q. err=%v", vcconfig.Host, err)
+		return nil, err
+	}
+	var k8sclient clientset.Interface
+	if kubeconfig != "" {
+		k8sclient, err = k8s.CreateKubernetesClientFromConfig(kubeconfig)
+	} else {
+		k8sclient, err = k8s.NewClient()
+	}
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
+		return nil, err
+	}
+	return &ctl.Tool{
+		ClusterID:        cfg.Global.ClusterID,
+		ContainerCluster: cnsvsphere.GetContainerCluster(cfg.Global.ClusterID, cfg.VirtualCenter[vcconfig.Host].User),
+		VolumeManager:    cnsvolume.GetManager(vc),
+		K8sClient:        k8sclient,
+		Metadata:         cfg.Metadata,
+		NodeVM: func(ctx context.Context, node *v1.Node) (*cnsvsphere.VirtualMachine, error) {
+			return nodeVM(ctx, vc, node)
+		},
+	}, nil
+}
+
+// nodeVM finds the VM of the node by the UUID of its provider ID.
+func nodeVM(ctx context.Context, vc *cnsvsphere.VirtualCenter, node *v1.Node) (*cnsvsphere.VirtualMachine, error) {
+	uuid := common.GetUUIDFromProviderID(node.Spec.ProviderID)
+	if uuid == "" {
+		return nil, fmt.Errorf("node %s has no provider ID", node.Name)
+	}
+	dcs, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, dc := range dcs {
+		vm, err := dc.GetVirtualMachineByUUID(ctx, uuid, false)
+		if err == nil {
+			return vm, nil
+		}
+	}
+	return nil, fmt.Errorf("no VM with UUID %s found for node %s", uuid, node.Name)
+}
+
+// run runs the command and returns the exit code.
+func run(ctx context.Context, tool *ctl.Tool, args []string, out io.Writer) int {
+	switch args[0] {
+	case "volumes":
+		infos, err := tool.ListVolumes(ctx)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to list volumes: %v\n", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VOLUME ID\tPV\tPVC\tPODS\tDATASTORE\tATTACHED TO")
+		for _, info := range infos {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.VolumeID, pvName(info), pvcName(info),
+				podNames(info), orNone(info.Datastore()), orNone(strings.Join(info.AttachedNodes(), ",")))
+		}
+		w.Flush()
+		return 0
+	case "show":
+		if len(args) != 2 {
+			fmt.Fprint(out, usage)
+			return 2
+		}
+		info, err := tool.Show(ctx, args[1])
+		if err != nil {
+			fmt.Fprintf(out, "Failed to show volume %s: %v\n", args[1], err)
+			return 1
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Volume ID:\t%s\n", info.VolumeID)
+		fmt.Fprintf(w, "In CNS:\t%t\n", info.CNS != nil)
+		fmt.Fprintf(w, "PV:\t%s\n", pvName(info))
+		fmt.Fprintf(w, "PVC:\t%s\n", pvcName(info))
+		fmt.Fprintf(w, "Pods:\t%s\n", podNames(info))
+		fmt.Fprintf(w, "Datastore:\t%s\n", orNone(info.Datastore()))
+		fmt.Fprintf(w, "VolumeAttachments:\t%s\n", orNone(strings.Join(info.AttachedNodes(), ",")))
+		fmt.Fprintf(w, "Attached in vCenter:\t%s\n", orNone(strings.Join(info.AttachedVMs, ",")))
+		w.Flush()
+		printDiffs(out, ctl.Diff(info))
+		return 0
+	case "diff":
+		if len(args) != 2 {
+			fmt.Fprint(out, usage)
+			return 2
+		}
+		info, err := tool.GetVolume(ctx, args[1])
+		if err != nil {
+			fmt.Fprintf(out, "Failed to get volume %s: %v\n", args[1], err)
+			return 1
+		}
+		printDiffs(out, ctl.Diff(info))
+		return 0
+	case "resync":
+		if len(args) != 2 {
+			fmt.Fprint(out, usage)
+			return 2
+		}
+		diffs, err := tool.Resync(ctx, args[1])
+		if err != nil {
+			fmt.Fprintf(out, "Failed to resync volume %s: %v\n", args[1], err)
+			return 1
+		}
+		fmt.Fprintf(out, "Resynced volume %s.\n", args[1])
+		printDiffs(out, diffs)
+		return 0
+	case "detach":
+		flags := flag.NewFlagSet("detach", flag.ContinueOnError)
+		flags.SetOutput(out)
+		flags.Usage = func() { fmt.Fprint(out, usage) }
+		force := flags.Bool("force", false, "Skip the safety checks")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 2 {
+			fmt.Fprint(out, usage)
+			return 2
+		}
+		if err := tool.Detach(ctx, flags.Arg(0), flags.Arg(1), *force); err != nil {
+			fmt.Fprintf(out, "Failed to detach volume %s from node %s: %v\n", flags.Arg(0), flags.Arg(1), err)
+			return 1
+		}
+		fmt.Fprintf(out, "Detached volume %s from node %s.\n", flags.Arg(0), flags.Arg(1))
+		return 0
+	default:
+		fmt.Fprint(out, usage)
+		return 2
+	}
+}
+
+func printDiffs(out io.Writer, diffs []ctl.MetadataDiff) {
+	if len(diffs) == 0 {
+		fmt.Fprintln(out, "CNS metadata is in sync with Kubernetes.")
+		return
+	}
+	for _, diff := range diffs {
+		fmt.Fprintln(out, diff)
+	}
+}
+
+func pvName(info *ctl.VolumeInfo) string {
+	if info.PV == nil {
+		return "<none>"
+	}
+	return info.PV.Name
+}
+
+func pvcName(info *ctl.VolumeInfo) string {
+	if info.PVC == nil {
+		return "<none>"
+	}
+	return info.PVC.Namespace + "/" + info.PVC.Name
+}
+
+func podNames(info *ctl.VolumeInfo) string {
+	var names []string
+	for _, pod := range info.Pods {
+		names = append(names, pod.Namespace+"/"+pod.Name)
+	}
+	return orNone(strings.Join(names, ","))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+const configUsage = `Usage: vsphere-csi config validate [--config PATH]
+
+Validates the config file and prints the effective configuration, merged
+with the VSPHERE_* environment variables, along with the source of each
+value. Secrets are redacted, and credential Secrets are not read. Unknown
+keys are reported as errors.
+`
+
+// runConfigCommand runs the "config" subcommand and returns the exit code.
+func runConfigCommand(args []string, out io.Writer) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprint(out, configUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() { fmt.Fprint(out, configUsage) }
+	cfgPath := os.Getenv(cnsconfig.EnvCloudConfig)
+	if cfgPath == "" {
+		cfgPath = cnsconfig.DefaultCloudConfigPath
+	}
+	flags.StringVar(&cfgPath, "config", cfgPath, "Path of the config file")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, values, err := cnsconfig.Describe(cfgPath)
+	if err == nil {
+		_, err = limiter.ConfigFromCnsConfig(cfg)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "Invalid config %s: %v\n", cfgPath, err)
+		return 1
+	}
+	fmt.Fprintf(out, "Config %s is valid.\n\n", cfgPath)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, v := range values {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Key, v.Value, v.Source)
+	}
+	w.Flush()
+	return 0
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"flag"
+	"os"
 
 	"github.com/rexray/gocsi"
 	"k8s.io/klog"
@@ -29,6 +30,9 @@ import (
 
 // main is ignored when this package is built as a go plug-in.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:], os.Stdout))
+	}
 	klog.InitFlags(nil)
 	flag.Parse()
 	gocsi.Run(
@@ -43,4 +47,13 @@ const usage = `    VSPHERE_CSI_CONFIG
         Specifies the path to the csi-vsphere.conf file
 
         The default value is "/etc/cloud/csi-vsphere.conf"
+
+    VSPHERE_CSI_HEALTH_ADDRESS
+        Specifies the address on which the /healthz and /readyz endpoints
+        are served, for example ":9809"
+
+        The endpoints are disabled if the variable is not set
+
+    The "vsphere-csi config validate" command validates the config file and
+    prints the effective configuration with the source of each value
 `
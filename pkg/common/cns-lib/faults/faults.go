@@ -0,0 +1,197 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// EnvFaultInjectionConfig is the environment variable holding the path of
+// the fault injection config file. Fault injection is disabled when the
+// variable is unset.
+const EnvFaultInjectionConfig = "VSPHERE_CSI_FAULT_INJECTION"
+
+// Operations which faults can be injected in.
+const (
+	Connect              = "Connect"
+	CreateVolume         = "CreateVolume"
+	AttachVolume         = "AttachVolume"
+	DetachVolume         = "DetachVolume"
+	DeleteVolume         = "DeleteVolume"
+	UpdateVolumeMetadata = "UpdateVolumeMetadata"
+	QueryVolume          = "QueryVolume"
+	QueryAllVolume       = "QueryAllVolume"
+)
+
+var operations = map[string]bool{
+	Connect: true, CreateVolume: true, AttachVolume: true, DetachVolume: true,
+	DeleteVolume: true, UpdateVolumeMetadata: true, QueryVolume: true, QueryAllVolume: true,
+}
+
+// faultErrors are the errors of the named faults, as returned by CNS.
+var faultErrors = map[string]error{
+	"resource-in-use":    errors.New("The resource 'volume' is in use."),
+	"not-found":          errors.New("The object or item referred to could not be found."),
+	"connection-refused": &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+}
+
+// Rule describes the fault injected in an operation.
+type Rule struct {
+	// Probability is the probability in [0, 1] that a call fails.
+	Probability float64 `json:"probability"`
+	// Fault is the name of a CNS fault: resource-in-use, not-found or
+	// connection-refused.
+	Fault string `json:"fault,omitempty"`
+	// Error is the message of the error returned, if Fault is not set.
+	Error string `json:"error,omitempty"`
+	// Timeout makes failing calls hang for the duration, for example "30s",
+	// and fail with context.DeadlineExceeded.
+	Timeout string `json:"timeout,omitempty"`
+
+	timeout time.Duration
+	err     error
+}
+
+// Config is the fault injection config file.
+type Config struct {
+	// Operations maps operation names to the fault injected in them.
+	Operations map[string]*Rule `json:"operations"`
+}
+
+// Injector injects faults in operations according to a Config.
+type Injector struct {
+	lock   sync.Mutex
+	rand   *rand.Rand
+	config *Config
+}
+
+var (
+	// injectorInstance is the Injector singleton, nil when disabled.
+	injectorInstance *Injector
+	// onceForInjector is used for initializing the Injector singleton.
+	onceForInjector sync.Once
+)
+
+// GetInjector returns the Injector configured by the file given in
+// EnvFaultInjectionConfig, or nil if fault injection is disabled.
+func GetInjector() *Injector {
+	onceForInjector.Do(func() {
+		cfgPath := os.Getenv(EnvFaultInjectionConfig)
+		if cfgPath == "" {
+			return
+		}
+		injector, err := Load(cfgPath)
+		if err != nil {
+			klog.Errorf("Fault injection is disabled, failed to load %s. Err: %v", cfgPath, err)
+			return
+		}
+		for op, rule := range injector.config.Operations {
+			klog.Warningf("FAULT INJECTION IS ACTIVE: %s fails with probability %v (fault: %q, error: %q, timeout: %q)",
+				op, rule.Probability, rule.Fault, rule.Error, rule.Timeout)
+		}
+		injectorInstance = injector
+	})
+	return injectorInstance
+}
+
+// Load reads and validates the fault injection config file.
+func Load(cfgPath string) (*Injector, error) {
+	data, err := ioutil.ReadFile(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err = yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	return New(config)
+}
+
+// New returns an Injector for the validated config.
+func New(config *Config) (*Injector, error) {
+	for op, rule := range config.Operations {
+		if !operations[op] {
+			return nil, fmt.Errorf("unknown operation %q", op)
+		}
+		if rule == nil || rule.Probability < 0 || rule.Probability > 1 {
+			return nil, fmt.Errorf("probability of %s must be between 0 and 1", op)
+		}
+		switch {
+		case rule.Fault != "":
+			if rule.err = faultErrors[rule.Fault]; rule.err == nil {
+				return nil, fmt.Errorf("unknown fault %q for %s", rule.Fault, op)
+			}
+		case rule.Error != "":
+			rule.err = errors.New(rule.Error)
+		case rule.Timeout == "":
+			return nil, fmt.Errorf("one of fault, error or timeout must be set for %s", op)
+		}
+		if rule.Timeout != "" {
+			timeout, err := time.ParseDuration(rule.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout for %s: %v", op, err)
+			}
+			rule.timeout = timeout
+			if rule.err == nil {
+				rule.err = context.DeadlineExceeded
+			}
+		}
+	}
+	return &Injector{
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		config: config,
+	}, nil
+}
+
+// Inject returns the injected error if the call of op must fail, after the
+// timeout of the rule or when ctx is done. It returns nil on a nil Injector.
+func (i *Injector) Inject(ctx context.Context, op string) error {
+	if i == nil {
+		return nil
+	}
+	rule, ok := i.config.Operations[op]
+	if !ok {
+		return nil
+	}
+	i.lock.Lock()
+	fail := i.rand.Float64() < rule.Probability
+	i.lock.Unlock()
+	if !fail {
+		return nil
+	}
+	klog.Warningf("Injecting fault in %s: %v", op, rule.err)
+	if rule.timeout > 0 {
+		select {
+		case <-time.After(rule.timeout):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return rule.err
+}
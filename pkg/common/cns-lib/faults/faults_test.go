@@ -0,0 +1,70 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package faults
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInject(t *testing.T) {
+	injector, err := New(&Config{
+		Operations: map[string]*Rule{
+			CreateVolume: {Probability: 1, Fault: "resource-in-use"},
+			DeleteVolume: {Probability: 0, Error: "never"},
+			Connect:      {Probability: 1, Timeout: "10ms"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = injector.Inject(ctx, CreateVolume); err == nil || err.Error() != "The resource 'volume' is in use." {
+		t.Errorf("unexpected CreateVolume error: %v", err)
+	}
+	if err = injector.Inject(ctx, DeleteVolume); err != nil {
+		t.Errorf("unexpected DeleteVolume error: %v", err)
+	}
+	if err = injector.Inject(ctx, QueryVolume); err != nil {
+		t.Errorf("unexpected QueryVolume error: %v", err)
+	}
+	start := time.Now()
+	if err = injector.Inject(ctx, Connect); err != context.DeadlineExceeded {
+		t.Errorf("unexpected Connect error: %v", err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Errorf("Connect fault returned before its timeout")
+	}
+	if err = (*Injector)(nil).Inject(ctx, Connect); err != nil {
+		t.Errorf("nil injector returned %v", err)
+	}
+
+	for name, rule := range map[string]*Rule{
+		"unknown fault":       {Probability: 1, Fault: "unknown"},
+		"invalid probability": {Probability: 2, Error: "error"},
+		"no fault":            {Probability: 1},
+		"invalid timeout":     {Probability: 1, Timeout: "soon"},
+	} {
+		if _, err = New(&Config{Operations: map[string]*Rule{AttachVolume: rule}}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err = New(&Config{Operations: map[string]*Rule{"Unknown": {Probability: 1, Error: "error"}}}); err == nil {
+		t.Errorf("unknown operation: expected an error")
+	}
+}
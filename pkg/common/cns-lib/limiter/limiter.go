@@ -0,0 +1,310 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+// Class is a class of vCenter operations sharing a budget.
+type Class string
+
+const (
+	// CreateDelete is the class of CNS volume create and delete tasks.
+	CreateDelete Class = "create-delete"
+	// AttachDetach is the class of CNS volume attach and detach tasks.
+	AttachDetach Class = "attach-detach"
+	// Metadata is the class of CNS volume metadata updates.
+	Metadata Class = "metadata"
+	// Query is the class of CNS queries and property collector calls.
+	Query Class = "query"
+)
+
+// Classes lists the operation classes in scheduling order.
+var Classes = []Class{AttachDetach, CreateDelete, Metadata, Query}
+
+// Budget limits the operations of a class. Zero values mean no limit.
+type Budget struct {
+	// QPS is the rate at which operations are started.
+	QPS float64
+	// Burst is the number of operations that can be started at once.
+	Burst int
+	// Concurrency is the number of operations running at the same time.
+	Concurrency int
+}
+
+// Config configures the limiter.
+type Config struct {
+	// MaxConcurrency is the number of operations of all classes running at
+	// the same time. Zero means no limit.
+	MaxConcurrency int
+	// Budgets are the budgets of the operation classes.
+	Budgets map[Class]Budget
+	// MaxWait bounds the time an operation whose context has no deadline
+	// waits for a slot. Zero means no bound.
+	MaxWait time.Duration
+}
+
+// DefaultConfig returns the default limits.
+func DefaultConfig() Config {
+	return Config{
+		MaxConcurrency: 32,
+		Budgets: map[Class]Budget{
+			CreateDelete: {QPS: 10, Burst: 20, Concurrency: 16},
+			AttachDetach: {QPS: 10, Burst: 20, Concurrency: 16},
+			Metadata:     {QPS: 5, Burst: 10, Concurrency: 8},
+			Query:        {QPS: 20, Burst: 40, Concurrency: 16},
+		},
+		MaxWait: 5 * time.Minute,
+	}
+}
+
+// ConfigFromCnsConfig returns the limiter config given by the Global
+// max-concurrent-operations and max-operation-wait-seconds keys and the Limit
+// sections of cfg, on top of the default limits.
+func ConfigFromCnsConfig(cfg *cnsconfig.Config) (Config, error) {
+	limits := DefaultConfig()
+	if cfg == nil {
+		return limits, nil
+	}
+	if cfg.Global.MaxConcurrentOperations != 0 {
+		limits.MaxConcurrency = cfg.Global.MaxConcurrentOperations
+	}
+	if cfg.Global.MaxOperationWaitSeconds < 0 {
+		return limits, fmt.Errorf("max-operation-wait-seconds must not be negative, got %d", cfg.Global.MaxOperationWaitSeconds)
+	}
+	if cfg.Global.MaxOperationWaitSeconds != 0 {
+		limits.MaxWait = time.Duration(cfg.Global.MaxOperationWaitSeconds) * time.Second
+	}
+	for name, limit := range cfg.Limit {
+		class := Class(name)
+		budget, ok := limits.Budgets[class]
+		if !ok {
+			return limits, fmt.Errorf("unknown operation class %q in Limit section, valid classes are %v", name, Classes)
+		}
+		if limit.QPS != 0 {
+			budget.QPS = limit.QPS
+		}
+		if limit.Burst != 0 {
+			budget.Burst = limit.Burst
+		}
+		if limit.Concurrency != 0 {
+			budget.Concurrency = limit.Concurrency
+		}
+		limits.Budgets[class] = budget
+	}
+	return limits, nil
+}
+
+// waiter is an operation waiting for a slot.
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// classState is the state of the operations of a class.
+type classState struct {
+	budget  Budget
+	rate    *rate.Limiter
+	running int
+	queue   []*waiter
+}
+
+// Limiter limits the rate and concurrency of vCenter operations per class.
+// When operations of several classes wait for a slot, the slots are handed
+// out round robin across the classes, so that no class can starve another.
+type Limiter struct {
+	lock           sync.Mutex
+	maxConcurrency int
+	maxWait        time.Duration
+	running        int
+	classes        map[Class]*classState
+	// next is the index in Classes of the class served first on the next
+	// dispatch.
+	next int
+}
+
+var (
+	// limiterInstance is a Limiter singleton.
+	limiterInstance *Limiter
+	// onceForLimiter is used for initializing the Limiter singleton.
+	onceForLimiter sync.Once
+)
+
+// GetLimiter returns the Limiter singleton, initialized with the default
+// limits.
+func GetLimiter() *Limiter {
+	onceForLimiter.Do(func() {
+		klog.V(1).Infof("Initializing limiter.Limiter...")
+		limiterInstance = New(DefaultConfig())
+		klog.V(1).Infof("limiter.Limiter initialized")
+	})
+	return limiterInstance
+}
+
+// Configure applies the limits given by cfg to the Limiter singleton.
+func Configure(cfg *cnsconfig.Config) error {
+	limits, err := ConfigFromCnsConfig(cfg)
+	if err != nil {
+		klog.Errorf("Failed to get limiter config. Err: %v", err)
+		return err
+	}
+	GetLimiter().SetConfig(limits)
+	return nil
+}
+
+// New returns a Limiter with the given limits.
+func New(cfg Config) *Limiter {
+	l := &Limiter{classes: make(map[Class]*classState)}
+	for _, class := range Classes {
+		l.classes[class] = &classState{}
+	}
+	l.SetConfig(cfg)
+	return l
+}
+
+// SetConfig applies new limits. Running operations are not affected.
+func (l *Limiter) SetConfig(cfg Config) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.maxConcurrency = cfg.MaxConcurrency
+	l.maxWait = cfg.MaxWait
+	for _, class := range Classes {
+		cs := l.classes[class]
+		cs.budget = cfg.Budgets[class]
+		limit, burst := rate.Inf, cs.budget.Burst
+		if cs.budget.QPS > 0 {
+			limit = rate.Limit(cs.budget.QPS)
+			if burst <= 0 {
+				burst = 1
+			}
+		}
+		if cs.rate == nil || cs.rate.Limit() != limit || cs.rate.Burst() != burst {
+			cs.rate = rate.NewLimiter(limit, burst)
+		}
+	}
+	klog.V(2).Infof("Limiter configured with max concurrency %d, max wait %v and budgets %+v", cfg.MaxConcurrency, cfg.MaxWait, cfg.Budgets)
+	l.dispatch()
+}
+
+// Acquire waits until an operation of the class may start and returns the
+// function to call once it is done. An error is returned if ctx is done
+// before, or if ctx has no deadline and the wait exceeds the max wait.
+func (l *Limiter) Acquire(ctx context.Context, class Class) (func(), error) {
+	cs, ok := l.classes[class]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation class %q", class)
+	}
+	start := time.Now()
+	waiting.WithLabelValues(string(class)).Inc()
+	defer waiting.WithLabelValues(string(class)).Dec()
+
+	l.lock.Lock()
+	rateLimiter, maxWait := cs.rate, l.maxWait
+	l.lock.Unlock()
+	if _, ok := ctx.Deadline(); !ok && maxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxWait)
+		defer cancel()
+	}
+	if err := rateLimiter.Wait(ctx); err != nil {
+		klog.V(4).Infof("Operation of class %s not started: %v", class, err)
+		return nil, err
+	}
+	w := &waiter{ready: make(chan struct{})}
+	l.lock.Lock()
+	cs.queue = append(cs.queue, w)
+	l.dispatch()
+	l.lock.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		l.lock.Lock()
+		granted := w.granted
+		if !granted {
+			for i := range cs.queue {
+				if cs.queue[i] == w {
+					cs.queue = append(cs.queue[:i], cs.queue[i+1:]...)
+					break
+				}
+			}
+		}
+		l.lock.Unlock()
+		if !granted {
+			klog.V(4).Infof("Operation of class %s not started after %v: %v", class, time.Since(start), ctx.Err())
+			return nil, ctx.Err()
+		}
+	}
+	waitDuration.WithLabelValues(string(class)).Observe(time.Since(start).Seconds())
+	running.WithLabelValues(string(class)).Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			running.WithLabelValues(string(class)).Dec()
+			l.release(cs)
+		})
+	}, nil
+}
+
+// release frees the slot of a finished operation.
+func (l *Limiter) release(cs *classState) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	cs.running--
+	l.running--
+	l.dispatch()
+}
+
+// dispatch grants slots to waiting operations, one class after another,
+// until no slot is free or no operation waits. It must be called with the
+// lock held.
+func (l *Limiter) dispatch() {
+	for {
+		granted := false
+		for i := range Classes {
+			idx := (l.next + i) % len(Classes)
+			cs := l.classes[Classes[idx]]
+			if len(cs.queue) == 0 || (cs.budget.Concurrency > 0 && cs.running >= cs.budget.Concurrency) {
+				continue
+			}
+			if l.maxConcurrency > 0 && l.running >= l.maxConcurrency {
+				return
+			}
+			w := cs.queue[0]
+			cs.queue = cs.queue[1:]
+			cs.running++
+			l.running++
+			w.granted = true
+			close(w.ready)
+			l.next = (idx + 1) % len(Classes)
+			granted = true
+			break
+		}
+		if !granted {
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+func TestFairScheduling(t *testing.T) {
+	l := New(Config{MaxConcurrency: 1, Budgets: map[Class]Budget{}})
+	ctx := context.Background()
+
+	release, err := l.Acquire(ctx, Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := make(chan Class, 4)
+	start := func(class Class) {
+		go func() {
+			done, err := l.Acquire(ctx, class)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- class
+			done()
+		}()
+		// Let the operation join its queue
+		time.Sleep(20 * time.Millisecond)
+	}
+	start(Metadata)
+	start(Metadata)
+	start(AttachDetach)
+	release()
+
+	var got []Class
+	for i := 0; i < 3; i++ {
+		got = append(got, <-order)
+	}
+	if got[0] != AttachDetach && got[1] != AttachDetach {
+		t.Errorf("attach was starved by metadata updates: %v", got)
+	}
+}
+
+func TestAcquireCanceled(t *testing.T) {
+	l := New(Config{Budgets: map[Class]Budget{Query: {Concurrency: 1}}})
+	release, err := l.Acquire(context.Background(), Query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, Query); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	release()
+	if l.classes[Query].running != 0 || len(l.classes[Query].queue) != 0 {
+		t.Errorf("canceled operation was not removed: %+v", l.classes[Query])
+	}
+}
+
+func TestAcquireMaxWait(t *testing.T) {
+	l := New(Config{Budgets: map[Class]Budget{Query: {Concurrency: 1}}, MaxWait: 20 * time.Millisecond})
+	release, err := l.Acquire(context.Background(), Query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := l.Acquire(context.Background(), Query); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestConfigFromCnsConfig(t *testing.T) {
+	cfg := &cnsconfig.Config{
+		Limit: map[string]*cnsconfig.LimitConfig{
+			string(AttachDetach): {Concurrency: 4},
+		},
+	}
+	cfg.Global.MaxConcurrentOperations = 8
+	cfg.Global.MaxOperationWaitSeconds = 60
+	limits, err := ConfigFromCnsConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.MaxConcurrency != 8 || limits.MaxWait != time.Minute || limits.Budgets[AttachDetach].Concurrency != 4 ||
+		limits.Budgets[AttachDetach].QPS != DefaultConfig().Budgets[AttachDetach].QPS {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+	cfg.Limit["unknown"] = &cnsconfig.LimitConfig{}
+	if _, err := ConfigFromCnsConfig(cfg); err == nil {
+		t.Error("expected error for unknown operation class")
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limiter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// waiting is the number of operations waiting to be started per class.
+	waiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vsphere_csi_vcenter_operations_waiting",
+		Help: "Number of vCenter operations waiting for the limiter per operation class.",
+	}, []string{"class"})
+	// running is the number of running operations per class.
+	running = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vsphere_csi_vcenter_operations_running",
+		Help: "Number of running vCenter operations per operation class.",
+	}, []string{"class"})
+	// waitDuration is the time operations waited for the limiter per class.
+	waitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vsphere_csi_vcenter_operation_wait_seconds",
+		Help:    "Time vCenter operations waited for the limiter per operation class.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"class"})
+)
+
+func init() {
+	prometheus.MustRegister(waiting, running, waitDuration)
+}
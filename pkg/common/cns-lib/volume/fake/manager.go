@@ -0,0 +1,503 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+// Operation is a method of the volume.Manager interface.
+type Operation string
+
+const (
+	// CreateVolume is the CreateVolume operation.
+	CreateVolume Operation = "CreateVolume"
+	// AttachVolume is the AttachVolume operation.
+	AttachVolume Operation = "AttachVolume"
+	// DetachVolume is the DetachVolume operation.
+	DetachVolume Operation = "DetachVolume"
+	// DeleteVolume is the DeleteVolume operation.
+	DeleteVolume Operation = "DeleteVolume"
+	// UpdateVolumeMetadata is the UpdateVolumeMetadata operation.
+	UpdateVolumeMetadata Operation = "UpdateVolumeMetadata"
+	// UpdateVolumeMetadataBatch is the UpdateVolumeMetadataBatch operation.
+	UpdateVolumeMetadataBatch Operation = "UpdateVolumeMetadataBatch"
+	// QueryVolume is the QueryVolume operation.
+	QueryVolume Operation = "QueryVolume"
+	// QueryAllVolume is the QueryAllVolume operation.
+	QueryAllVolume Operation = "QueryAllVolume"
+)
+
+// DefaultDatastoreURL is the URL of the datastore of volumes created without
+// a datastore.
+const DefaultDatastoreURL = "ds:///vmfs/volumes/fake-datastore/"
+
+// ErrVolumeNotFound is returned for operations on a volume which doesn't
+// exist.
+var ErrVolumeNotFound = errors.New("The object or item referred to could not be found.")
+
+// fault is an error returned by an operation instead of running it.
+type fault struct {
+	err error
+	// times is the number of calls still failing, negative for all calls.
+	times int
+}
+
+// volume is the state of a volume.
+type volume struct {
+	cnstypes.CnsVolume
+	diskUUID   string
+	attachedTo *vimtypes.ManagedObjectReference
+}
+
+// Manager is a volume.Manager keeping volumes, their metadata and
+// attachments in memory, like CNS would. Errors and latency can be injected
+// per operation to exercise the fault paths of callers.
+type Manager struct {
+	lock          sync.Mutex
+	volumes       map[string]*volume
+	datastoreURLs map[string]string
+	faults        map[Operation]*fault
+	volumeFaults  map[string]*fault
+	latency       map[Operation]time.Duration
+	calls         map[Operation]int
+}
+
+var _ cnsvolume.Manager = &Manager{}
+
+// NewManager returns a Manager without volumes.
+func NewManager() *Manager {
+	return &Manager{
+		volumes:       make(map[string]*volume),
+		datastoreURLs: make(map[string]string),
+		faults:        make(map[Operation]*fault),
+		volumeFaults:  make(map[string]*fault),
+		latency:       make(map[Operation]time.Duration),
+		calls:         make(map[Operation]int),
+	}
+}
+
+// SetDatastoreURL sets the URL reported for volumes created on the datastore.
+func (m *Manager) SetDatastoreURL(datastore vimtypes.ManagedObjectReference, url string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.datastoreURLs[datastore.Value] = url
+}
+
+// InjectFault makes the next times calls of op fail with err. If times is
+// zero or negative, all calls fail until the fault is cleared.
+func (m *Manager) InjectFault(op Operation, err error, times int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if times <= 0 {
+		times = -1
+	}
+	m.faults[op] = &fault{err: err, times: times}
+}
+
+// InjectTaskFault makes the next times calls of op fail like a CNS task
+// reporting a fault with the given localized message.
+func (m *Manager) InjectTaskFault(op Operation, message string, times int) {
+	m.InjectFault(op, errors.New(message), times)
+}
+
+// InjectVolumeFault makes the next times metadata updates of the volume fail
+// with err, like a CNS task reporting a fault for this volume only. If times
+// is zero or negative, all updates fail until the fault is cleared.
+func (m *Manager) InjectVolumeFault(volumeID string, err error, times int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if times <= 0 {
+		times = -1
+	}
+	m.volumeFaults[volumeID] = &fault{err: err, times: times}
+}
+
+// ClearFaults removes all injected faults.
+func (m *Manager) ClearFaults() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.faults = make(map[Operation]*fault)
+	m.volumeFaults = make(map[string]*fault)
+}
+
+// SetLatency delays every call of op by d.
+func (m *Manager) SetLatency(op Operation, d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.latency[op] = d
+}
+
+// Calls returns the number of calls of op, including failed ones.
+func (m *Manager) Calls(op Operation) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.calls[op]
+}
+
+// Volume returns a copy of the volume with the given ID.
+func (m *Manager) Volume(volumeID string) (cnstypes.CnsVolume, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	vol, ok := m.volumes[volumeID]
+	if !ok {
+		return cnstypes.CnsVolume{}, false
+	}
+	return copyVolume(vol.CnsVolume), true
+}
+
+// AttachedTo returns the virtual machine the volume is attached to.
+func (m *Manager) AttachedTo(volumeID string) (vimtypes.ManagedObjectReference, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	vol, ok := m.volumes[volumeID]
+	if !ok || vol.attachedTo == nil {
+		return vimtypes.ManagedObjectReference{}, false
+	}
+	return *vol.attachedTo, true
+}
+
+// begin records a call of op, waits for its latency and returns the injected
+// fault if any. The lock is held when it returns nil.
+func (m *Manager) begin(op Operation) error {
+	m.lock.Lock()
+	m.calls[op]++
+	latency := m.latency[op]
+	m.lock.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	m.lock.Lock()
+	if f, ok := m.faults[op]; ok {
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				delete(m.faults, op)
+			}
+		}
+		m.lock.Unlock()
+		klog.V(4).Infof("fake: %s failed with injected fault: %v", op, f.err)
+		return f.err
+	}
+	return nil
+}
+
+// CreateVolume creates a new volume given its spec. A block backing with a
+// backing disk ID registers the existing disk under that ID, as for
+// statically provisioned volumes.
+func (m *Manager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+	if err := m.begin(CreateVolume); err != nil {
+		return nil, err
+	}
+	defer m.lock.Unlock()
+	vol := &volume{
+		CnsVolume: cnstypes.CnsVolume{
+			VolumeId:     cnstypes.CnsVolumeId{Id: uuid.New()},
+			Name:         spec.Name,
+			VolumeType:   spec.VolumeType,
+			DatastoreUrl: DefaultDatastoreURL,
+			Metadata:     copyMetadata(spec.Metadata),
+		},
+		diskUUID: uuid.New(),
+	}
+	if backing, ok := spec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails); ok {
+		vol.BackingObjectDetails = backing.CnsBackingObjectDetails
+		if backing.BackingDiskId != "" {
+			if _, exists := m.volumes[backing.BackingDiskId]; exists {
+				return nil, fmt.Errorf("volume %q already exists", backing.BackingDiskId)
+			}
+			vol.VolumeId.Id = backing.BackingDiskId
+		}
+	} else if spec.BackingObjectDetails != nil {
+		vol.BackingObjectDetails = *spec.BackingObjectDetails.GetCnsBackingObjectDetails()
+	}
+	if len(spec.Datastores) > 0 {
+		if url, ok := m.datastoreURLs[spec.Datastores[0].Value]; ok {
+			vol.DatastoreUrl = url
+		}
+	}
+	for _, profile := range spec.Profile {
+		if p, ok := profile.(*vimtypes.VirtualMachineDefinedProfileSpec); ok {
+			vol.StoragePolicyId = p.ProfileId
+		}
+	}
+	m.volumes[vol.VolumeId.Id] = vol
+	klog.V(4).Infof("fake: created volume %q with ID %q", spec.Name, vol.VolumeId.Id)
+	return &cnstypes.CnsVolumeId{Id: vol.VolumeId.Id}, nil
+}
+
+// AttachVolume attaches a volume to a virtual machine and returns the disk
+// UUID. Attaching a volume attached to another virtual machine fails with
+// volume.CNSVolumeResourceInUseFaultMessage.
+func (m *Manager) AttachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) (string, error) {
+	if err := m.begin(AttachVolume); err != nil {
+		return "", err
+	}
+	defer m.lock.Unlock()
+	vol, ok := m.volumes[volumeID]
+	if !ok {
+		return "", ErrVolumeNotFound
+	}
+	ref := vm.Reference()
+	if vol.attachedTo != nil && *vol.attachedTo != ref {
+		return "", errors.New(cnsvolume.CNSVolumeResourceInUseFaultMessage)
+	}
+	vol.attachedTo = &ref
+	return vol.diskUUID, nil
+}
+
+// DetachVolume detaches a volume from the virtual machine.
+func (m *Manager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) error {
+	if err := m.begin(DetachVolume); err != nil {
+		return err
+	}
+	defer m.lock.Unlock()
+	vol, ok := m.volumes[volumeID]
+	if !ok {
+		return ErrVolumeNotFound
+	}
+	if vol.attachedTo == nil || *vol.attachedTo != vm.Reference() {
+		return fmt.Errorf("volume %q is not attached to %v", volumeID, vm.Reference())
+	}
+	vol.attachedTo = nil
+	return nil
+}
+
+// DeleteVolume deletes a volume. Deleting an attached volume fails with
+// volume.CNSVolumeResourceInUseFaultMessage.
+func (m *Manager) DeleteVolume(volumeID string, deleteDisk bool) error {
+	if err := m.begin(DeleteVolume); err != nil {
+		return err
+	}
+	defer m.lock.Unlock()
+	vol, ok := m.volumes[volumeID]
+	if !ok {
+		return ErrVolumeNotFound
+	}
+	if vol.attachedTo != nil && deleteDisk {
+		return errors.New(cnsvolume.CNSVolumeResourceInUseFaultMessage)
+	}
+	delete(m.volumes, volumeID)
+	return nil
+}
+
+// UpdateVolumeMetadata merges the entity metadata of the spec into the
+// volume. An entity replaces the entity of the same type, name and
+// namespace, and is removed if its delete flag is set.
+func (m *Manager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpdateSpec) error {
+	if err := m.begin(UpdateVolumeMetadata); err != nil {
+		return err
+	}
+	defer m.lock.Unlock()
+	return m.updateMetadata(spec)
+}
+
+// UpdateVolumeMetadataBatch updates the metadata of many volumes given their
+// specs, as UpdateVolumeMetadata does for each. A fault injected for the
+// operation fails every spec.
+func (m *Manager) UpdateVolumeMetadataBatch(specs []*cnstypes.CnsVolumeMetadataUpdateSpec) []error {
+	errs := make([]error, len(specs))
+	if err := m.begin(UpdateVolumeMetadataBatch); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	defer m.lock.Unlock()
+	for i, spec := range specs {
+		errs[i] = m.updateMetadata(spec)
+	}
+	return errs
+}
+
+// updateMetadata merges the entity metadata of the spec into the volume. The
+// lock must be held.
+func (m *Manager) updateMetadata(spec *cnstypes.CnsVolumeMetadataUpdateSpec) error {
+	if f, ok := m.volumeFaults[spec.VolumeId.Id]; ok {
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				delete(m.volumeFaults, spec.VolumeId.Id)
+			}
+		}
+		return f.err
+	}
+	vol, ok := m.volumes[spec.VolumeId.Id]
+	if !ok {
+		return ErrVolumeNotFound
+	}
+	vol.Metadata.ContainerCluster = spec.Metadata.ContainerCluster
+	for _, update := range spec.Metadata.EntityMetadata {
+		var entities []cnstypes.BaseCnsEntityMetadata
+		for _, entity := range vol.Metadata.EntityMetadata {
+			if !sameEntity(entity, update) {
+				entities = append(entities, entity)
+			}
+		}
+		if !update.GetCnsEntityMetadata().Delete {
+			entities = append(entities, copyEntity(update))
+		}
+		vol.Metadata.EntityMetadata = entities
+	}
+	return nil
+}
+
+// QueryVolume returns volumes matching the given filter.
+func (m *Manager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	if err := m.begin(QueryVolume); err != nil {
+		return nil, err
+	}
+	defer m.lock.Unlock()
+	return m.query(queryFilter), nil
+}
+
+// QueryAllVolume returns all volumes matching the given filter. The
+// selection is ignored and all fields are returned.
+func (m *Manager) QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error) {
+	if err := m.begin(QueryAllVolume); err != nil {
+		return nil, err
+	}
+	defer m.lock.Unlock()
+	return m.query(queryFilter), nil
+}
+
+// query returns the volumes matching all criteria of the filter. It must be
+// called with the lock held.
+func (m *Manager) query(filter cnstypes.CnsQueryFilter) *cnstypes.CnsQueryResult {
+	result := &cnstypes.CnsQueryResult{}
+	for _, vol := range m.volumes {
+		if matches(vol, filter, m.datastoreURLs) {
+			result.Volumes = append(result.Volumes, copyVolume(vol.CnsVolume))
+		}
+	}
+	if filter.Cursor != nil {
+		total := int64(len(result.Volumes))
+		start, end := filter.Cursor.Offset, total
+		if start > total {
+			start = total
+		}
+		if filter.Cursor.Limit > 0 && start+filter.Cursor.Limit < end {
+			end = start + filter.Cursor.Limit
+		}
+		result.Volumes = result.Volumes[start:end]
+		result.Cursor = cnstypes.CnsCursor{Offset: end, Limit: filter.Cursor.Limit, TotalRecords: total}
+	}
+	return result
+}
+
+// matches returns true if the volume matches all criteria of the filter.
+func matches(vol *volume, filter cnstypes.CnsQueryFilter, datastoreURLs map[string]string) bool {
+	if len(filter.VolumeIds) > 0 {
+		found := false
+		for _, id := range filter.VolumeIds {
+			found = found || id.Id == vol.VolumeId.Id
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(filter.Names) > 0 && !contains(filter.Names, vol.Name) {
+		return false
+	}
+	if len(filter.ContainerClusterIds) > 0 && !contains(filter.ContainerClusterIds, vol.Metadata.ContainerCluster.ClusterId) {
+		return false
+	}
+	if filter.StoragePolicyId != "" && filter.StoragePolicyId != vol.StoragePolicyId {
+		return false
+	}
+	if len(filter.Datastores) > 0 {
+		found := false
+		for _, ds := range filter.Datastores {
+			found = found || datastoreURLs[ds.Value] == vol.DatastoreUrl
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, label := range filter.Labels {
+		found := false
+		for _, entity := range vol.Metadata.EntityMetadata {
+			for _, l := range entity.GetCnsEntityMetadata().Labels {
+				found = found || l == label
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sameEntity returns true if both metadata describe the same Kubernetes
+// object.
+func sameEntity(a, b cnstypes.BaseCnsEntityMetadata) bool {
+	if a.GetCnsEntityMetadata().EntityName != b.GetCnsEntityMetadata().EntityName {
+		return false
+	}
+	ka, okA := a.(*cnstypes.CnsKubernetesEntityMetadata)
+	kb, okB := b.(*cnstypes.CnsKubernetesEntityMetadata)
+	if okA != okB {
+		return false
+	}
+	return !okA || (ka.EntityType == kb.EntityType && ka.Namespace == kb.Namespace)
+}
+
+func copyEntity(entity cnstypes.BaseCnsEntityMetadata) cnstypes.BaseCnsEntityMetadata {
+	if k, ok := entity.(*cnstypes.CnsKubernetesEntityMetadata); ok {
+		c := *k
+		c.Labels = append([]vimtypes.KeyValue(nil), k.Labels...)
+		return &c
+	}
+	c := *entity.GetCnsEntityMetadata()
+	c.Labels = append([]vimtypes.KeyValue(nil), c.Labels...)
+	return &c
+}
+
+func copyMetadata(metadata cnstypes.CnsVolumeMetadata) cnstypes.CnsVolumeMetadata {
+	c := metadata
+	c.EntityMetadata = nil
+	for _, entity := range metadata.EntityMetadata {
+		c.EntityMetadata = append(c.EntityMetadata, copyEntity(entity))
+	}
+	return c
+}
+
+func copyVolume(vol cnstypes.CnsVolume) cnstypes.CnsVolume {
+	c := vol
+	c.Metadata = copyMetadata(vol.Metadata)
+	return c
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/faults"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+// faultInjectingManager is a Manager failing calls as configured by a
+// faults.Injector before passing them to the wrapped Manager.
+type faultInjectingManager struct {
+	manager  Manager
+	injector *faults.Injector
+}
+
+// NewFaultInjectingManager returns a Manager injecting the faults of injector
+// in the calls to manager.
+func NewFaultInjectingManager(manager Manager, injector *faults.Injector) Manager {
+	return &faultInjectingManager{
+		manager:  manager,
+		injector: injector,
+	}
+}
+
+// CreateVolume creates a new volume given its spec.
+func (m *faultInjectingManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+	if err := m.injector.Inject(context.Background(), faults.CreateVolume); err != nil {
+		return nil, err
+	}
+	return m.manager.CreateVolume(spec)
+}
+
+// AttachVolume attaches a volume to a virtual machine given the spec.
+func (m *faultInjectingManager) AttachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) (string, error) {
+	if err := m.injector.Inject(context.Background(), faults.AttachVolume); err != nil {
+		return "", err
+	}
+	return m.manager.AttachVolume(vm, volumeID)
+}
+
+// DetachVolume detaches a volume from the virtual machine given the spec.
+func (m *faultInjectingManager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) error {
+	if err := m.injector.Inject(context.Background(), faults.DetachVolume); err != nil {
+		return err
+	}
+	return m.manager.DetachVolume(vm, volumeID)
+}
+
+// DeleteVolume deletes a volume given its spec.
+func (m *faultInjectingManager) DeleteVolume(volumeID string, deleteDisk bool) error {
+	if err := m.injector.Inject(context.Background(), faults.DeleteVolume); err != nil {
+		return err
+	}
+	return m.manager.DeleteVolume(volumeID, deleteDisk)
+}
+
+// UpdateVolumeMetadata updates a volume metadata given its spec.
+func (m *faultInjectingManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpdateSpec) error {
+	if err := m.injector.Inject(context.Background(), faults.UpdateVolumeMetadata); err != nil {
+		return err
+	}
+	return m.manager.UpdateVolumeMetadata(spec)
+}
+
+// UpdateVolumeMetadataBatch updates the metadata of many volumes given their
+// specs. Faults are injected per spec, the other specs are passed on.
+func (m *faultInjectingManager) UpdateVolumeMetadataBatch(specs []*cnstypes.CnsVolumeMetadataUpdateSpec) []error {
+	errs := make([]error, len(specs))
+	var passed []*cnstypes.CnsVolumeMetadataUpdateSpec
+	var passedIndexes []int
+	for i, spec := range specs {
+		if err := m.injector.Inject(context.Background(), faults.UpdateVolumeMetadata); err != nil {
+			errs[i] = err
+			continue
+		}
+		passed = append(passed, spec)
+		passedIndexes = append(passedIndexes, i)
+	}
+	if len(passed) > 0 {
+		for i, err := range m.manager.UpdateVolumeMetadataBatch(passed) {
+			errs[passedIndexes[i]] = err
+		}
+	}
+	return errs
+}
+
+// QueryVolume returns volumes matching the given filter.
+func (m *faultInjectingManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	if err := m.injector.Inject(context.Background(), faults.QueryVolume); err != nil {
+		return nil, err
+	}
+	return m.manager.QueryVolume(queryFilter)
+}
+
+// QueryAllVolume returns all volumes matching the given filter and selection.
+func (m *faultInjectingManager) QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error) {
+	if err := m.injector.Inject(context.Background(), faults.QueryAllVolume); err != nil {
+		return nil, err
+	}
+	return m.manager.QueryAllVolume(queryFilter, querySelection)
+}
@@ -19,6 +19,7 @@ package volume
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/davecgh/go-spew/spew"
@@ -26,6 +27,8 @@ import (
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	"k8s.io/klog"
 
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/faults"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 )
 
@@ -41,15 +44,22 @@ type Manager interface {
 	DeleteVolume(volumeID string, deleteDisk bool) error
 	// UpdateVolumeMetadata updates a volume metadata given its spec.
 	UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpdateSpec) error
+	// UpdateVolumeMetadataBatch updates the metadata of many volumes given
+	// their specs. It returns the error of each spec, nil if it succeeded.
+	UpdateVolumeMetadataBatch(specs []*cnstypes.CnsVolumeMetadataUpdateSpec) []error
 	// QueryVolume returns volumes matching the given filter.
 	QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)
 	// QueryAllVolume returns all volumes matching the given filter and selection.
 	QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error)
 }
 
+// maxUpdateBatchSize is the maximum number of update specs submitted in a
+// single CNS task.
+const maxUpdateBatchSize = 100
+
 var (
 	// managerInstance is a Manager singleton.
-	managerInstance *volumeManager
+	managerInstance Manager
 	// onceForManager is used for initializing the Manager singleton.
 	onceForManager sync.Once
 )
@@ -61,6 +71,9 @@ func GetManager(vc *cnsvsphere.VirtualCenter) Manager {
 		managerInstance = &volumeManager{
 			virtualCenter: vc,
 		}
+		if injector := faults.GetInjector(); injector != nil {
+			managerInstance = NewFaultInjectingManager(managerInstance, injector)
+		}
 		klog.V(1).Infof("volume.volumeManager initialized")
 	})
 	return managerInstance
@@ -79,6 +92,13 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Wait for a slot of the operation class
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.CreateDelete)
+	if err != nil {
+		klog.Errorf("Failed to acquire limiter for CreateVolume with err: %v", err)
+		return nil, err
+	}
+	defer release()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
@@ -86,14 +106,14 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 		return nil, err
 	}
 	// If the VSphereUser in the CreateSpec is different from session user, update the CreateSpec
-	s, err := m.virtualCenter.Client.SessionManager.UserSession(ctx)
+	userName, err := m.virtualCenter.SessionUserName(ctx)
 	if err != nil {
-		klog.Errorf("Failed to get usersession with err: %v", err)
+		klog.Errorf("Failed to get session user name with err: %v", err)
 		return nil, err
 	}
-	if s.UserName != spec.Metadata.ContainerCluster.VSphereUser {
-		klog.V(4).Infof("Update VSphereUser from %s to %s", spec.Metadata.ContainerCluster.VSphereUser, s.UserName)
-		spec.Metadata.ContainerCluster.VSphereUser = s.UserName
+	if userName != spec.Metadata.ContainerCluster.VSphereUser {
+		klog.V(4).Infof("Update VSphereUser from %s to %s", spec.Metadata.ContainerCluster.VSphereUser, userName)
+		spec.Metadata.ContainerCluster.VSphereUser = userName
 	}
 
 	// Construct the CNS VolumeCreateSpec list
@@ -101,6 +121,7 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 	cnsCreateSpecList = append(cnsCreateSpecList, *spec)
 	// Call the CNS CreateVolume
 	task, err := m.virtualCenter.CnsClient.CreateVolume(ctx, cnsCreateSpecList)
+	m.virtualCenter.RecordResult(err)
 	if err != nil {
 		klog.Errorf("CNS CreateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
@@ -144,6 +165,13 @@ func (m *volumeManager) AttachVolume(vm *cnsvsphere.VirtualMachine, volumeID str
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Wait for a slot of the operation class
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.AttachDetach)
+	if err != nil {
+		klog.Errorf("Failed to acquire limiter for AttachVolume with err: %v", err)
+		return "", err
+	}
+	defer release()
 
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
@@ -162,6 +190,7 @@ func (m *volumeManager) AttachVolume(vm *cnsvsphere.VirtualMachine, volumeID str
 	cnsAttachSpecList = append(cnsAttachSpecList, cnsAttachSpec)
 	// Call the CNS AttachVolume
 	task, err := m.virtualCenter.CnsClient.AttachVolume(ctx, cnsAttachSpecList)
+	m.virtualCenter.RecordResult(err)
 	if err != nil {
 		klog.Errorf("CNS AttachVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return "", err
@@ -214,6 +243,13 @@ func (m *volumeManager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID str
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Wait for a slot of the operation class
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.AttachDetach)
+	if err != nil {
+		klog.Errorf("Failed to acquire limiter for DetachVolume with err: %v", err)
+		return err
+	}
+	defer release()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
@@ -231,6 +267,7 @@ func (m *volumeManager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID str
 	cnsDetachSpecList = append(cnsDetachSpecList, cnsDetachSpec)
 	// Call the CNS DetachVolume
 	task, err := m.virtualCenter.CnsClient.DetachVolume(ctx, cnsDetachSpecList)
+	m.virtualCenter.RecordResult(err)
 	if err != nil {
 		klog.Errorf("CNS DetachVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
@@ -273,6 +310,13 @@ func (m *volumeManager) DeleteVolume(volumeID string, deleteDisk bool) error {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Wait for a slot of the operation class
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.CreateDelete)
+	if err != nil {
+		klog.Errorf("Failed to acquire limiter for DeleteVolume with err: %v", err)
+		return err
+	}
+	defer release()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
@@ -287,6 +331,7 @@ func (m *volumeManager) DeleteVolume(volumeID string, deleteDisk bool) error {
 	// Call the CNS DeleteVolume
 	cnsVolumeIDList = append(cnsVolumeIDList, cnsVolumeID)
 	task, err := m.virtualCenter.CnsClient.DeleteVolume(ctx, cnsVolumeIDList, deleteDisk)
+	m.virtualCenter.RecordResult(err)
 	if err != nil {
 		klog.Errorf("CNS DeleteVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
@@ -327,6 +372,13 @@ func (m *volumeManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpd
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Wait for a slot of the operation class
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Metadata)
+	if err != nil {
+		klog.Errorf("Failed to acquire limiter for UpdateVolumeMetadata with err: %v", err)
+		return err
+	}
+	defer release()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
@@ -334,14 +386,14 @@ func (m *volumeManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpd
 		return err
 	}
 	// If the VSphereUser in the VolumeMetadataUpdateSpec is different from session user, update the VolumeMetadataUpdateSpec
-	s, err := m.virtualCenter.Client.SessionManager.UserSession(ctx)
+	userName, err := m.virtualCenter.SessionUserName(ctx)
 	if err != nil {
-		klog.Errorf("Failed to get usersession with err: %v", err)
+		klog.Errorf("Failed to get session user name with err: %v", err)
 		return err
 	}
-	if s.UserName != spec.Metadata.ContainerCluster.VSphereUser {
-		klog.V(4).Infof("Update VSphereUser from %s to %s", spec.Metadata.ContainerCluster.VSphereUser, s.UserName)
-		spec.Metadata.ContainerCluster.VSphereUser = s.UserName
+	if userName != spec.Metadata.ContainerCluster.VSphereUser {
+		klog.V(4).Infof("Update VSphereUser from %s to %s", spec.Metadata.ContainerCluster.VSphereUser, userName)
+		spec.Metadata.ContainerCluster.VSphereUser = userName
 	}
 
 	var cnsUpdateSpecList []cnstypes.CnsVolumeMetadataUpdateSpec
@@ -353,6 +405,7 @@ func (m *volumeManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpd
 	}
 	cnsUpdateSpecList = append(cnsUpdateSpecList, cnsUpdateSpec)
 	task, err := m.virtualCenter.CnsClient.UpdateVolumeMetadata(ctx, cnsUpdateSpecList)
+	m.virtualCenter.RecordResult(err)
 	if err != nil {
 		klog.Errorf("CNS UpdateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
@@ -385,6 +438,122 @@ func (m *volumeManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpd
 	return nil
 }
 
+// UpdateVolumeMetadataBatch updates the metadata of many volumes given their
+// specs, submitting up to maxUpdateBatchSize specs per CNS task.
+func (m *volumeManager) UpdateVolumeMetadataBatch(specs []*cnstypes.CnsVolumeMetadataUpdateSpec) []error {
+	errs := make([]error, len(specs))
+	for start := 0; start < len(specs); start += maxUpdateBatchSize {
+		end := start + maxUpdateBatchSize
+		if end > len(specs) {
+			end = len(specs)
+		}
+		copy(errs[start:end], m.updateVolumeMetadataTask(specs[start:end]))
+	}
+	return errs
+}
+
+// updateVolumeMetadataTask updates the metadata of the volumes of specs in a
+// single CNS task. A failure of the task is the error of every spec.
+func (m *volumeManager) updateVolumeMetadataTask(specs []*cnstypes.CnsVolumeMetadataUpdateSpec) []error {
+	fail := func(err error) []error {
+		errs := make([]error, len(specs))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	err := validateManager(m)
+	if err != nil {
+		return fail(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Wait for a slot of the operation class
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Metadata)
+	if err != nil {
+		klog.Errorf("Failed to acquire limiter for UpdateVolumeMetadataBatch with err: %v", err)
+		return fail(err)
+	}
+	defer release()
+	// Set up the VC connection
+	err = m.virtualCenter.ConnectCNS(ctx)
+	if err != nil {
+		klog.Errorf("ConnectCNS failed with err: %+v", err)
+		return fail(err)
+	}
+	userName, err := m.virtualCenter.SessionUserName(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get session user name with err: %v", err)
+		return fail(err)
+	}
+	cnsUpdateSpecList := make([]cnstypes.CnsVolumeMetadataUpdateSpec, 0, len(specs))
+	for _, spec := range specs {
+		if userName != spec.Metadata.ContainerCluster.VSphereUser {
+			klog.V(4).Infof("Update VSphereUser from %s to %s", spec.Metadata.ContainerCluster.VSphereUser, userName)
+			spec.Metadata.ContainerCluster.VSphereUser = userName
+		}
+		cnsUpdateSpecList = append(cnsUpdateSpecList, cnstypes.CnsVolumeMetadataUpdateSpec{
+			VolumeId: cnstypes.CnsVolumeId{
+				Id: spec.VolumeId.Id,
+			},
+			Metadata: spec.Metadata,
+		})
+	}
+	task, err := m.virtualCenter.CnsClient.UpdateVolumeMetadata(ctx, cnsUpdateSpecList)
+	m.virtualCenter.RecordResult(err)
+	if err != nil {
+		klog.Errorf("CNS UpdateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+		return fail(err)
+	}
+	// Get the taskInfo
+	taskInfo, err := cns.GetTaskInfo(ctx, task)
+	if err != nil {
+		klog.Errorf("Failed to get taskInfo for UpdateVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+		return fail(err)
+	}
+	klog.V(2).Infof("UpdateVolumeMetadataBatch: %d volumes, opId: %q", len(specs), taskInfo.ActivationId)
+	batchResult, ok := taskInfo.Result.(cnstypes.CnsVolumeOperationBatchResult)
+	if !ok || len(batchResult.VolumeResults) == 0 {
+		klog.Errorf("taskResult is empty for UpdateVolume task: %q, opId: %q", taskInfo.Task.Value, taskInfo.ActivationId)
+		return fail(errors.New("taskResult is empty"))
+	}
+	errs := batchResultErrors(specs, batchResult.VolumeResults)
+	for i, err := range errs {
+		if err != nil {
+			klog.Errorf("Failed to update volume %q in batch. fault: %q, opID: %q", specs[i].VolumeId.Id, err, taskInfo.ActivationId)
+		}
+	}
+	return errs
+}
+
+// batchResultErrors returns the error of each spec from the volume results of
+// a CNS task. Results are matched to specs by volume ID, falling back to
+// their position for results without a volume ID. A spec without a result
+// fails, as CNS did not report its update.
+func batchResultErrors(specs []*cnstypes.CnsVolumeMetadataUpdateSpec, results []cnstypes.BaseCnsVolumeOperationResult) []error {
+	resultsByID := make(map[string]*cnstypes.CnsVolumeOperationResult)
+	for _, result := range results {
+		res := result.GetCnsVolumeOperationResult()
+		if res.VolumeId.Id != "" {
+			resultsByID[res.VolumeId.Id] = res
+		}
+	}
+	errs := make([]error, len(specs))
+	for i, spec := range specs {
+		res, ok := resultsByID[spec.VolumeId.Id]
+		if !ok && i < len(results) && results[i].GetCnsVolumeOperationResult().VolumeId.Id == "" {
+			res, ok = results[i].GetCnsVolumeOperationResult(), true
+		}
+		switch {
+		case !ok:
+			errs[i] = fmt.Errorf("no result for volume %q in the batch", spec.VolumeId.Id)
+		case res.Fault != nil:
+			errs[i] = errors.New(res.Fault.LocalizedMessage)
+		}
+	}
+	return errs
+}
+
 // QueryVolume returns volumes matching the given filter.
 func (m *volumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
 	err := validateManager(m)
@@ -393,6 +562,13 @@ func (m *volumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnsty
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Wait for a slot of the operation class
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		klog.Errorf("Failed to acquire limiter for QueryVolume with err: %v", err)
+		return nil, err
+	}
+	defer release()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
@@ -401,6 +577,7 @@ func (m *volumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnsty
 	}
 	//Call the CNS QueryVolume
 	res, err := m.virtualCenter.CnsClient.QueryVolume(ctx, queryFilter)
+	m.virtualCenter.RecordResult(err)
 	if err != nil {
 		klog.Errorf("CNS QueryVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
@@ -416,6 +593,13 @@ func (m *volumeManager) QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, quer
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Wait for a slot of the operation class
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		klog.Errorf("Failed to acquire limiter for QueryAllVolume with err: %v", err)
+		return nil, err
+	}
+	defer release()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
@@ -424,6 +608,7 @@ func (m *volumeManager) QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, quer
 	}
 	//Call the CNS QueryAllVolume
 	res, err := m.virtualCenter.CnsClient.QueryAllVolume(ctx, queryFilter, querySelection)
+	m.virtualCenter.RecordResult(err)
 	if err != nil {
 		klog.Errorf("CNS QueryAllVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
@@ -0,0 +1,48 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+)
+
+func TestBatchResultErrors(t *testing.T) {
+	specs := []*cnstypes.CnsVolumeMetadataUpdateSpec{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-1"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-2"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-3"}},
+	}
+	fault := &cnstypes.CnsFault{}
+	fault.LocalizedMessage = "The object or item referred to could not be found."
+	// Results out of order, and without the result of vol-3
+	results := []cnstypes.BaseCnsVolumeOperationResult{
+		&cnstypes.CnsVolumeOperationResult{VolumeId: cnstypes.CnsVolumeId{Id: "vol-2"}, Fault: fault},
+		&cnstypes.CnsVolumeOperationResult{VolumeId: cnstypes.CnsVolumeId{Id: "vol-1"}},
+	}
+	errs := batchResultErrors(specs, results)
+	if errs[0] != nil {
+		t.Errorf("Expected vol-1 to succeed, got %v", errs[0])
+	}
+	if errs[1] == nil || errs[1].Error() != fault.LocalizedMessage {
+		t.Errorf("Expected the fault of vol-2, got %v", errs[1])
+	}
+	if errs[2] == nil {
+		t.Errorf("Expected vol-3 without a result to fail")
+	}
+}
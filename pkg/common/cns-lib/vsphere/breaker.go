@@ -0,0 +1,189 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	neturl "net/url"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultBreakerFailureThreshold is the number of consecutive
+	// connectivity failures after which the circuit breaker opens.
+	DefaultBreakerFailureThreshold = 3
+	// DefaultBreakerOpenInterval is the time the circuit breaker stays open
+	// before a probe request is let through.
+	DefaultBreakerOpenInterval = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling vCenter while the circuit
+// breaker of the virtual center is open.
+var ErrCircuitOpen = errors.New("vCenter is unreachable, circuit breaker is open")
+
+// BreakerState is the state of the circuit breaker of a virtual center.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all requests immediately.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe request through.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// probeKey is the context key marking the probe request of a half-open
+// circuit breaker.
+type probeKey struct{}
+
+// circuitBreaker stops calling an unreachable vCenter after repeated
+// connectivity failures. The zero value is a closed breaker with the
+// default threshold and interval.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	state     BreakerState
+	failures  int
+	changed   time.Time
+	threshold int
+	interval  time.Duration
+}
+
+// allow returns ErrCircuitOpen if the request must fail immediately. When
+// the open interval has passed, the first request is let through as probe
+// and the returned context marks it, so that the nested calls of the probe
+// are let through as well.
+func (b *circuitBreaker) allow(ctx context.Context, host string) (context.Context, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		return ctx, nil
+	case BreakerHalfOpen:
+		if ctx.Value(probeKey{}) != nil {
+			return ctx, nil
+		}
+		// Let another probe through if the last one never reported back
+		if time.Since(b.changed) < b.openInterval() {
+			return ctx, ErrCircuitOpen
+		}
+	default:
+		if time.Since(b.changed) < b.openInterval() {
+			return ctx, ErrCircuitOpen
+		}
+	}
+	b.state = BreakerHalfOpen
+	b.changed = time.Now()
+	klog.Infof("Circuit breaker of VC %q is half-open, probing vCenter", host)
+	return context.WithValue(ctx, probeKey{}, true), nil
+}
+
+// record updates the breaker with the outcome of a request. Only
+// connectivity failures count, other errors show that vCenter is reachable.
+func (b *circuitBreaker) record(host string, err error) {
+	if err == ErrCircuitOpen {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !isConnectivityError(err) {
+		if b.state != BreakerClosed {
+			klog.Infof("Circuit breaker of VC %q is closed, vCenter is reachable again", host)
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	threshold := b.threshold
+	if threshold == 0 {
+		threshold = DefaultBreakerFailureThreshold
+	}
+	switch {
+	case b.state == BreakerHalfOpen:
+		klog.Errorf("Circuit breaker of VC %q is open again, probe failed with err: %v", host, err)
+	case b.state == BreakerClosed && b.failures >= threshold:
+		klog.Errorf("Circuit breaker of VC %q is open after %d connectivity failures, "+
+			"requests fail immediately for %v. Last err: %v", host, b.failures, b.openInterval(), err)
+	default:
+		return
+	}
+	b.state = BreakerOpen
+	b.changed = time.Now()
+	b.failures = 0
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) openInterval() time.Duration {
+	if b.interval == 0 {
+		return DefaultBreakerOpenInterval
+	}
+	return b.interval
+}
+
+// isConnectivityError returns true if err shows that vCenter could not be
+// reached, as opposed to a fault returned by vCenter.
+func isConnectivityError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	var urlErr *neturl.Error
+	return errors.As(err, &netErr) || errors.As(err, &urlErr) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsUnavailable returns true if err shows that vCenter is unreachable, either
+// because the circuit breaker is open or because of a connectivity failure.
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || isConnectivityError(err)
+}
+
+// BreakerState returns the state of the circuit breaker of the virtual center.
+func (vc *VirtualCenter) BreakerState() BreakerState {
+	return vc.breaker.State()
+}
+
+// RecordResult reports the outcome of a call made with a client which
+// doesn't go through the session round tripper, such as the CNS client, to
+// the circuit breaker of the virtual center.
+func (vc *VirtualCenter) RecordResult(err error) {
+	vc.breaker.record(vc.Config.Host, err)
+}
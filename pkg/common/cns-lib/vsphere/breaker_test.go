@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	vc := &VirtualCenter{Config: &VirtualCenterConfig{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "user",
+		Password: "pass",
+		Insecure: true,
+	}}
+	vc.breaker.interval = 50 * time.Millisecond
+	ctx := context.Background()
+
+	for i := 0; i < DefaultBreakerFailureThreshold; i++ {
+		if err := vc.Connect(ctx); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Expected a connectivity error, got %v", err)
+		}
+	}
+	if state := vc.BreakerState(); state != BreakerOpen {
+		t.Fatalf("Expected breaker to be open, got %s", state)
+	}
+	if err := vc.Connect(ctx); err != ErrCircuitOpen {
+		t.Fatalf("Expected %v, got %v", ErrCircuitOpen, err)
+	}
+	if !IsUnavailable(ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen to be unavailable")
+	}
+
+	// A failed probe opens the breaker again
+	time.Sleep(vc.breaker.interval)
+	if err := vc.Connect(ctx); err == ErrCircuitOpen {
+		t.Fatalf("Expected a probe to be let through")
+	}
+	if state := vc.BreakerState(); state != BreakerOpen {
+		t.Fatalf("Expected breaker to be open after a failed probe, got %s", state)
+	}
+
+	// A successful probe closes it
+	time.Sleep(vc.breaker.interval)
+	probeCtx, err := vc.breaker.allow(ctx, vc.Config.Host)
+	if err != nil || probeCtx.Value(probeKey{}) == nil {
+		t.Fatalf("Expected a probe to be let through, err: %v", err)
+	}
+	if _, err := vc.breaker.allow(ctx, vc.Config.Host); err != ErrCircuitOpen {
+		t.Errorf("Expected a single probe in half-open state, got %v", err)
+	}
+	vc.RecordResult(nil)
+	if state := vc.BreakerState(); state != BreakerClosed {
+		t.Errorf("Expected breaker to be closed, got %s", state)
+	}
+}
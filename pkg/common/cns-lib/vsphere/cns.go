@@ -20,18 +20,120 @@ import (
 	"context"
 
 	"github.com/vmware/govmomi/cns"
+	"github.com/vmware/govmomi/cns/methods"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
 	"k8s.io/klog"
 )
 
+// CNSClient calls the CNS APIs. Unlike cns.Client, it owns its SOAP client,
+// so that its transport can be wrapped.
+type CNSClient struct {
+	vim25Client   *vim25.Client
+	serviceClient *soap.Client
+}
+
 // NewCNSClient creates a new CNS client
-func NewCNSClient(ctx context.Context, c *vim25.Client) (*cns.Client, error) {
-	cnsClient, err := cns.NewClient(ctx, c)
+func NewCNSClient(ctx context.Context, c *vim25.Client) (*CNSClient, error) {
+	return &CNSClient{
+		vim25Client:   c,
+		serviceClient: c.Client.NewServiceClient(cns.Path, cns.Namespace),
+	}, nil
+}
+
+// CreateVolume calls the CNS create API.
+func (c *CNSClient) CreateVolume(ctx context.Context, createSpecList []cnstypes.CnsVolumeCreateSpec) (*object.Task, error) {
+	req := cnstypes.CnsCreateVolume{
+		This:        cns.CnsVolumeManagerInstance,
+		CreateSpecs: createSpecList,
+	}
+	res, err := methods.CnsCreateVolume(ctx, c.serviceClient, &req)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewTask(c.vim25Client, res.Returnval), nil
+}
+
+// UpdateVolumeMetadata calls the CNS update metadata API.
+func (c *CNSClient) UpdateVolumeMetadata(ctx context.Context, updateSpecList []cnstypes.CnsVolumeMetadataUpdateSpec) (*object.Task, error) {
+	req := cnstypes.CnsUpdateVolumeMetadata{
+		This:        cns.CnsVolumeManagerInstance,
+		UpdateSpecs: updateSpecList,
+	}
+	res, err := methods.CnsUpdateVolumeMetadata(ctx, c.serviceClient, &req)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewTask(c.vim25Client, res.Returnval), nil
+}
+
+// DeleteVolume calls the CNS delete API.
+func (c *CNSClient) DeleteVolume(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId, deleteDisk bool) (*object.Task, error) {
+	req := cnstypes.CnsDeleteVolume{
+		This:       cns.CnsVolumeManagerInstance,
+		VolumeIds:  volumeIDList,
+		DeleteDisk: deleteDisk,
+	}
+	res, err := methods.CnsDeleteVolume(ctx, c.serviceClient, &req)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewTask(c.vim25Client, res.Returnval), nil
+}
+
+// AttachVolume calls the CNS attach API.
+func (c *CNSClient) AttachVolume(ctx context.Context, attachSpecList []cnstypes.CnsVolumeAttachDetachSpec) (*object.Task, error) {
+	req := cnstypes.CnsAttachVolume{
+		This:        cns.CnsVolumeManagerInstance,
+		AttachSpecs: attachSpecList,
+	}
+	res, err := methods.CnsAttachVolume(ctx, c.serviceClient, &req)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewTask(c.vim25Client, res.Returnval), nil
+}
+
+// DetachVolume calls the CNS detach API.
+func (c *CNSClient) DetachVolume(ctx context.Context, detachSpecList []cnstypes.CnsVolumeAttachDetachSpec) (*object.Task, error) {
+	req := cnstypes.CnsDetachVolume{
+		This:        cns.CnsVolumeManagerInstance,
+		DetachSpecs: detachSpecList,
+	}
+	res, err := methods.CnsDetachVolume(ctx, c.serviceClient, &req)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewTask(c.vim25Client, res.Returnval), nil
+}
+
+// QueryVolume calls the CNS query API.
+func (c *CNSClient) QueryVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	req := cnstypes.CnsQueryVolume{
+		This:   cns.CnsVolumeManagerInstance,
+		Filter: queryFilter,
+	}
+	res, err := methods.CnsQueryVolume(ctx, c.serviceClient, &req)
+	if err != nil {
+		return nil, err
+	}
+	return &res.Returnval, nil
+}
+
+// QueryAllVolume calls the CNS query all API.
+func (c *CNSClient) QueryAllVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error) {
+	req := cnstypes.CnsQueryAllVolume{
+		This:      cns.CnsVolumeManagerInstance,
+		Filter:    queryFilter,
+		Selection: querySelection,
+	}
+	res, err := methods.CnsQueryAllVolume(ctx, c.serviceClient, &req)
 	if err != nil {
-		klog.Errorf("Failed to create a new client for CNS. err: %v", err)
 		return nil, err
 	}
-	return cnsClient, nil
+	return &res.Returnval, nil
 }
 
 // ConnectCNS creates a CNS client for the virtual center.
@@ -46,6 +148,7 @@ func (vc *VirtualCenter) ConnectCNS(ctx context.Context) error {
 			klog.Errorf("Failed to create CNS client on vCenter host %q with err: %v", vc.Config.Host, err)
 			return err
 		}
+		wrapTransport(vc.CnsClient.serviceClient, vc.Config)
 	}
 	return nil
 }
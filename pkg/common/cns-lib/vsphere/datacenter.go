@@ -27,6 +27,8 @@ import (
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
 )
 
 // DatastoreInfoProperty refers to the property name info for the Datastore
@@ -47,6 +49,11 @@ func (dc *Datacenter) String() string {
 
 // GetDatastoreByURL returns the *Datastore instance given its URL.
 func (dc *Datacenter) GetDatastoreByURL(ctx context.Context, datastoreURL string) (*Datastore, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	finder := find.NewFinder(dc.Datacenter.Client(), false)
 	finder.SetDatacenter(dc.Datacenter)
 	datastores, err := finder.DatastoreList(ctx, "*")
@@ -85,6 +92,11 @@ func (dc *Datacenter) GetDatastoreByURL(ctx context.Context, datastoreURL string
 // If instanceUUID is set to false, then UUID is BIOS UUID.
 //  - In this case, this function searches for virtual machines whose BIOS UUID matches the given uuid.
 func (dc *Datacenter) GetVirtualMachineByUUID(ctx context.Context, uuid string, instanceUUID bool) (*VirtualMachine, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	uuid = strings.ToLower(strings.TrimSpace(uuid))
 	searchIndex := object.NewSearchIndex(dc.Datacenter.Client())
 	svm, err := searchIndex.FindByUuid(ctx, dc.Datacenter, uuid, true, &instanceUUID)
@@ -173,6 +185,11 @@ func AsyncGetAllDatacenters(ctx context.Context, buffSize int) (<-chan *Datacent
 
 // GetVMMoList gets the VM Managed Objects with the given properties from the VM object
 func (dc *Datacenter) GetVMMoList(ctx context.Context, vmObjList []*VirtualMachine, properties []string) ([]mo.VirtualMachine, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	var vmMoList []mo.VirtualMachine
 	var vmRefs []types.ManagedObjectReference
 	if len(vmObjList) < 1 {
@@ -185,7 +202,7 @@ func (dc *Datacenter) GetVMMoList(ctx context.Context, vmObjList []*VirtualMachi
 		vmRefs = append(vmRefs, vmObj.Reference())
 	}
 	pc := property.DefaultCollector(dc.Client())
-	err := pc.Retrieve(ctx, vmRefs, properties, &vmMoList)
+	err = pc.Retrieve(ctx, vmRefs, properties, &vmMoList)
 	if err != nil {
 		klog.Errorf("Failed to get VM managed objects from VM objects. vmObjList: %+v, properties: %+v, err: %v", vmObjList, properties, err)
 		return nil, err
@@ -196,6 +213,11 @@ func (dc *Datacenter) GetVMMoList(ctx context.Context, vmObjList []*VirtualMachi
 // GetAllDatastores gets the datastore URL to DatastoreInfo map for all the datastores in
 // the datacenter.
 func (dc *Datacenter) GetAllDatastores(ctx context.Context) (map[string]*DatastoreInfo, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	finder := find.NewFinder(dc.Client(), false)
 	finder.SetDatacenter(dc.Datacenter)
 	datastores, err := finder.DatastoreList(ctx, "*")
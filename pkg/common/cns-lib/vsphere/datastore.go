@@ -24,7 +24,10 @@ import (
 	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vslm"
 	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
 )
 
 // Datastore holds Datastore and Datacenter information.
@@ -56,3 +59,59 @@ func (ds *Datastore) GetDatastoreURL(ctx context.Context) (string, error) {
 	}
 	return dsMo.Summary.Url, nil
 }
+
+// ListFirstClassDisks returns the IDs of the first class disks on the
+// datastore.
+func (ds *Datastore) ListFirstClassDisks(ctx context.Context) ([]string, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ids, err := vslm.NewObjectManager(ds.Client()).List(ctx, ds.Datastore)
+	if err != nil {
+		klog.Errorf("Failed to list first class disks on datastore %v: %v", ds.Reference(), err)
+		return nil, err
+	}
+	var result []string
+	for _, id := range ids {
+		result = append(result, id.Id)
+	}
+	return result, nil
+}
+
+// RetrieveFirstClassDisk returns the first class disk with the given ID on
+// the datastore.
+func (ds *Datastore) RetrieveFirstClassDisk(ctx context.Context, id string) (*types.VStorageObject, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	disk, err := vslm.NewObjectManager(ds.Client()).Retrieve(ctx, ds.Datastore, id)
+	if err != nil {
+		klog.Errorf("Failed to retrieve first class disk %s on datastore %v: %v", id, ds.Reference(), err)
+		return nil, err
+	}
+	return disk, nil
+}
+
+// DeleteFirstClassDisk deletes the first class disk with the given ID from
+// the datastore.
+func (ds *Datastore) DeleteFirstClassDisk(ctx context.Context, id string) error {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.CreateDelete)
+	if err != nil {
+		return err
+	}
+	defer release()
+	task, err := vslm.NewObjectManager(ds.Client()).Delete(ctx, ds.Datastore, id)
+	if err != nil {
+		klog.Errorf("Failed to delete first class disk %s on datastore %v: %v", id, ds.Reference(), err)
+		return err
+	}
+	if err = task.Wait(ctx); err != nil {
+		klog.Errorf("Failed to delete first class disk %s on datastore %v: %v", id, ds.Reference(), err)
+		return err
+	}
+	return nil
+}
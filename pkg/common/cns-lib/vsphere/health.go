@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/health"
+)
+
+const (
+	// SessionCheckName is the name of the vCenter session health check.
+	SessionCheckName = "vcenter-session"
+	// CnsCheckName is the name of the CNS client health check.
+	CnsCheckName = "cns-client"
+	// PbmCheckName is the name of the PBM client health check.
+	PbmCheckName = "pbm-client"
+	// BreakerCheckName is the name of the circuit breaker health check.
+	BreakerCheckName = "vcenter-circuit-breaker"
+)
+
+// SessionCheck returns a health check which verifies that the virtual center
+// has an authenticated session. An expired session is re-established by the
+// check, so it only fails if vCenter cannot be logged in to.
+func (vc *VirtualCenter) SessionCheck() health.Check {
+	return health.Check{
+		Name: SessionCheckName,
+		Fn: func(ctx context.Context) error {
+			return vc.Connect(ctx)
+		},
+	}
+}
+
+// CnsCheck returns a health check which verifies that the CNS client is
+// available on the virtual center.
+func (vc *VirtualCenter) CnsCheck() health.Check {
+	return health.Check{
+		Name: CnsCheckName,
+		Fn: func(ctx context.Context) error {
+			if err := vc.ConnectCNS(ctx); err != nil {
+				return err
+			}
+			if vc.CnsClient == nil {
+				return errors.New("CNS client is not initialized")
+			}
+			return nil
+		},
+	}
+}
+
+// PbmCheck returns a health check which verifies that the PBM client is
+// available on the virtual center.
+func (vc *VirtualCenter) PbmCheck() health.Check {
+	return health.Check{
+		Name: PbmCheckName,
+		Fn: func(ctx context.Context) error {
+			if err := vc.ConnectPbm(ctx); err != nil {
+				return err
+			}
+			if vc.PbmClient == nil {
+				return errors.New("PBM client is not initialized")
+			}
+			return nil
+		},
+	}
+}
+
+// BreakerCheck returns a health check which fails while the circuit breaker
+// of the virtual center is open.
+func (vc *VirtualCenter) BreakerCheck() health.Check {
+	return health.Check{
+		Name: BreakerCheckName,
+		Fn: func(ctx context.Context) error {
+			if vc.breaker.State() == BreakerOpen {
+				return ErrCircuitOpen
+			}
+			return nil
+		},
+	}
+}
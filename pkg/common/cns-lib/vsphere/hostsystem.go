@@ -24,6 +24,8 @@ import (
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
 )
 
 // HostSystem holds details of a host instance.
@@ -34,9 +36,14 @@ type HostSystem struct {
 
 // GetAllAccessibleDatastores gets the list of accessible datastores for the given host
 func (host *HostSystem) GetAllAccessibleDatastores(ctx context.Context) ([]*DatastoreInfo, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	var hostSystemMo mo.HostSystem
 	s := object.NewSearchIndex(host.Client())
-	err := s.Properties(ctx, host.Reference(), []string{"datastore"}, &hostSystemMo)
+	err = s.Properties(ctx, host.Reference(), []string{"datastore"}, &hostSystemMo)
 	if err != nil {
 		klog.Errorf("Failed to retrieve datastores for host %v with err: %v", host, err)
 		return nil, err
@@ -35,6 +35,7 @@ func (vc *VirtualCenter) ConnectPbm(ctx context.Context) error {
 			klog.Errorf("Failed to create pbm client with err: %v", err)
 			return err
 		}
+		wrapTransport(vc.PbmClient.Client, vc.Config)
 	}
 	return nil
 }
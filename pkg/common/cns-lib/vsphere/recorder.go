@@ -0,0 +1,403 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/soap"
+	"k8s.io/klog"
+)
+
+// EnvRecordDir is the environment variable holding the directory the SOAP
+// and REST exchanges with vCenter are recorded to. Recording is disabled
+// when the variable is unset.
+const EnvRecordDir = "VSPHERE_CSI_RECORD_DIR"
+
+// redacted replaces credentials, session IDs and tokens in the fixtures.
+const redacted = "REDACTED"
+
+// sessionIDHeader is the header carrying the vCenter REST session ID.
+const sessionIDHeader = "vmware-api-session-id"
+
+var (
+	passwordPattern  = regexp.MustCompile(`(?s)<password>.*?</password>`)
+	securityPattern  = regexp.MustCompile(`(?s)<([\w]+:)?Security\b.*?</([\w]+:)?Security>`)
+	cookiePattern    = regexp.MustCompile(`(?s)<([\w]+:)?vcSessionCookie\b.*?</([\w]+:)?vcSessionCookie>`)
+	assertionPattern = regexp.MustCompile(`(?s)<([\w]+:)?Assertion\b.*?</([\w]+:)?Assertion>`)
+	fileNamePattern  = regexp.MustCompile(`[^\w]+`)
+	// recordedHeaders are the response headers kept in the fixtures.
+	recordedHeaders = []string{"Content-Type"}
+)
+
+// Exchange is a recorded request to vCenter and its response.
+type Exchange struct {
+	// Method and Path are the HTTP method and URL path of the request.
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Operation is the SOAP method or, for REST requests, the method and path.
+	Operation string `json:"operation"`
+	// Request is the sanitized request body.
+	Request string `json:"request"`
+	// Status, Header and Response are the sanitized response.
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header,omitempty"`
+	Response string      `json:"response"`
+}
+
+// Recorder is an http.RoundTripper recording all exchanges with vCenter to
+// fixture files, with credentials, session IDs and tokens redacted.
+type Recorder struct {
+	dir  string
+	lock sync.Mutex
+	seq  int
+	// sessions are the session IDs seen in the exchanges. They are redacted
+	// wherever they appear, e.g. in the session key of a login response.
+	sessions map[string]bool
+}
+
+var (
+	// recorderInstance is the Recorder configured by EnvRecordDir.
+	recorderInstance *Recorder
+	// onceForRecorder is used for initializing the Recorder singleton.
+	onceForRecorder sync.Once
+)
+
+// getRecorder returns the Recorder writing to the directory given in
+// EnvRecordDir, or nil if recording is disabled.
+func getRecorder() *Recorder {
+	onceForRecorder.Do(func() {
+		dir := os.Getenv(EnvRecordDir)
+		if dir == "" {
+			return
+		}
+		recorder, err := NewRecorder(dir)
+		if err != nil {
+			klog.Errorf("Recording of vCenter requests is disabled. Err: %v", err)
+			return
+		}
+		klog.Warningf("Recording vCenter requests to %q", dir)
+		recorderInstance = recorder
+	})
+	return recorderInstance
+}
+
+// NewRecorder returns a Recorder writing fixture files to dir.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		klog.Errorf("Failed to create record directory %q. Err: %v", dir, err)
+		return nil, err
+	}
+	return &Recorder{dir: dir, sessions: make(map[string]bool)}, nil
+}
+
+// Wrap returns a RoundTripper recording the exchanges made with next. It can
+// be used as VirtualCenterConfig.WrapTransport.
+func (r *Recorder) Wrap(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		reqBody, err := readBody(&req.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.addSessions(req.Header, req.Cookies())
+		res, err := next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resBody, err := readBody(&res.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.addSessions(res.Header, res.Cookies())
+		exchange := newExchange(req, reqBody)
+		if isSessionCreate(exchange.Operation) {
+			var session struct {
+				Value string `json:"value"`
+			}
+			if json.Unmarshal(resBody, &session) == nil {
+				r.addSessions(http.Header{sessionIDHeader: {session.Value}}, nil)
+			}
+		}
+		exchange.Request = r.redactSessions(exchange.Request)
+		exchange.Status = res.StatusCode
+		exchange.Header = http.Header{}
+		for _, key := range recordedHeaders {
+			if value := res.Header.Get(key); value != "" {
+				exchange.Header.Set(key, value)
+			}
+		}
+		exchange.Response = r.redactSessions(sanitizeResponse(exchange.Operation, resBody))
+		r.write(exchange)
+		return res, nil
+	})
+}
+
+// addSessions remembers the SOAP session cookies and REST session IDs in
+// header and cookies.
+func (r *Recorder) addSessions(header http.Header, cookies []*http.Cookie) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if id := header.Get(sessionIDHeader); id != "" {
+		r.sessions[id] = true
+	}
+	for _, cookie := range cookies {
+		if cookie.Name == soap.SessionCookieName && cookie.Value != "" {
+			r.sessions[cookie.Value] = true
+		}
+	}
+}
+
+// redactSessions replaces the known session IDs in s.
+func (r *Recorder) redactSessions(s string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id := range r.sessions {
+		s = strings.Replace(s, id, redacted, -1)
+	}
+	return s
+}
+
+// write saves the exchange to the next fixture file. Failures are logged
+// only, so that recording never fails a request.
+func (r *Recorder) write(exchange *Exchange) {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(exchange); err != nil {
+		klog.Errorf("Failed to encode the exchange %s. Err: %v", exchange.Operation, err)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.seq++
+	name := fmt.Sprintf("%05d-%s.json", r.seq, fileName(exchange.Operation))
+	if err := ioutil.WriteFile(filepath.Join(r.dir, name), data.Bytes(), 0600); err != nil {
+		klog.Errorf("Failed to write the exchange %s. Err: %v", exchange.Operation, err)
+	}
+}
+
+// Replayer is an http.RoundTripper serving the exchanges recorded by a
+// Recorder. A request is answered by the first unused exchange with the same
+// operation and request body or, if there is none, with the same operation.
+type Replayer struct {
+	lock      sync.Mutex
+	exchanges []*Exchange
+	used      []bool
+}
+
+// NewReplayer returns a Replayer serving the fixture files in dir.
+func NewReplayer(dir string) (*Replayer, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	r := &Replayer{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		exchange := &Exchange{}
+		if err = json.Unmarshal(data, exchange); err != nil {
+			return nil, fmt.Errorf("invalid fixture %s: %v", file, err)
+		}
+		r.exchanges = append(r.exchanges, exchange)
+	}
+	r.used = make([]bool, len(r.exchanges))
+	return r, nil
+}
+
+// Wrap returns a RoundTripper serving the recorded exchanges without using
+// next. It can be used as VirtualCenterConfig.WrapTransport.
+func (r *Replayer) Wrap(next http.RoundTripper) http.RoundTripper {
+	return r
+}
+
+// RoundTrip serves the recorded response matching req.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	want := newExchange(req, body)
+	exchange := r.match(want)
+	if exchange == nil {
+		return nil, fmt.Errorf("no recorded exchange for %s %s %s", want.Method, want.Path, want.Operation)
+	}
+	header := http.Header{}
+	for key, values := range exchange.Header {
+		header[key] = values
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", exchange.Status, http.StatusText(exchange.Status)),
+		StatusCode:    exchange.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(exchange.Response)),
+		ContentLength: int64(len(exchange.Response)),
+		Request:       req,
+	}, nil
+}
+
+// match returns the first unused exchange matching want and marks it used.
+func (r *Replayer) match(want *Exchange) *Exchange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	found := -1
+	for i, exchange := range r.exchanges {
+		if r.used[i] || exchange.Method != want.Method || exchange.Path != want.Path ||
+			exchange.Operation != want.Operation {
+			continue
+		}
+		if exchange.Request == want.Request {
+			found = i
+			break
+		}
+		if found < 0 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil
+	}
+	r.used[found] = true
+	return r.exchanges[found]
+}
+
+// roundTripperFunc adapts a function to an http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newExchange returns the exchange for the request with its sanitized body.
+func newExchange(req *http.Request, body []byte) *Exchange {
+	exchange := &Exchange{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Request: sanitizeRequest(body),
+	}
+	exchange.Operation = soapOperation(body)
+	if exchange.Operation == "" {
+		exchange.Operation = req.Method + " " + req.URL.Path
+	}
+	return exchange
+}
+
+// soapOperation returns the name of the first element in the SOAP body, or
+// an empty string if body is not a SOAP envelope.
+func soapOperation(body []byte) string {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	inBody := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if inBody {
+				return start.Name.Local
+			}
+			inBody = start.Name.Local == "Body"
+		}
+	}
+}
+
+// sanitizeRequest redacts passwords, security tokens and session cookies in
+// a request body.
+func sanitizeRequest(body []byte) string {
+	s := passwordPattern.ReplaceAllString(string(body), "<password>"+redacted+"</password>")
+	s = cookiePattern.ReplaceAllString(s, "<vcSessionCookie>"+redacted+"</vcSessionCookie>")
+	return securityPattern.ReplaceAllString(s, "<Security>"+redacted+"</Security>")
+}
+
+// isSessionCreate returns whether operation creates a REST session.
+func isSessionCreate(operation string) bool {
+	return strings.HasSuffix(operation, "/session") && strings.HasPrefix(operation, http.MethodPost)
+}
+
+// sanitizeResponse redacts SAML tokens and REST session IDs in a response body.
+func sanitizeResponse(operation string, body []byte) string {
+	if isSessionCreate(operation) {
+		return fmt.Sprintf(`{"value":%q}`, redacted)
+	}
+	return assertionPattern.ReplaceAllString(string(body), "<Assertion>"+redacted+"</Assertion>")
+}
+
+// readBody reads and restores the body, which may be nil.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// fileName returns the operation as a file name.
+func fileName(operation string) string {
+	return strings.Trim(fileNamePattern.ReplaceAllString(operation, "_"), "_")
+}
+
+// wrapTransport carries the requests of client through the WrapTransport
+// of the config, if set.
+func wrapTransport(client *soap.Client, config *VirtualCenterConfig) {
+	if config.WrapTransport == nil || client == nil {
+		return
+	}
+	transport, ok := client.Client.Transport.(*http.Transport)
+	if !ok {
+		klog.Errorf("Unexpected transport %T for VC %q, requests are not wrapped", client.Client.Transport, config.Host)
+		return
+	}
+	// The registered protocols take over the requests of the transport, so
+	// the wrapped RoundTripper sends them with a copy of it.
+	next := &http.Transport{
+		Proxy:                 transport.Proxy,
+		DialContext:           transport.DialContext,
+		DialTLS:               transport.DialTLS,
+		TLSClientConfig:       transport.TLSClientConfig,
+		TLSHandshakeTimeout:   transport.TLSHandshakeTimeout,
+		MaxIdleConns:          transport.MaxIdleConns,
+		IdleConnTimeout:       transport.IdleConnTimeout,
+		ExpectContinueTimeout: transport.ExpectContinueTimeout,
+	}
+	wrapped := config.WrapTransport(next)
+	transport.RegisterProtocol("https", wrapped)
+	transport.RegisterProtocol("http", wrapped)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	cnssim "github.com/vmware/govmomi/cns/simulator"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+func TestRecordReplay(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.RegisterSDK(cnssim.New())
+	s := model.Service.NewServer()
+	port, _ := strconv.Atoi(s.URL.Port())
+	password, _ := s.URL.User.Password()
+	dir, err := ioutil.TempDir("", "vc-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// run queries the datacenters and CNS volumes of vc
+	run := func(vc *VirtualCenter) (string, int) {
+		ctx := context.Background()
+		if err := vc.ConnectCNS(ctx); err != nil {
+			t.Fatal(err)
+		}
+		dcs, err := vc.GetDatacenters(ctx)
+		if err != nil || len(dcs) != 1 {
+			t.Fatalf("Unexpected datacenters %v, err: %v", dcs, err)
+		}
+		res, err := vc.CnsClient.QueryVolume(ctx, cnstypes.CnsQueryFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dcs[0].InventoryPath, len(res.Volumes)
+	}
+	newVirtualCenter := func(wrap *VirtualCenterConfig) *VirtualCenter {
+		wrap.Host = s.URL.Hostname()
+		wrap.Port = port
+		wrap.Username = s.URL.User.Username()
+		wrap.Password = password
+		wrap.Insecure = true
+		wrap.DatacenterPaths = []string{"DC0"}
+		return &VirtualCenter{Config: wrap}
+	}
+
+	recorder, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := newVirtualCenter(&VirtualCenterConfig{WrapTransport: recorder.Wrap})
+	recordedPath, recordedVolumes := run(recorded)
+	s.Close()
+	var session string
+	soapClient := recorded.Client.Client.Client
+	for _, cookie := range soapClient.Jar.Cookies(soapClient.URL()) {
+		if cookie.Name == soap.SessionCookieName {
+			session = cookie.Value
+		}
+	}
+	if session == "" {
+		t.Fatal("No session cookie")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) == 0 {
+		t.Fatal("No exchanges recorded")
+	}
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(file)
+		if strings.Contains(string(data), ">"+password+"<") || strings.Contains(string(data), session) ||
+			strings.Contains(string(data), soap.SessionCookieName) {
+			t.Errorf("Fixture %s contains credentials: %s", file, data)
+		}
+	}
+
+	// The server is closed, the exchanges are replayed from the fixtures
+	replayer, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, volumes := run(newVirtualCenter(&VirtualCenterConfig{WrapTransport: replayer.Wrap}))
+	if path != recordedPath || volumes != recordedVolumes {
+		t.Errorf("Replayed %q and %d volumes, recorded %q and %d volumes", path, volumes, recordedPath, recordedVolumes)
+	}
+}
@@ -0,0 +1,414 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+)
+
+// DefaultSessionKeepaliveInterval is the interval at which the vCenter
+// session is verified and kept alive. It is well below the default idle
+// timeout of 30 minutes of vCenter sessions.
+const DefaultSessionKeepaliveInterval = 5 * time.Minute
+
+// ErrNotAuthenticated is returned when the session of the virtual center is
+// not authenticated.
+var ErrNotAuthenticated = errors.New("virtual center session is not authenticated")
+
+const (
+	// restSessionCookieName is the cookie holding the REST session ID.
+	restSessionCookieName = "vmware-api-session-id"
+	// restSessionPath is the suffix of the path of the REST session API.
+	restSessionPath = "/cis/session"
+)
+
+// reloginKey marks the context of a login retrying a request, so that the
+// login itself isn't retried.
+type reloginKey struct{}
+
+// sessionValid returns true if the session was verified within the
+// keepalive interval, so that Connect doesn't need a round-trip.
+func (vc *VirtualCenter) sessionValid() bool {
+	vc.sessionLock.Lock()
+	defer vc.sessionLock.Unlock()
+	return !vc.sessionChecked.IsZero() && time.Since(vc.sessionChecked) < DefaultSessionKeepaliveInterval
+}
+
+// setSession records the user name of the verified session.
+func (vc *VirtualCenter) setSession(userName string) {
+	vc.sessionLock.Lock()
+	defer vc.sessionLock.Unlock()
+	vc.sessionUser = userName
+	vc.sessionChecked = time.Now()
+}
+
+// invalidateSession forces the next Connect to verify the session.
+func (vc *VirtualCenter) invalidateSession() {
+	vc.sessionLock.Lock()
+	defer vc.sessionLock.Unlock()
+	vc.sessionChecked = time.Time{}
+}
+
+// resetSession forgets the session and the REST client derived from it,
+// after the SOAP client was replaced. The REST session ID is kept, so that
+// the next REST client resumes the REST session if it is still valid.
+func (vc *VirtualCenter) resetSession() {
+	vc.sessionLock.Lock()
+	defer vc.sessionLock.Unlock()
+	vc.sessionUser = ""
+	vc.sessionChecked = time.Time{}
+	vc.restClient = nil
+}
+
+// forgetRestSession forgets the REST session ID, after a logout or when the
+// credentials changed.
+func (vc *VirtualCenter) forgetRestSession() {
+	vc.sessionLock.Lock()
+	defer vc.sessionLock.Unlock()
+	vc.restSessionID = ""
+}
+
+// SessionUserName returns the user name of the current session. The name is
+// cached and only fetched again after re-authentication.
+func (vc *VirtualCenter) SessionUserName(ctx context.Context) (string, error) {
+	if err := vc.Connect(ctx); err != nil {
+		klog.Errorf("Failed to connect to Virtual Center host %q with err: %v", vc.Config.Host, err)
+		return "", err
+	}
+	vc.sessionLock.Lock()
+	userName := vc.sessionUser
+	vc.sessionLock.Unlock()
+	if userName != "" {
+		return userName, nil
+	}
+	s, err := vc.Client.SessionManager.UserSession(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get usersession with err: %v", err)
+		return "", err
+	}
+	if s == nil {
+		vc.invalidateSession()
+		return "", ErrNotAuthenticated
+	}
+	vc.setSession(s.UserName)
+	return s.UserName, nil
+}
+
+// RestClient returns the REST client used for tagging. It is created once
+// from the SOAP client and kept alive along with the SOAP session. A new
+// client resumes the previous REST session if it is still valid, and logs in
+// with the credentials of the SOAP session otherwise. Requests failing with
+// 401 Unauthorized log in again and are retried once.
+func (vc *VirtualCenter) RestClient(ctx context.Context) (*rest.Client, error) {
+	if err := vc.Connect(ctx); err != nil {
+		klog.Errorf("Failed to connect to Virtual Center host %q with err: %v", vc.Config.Host, err)
+		return nil, err
+	}
+	// Concurrent callers wait for a single login, which doesn't hold
+	// sessionLock
+	vc.restLock.Lock()
+	defer vc.restLock.Unlock()
+	vc.sessionLock.Lock()
+	restClient, sessionID := vc.restClient, vc.restSessionID
+	vc.sessionLock.Unlock()
+	if restClient != nil {
+		return restClient, nil
+	}
+	restClient = rest.NewClient(vc.Client.Client)
+	wrapTransport(restClient.Client, vc.Config)
+	restClient.Client.Client.Transport = &restRoundTripper{next: restClient.Client.Client.Transport, vc: vc, client: restClient}
+	if sessionID == "" || !vc.resumeRestSession(ctx, restClient, sessionID) {
+		if err := vc.restLogin(ctx, restClient); err != nil {
+			return nil, err
+		}
+	}
+	vc.sessionLock.Lock()
+	vc.restClient = restClient
+	vc.sessionLock.Unlock()
+	return restClient, nil
+}
+
+// resumeRestSession sets the REST session ID on restClient and returns true
+// if the session is still valid.
+func (vc *VirtualCenter) resumeRestSession(ctx context.Context, restClient *rest.Client, sessionID string) bool {
+	restClient.Jar.SetCookies(restClient.URL(), []*http.Cookie{{Name: restSessionCookieName, Value: sessionID}})
+	if err := restClient.Get(ctx); err != nil {
+		klog.V(3).Infof("REST session of VC %q can't be resumed. err: %v", vc.Config.Host, err)
+		return false
+	}
+	klog.V(3).Infof("Resumed REST session of VC %q", vc.Config.Host)
+	return true
+}
+
+// restLogin logs restClient in and records the ID of its REST session.
+func (vc *VirtualCenter) restLogin(ctx context.Context, restClient *rest.Client) error {
+	config := vc.configSnapshot()
+	signer, err := signer(ctx, vc.Client.Client, config)
+	if err != nil {
+		klog.Errorf("Failed to create the Signer. Error: %v", err)
+		return err
+	}
+	if signer == nil {
+		klog.V(3).Info("Using plain text username and password")
+		err = restClient.Login(ctx, neturl.UserPassword(config.Username, config.Password))
+	} else {
+		klog.V(3).Info("Using certificate and private key")
+		err = restClient.LoginByToken(restClient.WithSigner(ctx, signer))
+	}
+	if err != nil {
+		klog.Errorf("Failed to login for the rest client. Error: %v", err)
+		return err
+	}
+	vc.sessionLock.Lock()
+	defer vc.sessionLock.Unlock()
+	for _, cookie := range restClient.Jar.Cookies(restClient.URL()) {
+		if cookie.Name == restSessionCookieName {
+			vc.restSessionID = cookie.Value
+		}
+	}
+	return nil
+}
+
+// startKeepalive starts keeping the session alive if it isn't already.
+func (vc *VirtualCenter) startKeepalive() {
+	vc.sessionLock.Lock()
+	defer vc.sessionLock.Unlock()
+	if vc.stopKeepalive != nil {
+		return
+	}
+	vc.stopKeepalive = make(chan struct{})
+	go vc.keepalive(vc.stopKeepalive)
+}
+
+// stopKeepaliveLoop stops keeping the session alive.
+func (vc *VirtualCenter) stopKeepaliveLoop() {
+	vc.sessionLock.Lock()
+	defer vc.sessionLock.Unlock()
+	if vc.stopKeepalive != nil {
+		close(vc.stopKeepalive)
+		vc.stopKeepalive = nil
+	}
+}
+
+// keepalive verifies the SOAP and REST sessions every keepalive interval
+// until stop is closed. The verification keeps idle sessions from timing out,
+// and expired sessions are re-authenticated so that requests don't fail.
+func (vc *VirtualCenter) keepalive(stop chan struct{}) {
+	ticker := time.NewTicker(DefaultSessionKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultSessionKeepaliveInterval)
+			vc.invalidateSession()
+			if err := vc.Connect(ctx); err != nil {
+				klog.Errorf("Failed to keep session of VC %q alive with err: %v", vc.Config.Host, err)
+			}
+			vc.sessionLock.Lock()
+			restClient := vc.restClient
+			vc.sessionLock.Unlock()
+			if restClient != nil {
+				if err := restClient.Get(ctx); err != nil {
+					klog.V(2).Infof("REST session of VC %q is no longer valid, it is re-created on next use. err: %v", vc.Config.Host, err)
+					vc.sessionLock.Lock()
+					if vc.restClient == restClient {
+						vc.restClient = nil
+						vc.restSessionID = ""
+					}
+					vc.sessionLock.Unlock()
+				}
+			}
+			cancel()
+		}
+	}
+}
+
+// sessionRoundTripper logs the client in again and retries a request once
+// when vCenter reports that the session is not authenticated, e.g. after it
+// expired on the server side since it was last verified. It also fails
+// requests immediately while the circuit breaker of the virtual center is
+// open and reports their outcome to it.
+type sessionRoundTripper struct {
+	soap.RoundTripper
+	vc     *VirtualCenter
+	client *govmomi.Client
+	// loginLock serializes the logins of client, counted by logins so that
+	// requests failing concurrently log in once
+	loginLock sync.Mutex
+	logins    int32
+}
+
+func (rt *sessionRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	ctx, err := rt.vc.breaker.allow(ctx, rt.vc.Config.Host)
+	if err != nil {
+		return err
+	}
+	logins := atomic.LoadInt32(&rt.logins)
+	err = rt.RoundTripper.RoundTrip(ctx, req, res)
+	rt.vc.breaker.record(rt.vc.Config.Host, err)
+	if !isNotAuthenticated(err) || ctx.Value(reloginKey{}) != nil {
+		return err
+	}
+	klog.V(2).Infof("Session of VC %q is not authenticated, logging in again", rt.vc.Config.Host)
+	rt.vc.invalidateSession()
+	if loginErr := rt.relogin(ctx, logins); loginErr != nil {
+		klog.Errorf("Failed to log in to VC %q again with err: %v", rt.vc.Config.Host, loginErr)
+		return err
+	}
+	// The fault of the failed request must not remain in the response
+	resetResponse(res)
+	err = rt.RoundTripper.RoundTrip(ctx, req, res)
+	rt.vc.breaker.record(rt.vc.Config.Host, err)
+	return err
+}
+
+// resetResponse zeroes the response body res, which is decoded into again
+// when the request is retried.
+func resetResponse(res soap.HasFault) {
+	v := reflect.ValueOf(res)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	}
+}
+
+// relogin logs the client in unless it was logged in since the given number
+// of logins.
+func (rt *sessionRoundTripper) relogin(ctx context.Context, logins int32) error {
+	rt.loginLock.Lock()
+	defer rt.loginLock.Unlock()
+	if atomic.LoadInt32(&rt.logins) != logins {
+		return nil
+	}
+	if err := login(context.WithValue(ctx, reloginKey{}, true), rt.client, rt.vc.configSnapshot()); err != nil {
+		return err
+	}
+	atomic.AddInt32(&rt.logins, 1)
+	return nil
+}
+
+// isNotAuthenticated returns true if err is a NotAuthenticated fault.
+func isNotAuthenticated(err error) bool {
+	var fault interface{}
+	switch {
+	case err == nil:
+		return false
+	case soap.IsSoapFault(err):
+		fault = soap.ToSoapFault(err).VimFault()
+	case soap.IsVimFault(err):
+		fault = soap.ToVimFault(err)
+	}
+	switch fault.(type) {
+	case types.NotAuthenticated, *types.NotAuthenticated:
+		return true
+	}
+	return false
+}
+
+// restRoundTripper logs the REST client in again and retries a request once
+// when vCenter responds with 401 Unauthorized, e.g. after the REST session
+// expired on the server side.
+type restRoundTripper struct {
+	next   http.RoundTripper
+	vc     *VirtualCenter
+	client *rest.Client
+	// loginLock serializes the logins of client, counted by logins so that
+	// requests failing concurrently log in once
+	loginLock sync.Mutex
+	logins    int32
+}
+
+func (rt *restRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Session requests are not retried
+	if strings.HasSuffix(req.URL.Path, restSessionPath) {
+		return rt.next.RoundTrip(req)
+	}
+	// The REST client sends its bodies from plain readers, which are buffered
+	// so that they can be sent again
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(req.Context())
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+	logins := atomic.LoadInt32(&rt.logins)
+	res, err := rt.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	klog.V(2).Infof("REST session of VC %q is not authenticated, logging in again", rt.vc.Config.Host)
+	if loginErr := rt.relogin(req.Context(), logins); loginErr != nil {
+		return res, nil
+	}
+	retry := req.WithContext(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return res, nil
+		}
+	}
+	res.Body.Close()
+	// The cookies of the request were set by the client before the login
+	retry.Header = make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		if key != "Cookie" {
+			retry.Header[key] = values
+		}
+	}
+	for _, cookie := range rt.client.Jar.Cookies(req.URL) {
+		retry.AddCookie(cookie)
+	}
+	return rt.next.RoundTrip(retry)
+}
+
+// relogin logs the client in unless it was logged in since the given number
+// of logins.
+func (rt *restRoundTripper) relogin(ctx context.Context, logins int32) error {
+	rt.loginLock.Lock()
+	defer rt.loginLock.Unlock()
+	if atomic.LoadInt32(&rt.logins) != logins {
+		return nil
+	}
+	if err := rt.vc.restLogin(ctx, rt.client); err != nil {
+		return err
+	}
+	atomic.AddInt32(&rt.logins, 1)
+	return nil
+}
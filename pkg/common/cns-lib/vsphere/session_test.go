@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"strconv"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/simulator/vpx"
+	vapisim "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/methods"
+)
+
+func TestSessionReuse(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	s := model.Service.NewServer()
+	defer s.Close()
+	model.Service.Handle(vapisim.New(s.URL, vpx.Setting))
+	port, _ := strconv.Atoi(s.URL.Port())
+	password, _ := s.URL.User.Password()
+	vc := &VirtualCenter{Config: &VirtualCenterConfig{
+		Host:     s.URL.Hostname(),
+		Port:     port,
+		Username: s.URL.User.Username(),
+		Password: password,
+		Insecure: true,
+	}}
+	ctx := context.Background()
+	defer vc.Disconnect(ctx)
+
+	userName, err := vc.SessionUserName(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userName != s.URL.User.Username() {
+		t.Errorf("Expected session user %q, got %q", s.URL.User.Username(), userName)
+	}
+	client := vc.Client
+	if err := vc.Connect(ctx); err != nil || vc.Client != client {
+		t.Errorf("Expected the session to be reused, err: %v", err)
+	}
+
+	// A request failing as the session expired since it was last verified
+	// logs in again and is retried
+	if err := client.SessionManager.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := methods.GetCurrentTime(ctx, client.Client); err != nil {
+		t.Errorf("Expected the request to be retried after a login, err: %v", err)
+	}
+	if vc.Client != client {
+		t.Errorf("Expected the client to be kept when it logs in again")
+	}
+
+	// Requests with an expired REST session log in again and are retried,
+	// and a new REST client resumes the REST session
+	restClient, err := vc.RestClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restClient.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tags.NewManager(restClient).GetCategories(ctx); err != nil {
+		t.Errorf("Expected the REST request to be retried after a login, err: %v", err)
+	}
+	sessionID := vc.restSessionID
+	vc.resetSession()
+	if restClient, err = vc.RestClient(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tags.NewManager(restClient).GetCategories(ctx); err != nil || vc.restSessionID != sessionID {
+		t.Errorf("Expected REST session %q to be resumed, got %q, err: %v", sessionID, vc.restSessionID, err)
+	}
+
+	// An expired session is re-authenticated once it is no longer known valid
+	if err := client.SessionManager.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	vc.invalidateSession()
+	if err := vc.Connect(ctx); err != nil {
+		t.Fatalf("Failed to re-authenticate: %v", err)
+	}
+	if vc.Client == client {
+		t.Errorf("Expected a new client after session expiry")
+	}
+	if userName, err = vc.SessionUserName(ctx); err != nil || userName != s.URL.User.Username() {
+		t.Errorf("Unexpected session user %q after re-authentication, err: %v", userName, err)
+	}
+
+	// Config changes replace the clients only once the new session is
+	// established
+	client = vc.Client
+	config := *vc.Config
+	config.Password = ""
+	if err := vc.UpdateConfig(ctx, &config); err == nil {
+		t.Errorf("Expected the update with invalid credentials to fail")
+	}
+	if vc.Client != client {
+		t.Errorf("Expected the clients to be kept when the new session fails")
+	}
+	if vc.Config.Password != password || !vc.sessionValid() {
+		t.Errorf("Expected the config and session to be kept when the new session fails")
+	}
+	if _, err := methods.GetCurrentTime(ctx, vc.Client.Client); err != nil {
+		t.Errorf("Failed to use the kept session: %v", err)
+	}
+	config.Password = password
+	config.RoundTripperCount = 5
+	if err := vc.UpdateConfig(ctx, &config); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+	if vc.Client == nil || vc.Client == client {
+		t.Errorf("Expected a new client after the config update")
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/soap"
+	"k8s.io/klog"
+)
+
+// certificateCheckTimeout bounds the connection used to read the presented
+// certificate when verification fails.
+const certificateCheckTimeout = 10 * time.Second
+
+// errThumbprintMismatch is returned when the certificate presented by the
+// virtual center doesn't match the configured thumbprint.
+var errThumbprintMismatch = errors.New("certificate thumbprint does not match the configured thumbprint")
+
+// configureTLS sets up verification of the virtual center certificate on the
+// SOAP client. The TLS configuration is shared with the CNS, PBM, STS and tag
+// REST clients created from it. If a thumbprint is configured the presented
+// certificate must match it, otherwise the certificate is verified against
+// the CA bundle in CAFile or the system roots.
+func configureTLS(client *soap.Client, config *VirtualCenterConfig) error {
+	if config.Insecure {
+		if config.CAFile != "" || config.Thumbprint != "" {
+			klog.Warningf("Insecure flag is set for VC %q, ca-file and thumbprint are ignored", config.Host)
+		}
+		return nil
+	}
+	if config.CAFile != "" {
+		if err := client.SetRootCAs(config.CAFile); err != nil {
+			klog.Errorf("Failed to load CA file %q for VC %q with err: %v", config.CAFile, config.Host, err)
+			return err
+		}
+	}
+	if config.Thumbprint != "" {
+		thumbprint := normalizeThumbprint(config.Thumbprint)
+		transport, ok := client.Client.Transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("unexpected transport %T for VC %q", client.Client.Transport, config.Host)
+		}
+		// The certificate is verified by VerifyPeerCertificate against the
+		// thumbprint only
+		transport.TLSClientConfig.InsecureSkipVerify = true
+		transport.TLSClientConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errThumbprintMismatch
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if soap.ThumbprintSHA1(cert) != thumbprint {
+				return errThumbprintMismatch
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// normalizeThumbprint returns the thumbprint in the upper case, colon
+// separated format of soap.ThumbprintSHA1.
+func normalizeThumbprint(thumbprint string) string {
+	thumbprint = strings.ToUpper(strings.TrimSpace(thumbprint))
+	if strings.Contains(thumbprint, ":") {
+		return thumbprint
+	}
+	var parts []string
+	for i := 0; i+2 <= len(thumbprint); i += 2 {
+		parts = append(parts, thumbprint[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// isCertificateError returns true if err is caused by a failed verification
+// of the certificate presented by the virtual center.
+func isCertificateError(err error) bool {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.Is(err, errThumbprintMismatch) || errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// certificateError returns an error explaining the failed certificate
+// verification along with the thumbprint of the certificate presented by
+// the virtual center, so that it can be compared or configured.
+func certificateError(address string, err error) error {
+	dialer := &net.Dialer{Timeout: certificateCheckTimeout}
+	conn, dialErr := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if dialErr != nil {
+		return fmt.Errorf("failed to verify certificate of vCenter %q: %v", address, err)
+	}
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	return fmt.Errorf("failed to verify certificate of vCenter %q: %v. The presented certificate "+
+		"(subject %q, issuer %q) has thumbprint %s; configure ca-file with the CA that issued it "+
+		"or thumbprint with its thumbprint", address, err, cert.Subject, cert.Issuer, soap.ThumbprintSHA1(cert))
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+func TestConnectTLS(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	s := model.Service.NewServer()
+	defer s.Close()
+	caFile, err := s.CertificateFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint := soap.ThumbprintSHA1(s.Certificate())
+	port, _ := strconv.Atoi(s.URL.Port())
+	password, _ := s.URL.User.Password()
+
+	newVC := func(caFile, thumbprint string) *VirtualCenter {
+		return &VirtualCenter{Config: &VirtualCenterConfig{
+			Host:       s.URL.Hostname(),
+			Port:       port,
+			Username:   s.URL.User.Username(),
+			Password:   password,
+			CAFile:     caFile,
+			Thumbprint: thumbprint,
+		}}
+	}
+	ctx := context.Background()
+
+	// The simulator certificate is not trusted by the system roots, the
+	// error must show its thumbprint
+	err = newVC("", "").Connect(ctx)
+	if err == nil || !strings.Contains(err.Error(), thumbprint) {
+		t.Errorf("Expected certificate error with thumbprint %s, got: %v", thumbprint, err)
+	}
+	if err := newVC(caFile, "").Connect(ctx); err != nil {
+		t.Errorf("Failed to connect with CA file: %v", err)
+	}
+	if err := newVC("", strings.ToLower(strings.Replace(thumbprint, ":", "", -1))).Connect(ctx); err != nil {
+		t.Errorf("Failed to connect with thumbprint: %v", err)
+	}
+	err = newVC(caFile, "AA:BB").Connect(ctx)
+	if err == nil || !strings.Contains(err.Error(), thumbprint) {
+		t.Errorf("Expected thumbprint mismatch error with thumbprint %s, got: %v", thumbprint, err)
+	}
+}
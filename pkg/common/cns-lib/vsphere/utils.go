@@ -19,7 +19,6 @@ package vsphere
 import (
 	"context"
 	"crypto/tls"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"reflect"
@@ -94,12 +93,19 @@ func GetVirtualCenterConfig(cfg *config.Config) (*VirtualCenterConfig, error) {
 		Port:            port,
 		Username:        cfg.VirtualCenter[host].User,
 		Password:        cfg.VirtualCenter[host].Password,
+		ClientCert:      cfg.VirtualCenter[host].ClientCert,
+		ClientKey:       cfg.VirtualCenter[host].ClientKey,
 		Insecure:        cfg.VirtualCenter[host].InsecureFlag,
+		CAFile:          cfg.VirtualCenter[host].CAFile,
+		Thumbprint:      cfg.VirtualCenter[host].Thumbprint,
 		DatacenterPaths: strings.Split(cfg.VirtualCenter[host].Datacenters, ","),
 	}
 	for idx := range vcConfig.DatacenterPaths {
 		vcConfig.DatacenterPaths[idx] = strings.TrimSpace(vcConfig.DatacenterPaths[idx])
 	}
+	if recorder := getRecorder(); recorder != nil {
+		vcConfig.WrapTransport = recorder.Wrap
+	}
 	return vcConfig, nil
 }
 
@@ -135,12 +141,12 @@ func CompareKubernetesMetadata(pvMetaData *cnstypes.CnsKubernetesEntityMetadata,
 }
 
 // Signer decodes the certificate and private key and returns SAML token needed for authentication
-func signer(ctx context.Context, client *vim25.Client, username string, password string) (*sts.Signer, error) {
-	pemBlock, _ := pem.Decode([]byte(username))
-	if pemBlock == nil {
+func signer(ctx context.Context, client *vim25.Client, config *VirtualCenterConfig) (*sts.Signer, error) {
+	certPEM, keyPEM := config.clientCertificate()
+	if certPEM == "" {
 		return nil, nil
 	}
-	certificate, err := tls.X509KeyPair([]byte(username), []byte(password))
+	certificate, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load X509 key pair. Error: %+v", err)
 	}
@@ -148,6 +154,7 @@ func signer(ctx context.Context, client *vim25.Client, username string, password
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create STS client. err: %+v", err)
 	}
+	wrapTransport(tokens.Client, config)
 	req := sts.TokenRequest{
 		Certificate: &certificate,
 		Delegatable: true,
@@ -22,25 +22,30 @@ import (
 	"encoding/pem"
 	"fmt"
 	"net"
+	"net/http"
 	neturl "net/url"
 	"strconv"
 	"sync"
+	"time"
 
 	csictx "github.com/rexray/gocsi/context"
 	"github.com/vmware/govmomi"
-	"github.com/vmware/govmomi/cns"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/pbm"
 	"github.com/vmware/govmomi/session"
 	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
 
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/faults"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/redact"
 )
 
 const (
@@ -59,10 +64,25 @@ type VirtualCenter struct {
 	// PbmClient represents the govmomi PBM Client instance.
 	PbmClient *pbm.Client
 	// CnsClient represents the CNS client instance.
-	CnsClient       *cns.Client
+	CnsClient       *CNSClient
 	credentialsLock sync.Mutex
+
+	// Session state, see session.go.
+	sessionLock    sync.Mutex
+	sessionUser    string
+	sessionChecked time.Time
+	restClient     *rest.Client
+	restSessionID  string
+	stopKeepalive  chan struct{}
+	// restLock serializes the logins of the REST client.
+	restLock sync.Mutex
+
+	// breaker fails requests immediately while vCenter is unreachable.
+	breaker circuitBreaker
 }
 
+// String returns a human readable representation of the VirtualCenter with
+// credentials redacted.
 func (vc *VirtualCenter) String() string {
 	return fmt.Sprintf("VirtualCenter [Config: %v, Client: %v, PbmClient: %v]",
 		vc.Config, vc.Client, vc.PbmClient)
@@ -80,41 +100,78 @@ type VirtualCenterConfig struct {
 	Username string
 	// Password represents the virtual center password in clear text.
 	Password string
+	// ClientCert and ClientKey are the PEM encoded client certificate and
+	// private key used for STS token login instead of Username and Password.
+	ClientCert string
+	ClientKey  string
 	// Insecure tells if an insecure connection is allowed.
 	Insecure bool
+	// CAFile is the path of the CA bundle used to verify the virtual center
+	// certificate. The system roots are used if empty.
+	CAFile string
+	// Thumbprint is the SHA-1 thumbprint the virtual center certificate must
+	// match. It takes precedence over CAFile.
+	Thumbprint string
 	// RoundTripperCount is the SOAP round tripper count. (retries = RoundTripperCount - 1)
 	RoundTripperCount int
 	// DatacenterPaths represents paths of datacenters on the virtual center.
 	DatacenterPaths []string
+	// WrapTransport, if set, wraps the transport of the SOAP and REST
+	// requests to the virtual center, for example with a Recorder or a
+	// Replayer.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
 }
 
+// String returns a human readable representation of the VirtualCenterConfig.
+// The password and any private key passed in the username are redacted.
 func (vcc *VirtualCenterConfig) String() string {
 	return fmt.Sprintf("VirtualCenterConfig [Scheme: %v, Host: %v, Port: %v, "+
-		"Username: %v, Password: %v, Insecure: %v, RoundTripperCount: %v, "+
-		"DatacenterPaths: %v]", vcc.Scheme, vcc.Host, vcc.Port, vcc.Username,
-		vcc.Password, vcc.Insecure, vcc.RoundTripperCount, vcc.DatacenterPaths)
+		"Username: %v, Password: %v, ClientKey: %v, Insecure: %v, CAFile: %v, Thumbprint: %v, "+
+		"RoundTripperCount: %v, DatacenterPaths: %v]", vcc.Scheme, vcc.Host, vcc.Port,
+		redact.PEM(vcc.Username), redact.String(vcc.Password), redact.String(vcc.ClientKey),
+		vcc.Insecure, vcc.CAFile, vcc.Thumbprint, vcc.RoundTripperCount, vcc.DatacenterPaths)
 }
 
 // clientMutex is used for exclusive connection creation.
 var clientMutex sync.Mutex
 
-// newClient creates a new govmomi Client instance.
-func (vc *VirtualCenter) newClient(ctx context.Context) (*govmomi.Client, error) {
-	if vc.Config.Scheme == "" {
-		vc.Config.Scheme = DefaultScheme
+// configSnapshot returns a copy of Config with the default scheme and round
+// tripper count applied, taken under credentialsLock.
+func (vc *VirtualCenter) configSnapshot() *VirtualCenterConfig {
+	vc.credentialsLock.Lock()
+	defer vc.credentialsLock.Unlock()
+	config := *vc.Config
+	config.DatacenterPaths = append([]string(nil), vc.Config.DatacenterPaths...)
+	if config.Scheme == "" {
+		config.Scheme = DefaultScheme
+	}
+	if config.RoundTripperCount == 0 {
+		config.RoundTripperCount = DefaultRoundTripperCount
 	}
+	return &config
+}
 
-	url, err := soap.ParseURL(net.JoinHostPort(vc.Config.Host, strconv.Itoa(vc.Config.Port)))
+// newClient creates a new govmomi Client instance logged in with config, and
+// returns it along with the user name of its session.
+func (vc *VirtualCenter) newClient(ctx context.Context, config *VirtualCenterConfig) (*govmomi.Client, string, error) {
+	url, err := soap.ParseURL(net.JoinHostPort(config.Host, strconv.Itoa(config.Port)))
 	if err != nil {
 		klog.Errorf("Failed to parse URL %s with err: %v", url, err)
-		return nil, err
+		return nil, "", err
 	}
 
-	soapClient := soap.NewClient(url, vc.Config.Insecure)
+	soapClient := soap.NewClient(url, config.Insecure)
+	if err = configureTLS(soapClient, config); err != nil {
+		return nil, "", err
+	}
+	wrapTransport(soapClient, config)
 	vimClient, err := vim25.NewClient(ctx, soapClient)
 	if err != nil {
+		if isCertificateError(err) {
+			err = certificateError(url.Host, err)
+		}
 		klog.Errorf("Failed to create new client with err: %v", err)
-		return nil, err
+		return nil, "", err
 	}
 
 	vimClient.UserAgent = "k8s-csi-useragent"
@@ -124,36 +181,47 @@ func (vc *VirtualCenter) newClient(ctx context.Context) (*govmomi.Client, error)
 		SessionManager: session.NewManager(vimClient),
 	}
 
-	err = vc.login(ctx, client)
+	err = login(ctx, client, config)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
+	var userName string
 	s, err := client.SessionManager.UserSession(ctx)
-	if err == nil {
+	if err == nil && s != nil {
 		klog.V(4).Infof("New session ID for '%s' = %s", s.UserName, s.Key)
+		userName = s.UserName
 	}
 
-	if vc.Config.RoundTripperCount == 0 {
-		vc.Config.RoundTripperCount = DefaultRoundTripperCount
+	client.RoundTripper = vim25.Retry(client.RoundTripper, vim25.TemporaryNetworkError(config.RoundTripperCount))
+	client.RoundTripper = &sessionRoundTripper{RoundTripper: client.RoundTripper, vc: vc, client: client}
+	return client, userName, nil
+}
+
+// clientCertificate returns the PEM encoded client certificate and private key
+// used for STS token login, or empty strings if user and password are used.
+// A certificate in Username and a private key in Password are still accepted
+// for compatibility.
+func (vcc *VirtualCenterConfig) clientCertificate() (string, string) {
+	if vcc.ClientCert != "" {
+		return vcc.ClientCert, vcc.ClientKey
+	}
+	if b, _ := pem.Decode([]byte(vcc.Username)); b != nil {
+		return vcc.Username, vcc.Password
 	}
-	client.RoundTripper = vim25.Retry(client.RoundTripper, vim25.TemporaryNetworkError(vc.Config.RoundTripperCount))
-	return client, nil
+	return "", ""
 }
 
 // login calls SessionManager.LoginByToken if certificate and private key are configured,
 // otherwise calls SessionManager.Login with user and password.
-func (vc *VirtualCenter) login(ctx context.Context, client *govmomi.Client) error {
+func login(ctx context.Context, client *govmomi.Client, config *VirtualCenterConfig) error {
 	var err error
-	vc.credentialsLock.Lock()
-	defer vc.credentialsLock.Unlock()
-
-	b, _ := pem.Decode([]byte(vc.Config.Username))
-	if b == nil {
-		return client.SessionManager.Login(ctx, neturl.UserPassword(vc.Config.Username, vc.Config.Password))
+	certPEM, keyPEM := config.clientCertificate()
+	if certPEM == "" {
+		return client.SessionManager.Login(ctx, neturl.UserPassword(config.Username, config.Password))
 	}
 
-	cert, err := tls.X509KeyPair([]byte(vc.Config.Username), []byte(vc.Config.Password))
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
 	if err != nil {
 		klog.Errorf("Failed to load X509 key pair with err: %v", err)
 		return err
@@ -164,6 +232,7 @@ func (vc *VirtualCenter) login(ctx context.Context, client *govmomi.Client) erro
 		klog.Errorf("Failed to create STS client with err: %v", err)
 		return err
 	}
+	wrapTransport(tokens.Client, config)
 
 	req := sts.TokenRequest{
 		Certificate: &cert,
@@ -181,7 +250,29 @@ func (vc *VirtualCenter) login(ctx context.Context, client *govmomi.Client) erro
 
 // Connect establishes connection with vSphere with existing credentials if session doesn't exist.
 // If credentials are invalid then it fetches latest credential from credential store and connects with it.
+// ErrCircuitOpen is returned immediately while vCenter is unreachable.
 func (vc *VirtualCenter) Connect(ctx context.Context) error {
+	ctx, err := vc.breaker.allow(ctx, vc.Config.Host)
+	if err != nil {
+		klog.V(4).Infof("Not connecting to VC %q. err: %v", vc.Config.Host, err)
+		return err
+	}
+	if ctx.Value(probeKey{}) != nil {
+		// The probe must reach vCenter, not a cached session
+		vc.invalidateSession()
+	}
+	if err = faults.GetInjector().Inject(ctx, faults.Connect); err == nil {
+		err = vc.connectWithCredentials(ctx)
+	}
+	if err != nil {
+		vc.breaker.record(vc.Config.Host, err)
+	}
+	return err
+}
+
+// connectWithCredentials connects to vCenter, re-reading the credentials if
+// they are invalid.
+func (vc *VirtualCenter) connectWithCredentials(ctx context.Context) error {
 	err := vc.connect(ctx)
 	if err == nil {
 		return nil
@@ -212,6 +303,10 @@ func (vc *VirtualCenter) Connect(ctx context.Context) error {
 		return err
 	}
 	vc.UpdateCredentials(vcenterconfig.Username, vcenterconfig.Password)
+	vc.credentialsLock.Lock()
+	vc.Config.ClientCert = vcenterconfig.ClientCert
+	vc.Config.ClientKey = vcenterconfig.ClientKey
+	vc.credentialsLock.Unlock()
 	return vc.connect(ctx)
 }
 
@@ -221,15 +316,25 @@ func (vc *VirtualCenter) connect(ctx context.Context) error {
 	defer clientMutex.Unlock()
 
 	// If client was never initialized, initialize one.
-	var err error
 	if vc.Client == nil {
-		if vc.Client, err = vc.newClient(ctx); err != nil {
+		client, userName, err := vc.newClient(ctx, vc.configSnapshot())
+		if err != nil {
 			klog.Errorf("Failed to create govmomi client with err: %v", err)
 			return err
 		}
+		vc.Client = client
+		vc.resetSession()
+		if userName != "" {
+			vc.setSession(userName)
+		}
+		vc.startKeepalive()
 		return nil
 	}
 
+	// If the session was verified recently, nothing to do.
+	if vc.sessionValid() {
+		return nil
+	}
 	// If session hasn't expired, nothing to do.
 	sessionMgr := session.NewManager(vc.Client.Client)
 	// SessionMgr.UserSession(ctx) retrieves and returns the SessionManager's CurrentSession field
@@ -238,27 +343,56 @@ func (vc *VirtualCenter) connect(ctx context.Context) error {
 		klog.Errorf("Failed to obtain user session with err: %v", err)
 		return err
 	} else if userSession != nil {
+		vc.setSession(userSession.UserName)
 		return nil
 	}
 	// If session has expired, create a new instance.
 	klog.Warning("Creating a new client session as the existing session isn't valid or not authenticated")
-	if vc.Client, err = vc.newClient(ctx); err != nil {
+	vc.invalidateSession()
+	return vc.replaceClients(ctx, vc.configSnapshot(), nil)
+}
+
+// replaceClients creates a new govmomi client logged in with config and, for
+// the ones in use, new PBM and CNS clients on top of it. Once all of them are
+// ready, it calls commit if set, replaces the current clients and resets the
+// session state. The current clients and session state are kept if any of
+// the new clients can't be created, so that callers never observe a nil
+// client. clientMutex must be held.
+func (vc *VirtualCenter) replaceClients(ctx context.Context, config *VirtualCenterConfig, commit func()) error {
+	client, userName, err := vc.newClient(ctx, config)
+	if err != nil {
 		klog.Errorf("Failed to create govmomi client with err: %v", err)
 		return err
 	}
-	// Recreate PbmClient If created using timed out VC Client
+	var pbmClient *pbm.Client
 	if vc.PbmClient != nil {
-		if vc.PbmClient, err = pbm.NewClient(ctx, vc.Client.Client); err != nil {
+		if pbmClient, err = pbm.NewClient(ctx, client.Client); err != nil {
 			klog.Errorf("Failed to create pbm client with err: %v", err)
 			return err
 		}
+		wrapTransport(pbmClient.Client, config)
 	}
-	// Recreate CNSClient If created using timed out VC Client
+	var cnsClient *CNSClient
 	if vc.CnsClient != nil {
-		if vc.CnsClient, err = NewCNSClient(ctx, vc.Client.Client); err != nil {
-			klog.Errorf("Failed to create CNS client on vCenter host %v with err: %v", vc.Config.Host, err)
+		if cnsClient, err = NewCNSClient(ctx, client.Client); err != nil {
+			klog.Errorf("Failed to create CNS client on vCenter host %v with err: %v", config.Host, err)
 			return err
 		}
+		wrapTransport(cnsClient.serviceClient, config)
+	}
+	if commit != nil {
+		commit()
+	}
+	vc.Client = client
+	if pbmClient != nil {
+		vc.PbmClient = pbmClient
+	}
+	if cnsClient != nil {
+		vc.CnsClient = cnsClient
+	}
+	vc.resetSession()
+	if userName != "" {
+		vc.setSession(userName)
 	}
 	return nil
 }
@@ -302,23 +436,34 @@ func (vc *VirtualCenter) getDatacenters(ctx context.Context, dcPaths []string) (
 // is configured in VirtualCenterConfig during registration, only the listed
 // Datacenters are returned.
 func (vc *VirtualCenter) GetDatacenters(ctx context.Context) ([]*Datacenter, error) {
-	if len(vc.Config.DatacenterPaths) != 0 {
-		return vc.getDatacenters(ctx, vc.Config.DatacenterPaths)
+	if dcPaths := vc.configSnapshot().DatacenterPaths; len(dcPaths) != 0 {
+		return vc.getDatacenters(ctx, dcPaths)
 	}
 	return vc.listDatacenters(ctx)
 }
 
 // Disconnect disconnects the virtual center host connection if connected.
 func (vc *VirtualCenter) Disconnect(ctx context.Context) error {
+	vc.stopKeepaliveLoop()
 	if vc.Client == nil {
 		klog.V(1).Info("Client wasn't connected, ignoring")
 		return nil
 	}
+	vc.sessionLock.Lock()
+	restClient := vc.restClient
+	vc.sessionLock.Unlock()
+	if restClient != nil {
+		if err := restClient.Logout(ctx); err != nil {
+			klog.Warningf("Failed to logout REST session with err: %v", err)
+		}
+	}
 	if err := vc.Client.Logout(ctx); err != nil {
 		klog.Errorf("Failed to logout with err: %v", err)
 		return err
 	}
 	vc.Client = nil
+	vc.resetSession()
+	vc.forgetRestSession()
 	return nil
 }
 
@@ -330,14 +475,88 @@ func (vc *VirtualCenter) UpdateCredentials(username, password string) {
 	vc.Config.Password = password
 }
 
+// UpdateConfig applies config to the virtual center. Credential, port, scheme
+// and TLS (insecure flag, CA file, thumbprint) changes log in with the new
+// settings and replace the clients once the new ones are ready. The current
+// config, clients and session are kept if the new settings fail. The host of
+// the virtual center can't be changed.
+func (vc *VirtualCenter) UpdateConfig(ctx context.Context, config *VirtualCenterConfig) error {
+	if config.Host != vc.Config.Host {
+		return fmt.Errorf("cannot change host of virtual center %q to %q", vc.Config.Host, config.Host)
+	}
+	current := vc.configSnapshot()
+	updated := *current
+	updated.Scheme = config.Scheme
+	updated.Port = config.Port
+	updated.Username = config.Username
+	updated.Password = config.Password
+	updated.ClientCert = config.ClientCert
+	updated.ClientKey = config.ClientKey
+	updated.Insecure = config.Insecure
+	updated.CAFile = config.CAFile
+	updated.Thumbprint = config.Thumbprint
+	updated.RoundTripperCount = config.RoundTripperCount
+	updated.DatacenterPaths = append([]string(nil), config.DatacenterPaths...)
+	if updated.Scheme == "" {
+		updated.Scheme = DefaultScheme
+	}
+	if updated.RoundTripperCount == 0 {
+		updated.RoundTripperCount = DefaultRoundTripperCount
+	}
+	apply := func() {
+		vc.credentialsLock.Lock()
+		defer vc.credentialsLock.Unlock()
+		vc.Config.Scheme = updated.Scheme
+		vc.Config.Port = updated.Port
+		vc.Config.Username = updated.Username
+		vc.Config.Password = updated.Password
+		vc.Config.ClientCert = updated.ClientCert
+		vc.Config.ClientKey = updated.ClientKey
+		vc.Config.Insecure = updated.Insecure
+		vc.Config.CAFile = updated.CAFile
+		vc.Config.Thumbprint = updated.Thumbprint
+		vc.Config.RoundTripperCount = updated.RoundTripperCount
+		vc.Config.DatacenterPaths = updated.DatacenterPaths
+	}
+	reconnected := func() {
+		apply()
+		vc.forgetRestSession()
+	}
+
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	reconnect := current.Scheme != updated.Scheme || current.Port != updated.Port ||
+		current.Insecure != updated.Insecure || current.CAFile != updated.CAFile ||
+		current.Thumbprint != updated.Thumbprint || current.RoundTripperCount != updated.RoundTripperCount ||
+		current.Username != updated.Username || current.Password != updated.Password ||
+		current.ClientCert != updated.ClientCert || current.ClientKey != updated.ClientKey
+	if !reconnect || vc.Client == nil {
+		apply()
+		return nil
+	}
+	klog.V(2).Infof("Connection settings of VC %q changed, creating a new session", vc.Config.Host)
+	if err := vc.replaceClients(ctx, &updated, reconnected); err != nil {
+		klog.Errorf("Failed to connect to VC %q with the new settings, keeping the current config and session. err: %v", vc.Config.Host, err)
+		return err
+	}
+	// The previous session is not logged out so that calls in flight on the
+	// previous clients complete, it expires on the server side
+	return nil
+}
+
 // GetHostsByCluster return hosts inside the cluster using cluster moref.
 func (vc *VirtualCenter) GetHostsByCluster(ctx context.Context, clusterMorefValue string) ([]*HostSystem, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	clusterMoref := types.ManagedObjectReference{
 		Type:  "ClusterComputeResource",
 		Value: clusterMorefValue,
 	}
 	clusterComputeResourceMo := mo.ClusterComputeResource{}
-	err := vc.Client.RetrieveOne(ctx, clusterMoref, []string{"host"}, &clusterComputeResourceMo)
+	err = vc.Client.RetrieveOne(ctx, clusterMoref, []string{"host"}, &clusterComputeResourceMo)
 	if err != nil {
 		klog.Errorf("Failed to fetch hosts from cluster given clusterMorefValue %s with err: %v", clusterMorefValue, err)
 		return nil, err
@@ -43,6 +43,10 @@ type VirtualCenterManager interface {
 	// RegisterVirtualCenter registers a virtual center, but doesn't initiate
 	// the connection to the host.
 	RegisterVirtualCenter(config *VirtualCenterConfig) (*VirtualCenter, error)
+	// UpdateVirtualCenter applies config to the registered virtual center
+	// with the same host. Changed connection settings take effect on the
+	// next connection.
+	UpdateVirtualCenter(ctx context.Context, config *VirtualCenterConfig) (*VirtualCenter, error)
 	// UnregisterVirtualCenter disconnects and unregisters the virtual center
 	// given it's host.
 	UnregisterVirtualCenter(host string) error
@@ -108,6 +112,20 @@ func (m *defaultVirtualCenterManager) RegisterVirtualCenter(config *VirtualCente
 	return vc, nil
 }
 
+func (m *defaultVirtualCenterManager) UpdateVirtualCenter(ctx context.Context, config *VirtualCenterConfig) (*VirtualCenter, error) {
+	vc, err := m.GetVirtualCenter(config.Host)
+	if err != nil {
+		klog.Errorf("Failed to find VC %s, couldn't update", config.Host)
+		return nil, err
+	}
+	if err := vc.UpdateConfig(ctx, config); err != nil {
+		klog.Errorf("Failed to update VC %s with err: %v", config.Host, err)
+		return nil, err
+	}
+	klog.V(2).Infof("Successfully updated VC %q", config.Host)
+	return vc, nil
+}
+
 func (m *defaultVirtualCenterManager) UnregisterVirtualCenter(host string) error {
 	vc, err := m.GetVirtualCenter(host)
 	if err != nil {
@@ -20,15 +20,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/url"
 	"sync"
 
 	"github.com/vmware/govmomi/object"
-	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vapi/tags"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
 )
 
 // ErrVMNotFound is returned when a virtual machine isn't found.
@@ -200,6 +200,11 @@ func GetVirtualMachineByUUID(uuid string, instanceUUID bool) (*VirtualMachine, e
 
 // GetHostSystem returns HostSystem object of the virtual machine
 func (vm *VirtualMachine) GetHostSystem(ctx context.Context) (*object.HostSystem, error) {
+	release, err := limiter.GetLimiter().Acquire(ctx, limiter.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	vmHost, err := vm.VirtualMachine.HostSystem(ctx)
 	if err != nil {
 		klog.Errorf("Failed to get host system for vm: %v. err: %+v", vm, err)
@@ -215,35 +220,20 @@ func (vm *VirtualMachine) GetHostSystem(ctx context.Context) (*object.HostSystem
 	return vmHost, nil
 }
 
-// GetTagManager returns tagManager using vm client
+// GetTagManager returns tagManager using the shared REST session of the
+// virtual center of the vm
 func (vm *VirtualMachine) GetTagManager(ctx context.Context) (*tags.Manager, error) {
-	restClient := rest.NewClient(vm.Client())
 	virtualCenter, err := GetVirtualCenterManager().GetVirtualCenter(vm.VirtualCenterHost)
 	if err != nil {
 		klog.Errorf("Failed to get virtualCenter. Error: %v", err)
 		return nil, err
 	}
-	signer, err := signer(ctx, vm.Client(), virtualCenter.Config.Username, virtualCenter.Config.Password)
+	restClient, err := virtualCenter.RestClient(ctx)
 	if err != nil {
-		klog.Errorf("Failed to create the Signer. Error: %v", err)
+		klog.Errorf("Failed to get the rest client. Error: %v", err)
 		return nil, err
 	}
-	if signer == nil {
-		klog.V(3).Info("Using plain text username and password")
-		user := url.UserPassword(virtualCenter.Config.Username, virtualCenter.Config.Password)
-		err = restClient.Login(ctx, user)
-	} else {
-		klog.V(3).Info("Using certificate and private key")
-		err = restClient.LoginByToken(restClient.WithSigner(ctx, signer))
-	}
-	if err != nil {
-		klog.Errorf("Failed to login for the rest client. Error: %v", err)
-	}
-	tagManager := tags.NewManager(restClient)
-	if tagManager == nil {
-		klog.Errorf("Failed to create a tagManager")
-	}
-	return tagManager, nil
+	return tags.NewManager(restClient), nil
 }
 
 // GetAncestors returns ancestors of VM
@@ -274,7 +264,6 @@ func (vm *VirtualMachine) GetZoneRegion(ctx context.Context, zoneCategoryName st
 		klog.Errorf("Failed to get tagManager. Error: %v", err)
 		return "", "", err
 	}
-	defer tagManager.Logout(ctx)
 	var objects []mo.ManagedEntity
 	objects, err = vm.GetAncestors(ctx)
 	if err != nil {
@@ -329,7 +318,6 @@ func (vm *VirtualMachine) IsInZoneRegion(ctx context.Context, zoneCategoryName s
 		klog.Errorf("Failed to get tagManager. Error: %v", err)
 		return false, err
 	}
-	defer tagManager.Logout(ctx)
 	vmZone, vmRegion, err := vm.GetZoneRegion(ctx, zoneCategoryName, regionCategoryName)
 	if err != nil {
 		klog.Errorf("failed to get accessibleTopology for vm: %v, err: %v", vm.Reference(), err)
@@ -20,12 +20,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"gopkg.in/gcfg.v1"
 	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -40,6 +43,18 @@ const (
 	EnvCloudConfig = "VSPHERE_CSI_CONFIG"
 )
 
+// Format is the format of a config file.
+type Format string
+
+const (
+	// FormatINI is the gcfg INI format shared with the vSphere cloud provider.
+	FormatINI Format = "INI"
+	// FormatYAML is the YAML format.
+	FormatYAML Format = "YAML"
+	// FormatJSON is the JSON format.
+	FormatJSON Format = "JSON"
+)
+
 // Errors
 var (
 	// ErrUsernameMissing is returned when the provided username is empty.
@@ -121,6 +136,12 @@ func FromEnv(cfg *Config) error {
 			cfg.Global.InsecureFlag = InsecureFlag
 		}
 	}
+	if v := os.Getenv("VSPHERE_CA_FILE"); v != "" {
+		cfg.Global.CAFile = v
+	}
+	if v := os.Getenv("VSPHERE_THUMBPRINT"); v != "" {
+		cfg.Global.Thumbprint = v
+	}
 	if v := os.Getenv("VSPHERE_LABEL_REGION"); v != "" {
 		cfg.Labels.Region = v
 	}
@@ -166,11 +187,21 @@ func FromEnv(cfg *Config) error {
 			if errDatacenters != nil {
 				datacenters = cfg.Global.Datacenters
 			}
+			_, caFile, errCAFile := getEnvKeyValue("VCENTER_"+id+"_CA_FILE", false)
+			if errCAFile != nil {
+				caFile = cfg.Global.CAFile
+			}
+			_, thumbprint, errThumbprint := getEnvKeyValue("VCENTER_"+id+"_THUMBPRINT", false)
+			if errThumbprint != nil {
+				thumbprint = cfg.Global.Thumbprint
+			}
 			cfg.VirtualCenter[vcenter] = &VirtualCenterConfig{
 				User:         username,
 				Password:     password,
 				VCenterPort:  port,
 				InsecureFlag: insecureFlag,
+				CAFile:       caFile,
+				Thumbprint:   thumbprint,
 				Datacenters:  datacenters,
 			}
 		}
@@ -181,6 +212,8 @@ func FromEnv(cfg *Config) error {
 			Password:     cfg.Global.Password,
 			VCenterPort:  cfg.Global.VCenterPort,
 			InsecureFlag: cfg.Global.InsecureFlag,
+			CAFile:       cfg.Global.CAFile,
+			Thumbprint:   cfg.Global.Thumbprint,
 			Datacenters:  cfg.Global.Datacenters,
 		}
 	}
@@ -209,18 +242,38 @@ func validateConfig(cfg *Config) error {
 			return ErrInvalidVCenterIP
 		}
 
-		if vcConfig.User == "" {
-			vcConfig.User = cfg.Global.User
-			if vcConfig.User == "" {
-				klog.Errorf("vcConfig.User is empty for vc %s!", vcServer)
-				return ErrUsernameMissing
+		// A vCenter without credentials of its own uses the global
+		// credential sources
+		if vcConfig.User == "" && vcConfig.Password == "" && !vcConfig.hasCredentialSource() {
+			vcConfig.UserFile = cfg.Global.UserFile
+			vcConfig.PasswordFile = cfg.Global.PasswordFile
+			vcConfig.ClientCertFile = cfg.Global.ClientCertFile
+			vcConfig.ClientKeyFile = cfg.Global.ClientKeyFile
+			vcConfig.SecretName = cfg.Global.SecretName
+			vcConfig.SecretNamespace = cfg.Global.SecretNamespace
+		}
+		if vcConfig.SecretName != "" && cfg.skipSecrets {
+			klog.Warningf("Not reading secret %s with the credentials of vc %s while validating the config", vcConfig.SecretName, vcServer)
+		} else if vcConfig.hasCredentialSource() {
+			if err := loadCredentials(vcServer, vcConfig); err != nil {
+				klog.Errorf("Failed to load credentials for vc %s. Err: %v", vcServer, err)
+				return err
 			}
 		}
-		if vcConfig.Password == "" {
-			vcConfig.Password = cfg.Global.Password
+		if vcConfig.ClientCert == "" && (vcConfig.SecretName == "" || !cfg.skipSecrets) {
+			if vcConfig.User == "" {
+				vcConfig.User = cfg.Global.User
+				if vcConfig.User == "" {
+					klog.Errorf("vcConfig.User is empty for vc %s!", vcServer)
+					return ErrUsernameMissing
+				}
+			}
 			if vcConfig.Password == "" {
-				klog.Errorf("vcConfig.Password is empty for vc %s!", vcServer)
-				return ErrPasswordMissing
+				vcConfig.Password = cfg.Global.Password
+				if vcConfig.Password == "" {
+					klog.Errorf("vcConfig.Password is empty for vc %s!", vcServer)
+					return ErrPasswordMissing
+				}
 			}
 		}
 		if vcConfig.VCenterPort == "" {
@@ -235,6 +288,16 @@ func validateConfig(cfg *Config) error {
 		if !insecure {
 			vcConfig.InsecureFlag = cfg.Global.InsecureFlag
 		}
+		if vcConfig.CAFile == "" {
+			vcConfig.CAFile = cfg.Global.CAFile
+		}
+		if vcConfig.Thumbprint == "" {
+			vcConfig.Thumbprint = cfg.Global.Thumbprint
+		}
+	}
+	if err := cfg.Metadata.ParseRenames(); err != nil {
+		klog.Error(err)
+		return err
 	}
 	return nil
 }
@@ -245,8 +308,12 @@ func ReadConfig(config io.Reader) (*Config, error) {
 	if config == nil {
 		return nil, fmt.Errorf("no vSphere cloud provider config file given")
 	}
-	cfg := &Config{}
-	if err := gcfg.FatalOnly(gcfg.ReadInto(cfg, config)); err != nil {
+	data, err := ioutil.ReadAll(config)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(data, false)
+	if err != nil {
 		return nil, err
 	}
 	// Env Vars should override config file entries if present
@@ -256,6 +323,58 @@ func ReadConfig(config io.Reader) (*Config, error) {
 	return cfg, nil
 }
 
+// iniSectionPattern matches the start of an INI section header such as
+// "[Global]", unlike a YAML or JSON flow sequence such as "[1, 2]".
+var iniSectionPattern = regexp.MustCompile(`^\[[A-Za-z]`)
+
+// DetectFormat returns the format of the config file content. Content
+// starting with "{" is JSON, content starting with an INI section header
+// (or empty content) is INI, anything else is YAML. Leading blank and
+// comment lines are skipped.
+func DetectFormat(data []byte) Format {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		switch {
+		case line[0] == '{':
+			return FormatJSON
+		case iniSectionPattern.MatchString(line):
+			return FormatINI
+		}
+		return FormatYAML
+	}
+	return FormatINI
+}
+
+// ParseConfig parses the config file content without applying environment
+// variables or defaults. Unknown keys are always an error in the YAML and
+// JSON formats. In the INI format they are only an error if strict is set
+// and are logged otherwise, as existing INI files shared with the cloud
+// provider may contain keys that the driver doesn't use.
+func ParseConfig(data []byte, strict bool) (*Config, error) {
+	cfg := &Config{}
+	format := DetectFormat(data)
+	if format != FormatINI {
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("invalid %s config: %v", format, err)
+		}
+		return cfg, nil
+	}
+	err := gcfg.ReadStringInto(cfg, string(data))
+	if fatalErr := gcfg.FatalOnly(err); fatalErr != nil {
+		return nil, fatalErr
+	}
+	if err != nil {
+		if strict {
+			return nil, fmt.Errorf("unknown keys in %s config: %v", format, err)
+		}
+		klog.Warningf("Ignoring unknown keys in %s config: %v", format, err)
+	}
+	return cfg, nil
+}
+
 // GetCnsconfig returns Config from specified config file path
 func GetCnsconfig(cfgPath string) (*Config, error) {
 	klog.V(4).Infof("GetCnsconfig called with cfgPath: %s", cfgPath)
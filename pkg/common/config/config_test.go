@@ -0,0 +1,124 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	ini := "[Global]\ncluster-id = \"c1\"\n[VirtualCenter \"1.2.3.4\"]\nuser = \"u\"\npassword = \"p\"\n"
+	yamlConfig := "global:\n  cluster-id: c1\nvirtualcenter:\n  \"1.2.3.4\":\n    user: u\n    password: p\n"
+	jsonConfig := `{"global": {"cluster-id": "c1"}, "virtualcenter": {"1.2.3.4": {"user": "u", "password": "p"}}}`
+	for format, data := range map[Format]string{FormatINI: ini, FormatYAML: yamlConfig, FormatJSON: jsonConfig} {
+		if detected := DetectFormat([]byte(data)); detected != format {
+			t.Errorf("Expected format %s, got %s", format, detected)
+		}
+		cfg, err := ParseConfig([]byte(data), true)
+		if err != nil {
+			t.Errorf("Failed to parse %s config: %v", format, err)
+			continue
+		}
+		if cfg.Global.ClusterID != "c1" || cfg.VirtualCenter["1.2.3.4"] == nil || cfg.VirtualCenter["1.2.3.4"].User != "u" {
+			t.Errorf("Unexpected %s config: %v", format, cfg)
+		}
+	}
+
+	// Only section headers are detected as INI
+	for data, format := range map[string]Format{
+		"# comment\n\n[VirtualCenter \"1.2.3.4\"]\n": FormatINI,
+		"[\"global\"]\n": FormatYAML,
+		"[1, 2]\n":       FormatYAML,
+		"":               FormatINI,
+	} {
+		if detected := DetectFormat([]byte(data)); detected != format {
+			t.Errorf("Expected format %s for %q, got %s", format, data, detected)
+		}
+	}
+
+	// A typo in a section name must not be silently ignored in strict mode
+	typo := "[Global]\ncluster-id = \"c1\"\n[VirtualCentre \"1.2.3.4\"]\nuser = \"u\"\n"
+	if _, err := ParseConfig([]byte(typo), true); err == nil {
+		t.Errorf("Expected error for unknown INI section")
+	}
+	if _, err := ParseConfig([]byte(typo), false); err != nil {
+		t.Errorf("Unexpected error for unknown INI section in non-strict mode: %v", err)
+	}
+	if _, err := ParseConfig([]byte("global:\n  clusterid: c1\n"), false); err == nil {
+		t.Errorf("Expected error for unknown YAML key")
+	}
+}
+
+func TestParseMetadataConfig(t *testing.T) {
+	ini := "[Metadata]\ninclude-label = app\ninclude-label = example.com/*\nnamespace-labels = true\nrename = example.com/*=ex/*\n"
+	yamlConfig := "metadata:\n  include-labels: [app, example.com/*]\n  namespace-labels: true\n  rename: [example.com/*=ex/*]\n"
+	for _, data := range []string{ini, yamlConfig} {
+		cfg, err := ParseConfig([]byte(data), true)
+		if err != nil {
+			t.Fatalf("Failed to parse config %q: %v", data, err)
+		}
+		if len(cfg.Metadata.IncludeLabels) != 2 || !cfg.Metadata.NamespaceLabels || len(cfg.Metadata.Rename) != 1 {
+			t.Errorf("Unexpected metadata config: %+v", cfg.Metadata)
+		}
+	}
+
+	for rule, valid := range map[string]bool{
+		"app=application":    true,
+		"example.com/*=ex/*": true,
+		"example.com/*=ex":   false,
+		"app":                false,
+		"=app":               false,
+		"*=prefix/*":         false,
+	} {
+		if _, _, err := ParseRename(rule); (err == nil) != valid {
+			t.Errorf("Expected rename rule %q valid=%v, got err %v", rule, valid, err)
+		}
+	}
+}
+
+func TestMetadataLabels(t *testing.T) {
+	labels := map[string]string{"app": "db", "example.com/team": "storage", "internal": "x", "team": "other"}
+	annotations := map[string]string{"example.com/owner": "alice", "kubectl.kubernetes.io/last-applied-configuration": "{}"}
+	namespaceLabels := map[string]string{"app": "namespace", "env": "prod"}
+
+	if curated := (&MetadataConfig{}).Labels(labels, annotations, nil); !reflect.DeepEqual(curated, labels) {
+		t.Errorf("Expected labels to be propagated unchanged by default, got %v", curated)
+	}
+
+	m := &MetadataConfig{
+		ExcludeLabels:      []string{"internal"},
+		IncludeAnnotations: []string{"example.com/*"},
+		NamespaceLabels:    true,
+		Rename:             []string{"example.com/*=ex/*", "env=environment", "team=ex/team"},
+	}
+	if err := m.ParseRenames(); err != nil {
+		t.Fatal(err)
+	}
+	// "team" is renamed like "example.com/team", which comes first
+	expected := map[string]string{
+		"app":         "db",
+		"ex/team":     "storage",
+		"ex/owner":    "alice",
+		"environment": "prod",
+	}
+	for i := 0; i < 10; i++ {
+		if curated := m.Labels(labels, annotations, namespaceLabels); !reflect.DeepEqual(curated, expected) {
+			t.Fatalf("Expected curated labels %v, got %v", expected, curated)
+		}
+	}
+}
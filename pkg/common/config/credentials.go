@@ -0,0 +1,201 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+const (
+	// defaultSecretNamespace is used for secrets without a namespace when the
+	// namespace of the pod can't be determined.
+	defaultSecretNamespace = "kube-system"
+	// podNamespaceFile contains the namespace of the pod when running in-cluster.
+	podNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// Keys of the credential Secret. Keys prefixed with "<vCenter host>." take
+	// precedence so that one Secret can hold credentials of several vCenters.
+	secretUsernameKey   = "username"
+	secretPasswordKey   = "password"
+	secretClientCertKey = "tls.crt"
+	secretClientKeyKey  = "tls.key"
+)
+
+// getSecret returns the data of the Secret. It is a variable so that tests
+// can replace it.
+var getSecret = getSecretInCluster
+
+var (
+	// secretClient reads the Secrets, it is created on first use
+	secretClient     clientset.Interface
+	secretClientLock sync.Mutex
+)
+
+// getSecretInCluster reads the Secret using the in-cluster service account.
+func getSecretInCluster(namespace, name string) (map[string][]byte, error) {
+	client, err := getSecretClient()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// getSecretClient returns the client of the in-cluster service account,
+// creating it once.
+func getSecretClient() (clientset.Interface, error) {
+	secretClientLock.Lock()
+	defer secretClientLock.Unlock()
+	if secretClient != nil {
+		return secretClient, nil
+	}
+	config, err := restclient.InClusterConfig()
+	if err != nil {
+		klog.Errorf("Failed to get the in-cluster config. Err: %v", err)
+		return nil, err
+	}
+	client, err := clientset.NewForConfig(config)
+	if err != nil {
+		klog.Errorf("Failed to create the Kubernetes client. Err: %v", err)
+		return nil, err
+	}
+	secretClient = client
+	return secretClient, nil
+}
+
+// hasCredentialSource returns true if the vCenter credentials are read from
+// files or a Secret rather than given in clear text.
+func (vcc *VirtualCenterConfig) hasCredentialSource() bool {
+	return vcc.SecretName != "" || vcc.ClientCertFile != "" || vcc.ClientKeyFile != "" ||
+		vcc.UserFile != "" || vcc.PasswordFile != ""
+}
+
+// credentialFiles returns the files the credentials of the vCenter are read from.
+func (vcc *VirtualCenterConfig) credentialFiles() []string {
+	var files []string
+	for _, file := range []string{vcc.UserFile, vcc.PasswordFile, vcc.ClientCertFile, vcc.ClientKeyFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// loadCredentials reads the credentials of the vCenter from the configured
+// Secret or files. A Secret takes precedence over client certificate files,
+// which take precedence over username and password files. The loaded
+// credentials are validated.
+func loadCredentials(host string, vcc *VirtualCenterConfig) error {
+	switch {
+	case vcc.SecretName != "":
+		if err := loadSecretCredentials(host, vcc); err != nil {
+			return err
+		}
+	case vcc.ClientCertFile != "" || vcc.ClientKeyFile != "":
+		if vcc.ClientCertFile == "" || vcc.ClientKeyFile == "" {
+			return fmt.Errorf("both client-cert-file and client-key-file are required for vCenter %s", host)
+		}
+		cert, err := readCredentialFile(vcc.ClientCertFile)
+		if err != nil {
+			return err
+		}
+		key, err := readCredentialFile(vcc.ClientKeyFile)
+		if err != nil {
+			return err
+		}
+		vcc.ClientCert, vcc.ClientKey = cert, key
+	default:
+		if vcc.UserFile != "" {
+			user, err := readCredentialFile(vcc.UserFile)
+			if err != nil {
+				return err
+			}
+			vcc.User = strings.TrimSpace(user)
+		}
+		if vcc.PasswordFile != "" {
+			password, err := readCredentialFile(vcc.PasswordFile)
+			if err != nil {
+				return err
+			}
+			vcc.Password = strings.TrimRight(password, "\r\n")
+		}
+	}
+	if vcc.ClientCert != "" {
+		if _, err := tls.X509KeyPair([]byte(vcc.ClientCert), []byte(vcc.ClientKey)); err != nil {
+			return fmt.Errorf("invalid client certificate and key for vCenter %s: %v", host, err)
+		}
+	}
+	return nil
+}
+
+// loadSecretCredentials reads the credentials of the vCenter from the
+// referenced Secret, either a client certificate and key or a username and
+// password.
+func loadSecretCredentials(host string, vcc *VirtualCenterConfig) error {
+	namespace := vcc.SecretNamespace
+	if namespace == "" {
+		namespace = defaultSecretNamespace
+		if ns, err := ioutil.ReadFile(podNamespaceFile); err == nil && len(strings.TrimSpace(string(ns))) > 0 {
+			namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	data, err := getSecret(namespace, vcc.SecretName)
+	if err != nil {
+		klog.Errorf("Failed to get secret %s/%s for vCenter %s. Err: %v", namespace, vcc.SecretName, host, err)
+		return err
+	}
+	value := func(key string) string {
+		if v, ok := data[host+"."+key]; ok {
+			return string(v)
+		}
+		return string(data[key])
+	}
+	if cert := value(secretClientCertKey); cert != "" {
+		vcc.ClientCert, vcc.ClientKey = cert, value(secretClientKeyKey)
+		return nil
+	}
+	vcc.User = value(secretUsernameKey)
+	vcc.Password = value(secretPasswordKey)
+	if vcc.User == "" || vcc.Password == "" {
+		return fmt.Errorf("secret %s/%s has no %q and %q or %q and %q keys for vCenter %s", namespace, vcc.SecretName,
+			secretUsernameKey, secretPasswordKey, secretClientCertKey, secretClientKeyKey, host)
+	}
+	return nil
+}
+
+// readCredentialFile returns the content of a credential file.
+func readCredentialFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		klog.Errorf("Failed to read credential file %s. Err: %v", path, err)
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a PEM encoded self-signed certificate and its key.
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "csi-solution-user"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestLoadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPEM, keyPEM := testCertificate(t)
+	files := map[string]string{
+		"user": "administrator@vsphere.local\n", "password": "s3cr3t\n",
+		"tls.crt": certPEM, "tls.key": keyPEM, "bad.key": "not a key",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	cfg := "[Global]\nuser-file = \"" + path("user") + "\"\npassword-file = \"" + path("password") + "\"\n" +
+		"[VirtualCenter \"vc1\"]\n" +
+		"[VirtualCenter \"vc2\"]\nclient-cert-file = \"" + path("tls.crt") + "\"\nclient-key-file = \"" + path("tls.key") + "\"\n" +
+		"[VirtualCenter \"vc3\"]\nsecret-name = \"vc-creds\"\nsecret-namespace = \"ns\"\n"
+	getSecret = func(namespace, name string) (map[string][]byte, error) {
+		if namespace != "ns" || name != "vc-creds" {
+			t.Errorf("Unexpected secret %s/%s", namespace, name)
+		}
+		return map[string][]byte{"vc3.username": []byte("secret-user"), "password": []byte("secret-password")}, nil
+	}
+	defer func() { getSecret = getSecretInCluster }()
+
+	parsed, err := ParseConfig([]byte(cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(parsed); err != nil {
+		t.Fatalf("Failed to validate config: %v", err)
+	}
+	if vc := parsed.VirtualCenter["vc1"]; vc.User != "administrator@vsphere.local" || vc.Password != "s3cr3t" {
+		t.Errorf("Credentials not loaded from files: %v", vc)
+	}
+	if vc := parsed.VirtualCenter["vc2"]; vc.ClientCert != certPEM || vc.ClientKey != keyPEM {
+		t.Errorf("Client certificate not loaded from files: %v", vc)
+	}
+	if vc := parsed.VirtualCenter["vc3"]; vc.User != "secret-user" || vc.Password != "secret-password" {
+		t.Errorf("Credentials not loaded from secret: %v", vc)
+	}
+
+	// Validating the config outside the cluster doesn't read the Secret
+	getSecret = func(namespace, name string) (map[string][]byte, error) {
+		t.Errorf("Unexpected read of secret %s/%s while validating the config", namespace, name)
+		return nil, errors.New("not running in a cluster")
+	}
+	if err := ioutil.WriteFile(path("csi-vsphere.conf"), []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Describe(path("csi-vsphere.conf")); err != nil {
+		t.Errorf("Failed to validate config with a secret: %v", err)
+	}
+
+	// An invalid key pair is rejected at startup
+	bad := "[VirtualCenter \"vc\"]\nclient-cert-file = \"" + path("tls.crt") + "\"\nclient-key-file = \"" + path("bad.key") + "\"\n"
+	parsed, err = ParseConfig([]byte(bad), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(parsed); err == nil {
+		t.Errorf("Expected error for invalid client key")
+	}
+}
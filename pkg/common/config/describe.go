@@ -0,0 +1,215 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/redact"
+)
+
+const (
+	// SourceFile marks values read from the config file.
+	SourceFile = "file"
+	// SourceGlobal marks virtual center values inherited from the Global
+	// section or the global environment variables.
+	SourceGlobal = "global"
+	// SourceDefault marks values set to their default.
+	SourceDefault = "default"
+)
+
+// globalEnvVars maps the keys of the Global and Labels sections to the
+// environment variables overriding them.
+var globalEnvVars = map[string]string{
+	"global.vcenterip":     "VSPHERE_VCENTER",
+	"global.port":          "VSPHERE_VCENTER_PORT",
+	"global.user":          "VSPHERE_USER",
+	"global.password":      "VSPHERE_PASSWORD",
+	"global.datacenters":   "VSPHERE_DATACENTER",
+	"global.insecure-flag": "VSPHERE_INSECURE",
+	"global.ca-file":       "VSPHERE_CA_FILE",
+	"global.thumbprint":    "VSPHERE_THUMBPRINT",
+	"labels.region":        "VSPHERE_LABEL_REGION",
+	"labels.zone":          "VSPHERE_LABEL_ZONE",
+}
+
+// virtualCenterEnvVars maps the keys of a virtual center to the suffix of
+// the environment variables overriding them.
+var virtualCenterEnvVars = map[string]string{
+	"user":          "USERNAME",
+	"password":      "PASSWORD",
+	"port":          "PORT",
+	"insecure-flag": "INSECURE",
+	"ca-file":       "CA_FILE",
+	"thumbprint":    "THUMBPRINT",
+	"datacenters":   "DATACENTERS",
+}
+
+// Value is an effective configuration value along with its source.
+type Value struct {
+	// Key is the dotted path of the value, e.g. "virtualcenter.1.2.3.4.user".
+	Key string
+	// Value is the value with secrets redacted.
+	Value string
+	// Source is where the value comes from: SourceFile, SourceGlobal,
+	// SourceDefault or "env <name>".
+	Source string
+}
+
+// Describe strictly reads the config at cfgPath, merges it with the VSPHERE_*
+// environment variables the same way GetCnsconfig does and returns the
+// validated config along with each effective value and its source. The
+// credential Secrets are not read, as Describe runs outside the cluster.
+func Describe(cfgPath string) (*Config, []Value, error) {
+	fileCfg := &Config{}
+	cfg := &Config{}
+	data, err := ioutil.ReadFile(cfgPath)
+	if err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to read %s. Err: %v", cfgPath, err)
+		return nil, nil, err
+	}
+	if err == nil {
+		if fileCfg, err = ParseConfig(data, true); err != nil {
+			return nil, nil, err
+		}
+		if cfg, err = ParseConfig(data, true); err != nil {
+			return nil, nil, err
+		}
+	}
+	cfg.skipSecrets = true
+	if err = FromEnv(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	fileValues := flatten(fileCfg)
+	values := flatten(cfg)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	envVCenters := virtualCentersFromEnv()
+	var described []Value
+	for _, key := range keys {
+		value := values[key]
+		source := SourceDefault
+		if envVar, ok := globalEnvVars[key]; ok {
+			if os.Getenv(envVar) != "" {
+				source = "env " + envVar
+			} else if fileValues[key] == value {
+				source = SourceFile
+			}
+		} else if strings.HasPrefix(key, "virtualcenter.") {
+			host := strings.TrimPrefix(key[:strings.LastIndex(key, ".")], "virtualcenter.")
+			field := key[strings.LastIndex(key, ".")+1:]
+			source = SourceGlobal
+			if vcSource := credentialSource(cfg.VirtualCenter[host], field); vcSource != "" {
+				source = vcSource
+			} else if id, ok := envVCenters[host]; ok {
+				if envVar := "VCENTER_" + id + "_" + virtualCenterEnvVars[field]; os.Getenv(envVar) != "" {
+					source = "env " + envVar
+				}
+			} else if fileValue, ok := fileValues[key]; ok && fileValue == value {
+				source = SourceFile
+			}
+		} else if fileValues[key] == value {
+			source = SourceFile
+		}
+		if strings.HasSuffix(key, ".password") {
+			value = redact.String(value)
+		} else if strings.HasSuffix(key, ".user") {
+			value = redact.PEM(value)
+		}
+		described = append(described, Value{Key: key, Value: value, Source: source})
+	}
+	return cfg, described, nil
+}
+
+// credentialSource returns the source of the user or password field of the
+// virtual center if they were loaded from a Secret or files.
+func credentialSource(vcc *VirtualCenterConfig, field string) string {
+	if vcc == nil || (field != "user" && field != "password") {
+		return ""
+	}
+	switch {
+	case vcc.SecretName != "" && vcc.SecretNamespace != "":
+		return "secret " + vcc.SecretNamespace + "/" + vcc.SecretName
+	case vcc.SecretName != "":
+		return "secret " + vcc.SecretName
+	case field == "user" && vcc.UserFile != "":
+		return "file " + vcc.UserFile
+	case field == "password" && vcc.PasswordFile != "":
+		return "file " + vcc.PasswordFile
+	}
+	return ""
+}
+
+// virtualCentersFromEnv returns the ids of the VSPHERE_VCENTER_<id>
+// environment variables keyed by the virtual center host they define.
+func virtualCentersFromEnv() map[string]string {
+	vcenters := make(map[string]string)
+	for _, e := range os.Environ() {
+		pair := strings.Split(e, "=")
+		if len(pair) == 2 && strings.HasPrefix(pair[0], "VSPHERE_VCENTER_") && pair[1] != "" {
+			vcenters[pair[1]] = strings.TrimPrefix(pair[0], "VSPHERE_VCENTER_")
+		}
+	}
+	return vcenters
+}
+
+// flatten returns the non-empty values of cfg keyed by their dotted path
+// built from the json tags.
+func flatten(cfg *Config) map[string]string {
+	values := make(map[string]string)
+	flattenValue("", reflect.ValueOf(cfg).Elem(), values)
+	return values
+}
+
+func flattenValue(prefix string, v reflect.Value, values map[string]string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			flattenValue(prefix, v.Elem(), values)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			// Unexported fields are derived state, not configuration
+			if name == "-" || field.PkgPath != "" {
+				continue
+			}
+			flattenValue(prefix+name+".", v.Field(i), values)
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			flattenValue(prefix+key.String()+".", v.MapIndex(key), values)
+		}
+	default:
+		if !v.IsValid() || reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) {
+			return
+		}
+		values[strings.TrimSuffix(prefix, ".")] = fmt.Sprintf("%v", v.Interface())
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// renameRule is a parsed rename rule of the Metadata section.
+type renameRule struct {
+	from, to string
+	// prefix is set if from and to are prefixes, without the "*"
+	prefix bool
+}
+
+// Labels returns the labels propagated into the CNS metadata of an entity:
+// its selected namespace labels, annotations and labels, in increasing order
+// of precedence, with their keys renamed. If several keys of the same kind
+// are renamed to the same key, the first one in sorted order is kept.
+// Without any selection or renaming configured, the labels of the entity are
+// returned unchanged.
+func (m *MetadataConfig) Labels(labels, annotations, namespaceLabels map[string]string) map[string]string {
+	if len(m.IncludeLabels) == 0 && len(m.ExcludeLabels) == 0 && len(m.IncludeAnnotations) == 0 &&
+		len(m.Rename) == 0 && len(namespaceLabels) == 0 {
+		return labels
+	}
+	curated := make(map[string]string)
+	m.add(curated, namespaceLabels, m.IncludeLabels, m.ExcludeLabels, true)
+	m.add(curated, annotations, m.IncludeAnnotations, m.ExcludeAnnotations, false)
+	m.add(curated, labels, m.IncludeLabels, m.ExcludeLabels, true)
+	return curated
+}
+
+// add adds the selected values with their keys renamed to curated. All keys
+// are selected by an empty include list if includeAll is set. The keys are
+// added in sorted order, a key renamed to the key of a previous one is
+// skipped.
+func (m *MetadataConfig) add(curated, values map[string]string, include, exclude []string, includeAll bool) {
+	if len(include) == 0 && !includeAll {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	added := make(map[string]bool)
+	for _, key := range keys {
+		if (len(include) > 0 && !matchesKey(include, key)) || matchesKey(exclude, key) {
+			continue
+		}
+		renamed := m.rename(key)
+		if added[renamed] {
+			continue
+		}
+		added[renamed] = true
+		curated[renamed] = values[key]
+	}
+}
+
+// rename returns the key renamed by the first matching rename rule.
+func (m *MetadataConfig) rename(key string) string {
+	for _, rule := range m.renameRules {
+		if !rule.prefix {
+			if key == rule.from {
+				return rule.to
+			}
+			continue
+		}
+		if strings.HasPrefix(key, rule.from) {
+			return rule.to + strings.TrimPrefix(key, rule.from)
+		}
+	}
+	return key
+}
+
+// ParseRenames parses the rename rules once, when the config is loaded.
+func (m *MetadataConfig) ParseRenames() error {
+	rules := make([]renameRule, 0, len(m.Rename))
+	for _, rule := range m.Rename {
+		from, to, err := ParseRename(rule)
+		if err != nil {
+			return err
+		}
+		prefix := strings.HasSuffix(from, "*")
+		rules = append(rules, renameRule{
+			from:   strings.TrimSuffix(from, "*"),
+			to:     strings.TrimSuffix(to, "*"),
+			prefix: prefix,
+		})
+	}
+	m.renameRules = rules
+	return nil
+}
+
+// matchesKey returns true if the key equals one of the patterns, or starts
+// with one of the patterns ending with "*".
+func matchesKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if pattern == key || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(key, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRename returns the source and target keys of a rename rule of the
+// Metadata section. Both keys end with "*" for a prefix rule.
+func ParseRename(rule string) (string, string, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid rename rule %q: expected <from>=<to>", rule)
+	}
+	from, to := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if from == "" || to == "" || from == "*" {
+		return "", "", fmt.Errorf("invalid rename rule %q: keys must not be empty", rule)
+	}
+	if strings.HasSuffix(from, "*") != strings.HasSuffix(to, "*") {
+		return "", "", fmt.Errorf("invalid rename rule %q: both or none of the keys must end with *", rule)
+	}
+	return from, to, nil
+}
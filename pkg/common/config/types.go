@@ -16,46 +16,156 @@ limitations under the License.
 
 package config
 
-// Config is used to read and store information from the cloud configuration file
+import (
+	"fmt"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/redact"
+)
+
+// Config is used to read and store information from the cloud configuration file.
+// The gcfg tags name the keys of the INI format, the json tags the keys of the
+// YAML and JSON formats. See docs/csi-vsphere-config.md for the schema.
 type Config struct {
 	Global struct {
 		//vCenter IP address or FQDN
-		VCenterIP string
+		VCenterIP string `json:"vcenterip,omitempty"`
 		// Kubernetes Cluster ID
-		ClusterID string `gcfg:"cluster-id"`
+		ClusterID string `gcfg:"cluster-id" json:"cluster-id,omitempty"`
 		// vCenter username.
-		User string `gcfg:"user"`
+		User string `gcfg:"user" json:"user,omitempty"`
 		// vCenter password in clear text.
-		Password string `gcfg:"password"`
+		Password string `gcfg:"password" json:"password,omitempty"`
+		// Files containing the vCenter username and password.
+		UserFile     string `gcfg:"user-file" json:"user-file,omitempty"`
+		PasswordFile string `gcfg:"password-file" json:"password-file,omitempty"`
+		// PEM files containing the client certificate and private key used
+		// for STS token login.
+		ClientCertFile string `gcfg:"client-cert-file" json:"client-cert-file,omitempty"`
+		ClientKeyFile  string `gcfg:"client-key-file" json:"client-key-file,omitempty"`
+		// Kubernetes Secret containing the vCenter credentials.
+		SecretName      string `gcfg:"secret-name" json:"secret-name,omitempty"`
+		SecretNamespace string `gcfg:"secret-namespace" json:"secret-namespace,omitempty"`
 		// vCenter port.
-		VCenterPort string `gcfg:"port"`
+		VCenterPort string `gcfg:"port" json:"port,omitempty"`
 		// True if vCenter uses self-signed cert.
-		InsecureFlag bool `gcfg:"insecure-flag"`
+		InsecureFlag bool `gcfg:"insecure-flag" json:"insecure-flag,omitempty"`
+		// Path of the CA bundle used to verify the vCenter certificate.
+		CAFile string `gcfg:"ca-file" json:"ca-file,omitempty"`
+		// SHA-1 thumbprint the vCenter certificate must match.
+		Thumbprint string `gcfg:"thumbprint" json:"thumbprint,omitempty"`
 		// Datacenter in which Node VMs are located.
-		Datacenters string `gcfg:"datacenters"`
-	}
+		Datacenters string `gcfg:"datacenters" json:"datacenters,omitempty"`
+		// Number of vCenter operations of all classes running at the same time.
+		MaxConcurrentOperations int `gcfg:"max-concurrent-operations" json:"max-concurrent-operations,omitempty"`
+		// Seconds an operation without deadline waits for a slot of its
+		// class before it fails.
+		MaxOperationWaitSeconds int `gcfg:"max-operation-wait-seconds" json:"max-operation-wait-seconds,omitempty"`
+	} `json:"global"`
 
 	// Virtual Center configurations
-	VirtualCenter map[string]*VirtualCenterConfig
+	VirtualCenter map[string]*VirtualCenterConfig `json:"virtualcenter,omitempty"`
 
 	// Tag categories and tags which correspond to "built-in node labels: zones and region"
 	Labels struct {
-		Zone   string `gcfg:"zone"`
-		Region string `gcfg:"region"`
-	}
+		Zone   string `gcfg:"zone" json:"zone,omitempty"`
+		Region string `gcfg:"region" json:"region,omitempty"`
+	} `json:"labels"`
+
+	// Rate and concurrency limits per class of vCenter operations
+	Limit map[string]*LimitConfig `json:"limit,omitempty"`
+
+	// Kubernetes labels and annotations propagated into CNS metadata
+	Metadata MetadataConfig `json:"metadata"`
+
+	// skipSecrets is set when validating the config outside the cluster,
+	// where the credential Secrets can't be read
+	skipSecrets bool
+}
+
+// MetadataConfig selects the labels and annotations of PVs and PVCs the
+// syncer propagates into the CNS metadata of volumes. Keys are matched
+// exactly, or by prefix when the pattern ends with "*".
+type MetadataConfig struct {
+	// Label keys propagated, all labels if empty.
+	IncludeLabels []string `gcfg:"include-label" json:"include-labels,omitempty"`
+	// Label keys never propagated.
+	ExcludeLabels []string `gcfg:"exclude-label" json:"exclude-labels,omitempty"`
+	// Annotation keys propagated, none if empty.
+	IncludeAnnotations []string `gcfg:"include-annotation" json:"include-annotations,omitempty"`
+	// Annotation keys never propagated.
+	ExcludeAnnotations []string `gcfg:"exclude-annotation" json:"exclude-annotations,omitempty"`
+	// True if the labels of the namespace of PVCs are propagated too.
+	NamespaceLabels bool `gcfg:"namespace-labels" json:"namespace-labels,omitempty"`
+	// Rules "<from>=<to>" renaming propagated keys. A rule ending with "*"
+	// on both sides replaces the prefix of the keys.
+	Rename []string `gcfg:"rename" json:"rename,omitempty"`
+
+	// renameRules are the parsed Rename rules
+	renameRules []renameRule
+}
+
+// LimitConfig contains the limits of a class of vCenter operations.
+type LimitConfig struct {
+	// Operations started per second.
+	QPS float64 `gcfg:"qps" json:"qps,omitempty"`
+	// Operations that can be started at once.
+	Burst int `gcfg:"burst" json:"burst,omitempty"`
+	// Operations running at the same time.
+	Concurrency int `gcfg:"concurrency" json:"concurrency,omitempty"`
 }
 
 // VirtualCenterConfig contains information used to access a remote vCenter
 // endpoint.
 type VirtualCenterConfig struct {
 	// vCenter username.
-	User string `gcfg:"user"`
+	User string `gcfg:"user" json:"user,omitempty"`
 	// vCenter password in clear text.
-	Password string `gcfg:"password"`
+	Password string `gcfg:"password" json:"password,omitempty"`
+	// Files containing the vCenter username and password.
+	UserFile     string `gcfg:"user-file" json:"user-file,omitempty"`
+	PasswordFile string `gcfg:"password-file" json:"password-file,omitempty"`
+	// PEM files containing the client certificate and private key used for
+	// STS token login.
+	ClientCertFile string `gcfg:"client-cert-file" json:"client-cert-file,omitempty"`
+	ClientKeyFile  string `gcfg:"client-key-file" json:"client-key-file,omitempty"`
+	// Kubernetes Secret containing the vCenter credentials.
+	SecretName      string `gcfg:"secret-name" json:"secret-name,omitempty"`
+	SecretNamespace string `gcfg:"secret-namespace" json:"secret-namespace,omitempty"`
+	// Client certificate and private key loaded from ClientCertFile and
+	// ClientKeyFile or the Secret.
+	ClientCert string `gcfg:"-" json:"-"`
+	ClientKey  string `gcfg:"-" json:"-"`
 	// vCenter port.
-	VCenterPort string `gcfg:"port"`
+	VCenterPort string `gcfg:"port" json:"port,omitempty"`
 	// True if vCenter uses self-signed cert.
-	InsecureFlag bool `gcfg:"insecure-flag"`
+	InsecureFlag bool `gcfg:"insecure-flag" json:"insecure-flag,omitempty"`
+	// Path of the CA bundle used to verify the vCenter certificate.
+	CAFile string `gcfg:"ca-file" json:"ca-file,omitempty"`
+	// SHA-1 thumbprint the vCenter certificate must match.
+	Thumbprint string `gcfg:"thumbprint" json:"thumbprint,omitempty"`
 	// Datacenter in which VMs are located.
-	Datacenters string `gcfg:"datacenters"`
+	Datacenters string `gcfg:"datacenters" json:"datacenters,omitempty"`
+}
+
+// String returns a human readable representation of the Config with
+// passwords redacted.
+func (cfg Config) String() string {
+	return fmt.Sprintf("Config [Global: [VCenterIP: %v, ClusterID: %v, User: %v, "+
+		"Password: %v, VCenterPort: %v, InsecureFlag: %v, CAFile: %v, Thumbprint: %v, "+
+		"Datacenters: %v], VirtualCenter: %v, Labels: [Zone: %v, Region: %v]]",
+		cfg.Global.VCenterIP, cfg.Global.ClusterID, redact.PEM(cfg.Global.User),
+		redact.String(cfg.Global.Password), cfg.Global.VCenterPort, cfg.Global.InsecureFlag,
+		cfg.Global.CAFile, cfg.Global.Thumbprint, cfg.Global.Datacenters, cfg.VirtualCenter, cfg.Labels.Zone, cfg.Labels.Region)
+}
+
+// String returns a human readable representation of the VirtualCenterConfig
+// with the password redacted.
+func (vcc VirtualCenterConfig) String() string {
+	return fmt.Sprintf("VirtualCenterConfig [User: %v, Password: %v, UserFile: %v, PasswordFile: %v, "+
+		"ClientCertFile: %v, ClientKeyFile: %v, SecretName: %v, SecretNamespace: %v, ClientKey: %v, "+
+		"VCenterPort: %v, InsecureFlag: %v, CAFile: %v, Thumbprint: %v, Datacenters: %v]",
+		redact.PEM(vcc.User), redact.String(vcc.Password), vcc.UserFile, vcc.PasswordFile,
+		vcc.ClientCertFile, vcc.ClientKeyFile, vcc.SecretName, vcc.SecretNamespace,
+		redact.String(vcc.ClientKey), vcc.VCenterPort, vcc.InsecureFlag, vcc.CAFile, vcc.Thumbprint,
+		vcc.Datacenters)
 }
@@ -0,0 +1,125 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+	"k8s.io/klog"
+)
+
+const (
+	// reloadDelay is the time to wait after the last change event before
+	// reloading the config, so that the several events produced by an atomic
+	// Secret or ConfigMap update are handled once.
+	reloadDelay = 2 * time.Second
+	// secretResyncPeriod is the interval at which credentials are re-read
+	// from referenced Kubernetes Secrets.
+	secretResyncPeriod = time.Minute
+)
+
+// WatchConfig watches the config file at cfgPath and the credential files it
+// references, and calls onChange with the new, validated configuration each
+// time it changes. Credentials in referenced Secrets are re-read every
+// secretResyncPeriod. Invalid configurations are logged and ignored so that
+// the last valid configuration stays in effect. Directories are watched
+// rather than the files themselves because Kubernetes updates Secret and
+// ConfigMap volumes by swapping a symlink. WatchConfig returns once the watch
+// is set up; watching stops when ctx is done.
+func WatchConfig(ctx context.Context, cfgPath string, onChange func(cfg *Config)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Errorf("Failed to create watcher for %s. Err: %v", cfgPath, err)
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(cfgPath)); err != nil {
+		klog.Errorf("Failed to watch %s. Err: %v", cfgPath, err)
+		watcher.Close()
+		return err
+	}
+	last, _ := GetCnsconfig(cfgPath)
+	watchCredentialFiles(watcher, last)
+	go func() {
+		defer watcher.Close()
+		reload := time.NewTimer(reloadDelay)
+		reload.Stop()
+		resync := time.NewTicker(secretResyncPeriod)
+		defer resync.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				reload.Stop()
+				return
+			case err := <-watcher.Errors:
+				klog.Warningf("Error watching config file %s. Err: %v", cfgPath, err)
+			case <-watcher.Events:
+				reload.Reset(reloadDelay)
+			case <-resync.C:
+				if !usesSecrets(last) {
+					continue
+				}
+				reload.Reset(0)
+			case <-reload.C:
+				cfg, err := GetCnsconfig(cfgPath)
+				if err != nil {
+					klog.Errorf("Ignoring invalid config change in %s, the previous config stays in effect. Err: %v", cfgPath, err)
+					continue
+				}
+				if reflect.DeepEqual(cfg, last) {
+					continue
+				}
+				last = cfg
+				watchCredentialFiles(watcher, cfg)
+				klog.Infof("Config %s changed, applying new config", cfgPath)
+				onChange(cfg)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchCredentialFiles adds the directories of the credential files
+// referenced by cfg to the watcher.
+func watchCredentialFiles(watcher *fsnotify.Watcher, cfg *Config) {
+	if cfg == nil {
+		return
+	}
+	for _, vcConfig := range cfg.VirtualCenter {
+		for _, file := range vcConfig.credentialFiles() {
+			if err := watcher.Add(filepath.Dir(file)); err != nil {
+				klog.Warningf("Failed to watch credential file %s. Err: %v", file, err)
+			}
+		}
+	}
+}
+
+// usesSecrets returns true if cfg references a Kubernetes Secret.
+func usesSecrets(cfg *Config) bool {
+	if cfg == nil {
+		return false
+	}
+	for _, vcConfig := range cfg.VirtualCenter {
+		if vcConfig.SecretName != "" {
+			return true
+		}
+	}
+	return false
+}
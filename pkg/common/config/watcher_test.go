@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+[Global]
+cluster-id = "cluster1"
+
+[VirtualCenter "vc.example.com"]
+user = "user@vsphere.local"
+password = "%s"
+`
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfgPath := filepath.Join(dir, "csi-vsphere.conf")
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(cfgPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(fmt.Sprintf(testConfig, "old"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan *Config, 1)
+	if err := WatchConfig(ctx, cfgPath, func(cfg *Config) { changes <- cfg }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid configs are ignored
+	writeConfig("[VirtualCenter \"vc.example.com\"]\n")
+	select {
+	case cfg := <-changes:
+		t.Fatalf("Unexpected reload of invalid config: %v", cfg)
+	case <-time.After(2 * reloadDelay):
+	}
+
+	writeConfig(fmt.Sprintf(testConfig, "new"))
+	select {
+	case cfg := <-changes:
+		if password := cfg.VirtualCenter["vc.example.com"].Password; password != "new" {
+			t.Errorf("Expected reloaded password %q, got %q", "new", password)
+		}
+	case <-time.After(5 * reloadDelay):
+		t.Fatal("Config change was not detected")
+	}
+}
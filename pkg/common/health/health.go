@@ -0,0 +1,142 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+const (
+	// EnvHealthAddress is the environment variable holding the address the
+	// health HTTP server listens on, for example ":9809". The server is not
+	// started when the variable is unset.
+	EnvHealthAddress = "VSPHERE_CSI_HEALTH_ADDRESS"
+
+	// HealthzPath is the path of the liveness endpoint.
+	HealthzPath = "/healthz"
+	// ReadyzPath is the path of the readiness endpoint.
+	ReadyzPath = "/readyz"
+	// MetricsPath is the path of the Prometheus metrics endpoint.
+	MetricsPath = "/metrics"
+
+	// DefaultCheckTimeout is the time allowed for a single run of all checks.
+	DefaultCheckTimeout = 30 * time.Second
+)
+
+// Check is a named health check. Fn returns nil if the checked component
+// is healthy.
+type Check struct {
+	Name string
+	Fn   func(ctx context.Context) error
+}
+
+// Result holds the outcome of a single Check.
+type Result struct {
+	Name string
+	Err  error
+}
+
+// Checks returns the list of checks to run. It is evaluated on every run so
+// that components initialized after the server started are taken into account.
+type Checks func() []Check
+
+// Run runs the given checks and returns the result of each one. The returned
+// error is non-nil if at least one check failed.
+func Run(ctx context.Context, checks []Check) ([]Result, error) {
+	var results []Result
+	var failed []string
+	for _, check := range checks {
+		err := check.Fn(ctx)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", check.Name, err))
+		}
+		results = append(results, Result{Name: check.Name, Err: err})
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("health checks failed: %s", strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+// Handler returns an http.Handler which runs the given checks on every
+// request. It responds with 200 if all checks pass and 503 otherwise. The
+// response body lists every check with its status, one per line.
+func Handler(checks Checks) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), DefaultCheckTimeout)
+		defer cancel()
+		results, err := Run(ctx, checks())
+		var body bytes.Buffer
+		for _, result := range results {
+			if result.Err != nil {
+				fmt.Fprintf(&body, "[-]%s failed: %v\n", result.Name, result.Err)
+			} else {
+				fmt.Fprintf(&body, "[+]%s ok\n", result.Name)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if err != nil {
+			klog.V(2).Infof("%s check failed. err=%v", r.URL.Path, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			body.WriteString("check failed\n")
+		} else {
+			w.WriteHeader(http.StatusOK)
+			body.WriteString("ok\n")
+		}
+		_, _ = w.Write(body.Bytes())
+	})
+}
+
+// NewServeMux returns a ServeMux serving the liveness checks on HealthzPath
+// and the readiness checks on ReadyzPath, along with the Prometheus metrics
+// on MetricsPath.
+func NewServeMux(liveness Checks, readiness Checks) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(HealthzPath, Handler(liveness))
+	mux.Handle(ReadyzPath, Handler(readiness))
+	mux.Handle(MetricsPath, promhttp.Handler())
+	return mux
+}
+
+// Serve starts the health HTTP server in the background if EnvHealthAddress
+// is set. Additional handlers may be registered on the returned ServeMux,
+// which is nil if the server was not started.
+func Serve(liveness Checks, readiness Checks) *http.ServeMux {
+	addr := os.Getenv(EnvHealthAddress)
+	if addr == "" {
+		klog.V(4).Infof("%s is not set, health server is disabled", EnvHealthAddress)
+		return nil
+	}
+	mux := NewServeMux(liveness, readiness)
+	go func() {
+		klog.V(2).Infof("Serving health endpoints %s and %s on %s", HealthzPath, ReadyzPath, addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			klog.Errorf("Health server on %s stopped. err=%v", addr, err)
+		}
+	}()
+	return mux
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeMux(t *testing.T) {
+	ok := Check{Name: "ok-check", Fn: func(ctx context.Context) error { return nil }}
+	failing := Check{Name: "failing-check", Fn: func(ctx context.Context) error { return errors.New("session expired") }}
+	mux := NewServeMux(
+		func() []Check { return []Check{ok} },
+		func() []Check { return []Check{ok, failing} })
+
+	tests := []struct {
+		path     string
+		code     int
+		contains []string
+	}{
+		{
+			path:     HealthzPath,
+			code:     http.StatusOK,
+			contains: []string{"[+]ok-check ok"},
+		},
+		{
+			path:     ReadyzPath,
+			code:     http.StatusServiceUnavailable,
+			contains: []string{"[+]ok-check ok", "[-]failing-check failed: session expired"},
+		},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.code, rec.Code)
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(rec.Body.String(), s) {
+				t.Errorf("%s: expected body to contain %q, got %q", tt.path, s, rec.Body.String())
+			}
+		}
+	}
+}
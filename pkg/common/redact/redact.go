@@ -0,0 +1,87 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redact
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+)
+
+// Mask is the placeholder printed in place of a secret value.
+const Mask = "<redacted>"
+
+// secretsFieldName is the name of the field carrying secrets in CSI requests.
+const secretsFieldName = "Secrets"
+
+var (
+	// privateKeyRegexp matches PEM encoded private key blocks, for example
+	// "RSA PRIVATE KEY", "EC PRIVATE KEY" or "PRIVATE KEY".
+	privateKeyRegexp = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z0-9 ]*PRIVATE KEY-----`)
+
+	secretsType = reflect.TypeOf(map[string]string{})
+)
+
+// String returns Mask if s is not empty, otherwise it returns an empty string
+// so that unset values are still recognizable in the output.
+func String(s string) string {
+	if s == "" {
+		return ""
+	}
+	return Mask
+}
+
+// PEM returns s with every PEM encoded private key block replaced by Mask.
+// Certificates and other PEM blocks are left untouched.
+func PEM(s string) string {
+	return privateKeyRegexp.ReplaceAllString(s, Mask)
+}
+
+// Map returns a copy of m with all values replaced by Mask. Keys are kept
+// so that the presence of a secret can still be diagnosed.
+func Map(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	masked := make(map[string]string, len(m))
+	for k := range m {
+		masked[k] = Mask
+	}
+	return masked
+}
+
+// Request formats a CSI request the same way as "%+v" on the dereferenced
+// request, except that the values of its Secrets map are masked. The given
+// request is not modified.
+func Request(req interface{}) string {
+	v := reflect.ValueOf(req)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "<nil>"
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return fmt.Sprintf("%+v", req)
+	}
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	if f := c.FieldByName(secretsFieldName); f.IsValid() && f.CanSet() && f.Type() == secretsType && !f.IsNil() {
+		f.Set(reflect.ValueOf(Map(f.Interface().(map[string]string))))
+	}
+	return fmt.Sprintf("%+v", c.Interface())
+}
@@ -24,7 +24,11 @@ import (
 
 // New returns a new CSI Storage Plug-in Provider.
 func New() gocsi.StoragePluginProvider {
-	svc := service.New()
+	return NewWithService(service.New())
+}
+
+// NewWithService returns a new CSI Storage Plug-in Provider serving svc.
+func NewWithService(svc service.Service) gocsi.StoragePluginProvider {
 	ctrl := svc.GetController()
 
 	return &gocsi.StoragePlugin{
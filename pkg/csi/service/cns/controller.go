@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -28,11 +29,13 @@ import (
 	"github.com/vmware/govmomi/units"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/redact"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
@@ -53,8 +56,14 @@ type nodeManager interface {
 }
 
 type controller struct {
-	manager *common.Manager
-	nodeMgr nodeManager
+	// managerLock protects manager and nodeMgr, replaced by Init and
+	// ReloadConfig while requests and health checks are served
+	managerLock sync.RWMutex
+	manager     *common.Manager
+	nodeMgr     nodeManager
+	// k8sclient is the client of the node manager, nil for an in-cluster
+	// client
+	k8sclient clientset.Interface
 }
 
 // New creates a CNS controller
@@ -62,6 +71,11 @@ func New() csitypes.Controller {
 	return &controller{}
 }
 
+// NewWithClient creates a CNS controller watching the nodes with k8sclient.
+func NewWithClient(k8sclient clientset.Interface) csitypes.Controller {
+	return &controller{k8sclient: k8sclient}
+}
+
 // Init is initializing controller struct
 func (c *controller) Init(config *config.Config) error {
 	klog.Infof("Initializing CNS controller")
@@ -78,7 +92,7 @@ func (c *controller) Init(config *config.Config) error {
 		klog.Errorf("Failed to register VC with virtualCenterManager. err=%v", err)
 		return err
 	}
-	c.manager = &common.Manager{
+	manager := &common.Manager{
 		VcenterConfig:  vcenterconfig,
 		CnsConfig:      config,
 		VolumeManager:  cnsvolume.GetManager(vcenter),
@@ -87,7 +101,7 @@ func (c *controller) Init(config *config.Config) error {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	vc, err := common.GetVCenter(ctx, c.manager)
+	vc, err := common.GetVCenter(ctx, manager)
 	if err != nil {
 		klog.Errorf("Failed to get vcenter. err=%v", err)
 		return err
@@ -97,12 +111,53 @@ func (c *controller) Init(config *config.Config) error {
 		klog.Errorf("checkAPI failed for vcenter API version: %s, err=%v", vc.Client.ServiceContent.About.ApiVersion, err)
 		return err
 	}
-	c.nodeMgr = &Nodes{}
-	err = c.nodeMgr.Initialize()
+	nodeMgr := &Nodes{k8sclient: c.k8sclient}
+	err = nodeMgr.Initialize()
 	if err != nil {
 		klog.Errorf("Failed to initialize nodeMgr. err=%v", err)
 		return err
 	}
+	c.managerLock.Lock()
+	c.manager = manager
+	c.nodeMgr = nodeMgr
+	c.managerLock.Unlock()
+	return nil
+}
+
+// getManager returns the current manager and node manager, nil before Init.
+func (c *controller) getManager() (*common.Manager, nodeManager) {
+	c.managerLock.RLock()
+	defer c.managerLock.RUnlock()
+	return c.manager, c.nodeMgr
+}
+
+// ReloadConfig applies credential, port, datacenter and topology category
+// changes to the initialized controller. Changing the vCenter host requires
+// a restart.
+func (c *controller) ReloadConfig(config *config.Config) error {
+	current, _ := c.getManager()
+	if current == nil {
+		return fmt.Errorf("controller is not initialized")
+	}
+	vcenterconfig, err := cnsvsphere.GetVirtualCenterConfig(config)
+	if err != nil {
+		klog.Errorf("Failed to get VirtualCenterConfig. err=%v", err)
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err = current.VcenterManager.UpdateVirtualCenter(ctx, vcenterconfig); err != nil {
+		klog.Errorf("Failed to update VC with virtualCenterManager. err=%v", err)
+		return err
+	}
+	// VcenterConfig is shared with the registered VirtualCenter and was
+	// updated in place, only the CNS config needs to be replaced
+	c.managerLock.Lock()
+	manager := *c.manager
+	manager.CnsConfig = config
+	c.manager = &manager
+	c.managerLock.Unlock()
+	klog.Infof("Reloaded CNS controller config")
 	return nil
 }
 
@@ -111,7 +166,8 @@ func (c *controller) Init(config *config.Config) error {
 func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 
-	klog.V(4).Infof("CreateVolume: called with args %+v", *req)
+	klog.V(4).Infof("CreateVolume: called with args %s", redact.Request(req))
+	manager, nodeMgr := c.getManager()
 	err := validateVanillaCreateVolumeRequest(req)
 	if err != nil {
 		klog.Errorf("Failed to validate Create Volume Request with err: %v", err)
@@ -125,6 +181,23 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	}
 	volSizeMB := int64(common.RoundUpSize(volSizeBytes, common.MbInBytes))
 
+	// A volume created by a previous call with the same name is returned
+	// as long as its capacity matches
+	existing, err := queryVolumeByName(manager, req.Name)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to query volume %q. Error: %+v", req.Name, err)
+		klog.Error(msg)
+		return nil, status.Errorf(errorCode(err, codes.Internal), msg)
+	}
+	if existing != nil {
+		if existing.BackingObjectDetails.CapacityInMb != volSizeMB {
+			msg := fmt.Sprintf("Volume %q already exists with %d MB instead of %d MB", req.Name, existing.BackingObjectDetails.CapacityInMb, volSizeMB)
+			klog.Error(msg)
+			return nil, status.Error(codes.AlreadyExists, msg)
+		}
+		klog.V(2).Infof("Volume %q already exists with ID %s", req.Name, existing.VolumeId.Id)
+	}
+
 	var datastoreURL string
 	var storagePolicyName string
 	var fsType string
@@ -154,18 +227,18 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	topologyRequirement := req.GetAccessibilityRequirements()
 	if topologyRequirement != nil {
 		// Get shared accessible datastores for matching topology requirement
-		if c.manager.CnsConfig.Labels.Zone == "" || c.manager.CnsConfig.Labels.Region == "" {
+		if manager.CnsConfig.Labels.Zone == "" || manager.CnsConfig.Labels.Region == "" {
 			// if zone and region label (vSphere category names) not specified in the config secret, then return
 			// NotFound error.
 			errMsg := fmt.Sprintf("Zone/Region vsphere category names not specified in the vsphere config secret")
 			klog.Errorf(errMsg)
 			return nil, status.Error(codes.NotFound, errMsg)
 		}
-		sharedDatastores, datastoreTopologyMap, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, c.manager.CnsConfig.Labels.Zone, c.manager.CnsConfig.Labels.Region)
+		sharedDatastores, datastoreTopologyMap, err = nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, manager.CnsConfig.Labels.Zone, manager.CnsConfig.Labels.Region)
 		if err != nil || len(sharedDatastores) == 0 {
 			msg := fmt.Sprintf("Failed to get shared datastores in topology: %+v. Error: %+v", topologyRequirement, err)
 			klog.Errorf(msg)
-			return nil, status.Error(codes.NotFound, msg)
+			return nil, status.Error(errorCode(err, codes.NotFound), msg)
 		}
 		klog.V(4).Infof("Shared datastores [%+v] retrieved for topologyRequirement [%+v] with datastoreTopologyMap [+%v]", sharedDatastores, topologyRequirement, datastoreTopologyMap)
 		if createVolumeSpec.DatastoreURL != "" {
@@ -187,18 +260,20 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 
 	} else {
 		// Get shared datastores for the Kubernetes cluster
-		sharedDatastores, err = c.nodeMgr.GetSharedDatastoresInK8SCluster(ctx)
+		sharedDatastores, err = nodeMgr.GetSharedDatastoresInK8SCluster(ctx)
 		if err != nil || len(sharedDatastores) == 0 {
 			msg := fmt.Sprintf("Failed to get shared datastores in kubernetes cluster. Error: %+v", err)
 			klog.Error(msg)
-			return nil, status.Errorf(codes.Internal, msg)
+			return nil, status.Errorf(errorCode(err, codes.Internal), msg)
 		}
 	}
-	volumeID, err := common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec, sharedDatastores)
-	if err != nil {
+	var volumeID string
+	if existing != nil {
+		volumeID = existing.VolumeId.Id
+	} else if volumeID, err = common.CreateVolumeUtil(ctx, manager, &createVolumeSpec, sharedDatastores); err != nil {
 		msg := fmt.Sprintf("Failed to create volume. Error: %+v", err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(errorCode(err, codes.Internal), msg)
 	}
 	attributes := make(map[string]string)
 	attributes[common.AttributeDiskType] = common.DiskTypeString
@@ -217,10 +292,10 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 		queryFilter := cnstypes.CnsQueryFilter{
 			VolumeIds: volumeIds,
 		}
-		queryResult, err := c.manager.VolumeManager.QueryVolume(queryFilter)
+		queryResult, err := manager.VolumeManager.QueryVolume(queryFilter)
 		if err != nil {
 			klog.Errorf("QueryVolume failed for volumeID: %s", volumeID)
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, status.Error(errorCode(err, codes.Internal), err.Error())
 		}
 		if len(queryResult.Volumes) > 0 {
 			// Find datastore topology from the retrieved datastoreURL
@@ -245,17 +320,28 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 // CreateVolume is deleting CNS Volume specified in DeleteVolumeRequest
 func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (
 	*csi.DeleteVolumeResponse, error) {
-	klog.V(4).Infof("DeleteVolume: called with args: %+v", *req)
+	klog.V(4).Infof("DeleteVolume: called with args: %s", redact.Request(req))
+	manager, _ := c.getManager()
 	var err error
 	err = validateVanillaDeleteVolumeRequest(req)
 	if err != nil {
 		return nil, err
 	}
-	err = common.DeleteVolumeUtil(ctx, c.manager, req.VolumeId, true)
+	volume, err := queryVolume(manager, req.VolumeId)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to query volume: %q. Error: %+v", req.VolumeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(errorCode(err, codes.Internal), msg)
+	}
+	if volume == nil {
+		klog.V(2).Infof("Volume %q doesn't exist, nothing to delete", req.VolumeId)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	err = common.DeleteVolumeUtil(ctx, manager, req.VolumeId, true)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to delete volume: %q. Error: %+v", req.VolumeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(errorCode(err, codes.Internal), msg)
 	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -265,25 +351,37 @@ func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (
 	*csi.ControllerPublishVolumeResponse, error) {
 
-	klog.V(4).Infof("ControllerPublishVolume: called with args %+v", *req)
+	klog.V(4).Infof("ControllerPublishVolume: called with args %s", redact.Request(req))
+	manager, nodeMgr := c.getManager()
 	err := validateVanillaControllerPublishVolumeRequest(req)
 	if err != nil {
-		msg := fmt.Sprintf("Validation for PublishVolume Request: %+v has failed. Error: %v", *req, err)
+		msg := fmt.Sprintf("Validation for PublishVolume Request: %s has failed. Error: %v", redact.Request(req), err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
 	}
-	node, err := c.nodeMgr.GetNodeByName(req.NodeId)
+	volume, err := queryVolume(manager, req.VolumeId)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to query volume: %q. Error: %+v", req.VolumeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(errorCode(err, codes.Internal), msg)
+	}
+	if volume == nil {
+		msg := fmt.Sprintf("Volume %q not found", req.VolumeId)
+		klog.Error(msg)
+		return nil, status.Error(codes.NotFound, msg)
+	}
+	node, err := nodeMgr.GetNodeByName(req.NodeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to find VirtualMachine for node:%q. Error: %v", req.NodeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(nodeErrorCode(err), msg)
 	}
 	klog.V(4).Infof("Found VirtualMachine for node:%q.", req.NodeId)
-	diskUUID, err := common.AttachVolumeUtil(ctx, c.manager, node, req.VolumeId)
+	diskUUID, err := common.AttachVolumeUtil(ctx, manager, node, req.VolumeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q err %+v", req.VolumeId, req.NodeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(errorCode(err, codes.Internal), msg)
 	}
 	publishInfo := make(map[string]string)
 	publishInfo[common.AttributeDiskType] = common.DiskTypeString
@@ -299,24 +397,25 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (
 	*csi.ControllerUnpublishVolumeResponse, error) {
 
-	klog.V(4).Infof("ControllerUnpublishVolume: called with args %+v", *req)
+	klog.V(4).Infof("ControllerUnpublishVolume: called with args %s", redact.Request(req))
+	manager, nodeMgr := c.getManager()
 	err := validateVanillaControllerUnpublishVolumeRequest(req)
 	if err != nil {
-		msg := fmt.Sprintf("Validation for UnpublishVolume Request: %+v has failed. Error: %v", *req, err)
+		msg := fmt.Sprintf("Validation for UnpublishVolume Request: %s has failed. Error: %v", redact.Request(req), err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
 	}
-	node, err := c.nodeMgr.GetNodeByName(req.NodeId)
+	node, err := nodeMgr.GetNodeByName(req.NodeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to find VirtualMachine for node:%q. Error: %v", req.NodeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(nodeErrorCode(err), msg)
 	}
-	err = common.DetachVolumeUtil(ctx, c.manager, node, req.VolumeId)
+	err = common.DetachVolumeUtil(ctx, manager, node, req.VolumeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to detach disk: %+q from node: %q err %+v", req.VolumeId, req.NodeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(errorCode(err, codes.Internal), msg)
 	}
 	resp := &csi.ControllerUnpublishVolumeResponse{}
 	return resp, nil
@@ -326,7 +425,19 @@ func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 
-	klog.V(4).Infof("ControllerGetCapabilities: called with args %+v", *req)
+	klog.V(4).Infof("ValidateVolumeCapabilities: called with args %s", redact.Request(req))
+	manager, _ := c.getManager()
+	volume, err := queryVolume(manager, req.VolumeId)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to query volume: %q. Error: %+v", req.VolumeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(errorCode(err, codes.Internal), msg)
+	}
+	if volume == nil {
+		msg := fmt.Sprintf("Volume %q not found", req.VolumeId)
+		klog.Error(msg)
+		return nil, status.Error(codes.NotFound, msg)
+	}
 	volCaps := req.GetVolumeCapabilities()
 	var confirmed *csi.ValidateVolumeCapabilitiesResponse_Confirmed
 	if common.IsValidVolumeCapabilities(volCaps) {
@@ -340,21 +451,21 @@ func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 func (c *controller) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	klog.V(4).Infof("ListVolumes: called with args %+v", *req)
+	klog.V(4).Infof("ListVolumes: called with args %s", redact.Request(req))
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
 	*csi.GetCapacityResponse, error) {
 
-	klog.V(4).Infof("GetCapacity: called with args %+v", *req)
+	klog.V(4).Infof("GetCapacity: called with args %s", redact.Request(req))
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
-	klog.V(4).Infof("ControllerGetCapabilities: called with args %+v", *req)
+	klog.V(4).Infof("ControllerGetCapabilities: called with args %s", redact.Request(req))
 	var caps []*csi.ControllerServiceCapability
 	for _, cap := range controllerCaps {
 		c := &csi.ControllerServiceCapability{
@@ -372,20 +483,20 @@ func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.Con
 func (c *controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (
 	*csi.CreateSnapshotResponse, error) {
 
-	klog.V(4).Infof("CreateSnapshot: called with args %+v", *req)
+	klog.V(4).Infof("CreateSnapshot: called with args %s", redact.Request(req))
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (
 	*csi.DeleteSnapshotResponse, error) {
 
-	klog.V(4).Infof("DeleteSnapshot: called with args %+v", *req)
+	klog.V(4).Infof("DeleteSnapshot: called with args %s", redact.Request(req))
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (
 	*csi.ListSnapshotsResponse, error) {
 
-	klog.V(4).Infof("ListSnapshots: called with args %+v", *req)
+	klog.V(4).Infof("ListSnapshots: called with args %s", redact.Request(req))
 	return nil, status.Error(codes.Unimplemented, "")
 }
@@ -21,12 +21,73 @@ import (
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	cnstypes "github.com/vmware/govmomi/cns/types"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog"
 
+	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
 
+// errorCode returns codes.Unavailable if err shows that vCenter is
+// unreachable, so that the sidecars back off and retry, and code otherwise.
+func errorCode(err error, code codes.Code) codes.Code {
+	if cnsvsphere.IsUnavailable(err) {
+		return codes.Unavailable
+	}
+	return code
+}
+
+// nodeErrorCode returns codes.NotFound if err shows that the node isn't
+// registered, and the code of errorCode otherwise.
+func nodeErrorCode(err error) codes.Code {
+	if err == cnsnode.ErrNodeNotFound {
+		return codes.NotFound
+	}
+	return errorCode(err, codes.Internal)
+}
+
+// queryVolume returns the CNS volume with the given ID, or nil if it doesn't
+// exist.
+func queryVolume(manager *common.Manager, volumeID string) (*cnstypes.CnsVolume, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(queryFilter)
+	if err != nil {
+		klog.Errorf("QueryVolume failed for volumeID: %s. Err: %v", volumeID, err)
+		return nil, err
+	}
+	for i := range queryResult.Volumes {
+		if queryResult.Volumes[i].VolumeId.Id == volumeID {
+			return &queryResult.Volumes[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// queryVolumeByName returns the CNS volume of the cluster with the given
+// name, or nil if it doesn't exist.
+func queryVolumeByName(manager *common.Manager, name string) (*cnstypes.CnsVolume, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		Names:               []string{name},
+		ContainerClusterIds: []string{manager.CnsConfig.Global.ClusterID},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(queryFilter)
+	if err != nil {
+		klog.Errorf("QueryVolume failed for volume name: %s. Err: %v", name, err)
+		return nil, err
+	}
+	for i := range queryResult.Volumes {
+		if queryResult.Volumes[i].Name == name {
+			return &queryResult.Volumes[i], nil
+		}
+	}
+	return nil, nil
+}
+
 // validateVanillaCreateVolumeRequest is the helper function to validate
 // CreateVolumeRequest for Vanilla CSI driver.
 // Function returns error if validation fails otherwise returns nil.
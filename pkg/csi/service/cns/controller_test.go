@@ -17,9 +17,12 @@ limitations under the License.
 package cns
 
 import (
+	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 
@@ -33,11 +36,14 @@ import (
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	clientset "k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/klog"
 
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume/fake"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
@@ -442,3 +448,137 @@ func TestCompleteControllerFlow(t *testing.T) {
 		t.Fatalf("Volume should not exist after deletion with ID: %s", volID)
 	}
 }
+
+// TestRequestSecretsNotLogged verifies that secrets passed in CSI requests
+// never reach the log output, even at the highest verbosity.
+func TestRequestSecretsNotLogged(t *testing.T) {
+	const secret = "csi-secret-value"
+
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	if err := flags.Parse([]string{"-logtostderr=false", "-v=5"}); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	klog.SetOutput(&logs)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		_ = flags.Parse([]string{"-logtostderr=true", "-v=0"})
+	}()
+
+	ctx := context.Background()
+	c := &controller{}
+	secrets := map[string]string{"password": secret}
+	// Requests without a node id fail validation before reaching vCenter.
+	if _, err := c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: "volume-id",
+		Secrets:  secrets,
+	}); err == nil {
+		t.Fatal("Expected ControllerPublishVolume validation to fail")
+	}
+	if _, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "volume-id",
+		Secrets:  secrets,
+	}); err == nil {
+		t.Fatal("Expected ControllerUnpublishVolume validation to fail")
+	}
+	if _, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:    "snapshot",
+		Secrets: secrets,
+	}); err == nil {
+		t.Fatal("Expected CreateSnapshot to be unimplemented")
+	}
+	klog.Flush()
+
+	if !strings.Contains(logs.String(), "ControllerPublishVolume") {
+		t.Fatalf("Expected request to be logged, got: %q", logs.String())
+	}
+	if strings.Contains(logs.String(), secret) {
+		t.Errorf("Secret leaked into log output: %s", logs.String())
+	}
+}
+
+// staticNodeManager resolves every node to the same virtual machine.
+type staticNodeManager struct {
+	nodeManager
+	vm *cnsvsphere.VirtualMachine
+}
+
+func (s *staticNodeManager) GetNodeByName(nodeName string) (*cnsvsphere.VirtualMachine, error) {
+	return s.vm, nil
+}
+
+// TestControllerFaults verifies the error paths of the controller against
+// the in-memory CNS fake.
+func TestControllerFaults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	fakeCns := fake.NewManager()
+	manager := *ct.controller.manager
+	manager.VolumeManager = fakeCns
+	nodeID := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine).Name
+	vm, err := ct.controller.nodeMgr.GetNodeByName(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &controller{manager: &manager, nodeMgr: &staticNodeManager{ct.controller.nodeMgr, vm}}
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name:               testVolumeName,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 * common.GbInBytes},
+		VolumeCapabilities: capabilities,
+	}
+
+	// A task fault fails the request with Internal
+	fakeCns.InjectTaskFault(fake.CreateVolume, "Failed to create volume", 1)
+	if _, err := c.CreateVolume(ctx, reqCreate); status.Code(err) != codes.Internal {
+		t.Fatalf("Expected Internal for a task fault, got %v", err)
+	}
+	respCreate, err := c.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+
+	reqPublish := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volID,
+		NodeId:           nodeID,
+		VolumeCapability: capabilities[0],
+	}
+
+	// An unreachable vCenter fails the request with Unavailable
+	fakeCns.InjectFault(fake.AttachVolume, cnsvsphere.ErrCircuitOpen, 1)
+	if _, err := c.ControllerPublishVolume(ctx, reqPublish); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected Unavailable for an open circuit breaker, got %v", err)
+	}
+	if _, err := c.ControllerPublishVolume(ctx, reqPublish); err != nil {
+		t.Fatal(err)
+	}
+
+	// An attached volume is in use and cannot be deleted
+	reqDelete := &csi.DeleteVolumeRequest{VolumeId: volID}
+	_, err = c.DeleteVolume(ctx, reqDelete)
+	if err == nil || !strings.Contains(err.Error(), cnsvolume.CNSVolumeResourceInUseFaultMessage) {
+		t.Fatalf("Expected the volume to be in use, got %v", err)
+	}
+
+	reqUnpublish := &csi.ControllerUnpublishVolumeRequest{VolumeId: volID, NodeId: nodeID}
+	if _, err := c.ControllerUnpublishVolume(ctx, reqUnpublish); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DeleteVolume(ctx, reqDelete); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fakeCns.Volume(volID); ok {
+		t.Errorf("Volume %s should not exist after deletion", volID)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"errors"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/health"
+)
+
+const (
+	// nodeManagerCheckName is the name of the node manager health check.
+	nodeManagerCheckName = "node-manager"
+)
+
+// errControllerNotInitialized is returned by the health checks before Init
+// has completed successfully.
+var errControllerNotInitialized = errors.New("controller is not initialized")
+
+// LivenessChecks returns the checks which fail when the controller cannot
+// recover without a restart. vCenter connectivity is only part of the
+// readiness checks, so that a vCenter outage doesn't restart the controller.
+func (c *controller) LivenessChecks() []health.Check {
+	if manager, _ := c.getManager(); manager == nil {
+		return []health.Check{notInitializedCheck()}
+	}
+	return nil
+}
+
+// ReadinessChecks returns the checks which must pass for the controller to
+// serve requests: a reachable vCenter, a valid vCenter session, available CNS and PBM clients
+// and an initialized node manager.
+func (c *controller) ReadinessChecks() []health.Check {
+	manager, _ := c.getManager()
+	if manager == nil {
+		return []health.Check{notInitializedCheck()}
+	}
+	vc, err := manager.VcenterManager.GetVirtualCenter(manager.VcenterConfig.Host)
+	if err != nil {
+		return []health.Check{notInitializedCheck()}
+	}
+	return []health.Check{
+		vc.BreakerCheck(),
+		vc.SessionCheck(),
+		vc.CnsCheck(),
+		vc.PbmCheck(),
+		{
+			Name: nodeManagerCheckName,
+			Fn: func(ctx context.Context) error {
+				if _, nodeMgr := c.getManager(); nodeMgr == nil {
+					return errors.New("node manager is not initialized")
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// notInitializedCheck returns a check which always fails with
+// errControllerNotInitialized.
+func notInitializedCheck() health.Check {
+	return health.Check{
+		Name: "controller",
+		Fn: func(ctx context.Context) error {
+			return errControllerNotInitialized
+		},
+	}
+}
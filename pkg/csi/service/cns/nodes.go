@@ -22,6 +22,7 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
 	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
@@ -35,16 +36,21 @@ import (
 type Nodes struct {
 	cnsNodeManager cnsnode.Manager
 	informMgr      *k8s.InformerManager
+	// k8sclient is used instead of an in-cluster client if set
+	k8sclient clientset.Interface
 }
 
 // Initialize helps initialize node manager and node informer manager
 func (nodes *Nodes) Initialize() error {
 	nodes.cnsNodeManager = cnsnode.GetManager()
 	// Create the kubernetes client
-	k8sclient, err := k8s.NewClient()
-	if err != nil {
-		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
-		return err
+	k8sclient := nodes.k8sclient
+	if k8sclient == nil {
+		var err error
+		if k8sclient, err = k8s.NewClient(); err != nil {
+			klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
+			return err
+		}
 	}
 	nodes.cnsNodeManager.SetKubernetesClient(k8sclient)
 	nodes.informMgr = k8s.NewInformer(k8sclient)
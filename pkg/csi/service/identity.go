@@ -20,6 +20,13 @@ import (
 	"context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/health"
 )
 
 // set via ldflags
@@ -30,7 +37,19 @@ func (s *service) Probe(
 	req *csi.ProbeRequest) (
 	*csi.ProbeResponse, error) {
 
-	return &csi.ProbeResponse{}, nil
+	results, err := health.Run(ctx, s.readinessChecks())
+	if err != nil {
+		// Report an unreachable vCenter as Unavailable so that callers retry
+		code := codes.FailedPrecondition
+		for _, result := range results {
+			if cnsvsphere.IsUnavailable(result.Err) {
+				code = codes.Unavailable
+			}
+		}
+		klog.Warningf("Probe: plugin is not healthy. err=%v", err)
+		return nil, status.Error(code, err.Error())
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
 
 func (s *service) GetPluginInfo(
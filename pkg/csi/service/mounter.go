@@ -0,0 +1,79 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+
+	"github.com/akutz/gofsutil"
+)
+
+// Mounter performs the mount and device operations of the node service.
+type Mounter interface {
+	// FormatAndMount formats source with fsType if needed and mounts it to target.
+	FormatAndMount(ctx context.Context, source, target, fsType string, opts ...string) error
+	// Mount mounts source to target.
+	Mount(ctx context.Context, source, target, fsType string, opts ...string) error
+	// BindMount bind mounts source to target.
+	BindMount(ctx context.Context, source, target string, opts ...string) error
+	// Unmount unmounts target.
+	Unmount(ctx context.Context, target string) error
+	// GetMounts returns all mounts of the node.
+	GetMounts(ctx context.Context) ([]gofsutil.Info, error)
+	// GetDevMounts returns the mounts of the device dev.
+	GetDevMounts(ctx context.Context, dev string) ([]gofsutil.Info, error)
+	// GetDiskPath returns the path of the attached disk with the given ID,
+	// or an empty string if the disk is not attached.
+	GetDiskPath(id string) (string, error)
+	// GetDevice returns the block device at path.
+	GetDevice(path string) (*Device, error)
+}
+
+// gofsutilMounter is the Mounter of the node VM, using gofsutil.
+type gofsutilMounter struct{}
+
+func (gofsutilMounter) FormatAndMount(ctx context.Context, source, target, fsType string, opts ...string) error {
+	return gofsutil.FormatAndMount(ctx, source, target, fsType, opts...)
+}
+
+func (gofsutilMounter) Mount(ctx context.Context, source, target, fsType string, opts ...string) error {
+	return gofsutil.Mount(ctx, source, target, fsType, opts...)
+}
+
+func (gofsutilMounter) BindMount(ctx context.Context, source, target string, opts ...string) error {
+	return gofsutil.BindMount(ctx, source, target, opts...)
+}
+
+func (gofsutilMounter) Unmount(ctx context.Context, target string) error {
+	return gofsutil.Unmount(ctx, target)
+}
+
+func (gofsutilMounter) GetMounts(ctx context.Context) ([]gofsutil.Info, error) {
+	return gofsutil.GetMounts(ctx)
+}
+
+func (gofsutilMounter) GetDevMounts(ctx context.Context, dev string) ([]gofsutil.Info, error) {
+	return gofsutil.GetDevMounts(ctx, dev)
+}
+
+func (gofsutilMounter) GetDiskPath(id string) (string, error) {
+	return getDiskPath(id, nil)
+}
+
+func (gofsutilMounter) GetDevice(path string) (*Device, error) {
+	return getDevice(path)
+}
@@ -35,6 +35,7 @@ import (
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/redact"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
@@ -59,14 +60,14 @@ func (s *service) NodeStageVolume(
 		return nil, err
 	}
 	klog.V(2).Infof("Checking if volume: %s with diskID: %s is attached", volID, diskID)
-	volPath, err := verifyVolumeAttached(diskID)
+	volPath, err := s.verifyVolumeAttached(diskID)
 	if err != nil {
 		klog.Errorf("Failed to verify volume attachment. Error: %v", err)
 		return nil, err
 	}
 
 	// Check that block device looks good
-	dev, err := getDevice(volPath)
+	dev, err := s.mounter.GetDevice(volPath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"error getting block device for volume: %s, err: %s",
@@ -100,7 +101,7 @@ func (s *service) NodeStageVolume(
 	}
 
 	// Get mounts to check if already staged
-	mnts, err := gofsutil.GetDevMounts(context.Background(), dev.RealDev)
+	mnts, err := s.mounter.GetDevMounts(context.Background(), dev.RealDev)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
@@ -124,14 +125,14 @@ func (s *service) NodeStageVolume(
 		// If read-only access mode, we don't allow formatting
 		if ro {
 			mntFlags = append(mntFlags, "ro")
-			if err := gofsutil.Mount(ctx, dev.FullPath, target, fs, mntFlags...); err != nil {
+			if err := s.mounter.Mount(ctx, dev.FullPath, target, fs, mntFlags...); err != nil {
 				return nil, status.Errorf(codes.Internal,
 					"error with mount during staging: %s",
 					err.Error())
 			}
 			return &csi.NodeStageVolumeResponse{}, nil
 		}
-		if err := gofsutil.FormatAndMount(ctx, dev.FullPath, target, fs, mntFlags...); err != nil {
+		if err := s.mounter.FormatAndMount(ctx, dev.FullPath, target, fs, mntFlags...); err != nil {
 			return nil, status.Errorf(codes.Internal,
 				"error with format and mount during staging: %s",
 				err.Error())
@@ -184,7 +185,7 @@ func (s *service) NodeUnstageVolume(
 	// have created the staging path per the spec, even for BlockVolumes. Even
 	// though we don't use the staging path for block, the fact nothing will be
 	// mounted still indicates that unstaging is done.
-	dev, err := getDevFromMount(target)
+	dev, err := s.getDevFromMount(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"error getting block device for volume: %s, err: %s",
@@ -199,7 +200,7 @@ func (s *service) NodeUnstageVolume(
 	klog.V(2).Infof("found device. volID: %q, path: %q, block: %q, target: %q", volID, dev.FullPath, dev.RealDev, target)
 
 	// Get mounts for device
-	mnts, err := gofsutil.GetDevMounts(context.Background(), dev.RealDev)
+	mnts, err := s.mounter.GetDevMounts(context.Background(), dev.RealDev)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
@@ -216,7 +217,7 @@ func (s *service) NodeUnstageVolume(
 	// the one existing mount is from the block to the target
 
 	// unstage this
-	if err := gofsutil.Unmount(context.Background(), target); err != nil {
+	if err := s.mounter.Unmount(context.Background(), target); err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"Error unmounting target: %s", err.Error())
 	}
@@ -238,14 +239,14 @@ func (s *service) NodePublishVolume(
 	}
 
 	klog.V(2).Infof("Checking if volume: %s with diskID: %s is attached", volID, diskID)
-	volPath, err := verifyVolumeAttached(diskID)
+	volPath, err := s.verifyVolumeAttached(diskID)
 	if err != nil {
 		klog.Errorf("Failed to verify volume attachment. Error: %v", err)
 		return nil, err
 	}
 
 	// Get underlying block device
-	dev, err := getDevice(volPath)
+	dev, err := s.mounter.GetDevice(volPath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"error getting block device for volume: %s, err: %s",
@@ -255,11 +256,11 @@ func (s *service) NodePublishVolume(
 	volCap := req.GetVolumeCapability()
 	if _, ok := volCap.GetAccessType().(*csi.VolumeCapability_Block); ok {
 		// bind mount device to target
-		return publishBlockVol(ctx, req, dev)
+		return s.publishBlockVol(ctx, req, dev)
 	}
 
 	// Volume must be a mount volume
-	return publishMountVol(ctx, req, dev)
+	return s.publishMountVol(ctx, req, dev)
 }
 
 func (s *service) NodeUnpublishVolume(
@@ -281,7 +282,7 @@ func (s *service) NodeUnpublishVolume(
 	}
 
 	// Look up block device mounted to target
-	dev, err := getDevFromMount(target)
+	dev, err := s.getDevFromMount(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"error getting block device for volume: %s, err: %s",
@@ -299,7 +300,7 @@ func (s *service) NodeUnpublishVolume(
 
 	// get mounts
 	// Check if device is already unmounted
-	mnts, err := gofsutil.GetMounts(ctx)
+	mnts, err := s.mounter.GetMounts(ctx)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
@@ -309,7 +310,7 @@ func (s *service) NodeUnpublishVolume(
 	for _, m := range mnts {
 		if m.Source == dev.RealDev || m.Device == dev.RealDev {
 			if m.Path == target {
-				if err := gofsutil.Unmount(ctx, target); err != nil {
+				if err := s.mounter.Unmount(ctx, target); err != nil {
 					return nil, status.Errorf(codes.Internal,
 						"Error unmounting target: %s", err.Error())
 				}
@@ -433,7 +434,7 @@ func (s *service) NodeGetInfo(
 	}, nil
 }
 
-func publishMountVol(
+func (s *service) publishMountVol(
 	ctx context.Context,
 	req *csi.NodePublishVolumeRequest,
 	dev *Device) (
@@ -461,7 +462,7 @@ func publishMountVol(
 	ro := req.GetReadonly()
 	// get block device mounts
 	// Check if device is already mounted
-	devMnts, err := getDevMounts(dev)
+	devMnts, err := s.getDevMounts(dev)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
@@ -486,7 +487,7 @@ func publishMountVol(
 				}
 
 				// Existing mount satisfies request
-				klog.V(3).Infof("volume already published to target. volumePath: %q, device: %q, req: %v", dev.FullPath, dev.RealDev, req)
+				klog.V(3).Infof("volume already published to target. volumePath: %q, device: %q, req: %s", dev.FullPath, dev.RealDev, redact.Request(req))
 				return &csi.NodePublishVolumeResponse{}, nil
 			}
 		}
@@ -500,7 +501,7 @@ func publishMountVol(
 		mntFlags = append(mntFlags, "ro")
 	}
 
-	if err := gofsutil.BindMount(ctx, stagingTarget, target, mntFlags...); err != nil {
+	if err := s.mounter.BindMount(ctx, stagingTarget, target, mntFlags...); err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"error publish volume to target path: %s",
 			err.Error())
@@ -509,7 +510,7 @@ func publishMountVol(
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func publishBlockVol(
+func (s *service) publishBlockVol(
 	ctx context.Context,
 	req *csi.NodePublishVolumeRequest,
 	dev *Device) (
@@ -534,7 +535,7 @@ func publishBlockVol(
 	}
 
 	// get block device mounts
-	devMnts, err := getDevMounts(dev)
+	devMnts, err := s.getDevMounts(dev)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
@@ -545,7 +546,7 @@ func publishBlockVol(
 	if len(devMnts) == 0 {
 		// do the bind mount
 		mntFlags := make([]string, 0)
-		if err := gofsutil.BindMount(ctx, dev.FullPath, target, mntFlags...); err != nil {
+		if err := s.mounter.BindMount(ctx, dev.FullPath, target, mntFlags...); err != nil {
 			return nil, status.Errorf(codes.Internal,
 				"error publish volume to target path: %s",
 				err.Error())
@@ -640,10 +641,10 @@ func contains(list []string, item string) bool {
 	return false
 }
 
-func verifyVolumeAttached(diskID string) (string, error) {
+func (s *service) verifyVolumeAttached(diskID string) (string, error) {
 
 	// Check that volume is attached
-	volPath, err := getDiskPath(diskID, nil)
+	volPath, err := s.mounter.GetDiskPath(diskID)
 	if err != nil {
 		return "", status.Errorf(codes.Internal,
 			"Error trying to read attached disks: %v", err)
@@ -749,14 +750,14 @@ func ensureMountVol(volCap *csi.VolumeCapability) (string, []string, error) {
 	return fs, mntFlags, nil
 }
 
-// a wrapper around gofsutil.GetMounts that handles bind mounts
-func getDevMounts(
+// getDevMounts wraps GetMounts of the Mounter to handle bind mounts
+func (s *service) getDevMounts(
 	sysDevice *Device) ([]gofsutil.Info, error) {
 
 	ctx := context.Background()
 	devMnts := make([]gofsutil.Info, 0)
 
-	mnts, err := gofsutil.GetMounts(ctx)
+	mnts, err := s.mounter.GetMounts(ctx)
 	if err != nil {
 		return devMnts, err
 	}
@@ -808,10 +809,10 @@ func getDiskID(volID string, pubCtx map[string]string) (string, error) {
 	return pubCtx[common.AttributeFirstClassDiskUUID], nil
 }
 
-func getDevFromMount(target string) (*Device, error) {
+func (s *service) getDevFromMount(target string) (*Device, error) {
 
 	// Get list of all mounts on system
-	mnts, err := gofsutil.GetMounts(context.Background())
+	mnts, err := s.mounter.GetMounts(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -823,7 +824,7 @@ func getDevFromMount(target string) (*Device, error) {
 			if m.Device == "devtmpfs" {
 				d = m.Source
 			}
-			dev, err := getDevice(d)
+			dev, err := s.mounter.GetDevice(d)
 			if err != nil {
 				return nil, err
 			}
@@ -25,9 +25,12 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/rexray/gocsi"
 	csictx "github.com/rexray/gocsi/context"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/health"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/cns"
 	vTypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
@@ -53,8 +56,10 @@ type Service interface {
 }
 
 type service struct {
-	mode string
-	cs   vTypes.Controller
+	mode      string
+	cs        vTypes.Controller
+	mounter   Mounter
+	k8sclient clientset.Interface
 }
 
 // This works around a bug that if k8s node dies, this will clean up the sock file
@@ -70,11 +75,18 @@ func init() {
 
 // New returns a new Service.
 func New() Service {
-	return &service{}
+	return NewWithMounter(gofsutilMounter{}, nil)
+}
+
+// NewWithMounter returns a new Service performing the mount operations of
+// the node service with mounter. The controller uses k8sclient, or an
+// in-cluster client if it is nil.
+func NewWithMounter(mounter Mounter, k8sclient clientset.Interface) Service {
+	return &service{mounter: mounter, k8sclient: k8sclient}
 }
 
 func (s *service) GetController() csi.ControllerServer {
-	s.cs = cns.New()
+	s.cs = cns.NewWithClient(s.k8sclient)
 	return s.cs
 }
 
@@ -91,7 +103,7 @@ func (s *service) BeforeServe(
 	// Get the SP's operating mode.
 	s.mode = csictx.Getenv(ctx, gocsi.EnvVarMode)
 
-	if !strings.EqualFold(s.mode, "node") {
+	if !s.isNodeMode() {
 		// Controller service is needed
 		var cfg *cnsconfig.Config
 		cfgPath = csictx.Getenv(ctx, cnsconfig.EnvCloudConfig)
@@ -103,10 +115,52 @@ func (s *service) BeforeServe(
 			klog.Errorf("Failed to read cnsconfig. Error: %v", err)
 			return err
 		}
+		if err := limiter.Configure(cfg); err != nil {
+			return err
+		}
 		if err := s.cs.Init(cfg); err != nil {
 			klog.Errorf("Failed to init controller. Error: %v", err)
 			return err
 		}
+		// Apply changes of the config file, such as rotated credentials,
+		// without restarting
+		if err := cnsconfig.WatchConfig(context.Background(), cfgPath, s.reloadConfig); err != nil {
+			klog.Warningf("Config changes will not be applied until restart. Error: %v", err)
+		}
 	}
+	// Serve /healthz and /readyz if configured
+	health.Serve(s.livenessChecks, s.readinessChecks)
 	return nil
 }
+
+// reloadConfig applies a changed config to the controller service.
+func (s *service) reloadConfig(cfg *cnsconfig.Config) {
+	if err := limiter.Configure(cfg); err != nil {
+		klog.Errorf("Failed to reload limiter config. Error: %v", err)
+	}
+	if err := s.cs.ReloadConfig(cfg); err != nil {
+		klog.Errorf("Failed to reload controller config. Error: %v", err)
+	}
+}
+
+// isNodeMode returns true if the plugin only serves the node service.
+func (s *service) isNodeMode() bool {
+	return strings.EqualFold(s.mode, "node")
+}
+
+// livenessChecks returns the checks served on the health endpoint.
+// The node service has no external dependencies to check.
+func (s *service) livenessChecks() []health.Check {
+	if s.isNodeMode() || s.cs == nil {
+		return nil
+	}
+	return s.cs.LivenessChecks()
+}
+
+// readinessChecks returns the checks used by Probe and the readiness endpoint.
+func (s *service) readinessChecks() []health.Check {
+	if s.isNodeMode() || s.cs == nil {
+		return nil
+	}
+	return s.cs.ReadinessChecks()
+}
@@ -27,6 +27,8 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/rexray/gocsi"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/provider"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
@@ -97,11 +99,11 @@ var _ = Describe("CSI plugin", func() {
 							csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS))
 					})
 				})
-				PContext("Probe", func() {
+				Context("Probe", func() {
 					It("Should fail", func() {
 						_, err = client.Probe(ctx, &csi.ProbeRequest{})
 						Ω(err).Should(HaveOccurred())
-						//TODO check that the gRPC status code is FAILED_PRECONDITION
+						Ω(status.Code(err)).Should(Equal(codes.FailedPrecondition))
 					})
 				})
 			})
@@ -137,8 +139,14 @@ var _ = Describe("CSI plugin", func() {
 
 // getPipedClient serves the given SP over an in-memory pipe
 func getPipedClient(ctx context.Context, sp gocsi.StoragePluginProvider) (*grpc.ClientConn, func(), error) {
+	return getPipedClientWithLabel(ctx, sp, "csi-vsphere-test")
+}
+
+// getPipedClientWithLabel serves the given SP over the in-memory pipe with
+// the given label
+func getPipedClientWithLabel(ctx context.Context, sp gocsi.StoragePluginProvider, label string) (*grpc.ClientConn, func(), error) {
 
-	lis, err := memconn.Listen("memu", "csi-vsphere-test")
+	lis, err := memconn.Listen("memu", label)
 	Ω(err).Should(BeNil())
 	go func() {
 		defer GinkgoRecover()
@@ -150,7 +158,7 @@ func getPipedClient(ctx context.Context, sp gocsi.StoragePluginProvider) (*grpc.
 	clientOpts := []grpc.DialOption{
 		grpc.WithInsecure(),
 		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
-			return memconn.Dial("memu", "csi-vsphere-test")
+			return memconn.Dial("memu", label)
 		}),
 	}
 
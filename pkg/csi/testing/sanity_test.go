@@ -0,0 +1,381 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/akutz/gofsutil"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	cnssim "github.com/vmware/govmomi/cns/simulator"
+	pbmsim "github.com/vmware/govmomi/pbm/simulator"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/simulator/vpx"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/provider"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// sanityConfig configures the csi-sanity suite of kubernetes-csi/csi-test,
+// run against the full controller and node services served by
+// getSanityPlugin. Its address and paths are set once the plugin is served.
+var sanityConfig = &sanity.Config{TestVolumeSize: 1024 * 1024 * 1024}
+
+func init() {
+	sanity.GinkgoTest(sanityConfig)
+}
+
+var _ = BeforeSuite(func() {
+	getSanityPlugin()
+})
+
+// The specs below complement csi-sanity with the publish context and the
+// mounts specific to the plugin.
+var _ = Describe("CSI plugin lifecycle", func() {
+
+	var (
+		ctx        context.Context
+		plugin     *sanityPlugin
+		controller csi.ControllerClient
+		node       csi.NodeClient
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		plugin = getSanityPlugin()
+		controller = csi.NewControllerClient(plugin.conn)
+		node = csi.NewNodeClient(plugin.conn)
+	})
+
+	mountCapability := func() *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}
+	}
+
+	It("should create, attach, stage, publish, unpublish, unstage, detach and delete a volume", func() {
+		res, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "sanity-lifecycle",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		volume := res.GetVolume()
+		volumeID := volume.GetVolumeId()
+
+		pub, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           plugin.nodeID,
+			VolumeCapability: mountCapability(),
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pub.GetPublishContext()).Should(HaveKey(common.AttributeFirstClassDiskUUID))
+
+		// Staging and publishing twice must succeed
+		for i := 0; i < 2; i++ {
+			_, err = node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+				VolumeId:          volumeID,
+				PublishContext:    pub.GetPublishContext(),
+				StagingTargetPath: plugin.stagingPath,
+				VolumeCapability:  mountCapability(),
+				VolumeContext:     volume.GetVolumeContext(),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		for i := 0; i < 2; i++ {
+			_, err = node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+				VolumeId:          volumeID,
+				PublishContext:    pub.GetPublishContext(),
+				StagingTargetPath: plugin.stagingPath,
+				TargetPath:        plugin.targetPath,
+				VolumeCapability:  mountCapability(),
+				VolumeContext:     volume.GetVolumeContext(),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		Ω(plugin.mounter.mounted(plugin.targetPath)).Should(BeTrue())
+
+		// Unpublishing and unstaging twice must succeed
+		for i := 0; i < 2; i++ {
+			_, err = node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   volumeID,
+				TargetPath: plugin.targetPath,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		for i := 0; i < 2; i++ {
+			_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+				VolumeId:          volumeID,
+				StagingTargetPath: plugin.stagingPath,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		Ω(plugin.mounter.mounted(plugin.stagingPath)).Should(BeFalse())
+
+		_, err = controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   plugin.nodeID,
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+})
+
+var _ = AfterSuite(func() {
+	if sanityInstance != nil {
+		sanityInstance.cleanup()
+	}
+})
+
+// sanityPlugin is the plugin served against vcsim for the sanity specs.
+type sanityPlugin struct {
+	conn        *grpc.ClientConn
+	mounter     *fakeMounter
+	nodeID      string
+	stagingPath string
+	targetPath  string
+	// cleanup stops vcsim, removes the temporary directory and restores
+	// the environment
+	cleanup func()
+}
+
+var (
+	sanityInstance   *sanityPlugin
+	onceForSanity    sync.Once
+	sanityClusterID  = "sanity-cluster"
+	sanityAPIVersion = "6.7.3"
+)
+
+// getSanityPlugin starts vcsim and serves the full plugin once per test
+// process, as the Kubernetes informers of the controller can only be set
+// up once.
+func getSanityPlugin() *sanityPlugin {
+	onceForSanity.Do(func() {
+		// The controller requires vCenter 6.7u3
+		vpx.ServiceContent.About.ApiVersion = sanityAPIVersion
+		model := simulator.VPX()
+		Ω(model.Create()).Should(Succeed())
+		model.Service.RegisterSDK(cnssim.New())
+		model.Service.RegisterSDK(pbmsim.New())
+		model.Service.TLS = new(tls.Config)
+		s := model.Service.NewServer()
+
+		dir, err := ioutil.TempDir("", "csi-sanity")
+		Ω(err).ShouldNot(HaveOccurred())
+		cloudConfig, cloudConfigSet := os.LookupEnv(cnsconfig.EnvCloudConfig)
+		cleanup := func() {
+			if cloudConfigSet {
+				os.Setenv(cnsconfig.EnvCloudConfig, cloudConfig)
+			} else {
+				os.Unsetenv(cnsconfig.EnvCloudConfig)
+			}
+			os.RemoveAll(dir)
+			s.Close()
+			model.Remove()
+		}
+		password, _ := s.URL.User.Password()
+		cfgPath := filepath.Join(dir, "csi-vsphere.conf")
+		cfg := fmt.Sprintf("[Global]\ncluster-id = %q\ninsecure-flag = \"true\"\n\n"+
+			"[VirtualCenter %q]\nuser = %q\npassword = %q\nport = %q\ndatacenters = \"DC0\"\n",
+			sanityClusterID, s.URL.Hostname(), s.URL.User.Username(), password, s.URL.Port())
+		Ω(ioutil.WriteFile(cfgPath, []byte(cfg), 0600)).Should(Succeed())
+		Ω(os.Setenv(cnsconfig.EnvCloudConfig, cfgPath)).Should(Succeed())
+
+		// The node VM is registered through the Kubernetes Node object
+		nodeID, err := os.Hostname()
+		Ω(err).ShouldNot(HaveOccurred())
+		vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+		k8sClient := testclient.NewSimpleClientset(&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: nodeID},
+			Spec:       v1.NodeSpec{ProviderID: common.ProviderPrefix + vm.Config.Uuid},
+		})
+
+		mounter := newFakeMounter()
+		sp := provider.NewWithService(service.NewWithMounter(mounter, k8sClient))
+		// csi-sanity only dials unix sockets, so the plugin is served on one
+		// instead of a memory pipe
+		socketPath := filepath.Join(dir, "csi.sock")
+		lis, err := net.Listen("unix", socketPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			if err := sp.Serve(context.Background(), lis); err != nil {
+				Ω(err.Error()).Should(Equal("http: Server closed"))
+			}
+		}()
+		conn, err := grpc.DialContext(context.Background(), "", grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			}))
+		Ω(err).ShouldNot(HaveOccurred())
+		sanityConfig.Address = "unix://" + socketPath
+		sanityConfig.TargetPath = filepath.Join(dir, "sanity-target")
+		sanityConfig.StagingPath = filepath.Join(dir, "sanity-staging")
+		// Wait for the Node informer to register the node VM
+		_, err = csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Eventually(func() error {
+			_, err := cnsnode.GetManager().GetNodeByName(nodeID)
+			return err
+		}, 10*time.Second).Should(Succeed())
+
+		// Staging paths are created by the CO, target paths by the plugin
+		stagingPath := filepath.Join(dir, "staging")
+		Ω(os.Mkdir(stagingPath, 0750)).Should(Succeed())
+		sanityInstance = &sanityPlugin{
+			conn:        conn,
+			mounter:     mounter,
+			nodeID:      nodeID,
+			stagingPath: stagingPath,
+			targetPath:  filepath.Join(dir, "target"),
+			cleanup:     cleanup,
+		}
+	})
+	return sanityInstance
+}
+
+// fakeMounter is an in-memory Mounter. Every disk appears attached to the
+// node as a block device named after its ID.
+type fakeMounter struct {
+	lock   sync.Mutex
+	mounts []gofsutil.Info
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{}
+}
+
+func (m *fakeMounter) FormatAndMount(ctx context.Context, source, target, fsType string, opts ...string) error {
+	return m.Mount(ctx, source, target, fsType, opts...)
+}
+
+func (m *fakeMounter) Mount(ctx context.Context, source, target, fsType string, opts ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.mounts = append(m.mounts, gofsutil.Info{
+		Device: source,
+		Path:   target,
+		Source: source,
+		Type:   fsType,
+		Opts:   mountOpts(opts),
+	})
+	return nil
+}
+
+func (m *fakeMounter) BindMount(ctx context.Context, source, target string, opts ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// A bind mount shows the device of the mount of its source
+	device := source
+	for _, mnt := range m.mounts {
+		if mnt.Path == source {
+			device = mnt.Device
+		}
+	}
+	m.mounts = append(m.mounts, gofsutil.Info{
+		Device: device,
+		Path:   target,
+		Source: source,
+		Opts:   mountOpts(opts),
+	})
+	return nil
+}
+
+func (m *fakeMounter) Unmount(ctx context.Context, target string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, mnt := range m.mounts {
+		if mnt.Path == target {
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *fakeMounter) GetMounts(ctx context.Context) ([]gofsutil.Info, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]gofsutil.Info(nil), m.mounts...), nil
+}
+
+func (m *fakeMounter) GetDevMounts(ctx context.Context, dev string) ([]gofsutil.Info, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var mounts []gofsutil.Info
+	for _, mnt := range m.mounts {
+		if mnt.Device == dev {
+			mounts = append(mounts, mnt)
+		}
+	}
+	return mounts, nil
+}
+
+func (m *fakeMounter) GetDiskPath(id string) (string, error) {
+	return "/dev/disk/by-id/wwn-0x" + id, nil
+}
+
+func (m *fakeMounter) GetDevice(path string) (*service.Device, error) {
+	return &service.Device{
+		FullPath: path,
+		Name:     filepath.Base(path),
+		RealDev:  path,
+	}, nil
+}
+
+// mounted returns true if something is mounted to target.
+func (m *fakeMounter) mounted(target string) bool {
+	mounts, _ := m.GetMounts(context.Background())
+	for _, mnt := range mounts {
+		if mnt.Path == target {
+			return true
+		}
+	}
+	return false
+}
+
+// mountOpts returns opts with "rw" added unless the mount is read-only.
+func mountOpts(opts []string) []string {
+	for _, opt := range opts {
+		if strings.TrimSpace(opt) == "ro" {
+			return opts
+		}
+	}
+	return append([]string{"rw"}, opts...)
+}
@@ -19,6 +19,7 @@ package types
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/health"
 )
 
 // Controller is the interface for the CSI Controller Server plus extra methods
@@ -26,4 +27,13 @@ import (
 type Controller interface {
 	csi.ControllerServer
 	Init(config *config.Config) error
+	// ReloadConfig applies a changed configuration to the initialized
+	// controller without restarting it.
+	ReloadConfig(config *config.Config) error
+	// LivenessChecks returns the checks which fail when the controller
+	// cannot recover without a restart.
+	LivenessChecks() []health.Check
+	// ReadinessChecks returns the checks which must pass for the controller
+	// to serve requests.
+	ReadinessChecks() []health.Check
 }
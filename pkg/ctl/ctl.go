@@ -0,0 +1,421 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+// ErrVolumeNotFound is returned when neither a CNS volume nor a PV matches
+// the given volume ID or PV name.
+var ErrVolumeNotFound = errors.New("volume not found")
+
+// ErrUnsafeDetach is returned when a detach is refused by the safety checks.
+var ErrUnsafeDetach = errors.New("detach is not safe")
+
+// Tool inspects and repairs the CNS volumes of a Kubernetes cluster.
+type Tool struct {
+	// ClusterID is the cluster ID the CNS volumes are tagged with.
+	ClusterID string
+	// ContainerCluster is set on the metadata updated by Resync.
+	ContainerCluster cnstypes.CnsContainerCluster
+	VolumeManager    cnsvolume.Manager
+	K8sClient        clientset.Interface
+	// NodeVM returns the VM of a Kubernetes node.
+	NodeVM func(ctx context.Context, node *v1.Node) (*cnsvsphere.VirtualMachine, error)
+	// Metadata selects the labels the syncer propagates into CNS.
+	Metadata cnsconfig.MetadataConfig
+}
+
+// VolumeInfo is a CNS volume joined with its Kubernetes objects. CNS is nil
+// for a PV without CNS volume, PV is nil for a CNS volume without PV.
+type VolumeInfo struct {
+	VolumeID string
+	CNS      *cnstypes.CnsVolume
+	PV       *v1.PersistentVolume
+	PVC      *v1.PersistentVolumeClaim
+	// Pods are the running pods using the PVC.
+	Pods []*v1.Pod
+	// Attachments are the VolumeAttachments of the PV.
+	Attachments []*storagev1.VolumeAttachment
+	// AttachedVMs are the nodes whose VM has the disk attached in vCenter.
+	// It is set by Show only.
+	AttachedVMs []string
+	// PVLabels and PVCLabels are the labels the syncer propagates into CNS.
+	PVLabels  map[string]string
+	PVCLabels map[string]string
+}
+
+// Datastore returns the URL of the datastore of the volume.
+func (info *VolumeInfo) Datastore() string {
+	if info.CNS == nil {
+		return ""
+	}
+	return info.CNS.DatastoreUrl
+}
+
+// AttachedNodes returns the nodes of the VolumeAttachments of the volume.
+func (info *VolumeInfo) AttachedNodes() []string {
+	var nodes []string
+	for _, va := range info.Attachments {
+		if va.Status.Attached {
+			nodes = append(nodes, va.Spec.NodeName)
+		}
+	}
+	return nodes
+}
+
+// ListVolumes returns the CNS volumes of the cluster and the PVs of the
+// driver, joined by volume ID and sorted by volume ID.
+func (t *Tool) ListVolumes(ctx context.Context) ([]*VolumeInfo, error) {
+	res, err := t.VolumeManager.QueryAllVolume(cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{t.ClusterID},
+	}, cnstypes.CnsQuerySelection{})
+	if err != nil {
+		klog.Errorf("Failed to query CNS volumes of cluster %q. Err: %v", t.ClusterID, err)
+		return nil, err
+	}
+	volumes := make(map[string]*VolumeInfo)
+	for i := range res.Volumes {
+		id := res.Volumes[i].VolumeId.Id
+		volumes[id] = &VolumeInfo{VolumeID: id, CNS: &res.Volumes[i]}
+	}
+
+	pvs, err := t.K8sClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Failed to list PVs. Err: %v", err)
+		return nil, err
+	}
+	pods, err := t.K8sClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Failed to list pods. Err: %v", err)
+		return nil, err
+	}
+	attachments, err := t.K8sClient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Failed to list VolumeAttachments. Err: %v", err)
+		return nil, err
+	}
+
+	namespaceLabels := make(map[string]map[string]string)
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+			continue
+		}
+		info, ok := volumes[pv.Spec.CSI.VolumeHandle]
+		if !ok {
+			info = &VolumeInfo{VolumeID: pv.Spec.CSI.VolumeHandle}
+			volumes[info.VolumeID] = info
+		}
+		info.PV = pv
+		info.PVLabels = t.Metadata.Labels(pv.Labels, pv.Annotations, nil)
+		if pv.Spec.ClaimRef != nil && pv.Status.Phase == v1.VolumeBound {
+			pvc, err := t.K8sClient.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Get(pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+			if err != nil {
+				klog.Warningf("Failed to get PVC %s/%s of PV %s. Err: %v", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, pv.Name, err)
+			} else {
+				info.PVC = pvc
+				info.PVCLabels = t.Metadata.Labels(pvc.Labels, pvc.Annotations, t.namespaceLabels(pvc.Namespace, namespaceLabels))
+				info.Pods = podsUsingClaim(pods.Items, pvc)
+			}
+		}
+		for j := range attachments.Items {
+			va := &attachments.Items[j]
+			if va.Spec.Attacher == service.Name && va.Spec.Source.PersistentVolumeName != nil &&
+				*va.Spec.Source.PersistentVolumeName == pv.Name {
+				info.Attachments = append(info.Attachments, va)
+			}
+		}
+	}
+
+	infos := make([]*VolumeInfo, 0, len(volumes))
+	for _, info := range volumes {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].VolumeID < infos[j].VolumeID })
+	return infos, nil
+}
+
+// namespaceLabels returns the labels of the namespace propagated by the
+// syncer, caching them in cache.
+func (t *Tool) namespaceLabels(name string, cache map[string]map[string]string) map[string]string {
+	if !t.Metadata.NamespaceLabels {
+		return nil
+	}
+	if labels, ok := cache[name]; ok {
+		return labels
+	}
+	namespace, err := t.K8sClient.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("Failed to get namespace %s. Err: %v", name, err)
+		return nil
+	}
+	cache[name] = namespace.Labels
+	return namespace.Labels
+}
+
+// podsUsingClaim returns the running pods using the PVC.
+func podsUsingClaim(pods []v1.Pod, pvc *v1.PersistentVolumeClaim) []*v1.Pod {
+	var result []*v1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Namespace != pvc.Namespace || pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvc.Name {
+				result = append(result, pod)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// GetVolume returns the volume with the given volume ID or PV name.
+func (t *Tool) GetVolume(ctx context.Context, name string) (*VolumeInfo, error) {
+	infos, err := t.ListVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.VolumeID == name || (info.PV != nil && info.PV.Name == name) {
+			return info, nil
+		}
+	}
+	return nil, ErrVolumeNotFound
+}
+
+// Show returns the volume with the given volume ID or PV name, with the
+// nodes whose VM has the disk attached in vCenter.
+func (t *Tool) Show(ctx context.Context, name string) (*VolumeInfo, error) {
+	info, err := t.GetVolume(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if t.NodeVM == nil {
+		return info, nil
+	}
+	nodes, err := t.K8sClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Failed to list nodes. Err: %v", err)
+		return nil, err
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		vm, err := t.NodeVM(ctx, node)
+		if err != nil {
+			klog.Warningf("Failed to get the VM of node %s. Err: %v", node.Name, err)
+			continue
+		}
+		diskUUID, err := cnsvolume.GetDiskAttachedToVM(ctx, vm, info.VolumeID)
+		if err != nil {
+			klog.Warningf("Failed to get the disks of node %s. Err: %v", node.Name, err)
+			continue
+		}
+		if diskUUID != "" {
+			info.AttachedVMs = append(info.AttachedVMs, node.Name)
+		}
+	}
+	return info, nil
+}
+
+// MetadataDiff is a difference between the CNS metadata of a volume and
+// the Kubernetes objects.
+type MetadataDiff struct {
+	// EntityType, Namespace and Name identify the entity.
+	EntityType string
+	Namespace  string
+	Name       string
+	// Kubernetes and CNS are the labels of the entity, nil if it is missing.
+	Kubernetes map[string]string
+	CNS        map[string]string
+}
+
+// String returns the difference as "+" for an entity missing in CNS, "-"
+// for a stale entity in CNS, or "~" for different labels.
+func (d MetadataDiff) String() string {
+	entity := fmt.Sprintf("%s %s", d.EntityType, d.Name)
+	if d.Namespace != "" {
+		entity = fmt.Sprintf("%s %s/%s", d.EntityType, d.Namespace, d.Name)
+	}
+	switch {
+	case d.CNS == nil:
+		return fmt.Sprintf("+ %s labels %v", entity, d.Kubernetes)
+	case d.Kubernetes == nil:
+		return fmt.Sprintf("- %s labels %v", entity, d.CNS)
+	default:
+		return fmt.Sprintf("~ %s labels %v in Kubernetes, %v in CNS", entity, d.Kubernetes, d.CNS)
+	}
+}
+
+// Diff returns the differences between the CNS metadata of the volume and
+// the metadata the syncer builds from its PV, PVC and pods.
+func Diff(info *VolumeInfo) []MetadataDiff {
+	expected := make(map[string]*cnstypes.CnsKubernetesEntityMetadata)
+	for _, metadata := range expectedMetadata(info) {
+		expected[entityKey(metadata)] = metadata
+	}
+	actual := make(map[string]*cnstypes.CnsKubernetesEntityMetadata)
+	if info.CNS != nil {
+		for _, base := range info.CNS.Metadata.EntityMetadata {
+			if metadata, ok := base.(*cnstypes.CnsKubernetesEntityMetadata); ok {
+				actual[entityKey(metadata)] = metadata
+			}
+		}
+	}
+	var diffs []MetadataDiff
+	for key, want := range expected {
+		got, ok := actual[key]
+		diff := MetadataDiff{
+			EntityType: want.EntityType,
+			Namespace:  want.Namespace,
+			Name:       want.EntityName,
+			Kubernetes: cnsvsphere.GetLabelsMapFromKeyValue(want.Labels),
+		}
+		if !ok {
+			diffs = append(diffs, diff)
+			continue
+		}
+		diff.CNS = cnsvsphere.GetLabelsMapFromKeyValue(got.Labels)
+		if !reflect.DeepEqual(diff.Kubernetes, diff.CNS) {
+			diffs = append(diffs, diff)
+		}
+	}
+	for key, got := range actual {
+		if _, ok := expected[key]; !ok {
+			diffs = append(diffs, MetadataDiff{
+				EntityType: got.EntityType,
+				Namespace:  got.Namespace,
+				Name:       got.EntityName,
+				CNS:        cnsvsphere.GetLabelsMapFromKeyValue(got.Labels),
+			})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].String() < diffs[j].String() })
+	return diffs
+}
+
+// expectedMetadata returns the CNS metadata of the PV, PVC and pods of the
+// volume.
+func expectedMetadata(info *VolumeInfo) []*cnstypes.CnsKubernetesEntityMetadata {
+	if info.PV == nil {
+		return nil
+	}
+	metadata := []*cnstypes.CnsKubernetesEntityMetadata{
+		cnsvsphere.GetCnsKubernetesEntityMetaData(info.PV.Name, info.PVLabels, false, string(cnstypes.CnsKubernetesEntityTypePV), info.PV.Namespace),
+	}
+	if info.PVC != nil {
+		metadata = append(metadata, cnsvsphere.GetCnsKubernetesEntityMetaData(info.PVC.Name, info.PVCLabels, false, string(cnstypes.CnsKubernetesEntityTypePVC), info.PVC.Namespace))
+	}
+	for _, pod := range info.Pods {
+		metadata = append(metadata, cnsvsphere.GetCnsKubernetesEntityMetaData(pod.Name, nil, false, string(cnstypes.CnsKubernetesEntityTypePOD), pod.Namespace))
+	}
+	return metadata
+}
+
+// entityKey identifies an entity in the metadata of a volume.
+func entityKey(metadata *cnstypes.CnsKubernetesEntityMetadata) string {
+	return metadata.EntityType + "/" + metadata.Namespace + "/" + metadata.EntityName
+}
+
+// Resync updates the CNS metadata of the volume with the given volume ID or
+// PV name from Kubernetes and returns the differences it fixed.
+func (t *Tool) Resync(ctx context.Context, name string) ([]MetadataDiff, error) {
+	info, err := t.GetVolume(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.PV == nil || info.CNS == nil {
+		return nil, fmt.Errorf("volume %s must have both a PV and a CNS volume to be resynced", info.VolumeID)
+	}
+	diffs := Diff(info)
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+	var metadataList []cnstypes.BaseCnsEntityMetadata
+	for _, diff := range diffs {
+		labels, deleteFlag := diff.Kubernetes, false
+		if diff.Kubernetes == nil {
+			labels, deleteFlag = nil, true
+		}
+		metadataList = append(metadataList, cnsvsphere.GetCnsKubernetesEntityMetaData(diff.Name, labels, deleteFlag, diff.EntityType, diff.Namespace))
+	}
+	spec := &cnstypes.CnsVolumeMetadataUpdateSpec{
+		VolumeId: cnstypes.CnsVolumeId{Id: info.VolumeID},
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster: t.ContainerCluster,
+			EntityMetadata:   metadataList,
+		},
+	}
+	if err = t.VolumeManager.UpdateVolumeMetadata(spec); err != nil {
+		klog.Errorf("Failed to update the metadata of volume %s. Err: %v", info.VolumeID, err)
+		return nil, err
+	}
+	return diffs, nil
+}
+
+// Detach detaches the volume with the given volume ID or PV name from the VM
+// of the node. Unless force is set, the detach is refused with
+// ErrUnsafeDetach while a running pod on the node uses the volume or a
+// VolumeAttachment of the volume to the node exists and is not deleted.
+func (t *Tool) Detach(ctx context.Context, name string, nodeName string, force bool) error {
+	info, err := t.GetVolume(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !force {
+		for _, pod := range info.Pods {
+			if pod.Spec.NodeName == nodeName {
+				return fmt.Errorf("%v: pod %s/%s on node %s uses volume %s", ErrUnsafeDetach, pod.Namespace, pod.Name, nodeName, info.VolumeID)
+			}
+		}
+		for _, va := range info.Attachments {
+			if va.Spec.NodeName == nodeName && va.DeletionTimestamp == nil {
+				return fmt.Errorf("%v: VolumeAttachment %s attaches volume %s to node %s", ErrUnsafeDetach, va.Name, info.VolumeID, nodeName)
+			}
+		}
+	}
+	node, err := t.K8sClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Failed to get node %s. Err: %v", nodeName, err)
+		return err
+	}
+	vm, err := t.NodeVM(ctx, node)
+	if err != nil {
+		klog.Errorf("Failed to get the VM of node %s. Err: %v", nodeName, err)
+		return err
+	}
+	return t.VolumeManager.DetachVolume(vm, info.VolumeID)
+}
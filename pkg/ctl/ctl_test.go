@@ -0,0 +1,164 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ctl
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/object"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	cnsfake "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume/fake"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+const testClusterID = "test-cluster"
+
+func TestTool(t *testing.T) {
+	ctx := context.Background()
+	manager := cnsfake.NewManager()
+	cluster := cnsvsphere.GetContainerCluster(testClusterID, "user")
+	volumeID, err := manager.CreateVolume(&cnstypes.CnsVolumeCreateSpec{
+		Name:       "pvc-1",
+		VolumeType: "BLOCK",
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster: cluster,
+			EntityMetadata: []cnstypes.BaseCnsEntityMetadata{
+				cnsvsphere.GetCnsKubernetesEntityMetaData("stale-pod", nil, false, string(cnstypes.CnsKubernetesEntityTypePOD), "default"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.CreateVolume(&cnstypes.CnsVolumeCreateSpec{
+		Name:     "other-cluster",
+		Metadata: cnstypes.CnsVolumeMetadata{ContainerCluster: cnsvsphere.GetContainerCluster("other", "user")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	vm := &cnsvsphere.VirtualMachine{
+		VirtualMachine: object.NewVirtualMachine(nil, vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}),
+	}
+	if _, err = manager.AttachVolume(vm, volumeID.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	pvName := "pv-1"
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: pvName, Labels: map[string]string{"app": "db"}},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: volumeID.Id},
+				},
+				ClaimRef: &v1.ObjectReference{Namespace: "default", Name: "claim-1"},
+			},
+			Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+		},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-without-volume"},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: "missing"},
+				},
+			},
+		},
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-1"}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod-1"},
+			Spec: v1.PodSpec{
+				NodeName: "node-1",
+				Volumes: []v1.Volume{{
+					Name:         "data",
+					VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "claim-1"}},
+				}},
+			},
+			Status: v1.PodStatus{Phase: v1.PodRunning},
+		},
+		&storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: service.Name,
+				NodeName: "node-1",
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			},
+			Status: storagev1.VolumeAttachmentStatus{Attached: true},
+		},
+	)
+	tool := &Tool{
+		ClusterID:        testClusterID,
+		ContainerCluster: cluster,
+		VolumeManager:    manager,
+		K8sClient:        client,
+		NodeVM: func(ctx context.Context, node *v1.Node) (*cnsvsphere.VirtualMachine, error) {
+			return vm, nil
+		},
+	}
+
+	infos, err := tool.ListVolumes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("Expected the volume of the cluster and the PV without volume, got %d volumes", len(infos))
+	}
+	info, err := tool.GetVolume(ctx, pvName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CNS == nil || info.PVC == nil || len(info.Pods) != 1 || info.Datastore() != cnsfake.DefaultDatastoreURL {
+		t.Errorf("Volume %s is not joined with its Kubernetes objects: %+v", pvName, info)
+	}
+	if nodes := info.AttachedNodes(); len(nodes) != 1 || nodes[0] != "node-1" {
+		t.Errorf("Expected volume %s attached to node-1, got %v", pvName, nodes)
+	}
+
+	// PV, PVC and pod are missing in CNS, the stale pod is removed
+	if diffs := Diff(info); len(diffs) != 4 {
+		t.Errorf("Expected 4 differences, got %v", diffs)
+	}
+	if _, err = tool.Resync(ctx, volumeID.Id); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = tool.GetVolume(ctx, volumeID.Id); err != nil {
+		t.Fatal(err)
+	}
+	if diffs := Diff(info); len(diffs) != 0 {
+		t.Errorf("Expected no differences after resync, got %v", diffs)
+	}
+
+	err = tool.Detach(ctx, pvName, "node-1", false)
+	if err == nil || !strings.Contains(err.Error(), ErrUnsafeDetach.Error()) {
+		t.Errorf("Expected detach to be refused, got %v", err)
+	}
+	if err = tool.Detach(ctx, pvName, "node-1", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, attached := manager.AttachedTo(volumeID.Id); attached {
+		t.Errorf("Expected volume %s to be detached", volumeID.Id)
+	}
+}
@@ -91,6 +91,19 @@ func (im *InformerManager) AddPodListener(add func(obj interface{}), update func
 	})
 }
 
+// AddNamespaceListener hooks up add, update, delete callbacks
+func (im *InformerManager) AddNamespaceListener(add func(obj interface{}), update func(oldObj, newObj interface{}), remove func(obj interface{})) {
+	if im.namespaceInformer == nil {
+		im.namespaceInformer = im.informerFactory.Core().V1().Namespaces().Informer()
+	}
+
+	im.namespaceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    add,
+		UpdateFunc: update,
+		DeleteFunc: remove,
+	})
+}
+
 // GetPVLister returns Persistent Volume Lister for the calling informer manager
 func (im *InformerManager) GetPVLister() corelisters.PersistentVolumeLister {
 	return im.informerFactory.Core().V1().PersistentVolumes().Lister()
@@ -101,6 +114,22 @@ func (im *InformerManager) GetPVCLister() corelisters.PersistentVolumeClaimListe
 	return im.informerFactory.Core().V1().PersistentVolumeClaims().Lister()
 }
 
+// GetNamespaceLister returns Namespace Lister for the calling informer manager
+func (im *InformerManager) GetNamespaceLister() corelisters.NamespaceLister {
+	return im.informerFactory.Core().V1().Namespaces().Lister()
+}
+
+// HasSynced returns true once the caches of all informers with registered
+// listeners have been populated.
+func (im *InformerManager) HasSynced() bool {
+	for _, informer := range []cache.SharedInformer{im.nodeInformer, im.pvInformer, im.pvcInformer, im.podInformer, im.namespaceInformer} {
+		if informer != nil && !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
 // Listen starts the Informers
 func (im *InformerManager) Listen() (stopCh <-chan struct{}) {
 	go im.informerFactory.Start(im.stopCh)
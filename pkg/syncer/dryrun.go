@@ -0,0 +1,191 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+const (
+	// fullSyncPlanName is the name of the ConfigMap the operations planned
+	// by full sync are published in when running dry
+	fullSyncPlanName = "vsphere-csi-full-sync-plan"
+	// fullSyncPlanKey is the key of the planned operations in the ConfigMap
+	fullSyncPlanKey = "plan.yaml"
+	// fullSyncPlanTimeKey is the key of the time of the full sync
+	fullSyncPlanTimeKey = "lastFullSyncTime"
+
+	// Operations which are only performed if still needed in the next cycle
+	pendingCreateVolumeOperation = "pendingCreateVolume"
+	pendingDeleteVolumeOperation = "pendingDeleteVolume"
+	// Delete the volume from CNS, keeping its disk
+	deleteVolumeOperation = "deleteVolume"
+	// Delete an orphan volume after the reclaim period
+	reclaimOrphanVolumeOperation = "reclaimOrphanVolume"
+	// Only report an orphan volume
+	keepOrphanVolumeOperation = "keepOrphanVolume"
+)
+
+// plannedOperation is a CNS operation full sync performs on a volume.
+type plannedOperation struct {
+	VolumeID  string `json:"volumeID"`
+	PV        string `json:"pv,omitempty"`
+	Operation string `json:"operation"`
+	Reason    string `json:"reason"`
+}
+
+// SetDryRun sets whether the syncer only logs and reports the CNS operations
+// instead of performing them. It must be called before Init.
+func (metadataSyncer *MetadataSyncInformer) SetDryRun(dryRun bool) {
+	metadataSyncer.dryRun = dryRun
+}
+
+// buildFullSyncPlan returns the operations full sync performs in this cycle
+// and the ones it performs in the next cycle if they are still needed,
+// sorted by volume ID.
+func buildFullSyncPlan(pvList []*v1.PersistentVolume, k8sPVMap map[string]string, cnsVolumeList []cnstypes.CnsVolume, volToBeDeleted []cnstypes.CnsVolumeId, metadataSyncer *MetadataSyncInformer) []plannedOperation {
+	var plan []plannedOperation
+	for _, pv := range pvList {
+		volumeID := pv.Spec.CSI.VolumeHandle
+		operation := k8sPVMap[volumeID]
+		var reason string
+		switch operation {
+		case createVolumeOperation:
+			reason = "PV is missing in CNS for two full sync cycles"
+		case updateVolumeOperation:
+			reason = "Kubernetes metadata of the PV, its PVC or pod differs from CNS"
+		case updateVolumeWithDeleteClaimOperation:
+			reason = fmt.Sprintf("PV is not bound but CNS has PVC %s/%s", metadataSyncer.cnsVolumeToEntityNamespaceMap[pv.Name], metadataSyncer.cnsVolumeToPvcMap[pv.Name])
+		case updateVolumeWithDeletePodOperation:
+			reason = fmt.Sprintf("PVC is not used by a running pod but CNS has pod %s/%s", metadataSyncer.cnsVolumeToEntityNamespaceMap[pv.Name], metadataSyncer.cnsVolumeToPodMap[pv.Name])
+		default:
+			if !metadataSyncer.cnsCreationMap[volumeID] {
+				continue
+			}
+			operation = pendingCreateVolumeOperation
+			reason = "PV is missing in CNS, it is created if still missing in the next full sync cycle"
+		}
+		plan = append(plan, plannedOperation{VolumeID: volumeID, PV: pv.Name, Operation: operation, Reason: reason})
+	}
+	toBeDeleted := make(map[string]bool)
+	for _, volumeID := range volToBeDeleted {
+		toBeDeleted[volumeID.Id] = true
+		plan = append(plan, plannedOperation{
+			VolumeID:  volumeID.Id,
+			Operation: deleteVolumeOperation,
+			Reason:    "CNS volume of the cluster has no PV for two full sync cycles",
+		})
+	}
+	for _, vol := range cnsVolumeList {
+		if _, existsInK8s := k8sPVMap[vol.VolumeId.Id]; !existsInK8s && !toBeDeleted[vol.VolumeId.Id] && metadataSyncer.cnsDeletionMap[vol.VolumeId.Id] > 0 {
+			plan = append(plan, plannedOperation{
+				VolumeID:  vol.VolumeId.Id,
+				Operation: pendingDeleteVolumeOperation,
+				Reason:    "CNS volume of the cluster has no PV, it is deleted if still missing in the next full sync cycle",
+			})
+		}
+	}
+	return sortPlan(plan)
+}
+
+// sortPlan sorts the planned operations by volume ID, keeping the order of
+// the operations of a volume.
+func sortPlan(plan []plannedOperation) []plannedOperation {
+	sort.SliceStable(plan, func(i, j int) bool { return plan[i].VolumeID < plan[j].VolumeID })
+	return plan
+}
+
+// publishFullSyncPlan logs the planned operations and publishes them in the
+// full sync plan ConfigMap.
+func publishFullSyncPlan(k8sclient clientset.Interface, plan []plannedOperation) {
+	for _, op := range plan {
+		klog.Infof("FullSync: dry run, planned %s for volume %s (PV %q): %s", op.Operation, op.VolumeID, op.PV, op.Reason)
+	}
+	klog.Infof("FullSync: dry run, %d operations planned", len(plan))
+	report, err := yaml.Marshal(plan)
+	if err != nil {
+		klog.Warningf("FullSync: failed to marshal the plan. Err: %v", err)
+		return
+	}
+	namespace := podNamespace()
+	if err = applyConfigMap(k8sclient, namespace, fullSyncPlanName, map[string]string{
+		fullSyncPlanKey:     string(report),
+		fullSyncPlanTimeKey: time.Now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		klog.Warningf("FullSync: failed to publish the plan in %s/%s. Err: %v", namespace, fullSyncPlanName, err)
+	}
+}
+
+// dryRunManager is a volumes.Manager which logs the CNS writes instead of
+// performing them. Queries are performed.
+type dryRunManager struct {
+	volumes.Manager
+}
+
+// newDryRunManager returns a Manager which only performs the queries of the
+// given manager.
+func newDryRunManager(manager volumes.Manager) volumes.Manager {
+	return &dryRunManager{Manager: manager}
+}
+
+func (m *dryRunManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+	klog.Infof("DryRun: skipped CreateVolume for volume %s with spec %+v", spec.Name, spew.Sdump(spec))
+	volumeID := &cnstypes.CnsVolumeId{}
+	if backing, ok := spec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails); ok {
+		volumeID.Id = backing.BackingDiskId
+	}
+	return volumeID, nil
+}
+
+func (m *dryRunManager) AttachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) (string, error) {
+	klog.Infof("DryRun: skipped AttachVolume for volume %s to VM %v", volumeID, vm)
+	return "", nil
+}
+
+func (m *dryRunManager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) error {
+	klog.Infof("DryRun: skipped DetachVolume for volume %s from VM %v", volumeID, vm)
+	return nil
+}
+
+func (m *dryRunManager) DeleteVolume(volumeID string, deleteDisk bool) error {
+	klog.Infof("DryRun: skipped DeleteVolume for volume %s with delete disk %v", volumeID, deleteDisk)
+	return nil
+}
+
+func (m *dryRunManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpdateSpec) error {
+	klog.Infof("DryRun: skipped UpdateVolumeMetadata for volume %s with spec %+v", spec.VolumeId.Id, spew.Sdump(spec))
+	return nil
+}
+
+func (m *dryRunManager) UpdateVolumeMetadataBatch(specs []*cnstypes.CnsVolumeMetadataUpdateSpec) []error {
+	for _, spec := range specs {
+		klog.Infof("DryRun: skipped UpdateVolumeMetadata for volume %s with spec %+v", spec.VolumeId.Id, spew.Sdump(spec))
+	}
+	return make([]error, len(specs))
+}
@@ -17,17 +17,20 @@ limitations under the License.
 package syncer
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
-	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
@@ -36,11 +39,14 @@ import (
 // triggerFullSync triggers full sync
 func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
 	klog.V(2).Infof("FullSync: start")
+	status := &fullSyncStatus{startTime: time.Now()}
+	defer metadataSyncer.publishFullSyncStatus(k8sclient, status)
 
 	// Get K8s PVs in State "Bound", "Available" or "Released"
 	k8sPVs, err := getPVsInBoundAvailableOrReleased(k8sclient)
 	if err != nil {
 		klog.Warningf("FullSync: Failed to get PVs from kubernetes. Err: %v", err)
+		status.setError(err)
 		return
 	}
 
@@ -53,29 +59,41 @@ func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSync
 	//Call CNS QueryAll to get container volumes by cluster ID
 	queryFilter := cnstypes.CnsQueryFilter{
 		ContainerClusterIds: []string{
-			metadataSyncer.cfg.Global.ClusterID,
+			metadataSyncer.config().Global.ClusterID,
 		},
 	}
 	querySelection := cnstypes.CnsQuerySelection{}
-	queryAllResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryAllVolume(queryFilter, querySelection)
+	queryAllResult, err := metadataSyncer.volumeManager.QueryAllVolume(queryFilter, querySelection)
 	if err != nil {
 		klog.Warningf("FullSync: failed to queryAllVolume with err %v", err)
+		status.setError(err)
 		return
 	}
 	cnsVolumeArray := queryAllResult.Volumes
 
 	// Initialize CNS volume maps
-	cnsVolumeToPodMap = make(map[string]string)
-	cnsVolumeToPvcMap = make(map[string]string)
-	cnsVolumeToEntityNamespaceMap = make(map[string]string)
+	metadataSyncer.cnsVolumeToPodMap = make(map[string]string)
+	metadataSyncer.cnsVolumeToPvcMap = make(map[string]string)
+	metadataSyncer.cnsVolumeToEntityNamespaceMap = make(map[string]string)
 
 	// Map K8s PV's to the operation that needs to be performed on them
 	k8sPVsMap := buildVolumeMap(k8sPVs, cnsVolumeArray, pvToPVCMap, pvcToPodMap, metadataSyncer)
 	klog.V(4).Infof("FullSync: k8sPVMap %v", k8sPVsMap)
 
 	// Identify volumes to be created, updated and deleted
-	volToBeCreated, volToBeUpdated, volWithPvcEntryToBeDeleted, volWithPodEntryToBeDeleted := identifyVolumesToBeCreatedUpdated(k8sPVs, k8sPVsMap)
-	volToBeDeleted := identifyVolumesToBeDeleted(cnsVolumeArray, k8sPVsMap)
+	volToBeCreated, volToBeUpdated, volWithPvcEntryToBeDeleted, volWithPodEntryToBeDeleted := identifyVolumesToBeCreatedUpdated(k8sPVs, k8sPVsMap, metadataSyncer)
+	volToBeDeleted, volMissingInK8s := identifyVolumesToBeDeleted(cnsVolumeArray, k8sPVsMap, metadataSyncer)
+	if err = checkDeletionLimits(len(volToBeDeleted), len(cnsVolumeArray), metadataSyncer.fullSyncLimits); err != nil {
+		// An empty or partial PV list, for example from an API server
+		// glitch, must not wipe CNS nor count towards the confirmation
+		// cycles. Creations and updates still run.
+		klog.Errorf("FullSync: skipping the deletions of this cycle. Err: %v", err)
+		status.deletionsSkipped = true
+		status.setError(err)
+		volToBeDeleted = nil
+	} else {
+		countMissingVolumes(volMissingInK8s, metadataSyncer)
+	}
 
 	// Construct the cns spec for create and update operations
 	createSpecArray := constructCnsCreateSpec(volToBeCreated, pvToPVCMap, pvcToPodMap, metadataSyncer)
@@ -83,17 +101,36 @@ func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSync
 	updateSpecArray = append(updateSpecArray, constructCnsUpdateSpecWithPVCToBeDeleted(volWithPvcEntryToBeDeleted, metadataSyncer)...)
 	updateSpecArray = append(updateSpecArray, constructCnsUpdateSpecWithPodToBeDeleted(volWithPodEntryToBeDeleted, metadataSyncer)...)
 
+	if metadataSyncer.dryRun {
+		plan := buildFullSyncPlan(k8sPVs, k8sPVsMap, cnsVolumeArray, volToBeDeleted, metadataSyncer)
+		if metadataSyncer.orphanDetector != nil {
+			// Orphan volumes are detected and reported, but not reclaimed
+			metadataSyncer.orphanDetector.run(context.Background(), k8sclient, metadataSyncer)
+			plan = sortPlan(append(plan, metadataSyncer.orphanDetector.plan()...))
+		}
+		publishFullSyncPlan(k8sclient, plan)
+		cleanupCnsMaps(k8sPVsMap, metadataSyncer)
+		klog.V(2).Infof("FullSync: end of dry run")
+		return
+	}
+
+	klog.V(2).Infof("FullSync: %d volumes to create, %d to delete and %d to update with %d workers",
+		len(createSpecArray), len(volToBeDeleted), len(updateSpecArray), metadataSyncer.fullSyncWorkers)
+	pool := newFullSyncPool(metadataSyncer.fullSyncWorkers)
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 	// Perform operations
-	go fullSyncCreateVolumes(createSpecArray, metadataSyncer, k8sclient, &wg)
-	go fullSyncDeleteVolumes(volToBeDeleted, metadataSyncer, k8sclient, &wg)
-	go fullSyncUpdateVolumes(updateSpecArray, metadataSyncer, &wg)
+	go fullSyncCreateVolumes(createSpecArray, metadataSyncer, k8sclient, pool, status, &wg)
+	go fullSyncDeleteVolumes(volToBeDeleted, metadataSyncer, k8sclient, pool, status, &wg)
+	go fullSyncUpdateVolumes(updateSpecArray, metadataSyncer, pool, status, &wg)
 	wg.Wait()
 
-	cleanupCnsMaps(k8sPVsMap)
-	klog.V(4).Infof("FullSync: cnsDeletionMap at end of cycle: %v", cnsDeletionMap)
-	klog.V(4).Infof("FullSync: cnsCreationMap at end of cycle: %v", cnsCreationMap)
+	cleanupCnsMaps(k8sPVsMap, metadataSyncer)
+	klog.V(4).Infof("FullSync: cnsDeletionMap at end of cycle: %v", metadataSyncer.cnsDeletionMap)
+	klog.V(4).Infof("FullSync: cnsCreationMap at end of cycle: %v", metadataSyncer.cnsCreationMap)
+	if metadataSyncer.orphanDetector != nil {
+		metadataSyncer.orphanDetector.run(context.Background(), k8sclient, metadataSyncer)
+	}
 	klog.V(2).Infof("FullSync: end")
 }
 
@@ -108,7 +145,7 @@ func getPVsInBoundAvailableOrReleased(k8sclient clientset.Interface) ([]*v1.Pers
 	for index, pv := range allPVs.Items {
 		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == service.Name {
 			klog.V(4).Infof("FullSync: pv %v is in state %v", pv.Spec.CSI.VolumeHandle, pv.Status.Phase)
-			if pv.Status.Phase == v1.VolumeBound || pv.Status.Phase == v1.VolumeAvailable || pv.Status.Phase == v1.VolumeReleased {
+			if isPVInBoundAvailableOrReleased(&pv) {
 				pvsInDesiredState = append(pvsInDesiredState, &allPVs.Items[index])
 			}
 		}
@@ -116,97 +153,177 @@ func getPVsInBoundAvailableOrReleased(k8sclient clientset.Interface) ([]*v1.Pers
 	return pvsInDesiredState, nil
 }
 
+// isPVInBoundAvailableOrReleased returns true if the PV is in Bound, Available
+// or Released state
+func isPVInBoundAvailableOrReleased(pv *v1.PersistentVolume) bool {
+	return pv.Status.Phase == v1.VolumeBound || pv.Status.Phase == v1.VolumeAvailable || pv.Status.Phase == v1.VolumeReleased
+}
+
 // fullSyncCreateVolumes create volumes with given array of createSpec
-// Before creating a volume, all current K8s volumes are retrieved
-// If the volume is successfully created, it is removed from cnsCreationMap
-func fullSyncCreateVolumes(createSpecArray []cnstypes.CnsVolumeCreateSpec, metadataSyncer *MetadataSyncInformer, k8sclient clientset.Interface, wg *sync.WaitGroup) {
-	currentK8sPVMap := make(map[string]bool)
-	volumeOperationsLock.Lock()
-	defer volumeOperationsLock.Unlock()
-	// Get all K8s PVs
-	currentK8sPV, err := getPVsInBoundAvailableOrReleased(k8sclient)
-	if err != nil {
-		klog.Errorf("FullSync: fullSyncCreateVolumes failed to get PVs from kubernetes. Err: %v", err)
-		return
-	}
-	// Create map for easy lookup
-	for _, pv := range currentK8sPV {
-		currentK8sPVMap[pv.Spec.CSI.VolumeHandle] = true
-	}
-	for _, createSpec := range createSpecArray {
-		// Create volume if present in currentK8sPVMap
-		if createSpec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails) == nil {
+// Each volume is locked while its creation runs on the pool, and is only
+// created if its PV still exists and it is still missing in CNS, so that a
+// volume deleted or registered by the metadata syncer meanwhile is left alone
+// If the volume is created or no longer needs to be, it is removed from
+// cnsCreationMap
+func fullSyncCreateVolumes(createSpecArray []cnstypes.CnsVolumeCreateSpec, metadataSyncer *MetadataSyncInformer, k8sclient clientset.Interface, pool *fullSyncPool, status *fullSyncStatus, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var createSpecs []*cnstypes.CnsVolumeCreateSpec
+	var volumeIDs []string
+	for i := range createSpecArray {
+		backing, ok := createSpecArray[i].BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails)
+		if !ok || backing == nil {
 			continue
 		}
-		if _, existsInK8s := currentK8sPVMap[createSpec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails).BackingDiskId]; existsInK8s {
-			klog.V(4).Infof("FullSync: Calling CreateVolume for volume %s with id %s and create spec %+v", createSpec.Name, createSpec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails).BackingDiskId, spew.Sdump(createSpec))
-			_, err := volumes.GetManager(metadataSyncer.vcenter).CreateVolume(&createSpec)
-			if err != nil {
-				klog.Warningf("FullSync: Failed to create disk %s with id %s. Err: %+v", createSpec.Name, createSpec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails).BackingDiskId, err)
-				continue
+		createSpecs = append(createSpecs, &createSpecArray[i])
+		volumeIDs = append(volumeIDs, backing.BackingDiskId)
+	}
+	done := make([]bool, len(createSpecs))
+	pool.run("create", len(createSpecs), func(i int) {
+		metadataSyncer.volumeLocks.lock(volumeIDs[i])
+		defer metadataSyncer.volumeLocks.unlock(volumeIDs[i])
+		createSpec := createSpecs[i]
+		toBeCreated, err := isVolumeToBeCreated(k8sclient, metadataSyncer, createSpec.Name, volumeIDs[i])
+		if err != nil {
+			klog.Warningf("FullSync: Failed to check whether volume %s with id %s still needs to be created. Err: %v", createSpec.Name, volumeIDs[i], err)
+			status.setError(err)
+			return
+		}
+		if toBeCreated {
+			klog.V(4).Infof("FullSync: Calling CreateVolume for volume %s with id %s and create spec %+v", createSpec.Name, volumeIDs[i], spew.Sdump(createSpec))
+			if _, err := metadataSyncer.volumeManager.CreateVolume(createSpec); err != nil {
+				klog.Warningf("FullSync: Failed to create disk %s with id %s. Err: %+v", createSpec.Name, volumeIDs[i], err)
+				status.setError(err)
+				return
 			}
+			status.add(1, 0, 0)
+		}
+		done[i] = true
+	})
+	for i, volumeID := range volumeIDs {
+		if done[i] {
+			delete(metadataSyncer.cnsCreationMap, volumeID)
 		}
-		delete(cnsCreationMap, (createSpec.BackingObjectDetails).(*cnstypes.CnsBlockBackingDetails).BackingDiskId)
 	}
+}
 
-	wg.Done()
+// isVolumeToBeCreated returns true if the PV with the given name still has
+// the volume and the volume is still missing in CNS. The volume must be
+// locked.
+func isVolumeToBeCreated(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer, pvName string, volumeID string) (bool, error) {
+	pv, err := k8sclient.CoreV1().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle != volumeID || !isPVInBoundAvailableOrReleased(pv) {
+		return false, nil
+	}
+	queryResult, err := metadataSyncer.volumeManager.QueryVolume(cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(queryResult.Volumes) == 0, nil
 }
 
 // fullSyncDeleteVolumes delete volumes with given array of volumeId
-// Before deleting a volume, all current K8s volumes are retrieved
+// The volumes are locked before all current K8s volumes are retrieved, and
+// each is unlocked once it is deleted on the pool
 // If the volume is successfully deleted, it is removed from cnsDeletionMap
-func fullSyncDeleteVolumes(volumeIDDeleteArray []cnstypes.CnsVolumeId, metadataSyncer *MetadataSyncInformer, k8sclient clientset.Interface, wg *sync.WaitGroup) {
+func fullSyncDeleteVolumes(volumeIDDeleteArray []cnstypes.CnsVolumeId, metadataSyncer *MetadataSyncInformer, k8sclient clientset.Interface, pool *fullSyncPool, status *fullSyncStatus, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if len(volumeIDDeleteArray) == 0 {
+		return
+	}
 	deleteDisk := false
+	volumeIDs := make([]string, len(volumeIDDeleteArray))
+	for i, volID := range volumeIDDeleteArray {
+		volumeIDs[i] = volID.Id
+	}
+	metadataSyncer.volumeLocks.lock(volumeIDs...)
 	currentK8sPVMap := make(map[string]bool)
-	volumeOperationsLock.Lock()
-	defer volumeOperationsLock.Unlock()
 	// Get all K8s PVs
 	currentK8sPV, err := getPVsInBoundAvailableOrReleased(k8sclient)
 	if err != nil {
+		metadataSyncer.volumeLocks.unlock(volumeIDs...)
 		klog.Errorf("FullSync: fullSyncDeleteVolumes failed to get PVs from kubernetes. Err: %v", err)
+		status.setError(err)
 		return
 	}
 	// Create map for easy lookup
 	for _, pv := range currentK8sPV {
 		currentK8sPVMap[pv.Spec.CSI.VolumeHandle] = true
 	}
-	for _, volID := range volumeIDDeleteArray {
+	done := make([]bool, len(volumeIDs))
+	pool.run("delete", len(volumeIDs), func(i int) {
+		defer metadataSyncer.volumeLocks.unlock(volumeIDs[i])
 		// Delete volume if not present in currentK8sPVMap
-		if _, existsInK8s := currentK8sPVMap[volID.Id]; !existsInK8s {
-			klog.V(4).Infof("FullSync: Calling DeleteVolume for volume %v with delete disk %v", volID, deleteDisk)
-			err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(volID.Id, deleteDisk)
-			if err != nil {
-				klog.Warningf("FullSync: Failed to delete volume %s with error %+v", volID, err)
-				continue
+		if !currentK8sPVMap[volumeIDs[i]] {
+			klog.V(4).Infof("FullSync: Calling DeleteVolume for volume %s with delete disk %v", volumeIDs[i], deleteDisk)
+			if err := metadataSyncer.volumeManager.DeleteVolume(volumeIDs[i], deleteDisk); err != nil {
+				klog.Warningf("FullSync: Failed to delete volume %s with error %+v", volumeIDs[i], err)
+				status.setError(err)
+				return
 			}
+			status.add(0, 0, 1)
+		}
+		done[i] = true
+	})
+	for i, volumeID := range volumeIDs {
+		if done[i] {
+			delete(metadataSyncer.cnsDeletionMap, volumeID)
 		}
-		delete(cnsDeletionMap, volID.Id)
 	}
-	wg.Done()
 }
 
-// fullSyncUpdateVolumes update metadata for volumes with given array of createSpec
-func fullSyncUpdateVolumes(updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec, metadataSyncer *MetadataSyncInformer, wg *sync.WaitGroup) {
-	for _, updateSpec := range updateSpecArray {
-		klog.V(4).Infof("FullSync: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-		if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(&updateSpec); err != nil {
-			klog.Warningf("FullSync:UpdateVolumeMetadata failed with err %v", err)
+// fullSyncUpdateVolumes update metadata for volumes with given array of
+// updateSpec, in batches of fullSyncUpdateBatchSize volumes run on the pool.
+// The volumes of a batch are locked while it runs.
+func fullSyncUpdateVolumes(updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec, metadataSyncer *MetadataSyncInformer, pool *fullSyncPool, status *fullSyncStatus, wg *sync.WaitGroup) {
+	defer wg.Done()
+	batches := (len(updateSpecArray) + fullSyncUpdateBatchSize - 1) / fullSyncUpdateBatchSize
+	pool.run("update", batches, func(batch int) {
+		start := batch * fullSyncUpdateBatchSize
+		end := start + fullSyncUpdateBatchSize
+		if end > len(updateSpecArray) {
+			end = len(updateSpecArray)
 		}
-	}
-	wg.Done()
+		updateSpecs := make([]*cnstypes.CnsVolumeMetadataUpdateSpec, 0, end-start)
+		volumeIDs := make([]string, 0, end-start)
+		for i := start; i < end; i++ {
+			updateSpecs = append(updateSpecs, &updateSpecArray[i])
+			volumeIDs = append(volumeIDs, updateSpecArray[i].VolumeId.Id)
+		}
+		metadataSyncer.volumeLocks.lock(volumeIDs...)
+		defer metadataSyncer.volumeLocks.unlock(volumeIDs...)
+		for _, updateSpec := range updateSpecs {
+			klog.V(4).Infof("FullSync: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
+		}
+		for i, err := range metadataSyncer.volumeManager.UpdateVolumeMetadataBatch(updateSpecs) {
+			if err != nil {
+				klog.Warningf("FullSync: UpdateVolumeMetadata failed for volume %s with err %v", updateSpecs[i].VolumeId.Id, err)
+				status.setError(err)
+				continue
+			}
+			status.add(0, 1, 0)
+		}
+	})
 }
 
 // buildCnsUpdateMetadataList build metadata list for given PV
 // metadata list may include PV metadata, PVC metadata and POD metadata
-func buildCnsUpdateMetadataList(pv *v1.PersistentVolume, pvToPVCMap pvcMap, pvcToPodMap podMap) []cnstypes.BaseCnsEntityMetadata {
+func buildCnsUpdateMetadataList(pv *v1.PersistentVolume, pvToPVCMap pvcMap, pvcToPodMap podMap, metadataSyncer *MetadataSyncInformer) []cnstypes.BaseCnsEntityMetadata {
 	var metadataList []cnstypes.BaseCnsEntityMetadata
 
 	// get pv metadata
-	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, pv.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePV), pv.Namespace)
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, metadataSyncer.entityLabels(pv), false, string(cnstypes.CnsKubernetesEntityTypePV), pv.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvMetadata))
 	if pvc, ok := pvToPVCMap[pv.Name]; ok {
 		// get pvc metadata
-		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pvc.Name, pvc.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePVC), pvc.Namespace)
+		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pvc.Name, metadataSyncer.entityLabels(pvc), false, string(cnstypes.CnsKubernetesEntityTypePVC), pvc.Namespace)
 		metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvcMetadata))
 
 		key := pvc.Namespace + "/" + pvc.Name
@@ -233,6 +350,11 @@ func buildVolumeMap(pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsV
 	}
 	for _, pv := range pvList {
 		k8sPVMap[pv.Spec.CSI.VolumeHandle] = ""
+		if isFullSyncProtected(pv) {
+			// Keep the volume handle so that the volume is not deleted
+			klog.V(2).Infof("FullSync: skipping protected PV %s with volume %s", pv.Name, pv.Spec.CSI.VolumeHandle)
+			continue
+		}
 		if cnsVolumeMap[pv.Spec.CSI.VolumeHandle] {
 			// PV exist in both K8S and CNS cache, check metadata has been changed or not
 			queryFilter := cnstypes.CnsQueryFilter{
@@ -243,12 +365,12 @@ func buildVolumeMap(pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsV
 				},
 			}
 
-			queryResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryVolume(queryFilter)
+			queryResult, err := metadataSyncer.volumeManager.QueryVolume(queryFilter)
 			if err == nil && queryResult != nil && len(queryResult.Volumes) > 0 {
 				if &queryResult.Volumes[0].Metadata != nil {
 					cnsMetadata := queryResult.Volumes[0].Metadata.EntityMetadata
-					metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap)
-					k8sPVMap[pv.Spec.CSI.VolumeHandle] = getCnsUpdateOperationType(metadataList, cnsMetadata, pv.Name)
+					metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap, metadataSyncer)
+					k8sPVMap[pv.Spec.CSI.VolumeHandle] = getCnsUpdateOperationType(metadataList, cnsMetadata, pv.Name, metadataSyncer)
 				} else {
 					// metadata does not exist in CNS cache even the volume has an entry in CNS cache
 					klog.Warningf("FullSync: No metadata found for volume %v", pv.Spec.CSI.VolumeHandle)
@@ -257,10 +379,10 @@ func buildVolumeMap(pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsV
 			}
 		} else {
 			// PV exist in K8S but not in CNS cache, need to create
-			if _, existsInCnsCreationMap := cnsCreationMap[pv.Spec.CSI.VolumeHandle]; existsInCnsCreationMap {
+			if _, existsInCnsCreationMap := metadataSyncer.cnsCreationMap[pv.Spec.CSI.VolumeHandle]; existsInCnsCreationMap {
 				k8sPVMap[pv.Spec.CSI.VolumeHandle] = createVolumeOperation
 			} else {
-				cnsCreationMap[pv.Spec.CSI.VolumeHandle] = true
+				metadataSyncer.cnsCreationMap[pv.Spec.CSI.VolumeHandle] = true
 			}
 		}
 	}
@@ -273,7 +395,7 @@ func buildVolumeMap(pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsV
 // 	1. volumes whose existing metadata needs to be updated/created
 //  2. volumes whose existing PVC and Pod metadata needs to be deleted
 // 	3. volumes whose existing Pod metadata needs to be deleted
-func identifyVolumesToBeCreatedUpdated(pvList []*v1.PersistentVolume, k8sPVMap map[string]string) ([]*v1.PersistentVolume, []*v1.PersistentVolume, []*v1.PersistentVolume, []*v1.PersistentVolume) {
+func identifyVolumesToBeCreatedUpdated(pvList []*v1.PersistentVolume, k8sPVMap map[string]string, metadataSyncer *MetadataSyncInformer) ([]*v1.PersistentVolume, []*v1.PersistentVolume, []*v1.PersistentVolume, []*v1.PersistentVolume) {
 	pvToBeCreated := []*v1.PersistentVolume{}
 	pvToBeUpdated := []*v1.PersistentVolume{}
 	pvcToBeDeleted := []*v1.PersistentVolume{}
@@ -287,35 +409,68 @@ func identifyVolumesToBeCreatedUpdated(pvList []*v1.PersistentVolume, k8sPVMap m
 			klog.V(4).Infof("FullSync: Volume with id %s added to volume update list", pv.Spec.CSI.VolumeHandle)
 			pvToBeUpdated = append(pvToBeUpdated, pv)
 		case updateVolumeWithDeleteClaimOperation:
-			klog.V(4).Infof("FullSync: Volume with id %s and claim %s added to volume claim delete list", pv.Spec.CSI.VolumeHandle, cnsVolumeToPvcMap[pv.Name])
+			klog.V(4).Infof("FullSync: Volume with id %s and claim %s added to volume claim delete list", pv.Spec.CSI.VolumeHandle, metadataSyncer.cnsVolumeToPvcMap[pv.Name])
 			pvcToBeDeleted = append(pvcToBeDeleted, pv)
 		case updateVolumeWithDeletePodOperation:
-			klog.V(4).Infof("FullSync: Volume with id %s and pod name %s added to volume pod delete list", pv.Spec.CSI.VolumeHandle, cnsVolumeToPodMap[pv.Name])
+			klog.V(4).Infof("FullSync: Volume with id %s and pod name %s added to volume pod delete list", pv.Spec.CSI.VolumeHandle, metadataSyncer.cnsVolumeToPodMap[pv.Name])
 			podToBeDeleted = append(podToBeDeleted, pv)
 		}
 	}
 	return pvToBeCreated, pvToBeUpdated, pvcToBeDeleted, podToBeDeleted
 }
 
-// identifyVolumesToBeDeleted return list of volumeId's that need to be deleted
-// A volumeId is added to this list only if it was present in cnsDeletionMap across two
-// cycles of full sync
-func identifyVolumesToBeDeleted(cnsVolumeList []cnstypes.CnsVolume, k8sPVMap map[string]string) []cnstypes.CnsVolumeId {
+// identifyVolumesToBeDeleted returns the CNS volumes to be deleted and the
+// IDs of the CNS volumes missing in K8s. A volume is deleted once it was
+// missing in K8s across the given number of consecutive cycles of full sync,
+// 2 if it is zero, including this one. This cycle is only counted in
+// cnsDeletionMap by countMissingVolumes, once it passed the deletion limits.
+func identifyVolumesToBeDeleted(cnsVolumeList []cnstypes.CnsVolume, k8sPVMap map[string]string, metadataSyncer *MetadataSyncInformer) ([]cnstypes.CnsVolumeId, []string) {
+	confirmationCycles := metadataSyncer.fullSyncLimits.confirmationCycles
+	if confirmationCycles < 1 {
+		confirmationCycles = defaultDeletionConfirmationCycles
+	}
 	var volToBeDeleted []cnstypes.CnsVolumeId
+	var volMissingInK8s []string
 	for _, vol := range cnsVolumeList {
 		if _, existsInK8s := k8sPVMap[vol.VolumeId.Id]; !existsInK8s {
-			if _, existsInCnsDeletionMap := cnsDeletionMap[vol.VolumeId.Id]; existsInCnsDeletionMap {
-				// Volume does not exist in K8s across two fullsync cycles - add to delete list
-				klog.V(4).Infof("FullSync: Volume with id %s added to delete list as it was present in cnsDeletionMap across two fullsync cycles", vol.VolumeId.Id)
+			volMissingInK8s = append(volMissingInK8s, vol.VolumeId.Id)
+			cycles := metadataSyncer.cnsDeletionMap[vol.VolumeId.Id] + 1
+			if cycles >= confirmationCycles {
+				// Volume does not exist in K8s across the confirmation cycles - add to delete list
+				klog.V(4).Infof("FullSync: Volume with id %s added to delete list as it was missing in K8s across %d fullsync cycles", vol.VolumeId.Id, confirmationCycles)
 				volToBeDeleted = append(volToBeDeleted, vol.VolumeId)
 			} else {
-				// Add to cnsDeletionMap
-				klog.V(4).Infof("Volume with id %s added to cnsDeletionMap", vol.VolumeId.Id)
-				cnsDeletionMap[vol.VolumeId.Id] = true
+				klog.V(4).Infof("Volume with id %s missing in K8s for %d fullsync cycles", vol.VolumeId.Id, cycles)
 			}
 		}
 	}
-	return volToBeDeleted
+	return volToBeDeleted, volMissingInK8s
+}
+
+// countMissingVolumes counts this cycle in cnsDeletionMap for the CNS volumes
+// missing in K8s
+func countMissingVolumes(volMissingInK8s []string, metadataSyncer *MetadataSyncInformer) {
+	for _, volumeID := range volMissingInK8s {
+		metadataSyncer.cnsDeletionMap[volumeID]++
+	}
+}
+
+// checkDeletionLimits returns an error if deleting the given number of
+// volumes out of the CNS volumes of the cluster exceeds the limits. The
+// percentage only applies from minVolumesForPercent CNS volumes on.
+func checkDeletionLimits(deletions int, cnsVolumes int, limits fullSyncLimits) error {
+	if limits.maxDeletions > 0 && deletions > limits.maxDeletions {
+		return fmt.Errorf("%d volumes to be deleted exceed %s %d", deletions, envFullSyncMaxDeletions, limits.maxDeletions)
+	}
+	if limits.maxDeletionsPercent > 0 && cnsVolumes >= limits.minVolumesForPercent && cnsVolumes > 0 && deletions*100 > limits.maxDeletionsPercent*cnsVolumes {
+		return fmt.Errorf("%d volumes to be deleted out of %d exceed %s %d", deletions, cnsVolumes, envFullSyncMaxDeletionsPercent, limits.maxDeletionsPercent)
+	}
+	return nil
+}
+
+// isFullSyncProtected returns true if the PV has the protection annotation
+func isFullSyncProtected(pv *v1.PersistentVolume) bool {
+	return pv.Annotations[FullSyncProtectedAnnotation] == "true"
 }
 
 // constructCnsCreateSpec construct CnsVolumeCreateSpec for given list of PVs
@@ -323,13 +478,13 @@ func constructCnsCreateSpec(pvList []*v1.PersistentVolume, pvToPVCMap pvcMap, pv
 	var createSpecArray []cnstypes.CnsVolumeCreateSpec
 	for _, pv := range pvList {
 		// Create new metadata spec
-		metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap)
+		metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap, metadataSyncer)
 		// volume exist in K8S, but not in CNS cache, need to create this volume
 		createSpec := cnstypes.CnsVolumeCreateSpec{
 			Name:       pv.Name,
 			VolumeType: common.BlockVolumeType,
 			Metadata: cnstypes.CnsVolumeMetadata{
-				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
 				EntityMetadata:   metadataList,
 			},
 			BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{
@@ -348,14 +503,14 @@ func constructCnsUpdateSpec(pvUpdateList []*v1.PersistentVolume, pvToPVCMap pvcM
 	var updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec
 	for _, pv := range pvUpdateList {
 		// Create new metadata spec with delete flag false
-		metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap)
+		metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap, metadataSyncer)
 		// volume exist in K8S and CNS cache, but metadata is different, need to update this volume
 		updateSpec := cnstypes.CnsVolumeMetadataUpdateSpec{
 			VolumeId: cnstypes.CnsVolumeId{
 				Id: pv.Spec.CSI.VolumeHandle,
 			},
 			Metadata: cnstypes.CnsVolumeMetadata{
-				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
 				EntityMetadata:   metadataList,
 			},
 		}
@@ -373,10 +528,10 @@ func constructCnsUpdateSpecWithPVCToBeDeleted(pvUpdateList []*v1.PersistentVolum
 	var updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec
 
 	for _, pv := range pvUpdateList {
-		updateSpec := buildCnsMetadataSpecMarkedForDelete(pv, updateVolumeWithDeleteClaimOperation)
+		updateSpec := buildCnsMetadataSpecMarkedForDelete(pv, updateVolumeWithDeleteClaimOperation, metadataSyncer)
 		// volume exist in K8S and CNS cache, but PVC metadata does not exist in K8S
 		// need to delete PVC entries for this volume
-		updateSpec.Metadata.ContainerCluster = cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User)
+		updateSpec.Metadata.ContainerCluster = cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User)
 		updateSpecArray = append(updateSpecArray, updateSpec)
 		klog.V(4).Infof("FullSync: constructCnsUpdateSpecWithPVCToBeDeleted to update metadata for volume %s with delete flag true", pv.Spec.CSI.VolumeHandle)
 	}
@@ -389,10 +544,10 @@ func constructCnsUpdateSpecWithPodToBeDeleted(pvUpdateList []*v1.PersistentVolum
 	var updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec
 
 	for _, pv := range pvUpdateList {
-		updateSpec := buildCnsMetadataSpecMarkedForDelete(pv, updateVolumeWithDeletePodOperation)
+		updateSpec := buildCnsMetadataSpecMarkedForDelete(pv, updateVolumeWithDeletePodOperation, metadataSyncer)
 		// volume exist in K8S and CNS cache, but Pod metadata does not exist in K8S
 		// need to delete Pod entries for this volume
-		updateSpec.Metadata.ContainerCluster = cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User)
+		updateSpec.Metadata.ContainerCluster = cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User)
 		updateSpecArray = append(updateSpecArray, updateSpec)
 		klog.V(4).Infof("FullSync: constructCnsUpdateSpecWithPodToBeDeleted to update metadata for volume %s with delete flag true", pv.Spec.CSI.VolumeHandle)
 	}
@@ -447,7 +602,7 @@ func buildPVCMapPodMap(k8sclient clientset.Interface, pvList []*v1.PersistentVol
 // Returns the update operation type that needs to be performed on CNS
 // Empty string returned implies either no operation needs to be performed or
 // volume needs to be deleted from CNS
-func getCnsUpdateOperationType(pvMetadataList []cnstypes.BaseCnsEntityMetadata, cnsMetadataList []cnstypes.BaseCnsEntityMetadata, pvName string) string {
+func getCnsUpdateOperationType(pvMetadataList []cnstypes.BaseCnsEntityMetadata, cnsMetadataList []cnstypes.BaseCnsEntityMetadata, pvName string, metadataSyncer *MetadataSyncInformer) string {
 	// K8s resource metadata contains more entries than CNS - need to update
 	if len(pvMetadataList) > len(cnsMetadataList) {
 		return updateVolumeOperation
@@ -460,13 +615,13 @@ func getCnsUpdateOperationType(pvMetadataList []cnstypes.BaseCnsEntityMetadata,
 		for _, cnsMetadata := range cnsMetadataList {
 			// Construct CNS volume to Pod name mapping
 			if cnsMetadata.(*cnstypes.CnsKubernetesEntityMetadata).EntityType == string(cnstypes.CnsKubernetesEntityTypePOD) {
-				cnsVolumeToPodMap[pvName] = cnsMetadata.GetCnsEntityMetadata().EntityName
-				cnsVolumeToEntityNamespaceMap[pvName] = cnsMetadata.(*cnstypes.CnsKubernetesEntityMetadata).Namespace
+				metadataSyncer.cnsVolumeToPodMap[pvName] = cnsMetadata.GetCnsEntityMetadata().EntityName
+				metadataSyncer.cnsVolumeToEntityNamespaceMap[pvName] = cnsMetadata.(*cnstypes.CnsKubernetesEntityMetadata).Namespace
 			}
 			// Construct CNS volume to Pvc name mapping
 			if cnsMetadata.(*cnstypes.CnsKubernetesEntityMetadata).EntityType == string(cnstypes.CnsKubernetesEntityTypePVC) {
-				cnsVolumeToPvcMap[pvName] = cnsMetadata.GetCnsEntityMetadata().EntityName
-				cnsVolumeToEntityNamespaceMap[pvName] = cnsMetadata.(*cnstypes.CnsKubernetesEntityMetadata).Namespace
+				metadataSyncer.cnsVolumeToPvcMap[pvName] = cnsMetadata.GetCnsEntityMetadata().EntityName
+				metadataSyncer.cnsVolumeToEntityNamespaceMap[pvName] = cnsMetadata.(*cnstypes.CnsKubernetesEntityMetadata).Namespace
 			}
 		}
 		// PVC and Pod entries need to be deleted from CNS
@@ -500,15 +655,15 @@ func getCnsUpdateOperationType(pvMetadataList []cnstypes.BaseCnsEntityMetadata,
 // buildCnsMetadataSpecMarkedForDelete builds metadata list for a volume
 // where PVC and/or Pod entries need to be deleted from CNS
 // and returns the update spec to be passed to CNS
-func buildCnsMetadataSpecMarkedForDelete(pv *v1.PersistentVolume, operationType string) cnstypes.CnsVolumeMetadataUpdateSpec {
+func buildCnsMetadataSpecMarkedForDelete(pv *v1.PersistentVolume, operationType string, metadataSyncer *MetadataSyncInformer) cnstypes.CnsVolumeMetadataUpdateSpec {
 	// Create new metadata spec with delete flag true
 	var metadataList []cnstypes.BaseCnsEntityMetadata
-	if _, ok := cnsVolumeToPvcMap[pv.Name]; ok && operationType == updateVolumeWithDeleteClaimOperation {
-		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(cnsVolumeToPvcMap[pv.Name], nil, true, string(cnstypes.CnsKubernetesEntityTypePVC), cnsVolumeToEntityNamespaceMap[pv.Name])
+	if _, ok := metadataSyncer.cnsVolumeToPvcMap[pv.Name]; ok && operationType == updateVolumeWithDeleteClaimOperation {
+		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(metadataSyncer.cnsVolumeToPvcMap[pv.Name], nil, true, string(cnstypes.CnsKubernetesEntityTypePVC), metadataSyncer.cnsVolumeToEntityNamespaceMap[pv.Name])
 		metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvcMetadata))
 	}
-	if _, ok := cnsVolumeToPodMap[pv.Name]; ok {
-		podMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(cnsVolumeToPodMap[pv.Name], nil, true, string(cnstypes.CnsKubernetesEntityTypePOD), cnsVolumeToEntityNamespaceMap[pv.Name])
+	if _, ok := metadataSyncer.cnsVolumeToPodMap[pv.Name]; ok {
+		podMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(metadataSyncer.cnsVolumeToPodMap[pv.Name], nil, true, string(cnstypes.CnsKubernetesEntityTypePOD), metadataSyncer.cnsVolumeToEntityNamespaceMap[pv.Name])
 		metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(podMetadata))
 	}
 
@@ -529,17 +684,17 @@ func buildCnsMetadataSpecMarkedForDelete(pv *v1.PersistentVolume, operationType
 // An entry could have been added to cnsCreationMap (or cnsDeletionMap)
 // because full sync was triggered in between the delete (or create)
 // operation of a volume
-func cleanupCnsMaps(k8sPVs map[string]string) {
+func cleanupCnsMaps(k8sPVs map[string]string, metadataSyncer *MetadataSyncInformer) {
 	// Cleanup cnsCreationMap
-	for volID := range cnsCreationMap {
+	for volID := range metadataSyncer.cnsCreationMap {
 		if _, existsInK8s := k8sPVs[volID]; !existsInK8s {
-			delete(cnsCreationMap, volID)
+			delete(metadataSyncer.cnsCreationMap, volID)
 		}
 	}
 	// Cleanup cnsDeletionMap
-	for volID := range cnsDeletionMap {
+	for volID := range metadataSyncer.cnsDeletionMap {
 		if _, existsInK8s := k8sPVs[volID]; existsInK8s {
-			delete(cnsDeletionMap, volID)
+			delete(metadataSyncer.cnsDeletionMap, volID)
 		}
 	}
 }
@@ -0,0 +1,419 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume/fake"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+// TestFullSyncWithFakeCns verifies that full sync registers static volumes
+// missing in CNS and removes CNS volumes without PV, each after two cycles.
+func TestFullSyncWithFakeCns(t *testing.T) {
+	syncer, fakeCns := newTestSyncer(t)
+
+	orphan, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{
+		Name:       "orphan",
+		VolumeType: testVolumeType,
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster: cnsvsphere.GetContainerCluster(testClusterName, "user"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const staticVolumeID = "static-volume"
+	k8sclient := testclient.NewSimpleClientset(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "static-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: staticVolumeID},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeAvailable},
+	})
+
+	triggerFullSync(k8sclient, syncer)
+	if _, ok := fakeCns.Volume(staticVolumeID); ok {
+		t.Errorf("Static volume should only be created in the second cycle")
+	}
+	if _, ok := fakeCns.Volume(orphan.Id); !ok {
+		t.Errorf("Orphan volume should only be deleted in the second cycle")
+	}
+
+	triggerFullSync(k8sclient, syncer)
+	vol, ok := fakeCns.Volume(staticVolumeID)
+	if !ok {
+		t.Fatalf("Static volume %s was not created", staticVolumeID)
+	}
+	if len(vol.Metadata.EntityMetadata) != 1 || vol.Metadata.EntityMetadata[0].GetCnsEntityMetadata().EntityName != "static-pv" {
+		t.Errorf("Unexpected metadata of static volume: %+v", vol.Metadata.EntityMetadata)
+	}
+	if _, ok := fakeCns.Volume(orphan.Id); ok {
+		t.Errorf("Orphan volume %s was not deleted", orphan.Id)
+	}
+}
+
+// TestFullSyncDryRun verifies that a dry run full sync publishes the planned
+// operations, including the orphan volumes, without performing them.
+func TestFullSyncDryRun(t *testing.T) {
+	syncer, fakeCns := newTestSyncer(t)
+	syncer.volumeManager = newDryRunManager(fakeCns)
+	syncer.dryRun = true
+	now := time.Now()
+	syncer.orphanDetector = &orphanDetector{
+		disks:         fakeDiskStore{},
+		namespace:     podNamespace(),
+		reclaimPeriod: time.Hour,
+		orphans:       make(map[string]*orphanVolume),
+		now:           func() time.Time { return now },
+	}
+
+	orphan, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{
+		Name:       "orphan",
+		VolumeType: testVolumeType,
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster: cnsvsphere.GetContainerCluster(testClusterName, "user"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const staticVolumeID = "static-volume"
+	k8sclient := testclient.NewSimpleClientset(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "static-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: staticVolumeID},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeAvailable},
+	})
+
+	triggerFullSync(k8sclient, syncer)
+	now = now.Add(2 * time.Hour)
+	triggerFullSync(k8sclient, syncer)
+	if _, ok := fakeCns.Volume(staticVolumeID); ok {
+		t.Errorf("Static volume %s was created in a dry run", staticVolumeID)
+	}
+	if _, ok := fakeCns.Volume(orphan.Id); !ok {
+		t.Errorf("Orphan volume %s was deleted in a dry run", orphan.Id)
+	}
+	configMap, err := k8sclient.CoreV1().ConfigMaps(podNamespace()).Get(fullSyncPlanName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan []plannedOperation
+	if err = yaml.Unmarshal([]byte(configMap.Data[fullSyncPlanKey]), &plan); err != nil {
+		t.Fatal(err)
+	}
+	operations := make(map[string]map[string]bool)
+	for _, op := range plan {
+		if operations[op.VolumeID] == nil {
+			operations[op.VolumeID] = make(map[string]bool)
+		}
+		operations[op.VolumeID][op.Operation] = true
+	}
+	if !operations[staticVolumeID][createVolumeOperation] || !operations[orphan.Id][deleteVolumeOperation] {
+		t.Errorf("Expected create of %s and delete of %s to be planned, got %+v", staticVolumeID, orphan.Id, plan)
+	}
+	if !operations[orphan.Id][reclaimOrphanVolumeOperation] {
+		t.Errorf("Expected reclaim of orphan volume %s to be planned, got %+v", orphan.Id, plan)
+	}
+}
+
+// TestFullSyncDeletionLimits verifies that full sync skips the deletions of
+// cycles exceeding the deletion limits, waits for the confirmation cycles and skips protected
+// PVs.
+func TestFullSyncDeletionLimits(t *testing.T) {
+	syncer, fakeCns := newTestSyncer(t)
+	syncer.fullSyncLimits = fullSyncLimits{confirmationCycles: 3}
+
+	var orphans []string
+	for _, name := range []string{"orphan-1", "orphan-2", "protected"} {
+		volumeID, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{
+			Name:       name,
+			VolumeType: testVolumeType,
+			Metadata: cnstypes.CnsVolumeMetadata{
+				ContainerCluster: cnsvsphere.GetContainerCluster(testClusterName, "user"),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		orphans = append(orphans, volumeID.Id)
+	}
+	protectedVolumeID := orphans[2]
+	orphans = orphans[:2]
+	newProtectedPV := func(name string, volumeID string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{"app": "db"},
+				Annotations: map[string]string{FullSyncProtectedAnnotation: "true"},
+			},
+			Spec: v1.PersistentVolumeSpec{
+				Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: volumeID},
+				},
+			},
+			Status: v1.PersistentVolumeStatus{Phase: v1.VolumeAvailable},
+		}
+	}
+	k8sclient := testclient.NewSimpleClientset(
+		newProtectedPV("protected-pv", protectedVolumeID),
+		newProtectedPV("protected-static-pv", "static-volume"))
+
+	syncer.fullSyncLimits.maxDeletions = 0
+	for cycle := 0; cycle < 2; cycle++ {
+		triggerFullSync(k8sclient, syncer)
+	}
+	for _, volumeID := range orphans {
+		if _, ok := fakeCns.Volume(volumeID); !ok {
+			t.Errorf("Volume %s was deleted before the confirmation cycles", volumeID)
+		}
+	}
+
+	syncer.fullSyncLimits.maxDeletions = 1
+	triggerFullSync(k8sclient, syncer)
+	for _, volumeID := range orphans {
+		if _, ok := fakeCns.Volume(volumeID); !ok {
+			t.Errorf("Volume %s was deleted although the deletions exceed the limit", volumeID)
+		}
+		if syncer.cnsDeletionMap[volumeID] != 2 {
+			t.Errorf("Expected the skipped deletions not to be counted for volume %s, got %d cycles", volumeID, syncer.cnsDeletionMap[volumeID])
+		}
+	}
+
+	if err := fakeCns.DeleteVolume(orphans[1], false); err != nil {
+		t.Fatal(err)
+	}
+	triggerFullSync(k8sclient, syncer)
+	if _, ok := fakeCns.Volume(orphans[0]); ok {
+		t.Errorf("Volume %s was not deleted within the limit", orphans[0])
+	}
+	vol, ok := fakeCns.Volume(protectedVolumeID)
+	if !ok {
+		t.Fatalf("Volume %s of a protected PV was deleted", protectedVolumeID)
+	}
+	if len(vol.Metadata.EntityMetadata) != 0 {
+		t.Errorf("Metadata of the volume of a protected PV was updated: %+v", vol.Metadata.EntityMetadata)
+	}
+	if _, ok := fakeCns.Volume("static-volume"); ok {
+		t.Errorf("Volume of a protected static PV was created")
+	}
+}
+
+// TestFullSyncDeletionPercentOnSmallCluster verifies that the default
+// percentage limit doesn't keep the stale volumes of a small cluster forever,
+// and that a cycle exceeding it still creates volumes.
+func TestFullSyncDeletionPercentOnSmallCluster(t *testing.T) {
+	tests := []struct {
+		name                 string
+		stale                int
+		pvs                  int
+		minVolumesForPercent int
+		deleted              bool
+	}{
+		{name: "1 of 1 stale", stale: 1, minVolumesForPercent: defaultFullSyncMaxDeletionsPercentMinVolumes, deleted: true},
+		{name: "2 of 3 stale", stale: 2, pvs: 1, minVolumesForPercent: defaultFullSyncMaxDeletionsPercentMinVolumes, deleted: true},
+		{name: "2 of 3 stale above the minimum", stale: 2, pvs: 1, minVolumesForPercent: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			syncer, fakeCns := newTestSyncer(t)
+			syncer.fullSyncLimits = fullSyncLimits{
+				maxDeletionsPercent:  defaultFullSyncMaxDeletionsPercent,
+				minVolumesForPercent: test.minVolumesForPercent,
+				confirmationCycles:   defaultDeletionConfirmationCycles,
+			}
+			k8sclient := testclient.NewSimpleClientset()
+			var stale []string
+			for i := 0; i < test.stale+test.pvs; i++ {
+				volumeID, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{
+					Name:       fmt.Sprintf("volume-%d", i),
+					VolumeType: testVolumeType,
+					Metadata: cnstypes.CnsVolumeMetadata{
+						ContainerCluster: cnsvsphere.GetContainerCluster(testClusterName, "user"),
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i < test.stale {
+					stale = append(stale, volumeID.Id)
+					continue
+				}
+				if _, err := k8sclient.CoreV1().PersistentVolumes().Create(newStaticPV(fmt.Sprintf("pv-%d", i), volumeID.Id)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			const staticVolumeID = "static-volume"
+			if _, err := k8sclient.CoreV1().PersistentVolumes().Create(newStaticPV("static-pv", staticVolumeID)); err != nil {
+				t.Fatal(err)
+			}
+
+			for cycle := 0; cycle < defaultDeletionConfirmationCycles; cycle++ {
+				triggerFullSync(k8sclient, syncer)
+			}
+			for _, volumeID := range stale {
+				if _, ok := fakeCns.Volume(volumeID); ok == test.deleted {
+					t.Errorf("Expected stale volume %s to be deleted: %v", volumeID, test.deleted)
+				}
+			}
+			if _, ok := fakeCns.Volume(staticVolumeID); !ok {
+				t.Errorf("Static volume %s was not created", staticVolumeID)
+			}
+		})
+	}
+}
+
+// newStaticPV returns an available PV of the volume.
+func newStaticPV(name string, volumeID string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: volumeID},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeAvailable},
+	}
+}
+
+// TestFullSyncCreateVolumes verifies that full sync locks each volume only
+// while creating it, and skips the volumes registered or whose PV was deleted
+// meanwhile.
+func TestFullSyncCreateVolumes(t *testing.T) {
+	syncer, fakeCns := newTestSyncer(t)
+	newPV := func(name string, volumeID string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: volumeID},
+				},
+			},
+			Status: v1.PersistentVolumeStatus{Phase: v1.VolumeAvailable},
+		}
+	}
+	k8sclient := testclient.NewSimpleClientset(newPV("registered-pv", "registered"), newPV("missing-pv", "missing"))
+	var createSpecs []cnstypes.CnsVolumeCreateSpec
+	for _, name := range []string{"registered", "deleted", "missing"} {
+		syncer.cnsCreationMap[name] = true
+		createSpecs = append(createSpecs, cnstypes.CnsVolumeCreateSpec{
+			Name:                 name + "-pv",
+			BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{BackingDiskId: name},
+		})
+	}
+	// The metadata syncer registered the volume after the CNS volumes were
+	// queried
+	if _, err := fakeCns.CreateVolume(&createSpecs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer.volumeLocks.lock("missing")
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		fullSyncCreateVolumes(createSpecs, syncer, k8sclient, newFullSyncPool(1), &fullSyncStatus{}, &wg)
+		close(done)
+	}()
+	// The other volumes are checked while the missing volume is locked
+	deadline := time.Now().Add(5 * time.Second)
+	for fakeCns.Calls(fake.QueryVolume) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if fakeCns.Calls(fake.QueryVolume) < 1 {
+		t.Fatalf("Expected the registered volume to be checked while another volume is locked")
+	}
+	syncer.volumeLocks.unlock("missing")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the volumes to be created")
+	}
+	if calls := fakeCns.Calls(fake.CreateVolume); calls != 2 {
+		t.Errorf("Expected only the missing volume to be created, got %d CreateVolume calls", calls)
+	}
+	if _, ok := fakeCns.Volume("missing"); !ok {
+		t.Errorf("Volume missing was not created")
+	}
+	if len(syncer.cnsCreationMap) != 0 {
+		t.Errorf("Expected the volumes to be removed from cnsCreationMap, got %v", syncer.cnsCreationMap)
+	}
+}
+
+// TestFullSyncStatus verifies that full sync publishes the result of each
+// cycle and keeps the last error and success.
+func TestFullSyncStatus(t *testing.T) {
+	syncer, fakeCns := newTestSyncer(t)
+	k8sclient := testclient.NewSimpleClientset(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "static-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: "static-volume"},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeAvailable},
+	})
+	getStatus := func() map[string]string {
+		configMap, err := k8sclient.CoreV1().ConfigMaps(podNamespace()).Get(fullSyncStatusName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return configMap.Data
+	}
+
+	triggerFullSync(k8sclient, syncer)
+	status := getStatus()
+	if status["lastResult"] != fullSyncSucceeded || status["pendingCreations"] != "1" || status["clusterID"] != testClusterName {
+		t.Errorf("Unexpected status after the first cycle: %v", status)
+	}
+	triggerFullSync(k8sclient, syncer)
+	status = getStatus()
+	if status["lastResult"] != fullSyncSucceeded || status["volumesCreated"] != "1" || status["pendingCreations"] != "0" {
+		t.Errorf("Unexpected status after the second cycle: %v", status)
+	}
+
+	fakeCns.InjectFault(fake.QueryAllVolume, errors.New("vCenter is unreachable"), 1)
+	triggerFullSync(k8sclient, syncer)
+	status = getStatus()
+	if status["lastResult"] != fullSyncFailed || status["lastError"] != "vCenter is unreachable" || status["lastSuccessTime"] == "" {
+		t.Errorf("Unexpected status after a failed cycle: %v", status)
+	}
+}
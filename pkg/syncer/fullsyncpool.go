@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/klog"
+)
+
+// volumeLocks serializes the CNS operations on each volume. The zero value
+// has no volume locked.
+type volumeLocks struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	locked map[string]bool
+}
+
+// lock locks the given volumes, waiting for the ones locked by others. The
+// volumes are locked in order, so callers locking many volumes do not
+// deadlock.
+func (l *volumeLocks) lock(volumeIDs ...string) {
+	ids := make([]string, 0, len(volumeIDs))
+	seen := make(map[string]bool, len(volumeIDs))
+	for _, id := range volumeIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mutex)
+		l.locked = make(map[string]bool)
+	}
+	for _, id := range ids {
+		for l.locked[id] {
+			l.cond.Wait()
+		}
+		l.locked[id] = true
+	}
+}
+
+// unlock unlocks the given volumes.
+func (l *volumeLocks) unlock(volumeIDs ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, id := range volumeIDs {
+		delete(l.locked, id)
+	}
+	if l.cond != nil {
+		l.cond.Broadcast()
+	}
+}
+
+// fullSyncPool bounds the number of CNS operations of a FullSync cycle
+// running in parallel, across creations, deletions and updates.
+type fullSyncPool struct {
+	slots chan struct{}
+}
+
+// newFullSyncPool returns a fullSyncPool running up to workers operations.
+func newFullSyncPool(workers int) *fullSyncPool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &fullSyncPool{slots: make(chan struct{}, workers)}
+}
+
+// run calls fn with each index below n on the pool, and returns once all the
+// calls returned. Progress is logged every fullSyncProgressInterval calls.
+func (p *fullSyncPool) run(operation string, n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	var done int32
+	for i := 0; i < n; i++ {
+		p.slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-p.slots }()
+			fn(i)
+			if d := int(atomic.AddInt32(&done, 1)); d%fullSyncProgressInterval == 0 || d == n {
+				klog.V(2).Infof("FullSync: %s: %d of %d done", operation, d, n)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
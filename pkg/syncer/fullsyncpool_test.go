@@ -0,0 +1,74 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFullSyncPool(t *testing.T) {
+	pool := newFullSyncPool(3)
+	var running, maxRunning, calls int32
+	pool.run("test", 20, func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&calls, 1)
+	})
+	if calls != 20 {
+		t.Errorf("Expected 20 calls, got %d", calls)
+	}
+	if maxRunning > 3 {
+		t.Errorf("Expected at most 3 calls in parallel, got %d", maxRunning)
+	}
+}
+
+func TestVolumeLocks(t *testing.T) {
+	var locks volumeLocks
+	locks.lock("vol-2", "vol-1", "vol-1")
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("vol-3", "vol-1")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("Expected vol-1 to be locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Unlocking other volumes does not release vol-1
+	locks.unlock("vol-2")
+	select {
+	case <-locked:
+		t.Fatalf("Expected vol-1 to be locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	locks.unlock("vol-1")
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for vol-1 to be unlocked")
+	}
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume/fake"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+// newTestSyncer returns a syncer of the cluster testClusterName on a fake
+// virtual center, with its CNS volumes in the returned fake manager.
+func newTestSyncer(t *testing.T) (*MetadataSyncInformer, *fake.Manager) {
+	t.Helper()
+	const host = "fake-vc"
+	cfg := &cnsconfig.Config{VirtualCenter: map[string]*cnsconfig.VirtualCenterConfig{host: {User: "user"}}}
+	cfg.Global.ClusterID = testClusterName
+	fakeCns := fake.NewManager()
+	syncer := NewInformer()
+	syncer.cfg = cfg
+	syncer.vcenter = &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{Host: host}}
+	syncer.volumeManager = fakeCns
+	return syncer, fakeCns
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/health"
+)
+
+const (
+	// DefaultLeaseName is the default name of the Lease object used for
+	// leader election among syncer replicas.
+	DefaultLeaseName = "vsphere-syncer"
+	// DefaultLeaseDuration is the default duration non-leader candidates wait
+	// before forcing to acquire leadership.
+	DefaultLeaseDuration = 15 * time.Second
+	// DefaultRenewDeadline is the default duration the leader retries
+	// refreshing leadership before giving it up.
+	DefaultRenewDeadline = 10 * time.Second
+	// DefaultRetryPeriod is the default duration candidates wait between
+	// tries of actions.
+	DefaultRetryPeriod = 5 * time.Second
+
+	// defaultLeaseNamespace is used when the namespace of the pod can't be
+	// determined.
+	defaultLeaseNamespace = "kube-system"
+	// namespaceFile contains the namespace of the pod when running in-cluster.
+	namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	// leaderElectionCheckName is the name of the leader election health check.
+	leaderElectionCheckName = "leader-election"
+)
+
+// LeaderElectionConfig configures leader election among syncer replicas.
+type LeaderElectionConfig struct {
+	// Enabled turns on leader election. When disabled, the syncer always
+	// acts as the leader.
+	Enabled bool
+	// Namespace is the namespace of the Lease object. Defaults to the
+	// namespace of the pod.
+	Namespace string
+	// LeaseName is the name of the Lease object.
+	LeaseName string
+	// LeaseDuration, RenewDeadline and RetryPeriod tune the election, see
+	// k8s.io/client-go/tools/leaderelection for their meaning.
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// SetLeaderElectionConfig sets the leader election configuration used by Init.
+func (metadataSyncer *MetadataSyncInformer) SetLeaderElectionConfig(cfg LeaderElectionConfig) {
+	metadataSyncer.leaderElection = cfg
+}
+
+// isLeading returns true if this replica currently holds the lease and is
+// allowed to update CNS.
+func (metadataSyncer *MetadataSyncInformer) isLeading() bool {
+	return atomic.LoadInt32(&metadataSyncer.leading) == 1
+}
+
+// setLeading records whether this replica currently holds the lease.
+func (metadataSyncer *MetadataSyncInformer) setLeading(leading bool) {
+	var value int32
+	if leading {
+		value = 1
+	}
+	atomic.StoreInt32(&metadataSyncer.leading, value)
+}
+
+// lead makes this replica act as the leader until ctx is done: informer
+// callbacks are processed and full sync runs periodically and on demand,
+// one cycle at a time. In-flight full sync cycles are completed before lead
+// returns.
+func (metadataSyncer *MetadataSyncInformer) lead(ctx context.Context, k8sclient clientset.Interface) {
+	// A requested full sync is dropped once leadership is lost, the next
+	// leader runs its own cycles
+	defer metadataSyncer.dropFullSyncRequest()
+	if ctx.Err() != nil {
+		return
+	}
+	klog.V(2).Infof("Metadata syncer is the leader, starting metadata sync")
+	metadataSyncer.setLeading(true)
+	defer metadataSyncer.setLeading(false)
+	metadataSyncer.registerStaticVolumes(ctx)
+
+	interval := time.Duration(getFullSyncIntervalInMin()) * time.Minute
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+	for {
+		// Leadership lost during a cycle takes precedence over pending cycles
+		if ctx.Err() != nil {
+			klog.V(2).Infof("Metadata syncer stopped leading, full sync is stopped")
+			return
+		}
+		select {
+		case <-ctx.Done():
+			klog.V(2).Infof("Metadata syncer stopped leading, full sync is stopped")
+			return
+		case <-ticker.C:
+			klog.V(2).Infof("fullSync is triggered")
+			triggerFullSync(k8sclient, metadataSyncer)
+		case <-metadataSyncer.fullSyncRequests:
+			klog.V(2).Infof("fullSync is requested")
+			triggerFullSync(k8sclient, metadataSyncer)
+			// The next periodic cycle runs a full interval after this one
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
+		}
+	}
+}
+
+// runLeaderElection contends for the lease until ctx is done. While leading,
+// lead is run. When the lease is lost, the replica waits for lead to return
+// and goes back to standby, keeping its informer caches warm, before
+// contending again.
+func (metadataSyncer *MetadataSyncInformer) runLeaderElection(ctx context.Context, k8sclient clientset.Interface) error {
+	cfg := metadataSyncer.leaderElection
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname for leader election identity. err=%v", err)
+	}
+
+	// Each term gets its own lock, a renewal timed out in the previous term
+	// may still be using the previous one
+	newElector := func(leadDone chan struct{}) (*leaderelection.LeaderElector, error) {
+		lock, err := resourcelock.New(resourcelock.LeasesResourceLock, cfg.Namespace, cfg.LeaseName,
+			k8sclient.CoreV1(), k8sclient.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create leader election lock. err=%v", err)
+		}
+		return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:          lock,
+			LeaseDuration: cfg.LeaseDuration,
+			RenewDeadline: cfg.RenewDeadline,
+			RetryPeriod:   cfg.RetryPeriod,
+			WatchDog:      metadataSyncer.leaderWatchDog,
+			Name:          cfg.LeaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					defer close(leadDone)
+					metadataSyncer.lead(ctx, k8sclient)
+				},
+				OnStoppedLeading: func() {
+					klog.Warningf("Metadata syncer %q stopped leading on lease %s/%s", identity, cfg.Namespace, cfg.LeaseName)
+				},
+				OnNewLeader: func(leader string) {
+					if leader != identity {
+						klog.V(2).Infof("Metadata syncer %q is in standby, current leader is %q", identity, leader)
+					}
+				},
+			},
+		})
+	}
+	// Validate the configuration before going to the background
+	if _, err := newElector(make(chan struct{})); err != nil {
+		return fmt.Errorf("invalid leader election configuration. err=%v", err)
+	}
+
+	go func() {
+		for {
+			leadDone := make(chan struct{})
+			elector, err := newElector(leadDone)
+			if err != nil {
+				klog.Errorf("Failed to create leader elector. err=%v", err)
+				return
+			}
+			metadataSyncer.leaderWatchDog.SetLeaderElection(elector)
+			klog.V(2).Infof("Metadata syncer %q contending for lease %s/%s", identity, cfg.Namespace, cfg.LeaseName)
+			// Run returns once ctx is done or the lease is lost
+			elector.Run(ctx)
+			if ctx.Err() != nil {
+				if metadataSyncer.isLeading() {
+					<-leadDone
+				}
+				return
+			}
+			// The lease was lost, let in-flight operations finish before
+			// contending again
+			<-leadDone
+		}
+	}()
+	return nil
+}
+
+// leaderElectionCheck returns a health check which fails if this replica
+// holds the lease but has not renewed it in time.
+func (metadataSyncer *MetadataSyncInformer) leaderElectionCheck() health.Check {
+	return health.Check{
+		Name: leaderElectionCheckName,
+		Fn: func(ctx context.Context) error {
+			return metadataSyncer.leaderWatchDog.Check(nil)
+		},
+	}
+}
+
+// setLeaderElectionDefaults fills in unset fields of the configuration.
+func setLeaderElectionDefaults(cfg *LeaderElectionConfig) {
+	if cfg.Namespace == "" {
+		cfg.Namespace = podNamespace()
+	}
+	if cfg.LeaseName == "" {
+		cfg.LeaseName = DefaultLeaseName
+	}
+	if cfg.LeaseDuration == 0 {
+		cfg.LeaseDuration = DefaultLeaseDuration
+	}
+	if cfg.RenewDeadline == 0 {
+		cfg.RenewDeadline = DefaultRenewDeadline
+	}
+	if cfg.RetryPeriod == 0 {
+		cfg.RetryPeriod = DefaultRetryPeriod
+	}
+}
+
+// podNamespace returns the namespace of the pod, or defaultLeaseNamespace
+// when not running in-cluster.
+func podNamespace() string {
+	if ns, err := ioutil.ReadFile(namespaceFile); err == nil && len(strings.TrimSpace(string(ns))) > 0 {
+		return strings.TrimSpace(string(ns))
+	}
+	return defaultLeaseNamespace
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume/fake"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestLeaderElectionHandover(t *testing.T) {
+	syncer, fakeCns := newTestSyncer(t)
+	k8sclient := testclient.NewSimpleClientset()
+	cfg := LeaderElectionConfig{
+		Enabled:       true,
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+	setLeaderElectionDefaults(&cfg)
+	syncer.SetLeaderElectionConfig(cfg)
+	syncer.leaderWatchDog = leaderelection.NewLeaderHealthzAdaptor(cfg.LeaseDuration)
+	identity, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor := func(what string, condition func() bool) {
+		t.Helper()
+		if err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+			return condition(), nil
+		}); err != nil {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+	holder := func() string {
+		lease, err := k8sclient.CoordinationV1().Leases(cfg.Namespace).Get(cfg.LeaseName, metav1.GetOptions{})
+		if err != nil || lease.Spec.HolderIdentity == nil {
+			return ""
+		}
+		return *lease.Spec.HolderIdentity
+	}
+	statusPublished := func() bool {
+		_, err := k8sclient.CoreV1().ConfigMaps(podNamespace()).Get(fullSyncStatusName, metav1.GetOptions{})
+		return err == nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := syncer.runLeaderElection(ctx, k8sclient); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the lease to be acquired", func() bool { return syncer.isLeading() && holder() == identity })
+
+	// A full sync is running and another one is queued when the lease is lost
+	fakeCns.SetLatency(fake.QueryAllVolume, time.Second)
+	syncer.requestFullSync()
+	waitFor("the full sync to start", func() bool { return fakeCns.Calls(fake.QueryAllVolume) == 1 })
+	if !syncer.requestFullSync() {
+		t.Fatalf("Expected a full sync to be queued while one is running")
+	}
+	// Another replica takes over the lease and keeps renewing it
+	stopOther := make(chan struct{})
+	otherDone := make(chan struct{})
+	go func() {
+		defer close(otherDone)
+		other := "other-replica"
+		wait.Until(func() {
+			lease, err := k8sclient.CoordinationV1().Leases(cfg.Namespace).Get(cfg.LeaseName, metav1.GetOptions{})
+			if err != nil {
+				t.Errorf("Failed to get the lease: %v", err)
+				return
+			}
+			now := metav1.NewMicroTime(time.Now())
+			lease.Spec.HolderIdentity = &other
+			lease.Spec.RenewTime = &now
+			if _, err := k8sclient.CoordinationV1().Leases(cfg.Namespace).Update(lease); err != nil {
+				t.Errorf("Failed to update the lease: %v", err)
+			}
+		}, 50*time.Millisecond, stopOther)
+	}()
+	waitFor("leadership to be lost", func() bool { return !syncer.isLeading() })
+	if len(syncer.fullSyncRequests) != 0 {
+		t.Errorf("Expected the queued full sync to be dropped when leadership is lost")
+	}
+	if calls := fakeCns.Calls(fake.QueryAllVolume); calls != 1 {
+		t.Errorf("Expected only the running full sync to complete, got %d cycles", calls)
+	}
+
+	// Operations queued on a standby replica are dropped by the workers
+	volumeID, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{Name: "pv-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := cnsvsphere.GetCnsKubernetesEntityMetaData("pvc-1", nil, false, string(cnstypes.CnsKubernetesEntityTypePVC), testNamespace)
+	syncer.enqueueVolumeOperation(volumeID.Id, metadataOperation("test", &cnstypes.CnsVolumeMetadataUpdateSpec{
+		VolumeId: *volumeID,
+		Metadata: cnstypes.CnsVolumeMetadata{EntityMetadata: []cnstypes.BaseCnsEntityMetadata{metadata}},
+	}))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	syncer.runVolumeWorkers(1, stopCh)
+	waitFor("the operation to be dropped", func() bool {
+		syncer.pendingLock.Lock()
+		defer syncer.pendingLock.Unlock()
+		return len(syncer.pendingOperations) == 0 && syncer.volumeQueue.Len() == 0
+	})
+	if calls := fakeCns.Calls(fake.UpdateVolumeMetadataBatch) + fakeCns.Calls(fake.UpdateVolumeMetadata); calls != 0 {
+		t.Errorf("Expected no CNS update on a standby replica, got %d", calls)
+	}
+
+	// The lease is acquired again once the other replica stops renewing it,
+	// and full sync runs in the new term
+	close(stopOther)
+	<-otherDone
+	fakeCns.SetLatency(fake.QueryAllVolume, 0)
+	if err := k8sclient.CoreV1().ConfigMaps(podNamespace()).Delete(fullSyncStatusName, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the lease to be acquired again", func() bool { return syncer.isLeading() && holder() == identity })
+	if !syncer.requestFullSync() {
+		t.Fatalf("Expected a full sync to be queued in the new term")
+	}
+	waitFor("the full sync of the new term", statusPublished)
+	if calls := fakeCns.Calls(fake.QueryAllVolume); calls != 2 {
+		t.Errorf("Expected a single full sync in the new term, got %d cycles", calls-1)
+	}
+}
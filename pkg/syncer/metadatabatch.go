@@ -0,0 +1,144 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/klog"
+)
+
+// metadataUpdate holds the pending metadata updates of a volume, submitted
+// to CNS together with the updates of other volumes.
+type metadataUpdate struct {
+	volumeID string
+	ops      []volumeOperation
+}
+
+// metadataBatcher collects the metadata updates of the volume workers and
+// submits them in batches, once size volumes are pending or delay after the
+// first pending one.
+type metadataBatcher struct {
+	size   int
+	delay  time.Duration
+	submit func([]metadataUpdate)
+
+	lock    sync.Mutex
+	pending []metadataUpdate
+	timer   *time.Timer
+	// inflight counts the updates added and not submitted yet
+	inflight sync.WaitGroup
+}
+
+// newMetadataBatcher returns a metadataBatcher passing its batches to submit.
+// A size below 2 submits every update on its own.
+func newMetadataBatcher(size int, delay time.Duration, submit func([]metadataUpdate)) *metadataBatcher {
+	return &metadataBatcher{
+		size:   size,
+		delay:  delay,
+		submit: submit,
+	}
+}
+
+// add adds the update to the pending batch. The caller submits the batch if
+// the update fills it.
+func (b *metadataBatcher) add(update metadataUpdate) {
+	b.inflight.Add(1)
+	b.lock.Lock()
+	b.pending = append(b.pending, update)
+	if len(b.pending) < b.size {
+		if len(b.pending) == 1 {
+			b.timer = time.AfterFunc(b.delay, b.flush)
+		}
+		b.lock.Unlock()
+		return
+	}
+	batch := b.take()
+	b.lock.Unlock()
+	b.run(batch)
+}
+
+// flush submits the pending batch, if any.
+func (b *metadataBatcher) flush() {
+	b.lock.Lock()
+	batch := b.take()
+	b.lock.Unlock()
+	if len(batch) > 0 {
+		b.run(batch)
+	}
+}
+
+// wait flushes the pending batch and waits until all the added updates are
+// submitted.
+func (b *metadataBatcher) wait() {
+	b.flush()
+	b.inflight.Wait()
+}
+
+// take returns the pending batch and starts a new one. The lock must be held.
+func (b *metadataBatcher) take() []metadataUpdate {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+func (b *metadataBatcher) run(batch []metadataUpdate) {
+	defer b.inflight.Add(-len(batch))
+	b.submit(batch)
+}
+
+// updateVolumeMetadataBatch submits a batch of metadata updates in as few CNS
+// tasks as possible, and finishes processing their volumes. The updates of a
+// volume are merged in a single spec, and retried together if it fails.
+func (metadataSyncer *MetadataSyncInformer) updateVolumeMetadataBatch(batch []metadataUpdate) {
+	specs := make([]*cnstypes.CnsVolumeMetadataUpdateSpec, len(batch))
+	for i, update := range batch {
+		specs[i] = mergeMetadataOperations(update.volumeID, update.ops)
+	}
+	klog.V(4).Infof("Calling UpdateVolumeMetadataBatch for %d volumes", len(specs))
+	errs := metadataSyncer.volumeManager.UpdateVolumeMetadataBatch(specs)
+	for i, update := range batch {
+		if errs[i] != nil {
+			klog.Errorf("%s: UpdateVolumeMetadata failed for volume %s with err %v", update.ops[0].caller, update.volumeID, errs[i])
+			metadataSyncer.retryVolumeOperations(update.volumeID, update.ops, errs[i])
+		} else {
+			metadataSyncer.volumeQueue.Forget(update.volumeID)
+		}
+		metadataSyncer.volumeQueue.Done(update.volumeID)
+	}
+}
+
+// mergeMetadataOperations returns a spec updating the entity metadata of all
+// ops, with the container cluster of the last one.
+func mergeMetadataOperations(volumeID string, ops []volumeOperation) *cnstypes.CnsVolumeMetadataUpdateSpec {
+	spec := &cnstypes.CnsVolumeMetadataUpdateSpec{
+		VolumeId: cnstypes.CnsVolumeId{Id: volumeID},
+	}
+	for _, op := range ops {
+		klog.V(4).Infof("%s: Batching metadata update for volume %s with updateSpec: %+v", op.caller, volumeID, spew.Sdump(op.updateSpec))
+		spec.Metadata.ContainerCluster = op.updateSpec.Metadata.ContainerCluster
+		spec.Metadata.EntityMetadata = append(spec.Metadata.EntityMetadata, op.updateSpec.Metadata.EntityMetadata...)
+	}
+	return spec
+}
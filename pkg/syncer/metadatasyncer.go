@@ -23,17 +23,21 @@ import (
 	"os"
 	"reflect"
 	"strconv"
-	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	csictx "github.com/rexray/gocsi/context"
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/klog"
 
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/limiter"
 	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/health"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
@@ -41,7 +45,13 @@ import (
 
 // NewInformer returns uninitialized metadataSyncInformer
 func NewInformer() *MetadataSyncInformer {
-	return &MetadataSyncInformer{}
+	metadataSyncer := &MetadataSyncInformer{
+		fullSyncRequests: make(chan struct{}, 1),
+		cnsDeletionMap:   make(map[string]int),
+		cnsCreationMap:   make(map[string]bool),
+	}
+	metadataSyncer.initVolumeQueue()
+	return metadataSyncer
 }
 
 // getFullSyncIntervalInMin return the FullSyncInterval
@@ -67,6 +77,53 @@ func getFullSyncIntervalInMin() int {
 	return fullSyncIntervalInMin
 }
 
+// getFullSyncLimits returns the FullSync deletion safeguards set by the
+// FULL_SYNC_MAX_DELETIONS, FULL_SYNC_MAX_DELETIONS_PERCENT,
+// FULL_SYNC_MAX_DELETIONS_PERCENT_MIN_VOLUMES and
+// FULL_SYNC_DELETION_CONFIRMATION_CYCLES environment variables
+func getFullSyncLimits() fullSyncLimits {
+	limits := fullSyncLimits{
+		maxDeletions:         getNonNegativeEnv(envFullSyncMaxDeletions, 0, -1),
+		maxDeletionsPercent:  getNonNegativeEnv(envFullSyncMaxDeletionsPercent, defaultFullSyncMaxDeletionsPercent, 100),
+		minVolumesForPercent: getNonNegativeEnv(envFullSyncMaxDeletionsPercentMinVolumes, defaultFullSyncMaxDeletionsPercentMinVolumes, -1),
+		confirmationCycles:   getNonNegativeEnv(envFullSyncDeletionConfirmationCycles, defaultDeletionConfirmationCycles, -1),
+	}
+	if limits.confirmationCycles < 1 {
+		klog.Warningf("FullSync: %s must be at least 1, will use the default %d cycles", envFullSyncDeletionConfirmationCycles, defaultDeletionConfirmationCycles)
+		limits.confirmationCycles = defaultDeletionConfirmationCycles
+	}
+	klog.V(2).Infof("FullSync: deletions are limited to %d volumes and %d%% of the volumes from %d volumes on per cycle after %d cycles (0 for no limit)",
+		limits.maxDeletions, limits.maxDeletionsPercent, limits.minVolumesForPercent, limits.confirmationCycles)
+	return limits
+}
+
+// getFullSyncWorkers returns the number of parallel FullSync operations set
+// by the FULL_SYNC_WORKERS environment variable, or the default.
+func getFullSyncWorkers() int {
+	workers := getNonNegativeEnv(envFullSyncWorkers, defaultFullSyncWorkers, -1)
+	if workers == 0 {
+		klog.Warningf("FullSync: %s must be at least 1, will use the default %d workers", envFullSyncWorkers, defaultFullSyncWorkers)
+		workers = defaultFullSyncWorkers
+	}
+	return workers
+}
+
+// getNonNegativeEnv returns the value of the environment variable, or the
+// default value if it is not set, negative, above max when max is not
+// negative, or invalid
+func getNonNegativeEnv(name string, defaultValue int, max int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(v)
+	if err != nil || value < 0 || (max >= 0 && value > max) {
+		klog.Warningf("FullSync: %s %s is invalid, will use the default value %d", name, v, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
 // Init initializes the Metadata Sync Informer
 func (metadataSyncer *MetadataSyncInformer) Init() error {
 	var err error
@@ -82,6 +139,9 @@ func (metadataSyncer *MetadataSyncInformer) Init() error {
 		klog.Errorf("Failed to parse config. Err: %v", err)
 		return err
 	}
+	if err = limiter.Configure(metadataSyncer.cfg); err != nil {
+		return err
+	}
 
 	metadataSyncer.vcconfig, err = cnsvsphere.GetVirtualCenterConfig(metadataSyncer.cfg)
 	if err != nil {
@@ -105,6 +165,17 @@ func (metadataSyncer *MetadataSyncInformer) Init() error {
 		klog.Errorf("Failed to connect to VirtualCenter host: %q. err=%v", metadataSyncer.vcconfig.Host, err)
 		return err
 	}
+	metadataSyncer.volumeManager = volumes.GetManager(metadataSyncer.vcenter)
+	if metadataSyncer.dryRun {
+		klog.Warningf("Metadata syncer is running dry, CNS operations are only logged and full sync plans are published in ConfigMap %s", fullSyncPlanName)
+		metadataSyncer.volumeManager = newDryRunManager(metadataSyncer.volumeManager)
+	}
+	metadataSyncer.orphanDetector = newOrphanDetector(metadataSyncer.vcenter)
+	// Apply changes of the config file, such as rotated credentials,
+	// without restarting
+	if err = cnsconfig.WatchConfig(ctx, cfgPath, metadataSyncer.reloadConfig); err != nil {
+		klog.Warningf("Config changes will not be applied until restart. err=%v", err)
+	}
 	// Create the kubernetes client from config
 	k8sclient, err := k8s.NewClient()
 	if err != nil {
@@ -112,58 +183,369 @@ func (metadataSyncer *MetadataSyncInformer) Init() error {
 		return err
 	}
 
-	// Initialize cnsDeletionMap used by Full Sync
-	cnsDeletionMap = make(map[string]bool)
-	// Initialize cnsCreationMap used by Full Sync
-	cnsCreationMap = make(map[string]bool)
-
-	ticker := time.NewTicker(time.Duration(getFullSyncIntervalInMin()) * time.Minute)
-	// Trigger full sync
-	go func() {
-		for range ticker.C {
-			klog.V(2).Infof("fullSync is triggered")
-			triggerFullSync(k8sclient, metadataSyncer)
-		}
-	}()
+	if metadataSyncer.leaderElection.Enabled {
+		setLeaderElectionDefaults(&metadataSyncer.leaderElection)
+		metadataSyncer.leaderWatchDog = leaderelection.NewLeaderHealthzAdaptor(metadataSyncer.leaderElection.LeaseDuration)
+	}
 
-	stopFullSync := make(chan bool, 1)
+	metadataSyncer.fullSyncLimits = getFullSyncLimits()
+	metadataSyncer.fullSyncWorkers = getFullSyncWorkers()
 
 	// Set up kubernetes resource listeners for metadata syncer
 	metadataSyncer.k8sInformerManager = k8s.NewInformer(k8sclient)
 	metadataSyncer.k8sInformerManager.AddPVCListener(
-		nil, // Add
+		func(obj interface{}) { // Add
+			if metadataSyncer.isLeading() {
+				pvcAdded(obj, metadataSyncer)
+			}
+		},
 		func(oldObj interface{}, newObj interface{}) { // Update
-			pvcUpdated(oldObj, newObj, metadataSyncer)
+			if metadataSyncer.isLeading() {
+				pvcUpdated(oldObj, newObj, metadataSyncer)
+			}
 		},
 		func(obj interface{}) { // Delete
-			pvcDeleted(obj, metadataSyncer)
+			if metadataSyncer.isLeading() {
+				pvcDeleted(obj, metadataSyncer)
+			}
 		})
 	metadataSyncer.k8sInformerManager.AddPVListener(
-		nil, // Add
+		func(obj interface{}) { // Add
+			if metadataSyncer.isLeading() {
+				pvAdded(obj, metadataSyncer)
+			}
+		},
 		func(oldObj interface{}, newObj interface{}) { // Update
-			pvUpdated(oldObj, newObj, metadataSyncer)
+			if metadataSyncer.isLeading() {
+				pvUpdated(oldObj, newObj, metadataSyncer)
+			}
 		},
 		func(obj interface{}) { // Delete
-			pvDeleted(obj, metadataSyncer)
+			if metadataSyncer.isLeading() {
+				pvDeleted(obj, metadataSyncer)
+			}
 		})
 	metadataSyncer.k8sInformerManager.AddPodListener(
 		nil, // Add
 		func(oldObj interface{}, newObj interface{}) { // Update
-			podUpdated(oldObj, newObj, metadataSyncer)
+			if metadataSyncer.isLeading() {
+				podUpdated(oldObj, newObj, metadataSyncer)
+			}
 		},
 		func(obj interface{}) { // Delete
-			podDeleted(obj, metadataSyncer)
+			if metadataSyncer.isLeading() {
+				podDeleted(obj, metadataSyncer)
+			}
 		})
+	// Namespaces are only watched if their labels are propagated, enabling
+	// namespace-labels later takes effect on restart
+	if metadataSyncer.config().Metadata.NamespaceLabels {
+		metadataSyncer.k8sInformerManager.AddNamespaceListener(
+			nil, // Add
+			func(oldObj interface{}, newObj interface{}) { // Update
+				if metadataSyncer.isLeading() {
+					namespaceUpdated(oldObj, newObj, metadataSyncer)
+				}
+			},
+			nil) // Delete
+		metadataSyncer.namespaceLister = metadataSyncer.k8sInformerManager.GetNamespaceLister()
+	}
 	metadataSyncer.pvLister = metadataSyncer.k8sInformerManager.GetPVLister()
 	metadataSyncer.pvcLister = metadataSyncer.k8sInformerManager.GetPVCLister()
 	klog.V(2).Infof("Initialized metadata syncer")
+	// Serve /healthz, /readyz and /fullsync if configured
+	if mux := health.Serve(metadataSyncer.livenessChecks, metadataSyncer.readinessChecks); mux != nil {
+		if token := getFullSyncToken(); token != "" {
+			mux.Handle(FullSyncPath, metadataSyncer.fullSyncHandler(token))
+		} else {
+			klog.V(2).Infof("%s is not set, %s is disabled", envFullSyncToken, FullSyncPath)
+		}
+	}
+	// Informers are started on every replica so that standby replicas
+	// keep their caches warm and can take over without a resync
 	stopCh := metadataSyncer.k8sInformerManager.Listen()
+	metadataSyncer.runVolumeWorkers(getMetadataSyncWorkers(), stopCh)
+	syncCtx, stopSync := context.WithCancel(context.Background())
+	defer stopSync()
+	if metadataSyncer.leaderElection.Enabled {
+		if err = metadataSyncer.runLeaderElection(syncCtx, k8sclient); err != nil {
+			klog.Errorf("Failed to start leader election. err=%v", err)
+			return err
+		}
+		<-(stopCh)
+		return nil
+	}
+	go metadataSyncer.lead(syncCtx, k8sclient)
 	<-(stopCh)
-	<-(stopFullSync)
 	return nil
 }
 
-// pvcUpdated updates persistent volume claim metadata on VC when pvc labels on K8S cluster have been updated
+// reloadConfig applies credential, port and datacenter changes to the
+// registered virtual center and replaces the config used by the syncer.
+func (metadataSyncer *MetadataSyncInformer) reloadConfig(cfg *cnsconfig.Config) {
+	if err := limiter.Configure(cfg); err != nil {
+		klog.Errorf("Failed to reload limiter config. err=%v", err)
+	}
+	vcconfig, err := cnsvsphere.GetVirtualCenterConfig(cfg)
+	if err != nil {
+		klog.Errorf("Failed to get VirtualCenterConfig. err=%v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err = metadataSyncer.virtualcentermanager.UpdateVirtualCenter(ctx, vcconfig); err != nil {
+		klog.Errorf("Failed to update VirtualCenter. err=%v", err)
+		return
+	}
+	metadataSyncer.cfgLock.Lock()
+	metadataSyncer.cfg = cfg
+	metadataSyncer.cfgLock.Unlock()
+	klog.Infof("Reloaded metadata syncer config")
+}
+
+// config returns the current config of the syncer.
+func (metadataSyncer *MetadataSyncInformer) config() *cnsconfig.Config {
+	metadataSyncer.cfgLock.RLock()
+	defer metadataSyncer.cfgLock.RUnlock()
+	return metadataSyncer.cfg
+}
+
+// livenessChecks returns the checks served on the health endpoint of the
+// syncer. vCenter connectivity is only part of the readiness checks, so that
+// a vCenter outage doesn't restart the syncer.
+func (metadataSyncer *MetadataSyncInformer) livenessChecks() []health.Check {
+	if metadataSyncer.vcenter == nil {
+		return []health.Check{notInitializedCheck(syncerCheckName)}
+	}
+	var checks []health.Check
+	if metadataSyncer.leaderWatchDog != nil {
+		checks = append(checks, metadataSyncer.leaderElectionCheck())
+	}
+	return checks
+}
+
+// readinessChecks returns the checks served on the readiness endpoint of the
+// syncer: a reachable vCenter, a valid vCenter session, an available CNS
+// client and synced Kubernetes informer caches.
+func (metadataSyncer *MetadataSyncInformer) readinessChecks() []health.Check {
+	if metadataSyncer.vcenter == nil {
+		return []health.Check{notInitializedCheck(syncerCheckName)}
+	}
+	checks := []health.Check{
+		metadataSyncer.vcenter.BreakerCheck(),
+		metadataSyncer.vcenter.SessionCheck(),
+		metadataSyncer.vcenter.CnsCheck(),
+	}
+	if metadataSyncer.k8sInformerManager == nil {
+		return append(checks, notInitializedCheck(informersCheckName))
+	}
+	return append(checks, health.Check{
+		Name: informersCheckName,
+		Fn: func(ctx context.Context) error {
+			if !metadataSyncer.k8sInformerManager.HasSynced() {
+				return errors.New("informer caches are not synced")
+			}
+			return nil
+		},
+	})
+}
+
+// notInitializedCheck returns a check with the given name which always fails.
+func notInitializedCheck(name string) health.Check {
+	return health.Check{
+		Name: name,
+		Fn: func(ctx context.Context) error {
+			return errors.New("not initialized")
+		},
+	}
+}
+
+// entityLabels returns the labels of a pv or pvc propagated into CNS, curated
+// according to the Metadata section of the config
+func (metadataSyncer *MetadataSyncInformer) entityLabels(obj metav1.Object) map[string]string {
+	var namespaceLabels map[string]string
+	if metadataSyncer.config().Metadata.NamespaceLabels && obj.GetNamespace() != "" && metadataSyncer.namespaceLister != nil {
+		namespace, err := metadataSyncer.namespaceLister.Get(obj.GetNamespace())
+		if err != nil {
+			klog.Warningf("Failed to get namespace %s, its labels are not propagated. err: %v", obj.GetNamespace(), err)
+		} else {
+			namespaceLabels = namespace.Labels
+		}
+	}
+	return metadataSyncer.config().Metadata.Labels(obj.GetLabels(), obj.GetAnnotations(), namespaceLabels)
+}
+
+// namespaceUpdated queues the update of the metadata of the bound pvcs of the
+// namespace on VC when namespace labels are propagated and have been updated
+func namespaceUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer) {
+	oldNamespace, ok := oldObj.(*v1.Namespace)
+	if oldNamespace == nil || !ok {
+		klog.Warningf("NamespaceUpdated: unrecognized old object %+v", oldObj)
+		return
+	}
+	newNamespace, ok := newObj.(*v1.Namespace)
+	if newNamespace == nil || !ok {
+		klog.Warningf("NamespaceUpdated: unrecognized new object %+v", newObj)
+		return
+	}
+	if !metadataSyncer.config().Metadata.NamespaceLabels || reflect.DeepEqual(oldNamespace.Labels, newNamespace.Labels) {
+		return
+	}
+	pvcs, err := metadataSyncer.pvcLister.PersistentVolumeClaims(newNamespace.Name).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("NamespaceUpdated: Error listing pvcs in namespace %s with err: %v", newNamespace.Name, err)
+		return
+	}
+	for _, pvc := range pvcs {
+		if pvc.Status.Phase != v1.ClaimBound {
+			continue
+		}
+		pv, err := metadataSyncer.pvLister.Get(pvc.Spec.VolumeName)
+		if err != nil || pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+			continue
+		}
+		var metadataList []cnstypes.BaseCnsEntityMetadata
+		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pvc.Name, metadataSyncer.entityLabels(pvc), false, string(cnstypes.CnsKubernetesEntityTypePVC), pvc.Namespace)
+		metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvcMetadata))
+		updateSpec := &cnstypes.CnsVolumeMetadataUpdateSpec{
+			VolumeId: cnstypes.CnsVolumeId{
+				Id: pv.Spec.CSI.VolumeHandle,
+			},
+			Metadata: cnstypes.CnsVolumeMetadata{
+				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+				EntityMetadata:   metadataList,
+			},
+		}
+		metadataSyncer.enqueueVolumeOperation(pv.Spec.CSI.VolumeHandle, metadataOperation("NamespaceUpdated", updateSpec))
+	}
+}
+
+// pvcAdded queues the registration of a statically provisioned volume in CNS
+// when a pvc bound to it has been added on K8S cluster. A missing volume is
+// registered with the pvc metadata, a registered volume is left unchanged and
+// gets the pvc metadata from pvcUpdated or full sync
+func pvcAdded(obj interface{}, metadataSyncer *MetadataSyncInformer) {
+	pvc, ok := obj.(*v1.PersistentVolumeClaim)
+	if pvc == nil || !ok {
+		klog.Warningf("PVCAdded: unrecognized object %+v", obj)
+		return
+	}
+	if pvc.Status.Phase != v1.ClaimBound {
+		return
+	}
+	pv, err := metadataSyncer.pvLister.Get(pvc.Spec.VolumeName)
+	if err != nil {
+		// The volume is registered when the pv is added
+		klog.V(3).Infof("PVCAdded: Persistent Volume %s of pvc %s/%s not found. err: %v", pvc.Spec.VolumeName, pvc.Namespace, pvc.Name, err)
+		return
+	}
+	if isStaticVolume(pv) {
+		registerStaticVolume(pv, pvc, "PVCAdded", metadataSyncer)
+	}
+}
+
+// pvAdded queues the registration of a statically provisioned volume in CNS
+// when the pv has been added on K8S cluster, instead of waiting for the next
+// full sync
+func pvAdded(obj interface{}, metadataSyncer *MetadataSyncInformer) {
+	pv, ok := obj.(*v1.PersistentVolume)
+	if pv == nil || !ok {
+		klog.Warningf("PVAdded: unrecognized object %+v", obj)
+		return
+	}
+	if !isStaticVolume(pv) {
+		return
+	}
+	var pvc *v1.PersistentVolumeClaim
+	if pv.Spec.ClaimRef != nil && pv.Status.Phase == v1.VolumeBound {
+		var err error
+		pvc, err = metadataSyncer.pvcLister.PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Get(pv.Spec.ClaimRef.Name)
+		if err != nil {
+			// The pvc metadata is added when the pvc is added
+			klog.V(3).Infof("PVAdded: pvc %s/%s of PV %s not found. err: %v", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, pv.Name, err)
+			pvc = nil
+		}
+	}
+	registerStaticVolume(pv, pvc, "PVAdded", metadataSyncer)
+}
+
+// isStaticVolume returns true if the pv is a vsphere csi volume which was not
+// provisioned by the driver and may be missing in CNS
+func isStaticVolume(pv *v1.PersistentVolume) bool {
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+		return false
+	}
+	if pv.Annotations[annDynamicallyProvisioned] == service.Name {
+		return false
+	}
+	if pv.DeletionTimestamp != nil || pv.Status.Phase == v1.VolumeFailed || isFullSyncProtected(pv) {
+		return false
+	}
+	return true
+}
+
+// registerStaticVolume queues the creation of the volume of the pv in CNS, with
+// the metadata of the pv and of its pvc if not nil. The volume is only created
+// if it is missing in CNS.
+func registerStaticVolume(pv *v1.PersistentVolume, pvc *v1.PersistentVolumeClaim, caller string, metadataSyncer *MetadataSyncInformer) {
+	pvToPVCMap := make(pvcMap)
+	if pvc != nil {
+		pvToPVCMap[pv.Name] = pvc
+	}
+	createSpecs := constructCnsCreateSpec([]*v1.PersistentVolume{pv}, pvToPVCMap, make(podMap), metadataSyncer)
+	klog.V(3).Infof("%s: registering volume %s of PV %s in CNS", caller, pv.Spec.CSI.VolumeHandle, pv.Name)
+	metadataSyncer.enqueueVolumeOperation(pv.Spec.CSI.VolumeHandle, volumeOperation{
+		key:        createVolumeOperation,
+		caller:     caller,
+		createSpec: &createSpecs[0],
+	})
+}
+
+// registerStaticVolumes queues the registration of the statically
+// provisioned volumes of all PVs missing in CNS, including the PVs added
+// before this replica started leading. The volumes are looked up with a
+// single query. It returns once the informer caches are synced and the
+// volumes are queued, or ctx is done.
+func (metadataSyncer *MetadataSyncInformer) registerStaticVolumes(ctx context.Context) {
+	if metadataSyncer.pvLister == nil {
+		return
+	}
+	if metadataSyncer.k8sInformerManager != nil && !cache.WaitForCacheSync(ctx.Done(), metadataSyncer.k8sInformerManager.HasSynced) {
+		return
+	}
+	pvs, err := metadataSyncer.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list PVs to register static volumes. err=%v", err)
+		return
+	}
+	var staticPVs []*v1.PersistentVolume
+	var volumeIDs []cnstypes.CnsVolumeId
+	for _, pv := range pvs {
+		if isStaticVolume(pv) {
+			staticPVs = append(staticPVs, pv)
+			volumeIDs = append(volumeIDs, cnstypes.CnsVolumeId{Id: pv.Spec.CSI.VolumeHandle})
+		}
+	}
+	if len(staticPVs) == 0 {
+		return
+	}
+	queryResult, err := metadataSyncer.volumeManager.QueryVolume(cnstypes.CnsQueryFilter{VolumeIds: volumeIDs})
+	if err != nil {
+		klog.Errorf("Failed to query static volumes, full sync will register them. err=%v", err)
+		return
+	}
+	registered := make(map[string]bool)
+	for _, vol := range queryResult.Volumes {
+		registered[vol.VolumeId.Id] = true
+	}
+	for _, pv := range staticPVs {
+		if !registered[pv.Spec.CSI.VolumeHandle] {
+			pvAdded(pv, metadataSyncer)
+		}
+	}
+}
+
+// pvcUpdated queues the update of persistent volume claim metadata on VC when pvc labels on K8S cluster have been updated
 func pvcUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer) {
 	// Get old and new pvc objects
 	oldPvc, ok := oldObj.(*v1.PersistentVolumeClaim)
@@ -194,14 +576,15 @@ func pvcUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer
 	}
 
 	// Verify is old and new labels are not equal
-	if oldPvc.Status.Phase == v1.ClaimBound && reflect.DeepEqual(newPvc.Labels, oldPvc.Labels) {
+	newLabels := metadataSyncer.entityLabels(newPvc)
+	if oldPvc.Status.Phase == v1.ClaimBound && reflect.DeepEqual(newLabels, metadataSyncer.entityLabels(oldPvc)) {
 		klog.V(3).Infof("PVCUpdated: Old PVC and New PVC labels equal")
 		return
 	}
 
 	// Create updateSpec
 	var metadataList []cnstypes.BaseCnsEntityMetadata
-	pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPvc.Name, newPvc.Labels, false, string(cnstypes.CnsKubernetesEntityTypePVC), newPvc.Namespace)
+	pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPvc.Name, newLabels, false, string(cnstypes.CnsKubernetesEntityTypePVC), newPvc.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvcMetadata))
 
 	updateSpec := &cnstypes.CnsVolumeMetadataUpdateSpec{
@@ -209,18 +592,15 @@ func pvcUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer
 			Id: pv.Spec.CSI.VolumeHandle,
 		},
 		Metadata: cnstypes.CnsVolumeMetadata{
-			ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+			ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
 			EntityMetadata:   metadataList,
 		},
 	}
 
-	klog.V(4).Infof("PVCUpdated: Calling UpdateVolumeMetadata with updateSpec: %+v", spew.Sdump(updateSpec))
-	if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
-		klog.Errorf("PVCUpdated: UpdateVolumeMetadata failed with err %v", err)
-	}
+	metadataSyncer.enqueueVolumeOperation(pv.Spec.CSI.VolumeHandle, metadataOperation("PVCUpdated", updateSpec))
 }
 
-// pvDeleted deletes pvc metadata on VC when pvc has been deleted on K8s cluster
+// pvcDeleted queues the deletion of pvc metadata on VC when pvc has been deleted on K8s cluster
 func pvcDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 	pvc, ok := obj.(*v1.PersistentVolumeClaim)
 	if pvc == nil || !ok {
@@ -260,18 +640,15 @@ func pvcDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 			Id: pv.Spec.CSI.VolumeHandle,
 		},
 		Metadata: cnstypes.CnsVolumeMetadata{
-			ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+			ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
 			EntityMetadata:   metadataList,
 		},
 	}
 
-	klog.V(4).Infof("PVCDeleted: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-	if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
-		klog.Errorf("PVCDeleted: UpdateVolumeMetadata failed with err %v", err)
-	}
+	metadataSyncer.enqueueVolumeOperation(pv.Spec.CSI.VolumeHandle, metadataOperation("PVCDeleted", updateSpec))
 }
 
-// pvUpdated updates volume metadata on VC when volume labels on K8S cluster have been updated
+// pvUpdated queues the update of volume metadata on VC when volume labels on K8S cluster have been updated
 func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer) {
 	// Get old and new PV objects
 	oldPv, ok := oldObj.(*v1.PersistentVolume)
@@ -298,7 +675,8 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 		return
 	}
 	// Return if labels are unchanged
-	if oldPv.Status.Phase == v1.VolumeAvailable && reflect.DeepEqual(newPv.GetLabels(), oldPv.GetLabels()) {
+	newLabels := metadataSyncer.entityLabels(newPv)
+	if oldPv.Status.Phase == v1.VolumeAvailable && reflect.DeepEqual(newLabels, metadataSyncer.entityLabels(oldPv)) {
 		klog.V(3).Infof("PVUpdated: PV labels have not changed")
 		return
 	}
@@ -312,7 +690,7 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 	}
 
 	var metadataList []cnstypes.BaseCnsEntityMetadata
-	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPv.Name, newPv.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePV), newPv.Namespace)
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPv.Name, newLabels, false, string(cnstypes.CnsKubernetesEntityTypePV), newPv.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvMetadata))
 
 	if oldPv.Status.Phase == v1.VolumeAvailable || newPv.Spec.StorageClassName != "" {
@@ -321,21 +699,18 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 				Id: newPv.Spec.CSI.VolumeHandle,
 			},
 			Metadata: cnstypes.CnsVolumeMetadata{
-				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
 				EntityMetadata:   metadataList,
 			},
 		}
 
-		klog.V(4).Infof("PVUpdated: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-		if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
-			klog.Errorf("PVUpdated: UpdateVolumeMetadata failed with err %v", err)
-		}
+		metadataSyncer.enqueueVolumeOperation(newPv.Spec.CSI.VolumeHandle, metadataOperation("PVUpdated", updateSpec))
 	} else {
 		createSpec := &cnstypes.CnsVolumeCreateSpec{
 			Name:       oldPv.Name,
 			VolumeType: common.BlockVolumeType,
 			Metadata: cnstypes.CnsVolumeMetadata{
-				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
 				EntityMetadata:   metadataList,
 			},
 			BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{
@@ -343,18 +718,15 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 				BackingDiskId:           oldPv.Spec.CSI.VolumeHandle,
 			},
 		}
-		volumeOperationsLock.Lock()
-		defer volumeOperationsLock.Unlock()
-		klog.V(4).Infof("PVUpdated: vSphere provisioner creating volume %s with create spec %+v", oldPv.Name, spew.Sdump(createSpec))
-		_, err := volumes.GetManager(metadataSyncer.vcenter).CreateVolume(createSpec)
-
-		if err != nil {
-			klog.Errorf("PVUpdated: Failed to create disk %s with error %+v", oldPv.Name, err)
-		}
+		metadataSyncer.enqueueVolumeOperation(oldPv.Spec.CSI.VolumeHandle, volumeOperation{
+			key:        createVolumeOperation,
+			caller:     "PVUpdated",
+			createSpec: createSpec,
+		})
 	}
 }
 
-// pvDeleted deletes volume metadata on VC when volume has been deleted on K8s cluster
+// pvDeleted queues the deletion of the volume on VC when volume has been deleted on K8s cluster
 func pvDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 	pv, ok := obj.(*v1.PersistentVolume)
 	if pv == nil || !ok {
@@ -383,16 +755,14 @@ func pvDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 		klog.V(4).Infof("PVDeleted: Setting DeleteDisk to true")
 		deleteDisk = true
 	}
-	volumeOperationsLock.Lock()
-	defer volumeOperationsLock.Unlock()
-	klog.V(4).Infof("PVDeleted: vSphere provisioner deleting volume %v with delete disk %v", pv, deleteDisk)
-	if err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(pv.Spec.CSI.VolumeHandle, deleteDisk); err != nil {
-		klog.Errorf("PVDeleted: Failed to delete disk %s with error %+v", pv.Spec.CSI.VolumeHandle, err)
-		return
-	}
+	metadataSyncer.enqueueVolumeOperation(pv.Spec.CSI.VolumeHandle, volumeOperation{
+		key:        deleteVolumeOperation,
+		caller:     "PVDeleted",
+		deleteDisk: deleteDisk,
+	})
 }
 
-// podUpdated updates pod metadata on VC when pod labels have been updated on K8s cluster
+// podUpdated queues the update of pod metadata on VC when pod labels have been updated on K8s cluster
 func podUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer) {
 	// Get old and new pod objects
 	oldPod, ok := oldObj.(*v1.Pod)
@@ -420,7 +790,7 @@ func podUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer
 	}
 }
 
-// pvDeleted deletes pod metadata on VC when pod has been deleted on K8s cluster
+// podDeleted queues the deletion of pod metadata on VC when pod has been deleted on K8s cluster
 func podDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 	// Get pod object
 	pod, ok := obj.(*v1.Pod)
@@ -444,7 +814,7 @@ func podDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 	}
 }
 
-// updatePodMetadata updates metadata for volumes attached to the pod
+// updatePodMetadata queues the metadata update of the volumes attached to the pod
 func updatePodMetadata(pod *v1.Pod, metadataSyncer *MetadataSyncInformer, deleteFlag bool) []error {
 	var errorList []error
 	// Iterate through volumes attached to pod
@@ -480,16 +850,15 @@ func updatePodMetadata(pod *v1.Pod, metadataSyncer *MetadataSyncInformer, delete
 					Id: pv.Spec.CSI.VolumeHandle,
 				},
 				Metadata: cnstypes.CnsVolumeMetadata{
-					ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+					ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.config().Global.ClusterID, metadataSyncer.config().VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
 					EntityMetadata:   metadataList,
 				},
 			}
-
-			klog.V(4).Infof("Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-			if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
-				msg := fmt.Sprintf("UpdateVolumeMetadata failed for volume %s with err: %v", volume.Name, err)
-				errorList = append(errorList, errors.New(msg))
+			caller := "PodUpdated"
+			if deleteFlag {
+				caller = "PodDeleted"
 			}
+			metadataSyncer.enqueueVolumeOperation(pv.Spec.CSI.VolumeHandle, metadataOperation(caller, updateSpec))
 		}
 	}
 	return errorList
@@ -0,0 +1,217 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume/fake"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+// TestStaticVolumeRegistration verifies that statically provisioned volumes
+// existing when the syncer starts leading, and added afterwards, are
+// registered in CNS without waiting for full sync.
+func TestStaticVolumeRegistration(t *testing.T) {
+	syncer, fakeCns := newTestSyncer(t)
+
+	newPV := func(name, volumeHandle string, claim *v1.PersistentVolumeClaim) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: volumeHandle},
+				},
+			},
+			Status: v1.PersistentVolumeStatus{Phase: v1.VolumeAvailable},
+		}
+		if claim != nil {
+			pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: claim.Namespace, Name: claim.Name}
+			pv.Status.Phase = v1.VolumeBound
+		}
+		return pv
+	}
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "static-pvc", Namespace: testNamespace},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "static-pv"},
+		Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+	}
+	dynamicPV := newPV("dynamic-pv", "dynamic-volume", nil)
+	dynamicPV.Annotations = map[string]string{annDynamicallyProvisioned: service.Name}
+	registeredPV := newPV("registered-pv", "registered-volume", nil)
+	if _, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{
+		Name:                 registeredPV.Name,
+		BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{BackingDiskId: "registered-volume"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	k8sclient := testclient.NewSimpleClientset(newPV("static-pv", "static-volume", claim), claim, dynamicPV, registeredPV)
+	informerFactory := informers.NewSharedInformerFactory(k8sclient, 0)
+	syncer.pvLister = informerFactory.Core().V1().PersistentVolumes().Lister()
+	syncer.pvcLister = informerFactory.Core().V1().PersistentVolumeClaims().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
+	syncer.setLeading(true)
+
+	// PVs added before leading, queried at once
+	syncer.registerStaticVolumes(context.Background())
+	if calls := fakeCns.Calls(fake.QueryVolume); calls != 1 {
+		t.Errorf("Expected a single QueryVolume call for all static volumes, got %d", calls)
+	}
+	if n := syncer.volumeQueue.Len(); n != 1 {
+		t.Errorf("Expected only the missing static volume to be queued, got %d", n)
+	}
+	syncVolumeQueue(syncer)
+	vol, ok := fakeCns.Volume("static-volume")
+	if !ok {
+		t.Fatalf("Static volume was not registered")
+	}
+	if len(vol.Metadata.EntityMetadata) != 2 {
+		t.Errorf("Expected PV and PVC metadata on the static volume, got %+v", vol.Metadata.EntityMetadata)
+	}
+	if _, ok := fakeCns.Volume("dynamic-volume"); ok {
+		t.Errorf("Dynamically provisioned volume should not be registered by the syncer")
+	}
+	if calls := fakeCns.Calls(fake.CreateVolume); calls != 2 {
+		t.Errorf("Expected only the static volume to be created, got %d CreateVolume calls", calls)
+	}
+
+	// PVs and PVCs added while leading
+	pvAdded(newPV("new-pv", "new-volume", nil), syncer)
+	pvcAdded(claim, syncer)
+	syncVolumeQueue(syncer)
+	if _, ok := fakeCns.Volume("new-volume"); !ok {
+		t.Errorf("Added static volume was not registered")
+	}
+	if calls := fakeCns.Calls(fake.CreateVolume); calls != 3 {
+		t.Errorf("Expected registered volumes not to be created again, got %d CreateVolume calls", calls)
+	}
+}
+
+// TestMetadataPropagation verifies that the informer callbacks propagate the
+// labels and annotations selected by the Metadata section of the config.
+func TestMetadataPropagation(t *testing.T) {
+	syncer, fakeCns := newTestSyncer(t)
+	cfg := syncer.cfg
+	cfg.Metadata = cnsconfig.MetadataConfig{
+		ExcludeLabels:      []string{"internal"},
+		IncludeAnnotations: []string{"example.com/*"},
+		NamespaceLabels:    true,
+		Rename:             []string{"example.com/*=ex/*"},
+	}
+	if err := cfg.Metadata.ParseRenames(); err != nil {
+		t.Fatal(err)
+	}
+	syncer.setLeading(true)
+
+	volumeID, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{Name: "pv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace, Labels: map[string]string{"env": "prod"}}}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv", Annotations: map[string]string{annDynamicallyProvisioned: service.Name}},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: volumeID.Id},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+	}
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: testNamespace, Labels: map[string]string{"app": "db"}},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: pv.Name},
+		Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+	}
+	k8sclient := testclient.NewSimpleClientset(namespace, pv, pvc)
+	informerFactory := informers.NewSharedInformerFactory(k8sclient, 0)
+	syncer.pvLister = informerFactory.Core().V1().PersistentVolumes().Lister()
+	syncer.pvcLister = informerFactory.Core().V1().PersistentVolumeClaims().Lister()
+	syncer.namespaceLister = informerFactory.Core().V1().Namespaces().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
+
+	pvcLabels := func() map[string]string {
+		vol, _ := fakeCns.Volume(volumeID.Id)
+		for _, entity := range vol.Metadata.EntityMetadata {
+			if entity := entity.(*cnstypes.CnsKubernetesEntityMetadata); entity.EntityType == string(cnstypes.CnsKubernetesEntityTypePVC) {
+				return cnsvsphere.GetLabelsMapFromKeyValue(entity.Labels)
+			}
+		}
+		return nil
+	}
+
+	annotated := pvc.DeepCopy()
+	annotated.Annotations = map[string]string{"example.com/owner": "alice", "other": "x"}
+	pvcUpdated(pvc, annotated, syncer)
+	syncVolumeQueue(syncer)
+	expected := map[string]string{"app": "db", "ex/owner": "alice", "env": "prod"}
+	if labels := pvcLabels(); !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected PVC labels %v in CNS, got %v", expected, labels)
+	}
+
+	// Changes of keys which are not propagated do not update CNS
+	calls := fakeCns.Calls(fake.UpdateVolumeMetadata)
+	excluded := annotated.DeepCopy()
+	excluded.Labels["internal"] = "true"
+	pvcUpdated(annotated, excluded, syncer)
+	syncVolumeQueue(syncer)
+	if fakeCns.Calls(fake.UpdateVolumeMetadata) != calls {
+		t.Errorf("Expected no CNS update for a label which is not propagated")
+	}
+
+	// Namespace label changes are propagated to the PVCs of the namespace
+	relabeled := namespace.DeepCopy()
+	relabeled.Labels["env"] = "test"
+	if _, err := k8sclient.CoreV1().Namespaces().Update(relabeled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k8sclient.CoreV1().PersistentVolumeClaims(testNamespace).Update(annotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		ns, err := syncer.namespaceLister.Get(testNamespace)
+		if err != nil || ns.Labels["env"] != "test" {
+			return false, nil
+		}
+		claim, err := syncer.pvcLister.PersistentVolumeClaims(testNamespace).Get(pvc.Name)
+		return err == nil && claim.Annotations["example.com/owner"] != "", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	namespaceUpdated(namespace, relabeled, syncer)
+	syncVolumeQueue(syncer)
+	if labels := pvcLabels(); labels["env"] != "test" {
+		t.Errorf("Expected the namespace label update in CNS, got %v", labels)
+	}
+}
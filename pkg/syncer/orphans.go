@@ -0,0 +1,490 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+const (
+	// Env variable for the number of minutes an orphan volume is reported
+	// before it is deleted. Orphan volumes are not deleted if it is not set.
+	envOrphanVolumeReclaimMinutes = "ORPHAN_VOLUME_RECLAIM_MINUTES"
+	// minOrphanVolumeReclaimMinutes is the shortest reclaim safety period
+	minOrphanVolumeReclaimMinutes = 60
+
+	// orphanReportName is the name of the ConfigMap the orphan volumes are
+	// reported in, in the namespace of the syncer
+	orphanReportName = "vsphere-csi-orphan-volumes"
+	// orphanReportKey is the key of the orphan volumes in the ConfigMap
+	orphanReportKey = "orphans.yaml"
+	// orphanReportTimeKey is the key of the time of the last detection
+	orphanReportTimeKey = "lastDetectionTime"
+
+	// orphanTypeCNS is a CNS volume of the cluster not referenced by any PV
+	orphanTypeCNS = "cns"
+	// orphanTypeFCD is a first class disk without CNS volume on a datastore
+	// with volumes of the cluster
+	orphanTypeFCD = "fcd"
+)
+
+var (
+	orphanVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vsphere_csi_orphan_volumes",
+		Help: "Number of orphan volumes found by the last full sync per orphan type.",
+	}, []string{"type"})
+	orphanVolumesCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vsphere_csi_orphan_volumes_capacity_bytes",
+		Help: "Capacity of the orphan volumes found by the last full sync per orphan type.",
+	}, []string{"type"})
+	orphanVolumesReclaimed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vsphere_csi_orphan_volumes_reclaimed_total",
+		Help: "Number of orphan volumes deleted after the reclaim period per orphan type.",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(orphanVolumes, orphanVolumesCapacity, orphanVolumesReclaimed)
+}
+
+// orphanVolume is a volume which is not used by the cluster.
+type orphanVolume struct {
+	VolumeID     string `json:"volumeID"`
+	Type         string `json:"type"`
+	Name         string `json:"name,omitempty"`
+	Datastore    string `json:"datastore"`
+	CapacityInMb int64  `json:"capacityInMb"`
+	// CreateTime is the creation time of a first class disk
+	CreateTime *metav1.Time `json:"createTime,omitempty"`
+	// FirstDetected is the time the volume was first found orphaned
+	FirstDetected metav1.Time `json:"firstDetected"`
+	// Owned is set once the volume was seen as a CNS volume of the
+	// cluster. Only owned first class disks are reclaimed.
+	Owned bool `json:"owned"`
+	// Bound is set once the volume was seen with PV metadata, e.g. a volume
+	// of a deleted PV with the Retain reclaim policy. Bound volumes are
+	// never reclaimed.
+	Bound bool `json:"bound,omitempty"`
+}
+
+// diskStore lists, retrieves and deletes the first class disks of a
+// datastore given by its URL.
+type diskStore interface {
+	ListDisks(ctx context.Context, datastoreURL string) ([]string, error)
+	RetrieveDisk(ctx context.Context, datastoreURL string, id string) (*vimtypes.VStorageObject, error)
+	DeleteDisk(ctx context.Context, datastoreURL string, id string) error
+}
+
+// orphanDetector finds CNS volumes of the cluster not referenced by any PV
+// and first class disks without CNS volume, reports them and, once they
+// stayed orphaned for the reclaim period, optionally deletes them.
+type orphanDetector struct {
+	disks     diskStore
+	namespace string
+	// reclaimPeriod is zero if orphan volumes are not deleted
+	reclaimPeriod time.Duration
+	// orphans are the orphan volumes found by the last detection by ID
+	orphans map[string]*orphanVolume
+	// loaded is set once the previous report was read
+	loaded bool
+	now    func() time.Time
+}
+
+// newOrphanDetector returns an orphanDetector for the first class disks of
+// the virtual center. The report is kept in the namespace of the pod.
+func newOrphanDetector(vc *cnsvsphere.VirtualCenter) *orphanDetector {
+	return &orphanDetector{
+		disks:         &vcDiskStore{vc: vc},
+		namespace:     podNamespace(),
+		reclaimPeriod: getOrphanVolumeReclaimPeriod(),
+		orphans:       make(map[string]*orphanVolume),
+		now:           time.Now,
+	}
+}
+
+// getOrphanVolumeReclaimPeriod returns the period set by
+// ORPHAN_VOLUME_RECLAIM_MINUTES, at least minOrphanVolumeReclaimMinutes, or
+// zero if it is not set or invalid
+func getOrphanVolumeReclaimPeriod() time.Duration {
+	v := os.Getenv(envOrphanVolumeReclaimMinutes)
+	if v == "" {
+		return 0
+	}
+	value, err := strconv.Atoi(v)
+	if err != nil || value <= 0 {
+		klog.Warningf("Orphans: %s %q is invalid, orphan volumes will not be deleted", envOrphanVolumeReclaimMinutes, v)
+		return 0
+	}
+	if value < minOrphanVolumeReclaimMinutes {
+		klog.Warningf("Orphans: %s %d is too short, using %d minutes", envOrphanVolumeReclaimMinutes, value, minOrphanVolumeReclaimMinutes)
+		value = minOrphanVolumeReclaimMinutes
+	}
+	klog.V(2).Infof("Orphans: orphan volumes are deleted after %d minutes", value)
+	return time.Duration(value) * time.Minute
+}
+
+// run detects the orphan volumes, reports them and deletes the ones orphaned
+// for longer than the reclaim period.
+func (d *orphanDetector) run(ctx context.Context, k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
+	if !d.loaded {
+		d.loadReport(k8sclient)
+	}
+	if err := d.detect(ctx, k8sclient, metadataSyncer.volumeManager, metadataSyncer.config().Global.ClusterID); err != nil {
+		klog.Warningf("Orphans: failed to detect orphan volumes. Err: %v", err)
+		return
+	}
+	if d.reclaimPeriod > 0 && !metadataSyncer.dryRun {
+		d.reclaim(ctx, k8sclient, metadataSyncer)
+	}
+	d.updateMetrics()
+	if err := d.writeReport(k8sclient); err != nil {
+		klog.Warningf("Orphans: failed to write report %s/%s. Err: %v", d.namespace, orphanReportName, err)
+	}
+}
+
+// getPVVolumeHandles returns the volume handles of all PVs of the driver,
+// whatever their phase.
+func getPVVolumeHandles(k8sclient clientset.Interface) (map[string]bool, error) {
+	pvs, err := k8sclient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	handles := make(map[string]bool)
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == service.Name {
+			handles[pv.Spec.CSI.VolumeHandle] = true
+		}
+	}
+	return handles, nil
+}
+
+// detect replaces the orphan volumes with the ones found now. The time a
+// volume was first found orphaned is kept across detections. On error the
+// orphan volumes are left unchanged.
+func (d *orphanDetector) detect(ctx context.Context, k8sclient clientset.Interface, volumeManager volumes.Manager, clusterID string) error {
+	pvVolumes, err := getPVVolumeHandles(k8sclient)
+	if err != nil {
+		return err
+	}
+	queryResult, err := volumeManager.QueryAllVolume(cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{clusterID},
+	}, cnstypes.CnsQuerySelection{})
+	if err != nil {
+		return err
+	}
+	now := metav1.NewTime(d.now())
+	orphans := make(map[string]*orphanVolume)
+	clusterVolumes := make(map[string]bool)
+	// The datastores with volumes of the cluster or known orphan volumes
+	// are searched for first class disks
+	datastores := make(map[string]bool)
+	for _, orphan := range d.orphans {
+		datastores[orphan.Datastore] = true
+	}
+	for _, vol := range queryResult.Volumes {
+		clusterVolumes[vol.VolumeId.Id] = true
+		datastores[vol.DatastoreUrl] = true
+		if pvVolumes[vol.VolumeId.Id] {
+			continue
+		}
+		orphans[vol.VolumeId.Id] = &orphanVolume{
+			VolumeID:      vol.VolumeId.Id,
+			Type:          orphanTypeCNS,
+			Name:          vol.Name,
+			Datastore:     vol.DatastoreUrl,
+			CapacityInMb:  vol.BackingObjectDetails.CapacityInMb,
+			FirstDetected: now,
+			Owned:         true,
+		}
+	}
+	if err = markBound(volumeManager, orphans); err != nil {
+		return err
+	}
+
+	// First class disks of the datastores which are neither PVs nor CNS
+	// volumes of the cluster may still be CNS volumes of other clusters
+	candidates := make(map[string]string)
+	var candidateIDs []cnstypes.CnsVolumeId
+	for datastoreURL := range datastores {
+		ids, err := d.disks.ListDisks(ctx, datastoreURL)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if !pvVolumes[id] && !clusterVolumes[id] {
+				candidates[id] = datastoreURL
+				candidateIDs = append(candidateIDs, cnstypes.CnsVolumeId{Id: id})
+			}
+		}
+	}
+	if len(candidateIDs) > 0 {
+		queryResult, err = volumeManager.QueryVolume(cnstypes.CnsQueryFilter{VolumeIds: candidateIDs})
+		if err != nil {
+			return err
+		}
+		for _, vol := range queryResult.Volumes {
+			delete(candidates, vol.VolumeId.Id)
+		}
+	}
+	for id, datastoreURL := range candidates {
+		disk, err := d.disks.RetrieveDisk(ctx, datastoreURL, id)
+		if err != nil {
+			return err
+		}
+		createTime := metav1.NewTime(disk.Config.CreateTime)
+		orphans[id] = &orphanVolume{
+			VolumeID:      id,
+			Type:          orphanTypeFCD,
+			Name:          disk.Config.Name,
+			Datastore:     datastoreURL,
+			CapacityInMb:  disk.Config.CapacityInMB,
+			CreateTime:    &createTime,
+			FirstDetected: now,
+		}
+	}
+
+	for id, orphan := range orphans {
+		if previous, ok := d.orphans[id]; ok {
+			orphan.FirstDetected = previous.FirstDetected
+			orphan.Owned = orphan.Owned || previous.Owned
+			orphan.Bound = orphan.Bound || previous.Bound
+		}
+	}
+	d.orphans = orphans
+	klog.V(2).Infof("Orphans: found %d orphan volumes", len(orphans))
+	return nil
+}
+
+// markBound sets Bound on the CNS orphan volumes with PV metadata.
+func markBound(volumeManager volumes.Manager, orphans map[string]*orphanVolume) error {
+	var ids []cnstypes.CnsVolumeId
+	for id := range orphans {
+		ids = append(ids, cnstypes.CnsVolumeId{Id: id})
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	queryResult, err := volumeManager.QueryVolume(cnstypes.CnsQueryFilter{VolumeIds: ids})
+	if err != nil {
+		return err
+	}
+	for _, vol := range queryResult.Volumes {
+		orphan := orphans[vol.VolumeId.Id]
+		if orphan == nil {
+			continue
+		}
+		for _, metadata := range vol.Metadata.EntityMetadata {
+			if entity, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata); ok && entity.EntityType == string(cnstypes.CnsKubernetesEntityTypePV) {
+				orphan.Bound = true
+			}
+		}
+	}
+	return nil
+}
+
+// reclaimable returns true if the orphan volume is deleted by reclaim. Volumes
+// which were bound to a PV are kept, as their PV may have been deleted on
+// purpose with the Retain reclaim policy. First class disks are only deleted
+// if they were CNS volumes of the cluster.
+func (d *orphanDetector) reclaimable(orphan *orphanVolume) bool {
+	return d.reclaimPeriod > 0 && orphan.Owned && !orphan.Bound && d.now().Sub(orphan.FirstDetected.Time) >= d.reclaimPeriod
+}
+
+// plan returns the orphan volumes as operations of a dry run full sync plan.
+func (d *orphanDetector) plan() []plannedOperation {
+	var plan []plannedOperation
+	for _, orphan := range d.sortedOrphans() {
+		op := plannedOperation{VolumeID: orphan.VolumeID, Operation: keepOrphanVolumeOperation}
+		switch {
+		case d.reclaimable(orphan):
+			op.Operation = reclaimOrphanVolumeOperation
+			op.Reason = fmt.Sprintf("%s volume is orphaned since %v, longer than the reclaim period", orphan.Type, orphan.FirstDetected)
+		case orphan.Bound:
+			op.Reason = fmt.Sprintf("%s volume is orphaned but was bound to a PV, it is never deleted", orphan.Type)
+		case !orphan.Owned:
+			op.Reason = fmt.Sprintf("%s volume is orphaned but was never a CNS volume of the cluster, it is never deleted", orphan.Type)
+		case d.reclaimPeriod == 0:
+			op.Reason = fmt.Sprintf("%s volume is orphaned, it is not deleted as %s is not set", orphan.Type, envOrphanVolumeReclaimMinutes)
+		default:
+			op.Reason = fmt.Sprintf("%s volume is orphaned, it is deleted after %v if still orphaned", orphan.Type, orphan.FirstDetected.Add(d.reclaimPeriod).UTC())
+		}
+		plan = append(plan, op)
+	}
+	return plan
+}
+
+// reclaim deletes the orphan volumes found orphaned for longer than the
+// reclaim period. PVs are listed again before deleting, holding the volume
+// locks shared with full sync and the metadata syncer, so a volume statically
+// provisioned meanwhile is kept.
+func (d *orphanDetector) reclaim(ctx context.Context, k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
+	var reclaimable []string
+	for id, orphan := range d.orphans {
+		if d.reclaimable(orphan) {
+			reclaimable = append(reclaimable, id)
+		}
+	}
+	if len(reclaimable) == 0 {
+		return
+	}
+	metadataSyncer.volumeLocks.lock(reclaimable...)
+	defer metadataSyncer.volumeLocks.unlock(reclaimable...)
+	pvVolumes, err := getPVVolumeHandles(k8sclient)
+	if err != nil {
+		klog.Warningf("Orphans: failed to get PVs from kubernetes, orphan volumes are not deleted. Err: %v", err)
+		return
+	}
+	for _, id := range reclaimable {
+		orphan := d.orphans[id]
+		if pvVolumes[id] {
+			continue
+		}
+		klog.Infof("Orphans: deleting %s volume %s on datastore %s orphaned since %v", orphan.Type, id, orphan.Datastore, orphan.FirstDetected)
+		if orphan.Type == orphanTypeCNS {
+			err = metadataSyncer.volumeManager.DeleteVolume(id, true)
+		} else {
+			err = d.disks.DeleteDisk(ctx, orphan.Datastore, id)
+		}
+		if err != nil {
+			klog.Warningf("Orphans: failed to delete %s volume %s. Err: %v", orphan.Type, id, err)
+			continue
+		}
+		orphanVolumesReclaimed.WithLabelValues(orphan.Type).Inc()
+		delete(d.orphans, id)
+	}
+}
+
+// updateMetrics sets the orphan volume gauges.
+func (d *orphanDetector) updateMetrics() {
+	for _, orphanType := range []string{orphanTypeCNS, orphanTypeFCD} {
+		count, capacityInMb := 0, int64(0)
+		for _, orphan := range d.orphans {
+			if orphan.Type == orphanType {
+				count++
+				capacityInMb += orphan.CapacityInMb
+			}
+		}
+		orphanVolumes.WithLabelValues(orphanType).Set(float64(count))
+		orphanVolumesCapacity.WithLabelValues(orphanType).Set(float64(capacityInMb) * 1024 * 1024)
+	}
+}
+
+// sortedOrphans returns the orphan volumes sorted by ID.
+func (d *orphanDetector) sortedOrphans() []*orphanVolume {
+	orphans := make([]*orphanVolume, 0, len(d.orphans))
+	for _, orphan := range d.orphans {
+		orphans = append(orphans, orphan)
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].VolumeID < orphans[j].VolumeID })
+	return orphans
+}
+
+// writeReport creates or updates the ConfigMap listing the orphan volumes.
+func (d *orphanDetector) writeReport(k8sclient clientset.Interface) error {
+	report, err := yaml.Marshal(d.sortedOrphans())
+	if err != nil {
+		return err
+	}
+	data := map[string]string{
+		orphanReportKey:     string(report),
+		orphanReportTimeKey: d.now().UTC().Format(time.RFC3339),
+	}
+	return applyConfigMap(k8sclient, d.namespace, orphanReportName, data)
+}
+
+// loadReport restores the orphan volumes of the last report, so that the
+// reclaim period and ownership survive restarts and leader changes.
+func (d *orphanDetector) loadReport(k8sclient clientset.Interface) {
+	configMap, err := k8sclient.CoreV1().ConfigMaps(d.namespace).Get(orphanReportName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		d.loaded = true
+		return
+	}
+	if err != nil {
+		klog.Warningf("Orphans: failed to read report %s/%s. Err: %v", d.namespace, orphanReportName, err)
+		return
+	}
+	var orphans []*orphanVolume
+	if err = yaml.Unmarshal([]byte(configMap.Data[orphanReportKey]), &orphans); err != nil {
+		klog.Warningf("Orphans: ignoring invalid report %s/%s. Err: %v", d.namespace, orphanReportName, err)
+	}
+	for _, orphan := range orphans {
+		d.orphans[orphan.VolumeID] = orphan
+	}
+	d.loaded = true
+}
+
+// vcDiskStore is the diskStore of a virtual center.
+type vcDiskStore struct {
+	vc *cnsvsphere.VirtualCenter
+}
+
+// datastore returns the datastore with the given URL in any datacenter.
+func (s *vcDiskStore) datastore(ctx context.Context, datastoreURL string) (*cnsvsphere.Datastore, error) {
+	dcs, err := s.vc.GetDatacenters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, dc := range dcs {
+		if ds, err := dc.GetDatastoreByURL(ctx, datastoreURL); err == nil {
+			return ds, nil
+		}
+	}
+	return nil, fmt.Errorf("datastore %q not found", datastoreURL)
+}
+
+func (s *vcDiskStore) ListDisks(ctx context.Context, datastoreURL string) ([]string, error) {
+	ds, err := s.datastore(ctx, datastoreURL)
+	if err != nil {
+		return nil, err
+	}
+	return ds.ListFirstClassDisks(ctx)
+}
+
+func (s *vcDiskStore) RetrieveDisk(ctx context.Context, datastoreURL string, id string) (*vimtypes.VStorageObject, error) {
+	ds, err := s.datastore(ctx, datastoreURL)
+	if err != nil {
+		return nil, err
+	}
+	return ds.RetrieveFirstClassDisk(ctx, id)
+}
+
+func (s *vcDiskStore) DeleteDisk(ctx context.Context, datastoreURL string, id string) error {
+	ds, err := s.datastore(ctx, datastoreURL)
+	if err != nil {
+		return err
+	}
+	return ds.DeleteFirstClassDisk(ctx, id)
+}
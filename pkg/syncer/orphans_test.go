@@ -0,0 +1,163 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume/fake"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+// fakeDiskStore keeps the first class disks of a single datastore.
+type fakeDiskStore map[string]*vimtypes.VStorageObject
+
+func (s fakeDiskStore) ListDisks(ctx context.Context, datastoreURL string) ([]string, error) {
+	var ids []string
+	for id := range s {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s fakeDiskStore) RetrieveDisk(ctx context.Context, datastoreURL string, id string) (*vimtypes.VStorageObject, error) {
+	return s[id], nil
+}
+
+func (s fakeDiskStore) DeleteDisk(ctx context.Context, datastoreURL string, id string) error {
+	delete(s, id)
+	return nil
+}
+
+func TestOrphanDetector(t *testing.T) {
+	cfg := &cnsconfig.Config{}
+	cfg.Global.ClusterID = testClusterName
+	fakeCns := fake.NewManager()
+	syncer := &MetadataSyncInformer{cfg: cfg, volumeManager: fakeCns}
+	createVolume := func(name string, clusterID string, entities ...cnstypes.BaseCnsEntityMetadata) string {
+		id, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{
+			Name: name,
+			Metadata: cnstypes.CnsVolumeMetadata{
+				ContainerCluster: cnsvsphere.GetContainerCluster(clusterID, "user"),
+				EntityMetadata:   entities,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id.Id
+	}
+	usedVolume := createVolume("used", testClusterName)
+	orphanID := createVolume("orphan", testClusterName)
+	otherClusterVolume := createVolume("other", "other-cluster")
+	// retainedID is the volume of a PV with the Retain reclaim policy
+	// deleted by the admin
+	retainedID := createVolume("retained", testClusterName, cnsvsphere.GetCnsKubernetesEntityMetaData(
+		"retained-pv", nil, false, string(cnstypes.CnsKubernetesEntityTypePV), ""))
+	disks := fakeDiskStore{}
+	for _, id := range []string{usedVolume, orphanID, otherClusterVolume, retainedID, "unknown-disk"} {
+		disks[id] = &vimtypes.VStorageObject{Config: vimtypes.VStorageObjectConfigInfo{
+			BaseConfigInfo: vimtypes.BaseConfigInfo{Id: vimtypes.ID{Id: id}, Name: id},
+			CapacityInMB:   1024,
+		}}
+	}
+	k8sclient := testclient.NewSimpleClientset(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: usedVolume},
+			},
+		},
+	})
+	now := time.Now()
+	newDetector := func() *orphanDetector {
+		return &orphanDetector{
+			disks:         disks,
+			namespace:     "kube-system",
+			reclaimPeriod: time.Hour,
+			orphans:       make(map[string]*orphanVolume),
+			now:           func() time.Time { return now },
+		}
+	}
+
+	detector := newDetector()
+	detector.run(context.Background(), k8sclient, syncer)
+	if len(detector.orphans) != 3 {
+		t.Fatalf("Expected 3 orphan volumes, got %v", detector.sortedOrphans())
+	}
+	if orphan := detector.orphans[orphanID]; orphan == nil || orphan.Type != orphanTypeCNS || !orphan.Owned || orphan.Bound {
+		t.Errorf("Expected CNS volume %s without PV to be an owned orphan, got %+v", orphanID, orphan)
+	}
+	if orphan := detector.orphans[retainedID]; orphan == nil || !orphan.Owned || !orphan.Bound {
+		t.Errorf("Expected CNS volume %s of a deleted PV to be a bound orphan, got %+v", retainedID, orphan)
+	}
+	if orphan := detector.orphans["unknown-disk"]; orphan == nil || orphan.Type != orphanTypeFCD || orphan.Owned || orphan.CapacityInMb != 1024 {
+		t.Errorf("Expected disk without CNS volume to be an orphan, got %+v", orphan)
+	}
+
+	// The reclaim period is kept across restarts through the report
+	firstDetected := now
+	now = now.Add(2 * time.Hour)
+	detector = newDetector()
+	detector.run(context.Background(), k8sclient, syncer)
+	if _, ok := fakeCns.Volume(orphanID); ok {
+		t.Errorf("Orphan volume %s was not deleted after the reclaim period", orphanID)
+	}
+	if _, ok := detector.orphans[orphanID]; ok {
+		t.Errorf("Deleted orphan volume %s is still reported", orphanID)
+	}
+	orphan := detector.orphans["unknown-disk"]
+	if orphan == nil || !orphan.FirstDetected.Time.Equal(metav1.NewTime(firstDetected).Rfc3339Copy().Time) {
+		t.Errorf("Expected disk not owned by the cluster to be kept and reported since %v, got %+v", firstDetected, orphan)
+	}
+	if _, ok := disks[usedVolume]; !ok {
+		t.Errorf("Volume %s of a PV was deleted", usedVolume)
+	}
+	if _, ok := fakeCns.Volume(retainedID); !ok {
+		t.Errorf("Volume %s of a retained PV was deleted", retainedID)
+	}
+
+	// The retained disk is kept once full sync removed its CNS volume
+	if err := fakeCns.DeleteVolume(retainedID, false); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	detector.run(context.Background(), k8sclient, syncer)
+	if orphan := detector.orphans[retainedID]; orphan == nil || orphan.Type != orphanTypeFCD || !orphan.Bound {
+		t.Errorf("Expected retained disk %s to be reported as bound, got %+v", retainedID, orphan)
+	}
+	if _, ok := disks[retainedID]; !ok {
+		t.Errorf("Disk %s of a retained PV was deleted", retainedID)
+	}
+	configMap, err := k8sclient.CoreV1().ConfigMaps("kube-system").Get(orphanReportName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Data[orphanReportKey] == "" {
+		t.Errorf("Orphan volumes are not reported")
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// fullSyncStatusName is the name of the ConfigMap the status of full
+	// sync is published in, in the namespace of the syncer
+	fullSyncStatusName = "vsphere-csi-full-sync-status"
+
+	// Results of a full sync cycle
+	fullSyncSucceeded = "Succeeded"
+	// Some operations failed, or the cycle stopped on an error
+	fullSyncFailed = "Failed"
+	// The cycle exceeded the deletion limits and skipped its deletions
+	fullSyncDeletionsSkipped = "DeletionsSkipped"
+)
+
+// fullSyncStatus is the status of a full sync cycle.
+type fullSyncStatus struct {
+	lock             sync.Mutex
+	startTime        time.Time
+	created          int
+	updated          int
+	deleted          int
+	deletionsSkipped bool
+	err              error
+}
+
+// setError records an error which fails the cycle.
+func (status *fullSyncStatus) setError(err error) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+	status.err = err
+}
+
+// add adds to the number of volumes created, updated and deleted.
+func (status *fullSyncStatus) add(created, updated, deleted int) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+	status.created += created
+	status.updated += updated
+	status.deleted += deleted
+}
+
+// publishFullSyncStatus publishes the status of the cycle which just ended
+// in the full sync status ConfigMap. The time and message of the last
+// failure and the time of the last success are kept across cycles.
+func (metadataSyncer *MetadataSyncInformer) publishFullSyncStatus(k8sclient clientset.Interface, status *fullSyncStatus) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+	endTime := time.Now()
+	result := fullSyncSucceeded
+	if status.deletionsSkipped {
+		result = fullSyncDeletionsSkipped
+	} else if status.err != nil {
+		result = fullSyncFailed
+	}
+	data := map[string]string{
+		"clusterID":        metadataSyncer.config().Global.ClusterID,
+		"lastStartTime":    status.startTime.UTC().Format(time.RFC3339),
+		"lastEndTime":      endTime.UTC().Format(time.RFC3339),
+		"lastDuration":     endTime.Sub(status.startTime).String(),
+		"lastResult":       result,
+		"volumesCreated":   strconv.Itoa(status.created),
+		"volumesUpdated":   strconv.Itoa(status.updated),
+		"volumesDeleted":   strconv.Itoa(status.deleted),
+		"pendingCreations": strconv.Itoa(len(metadataSyncer.cnsCreationMap)),
+		"pendingDeletions": strconv.Itoa(len(metadataSyncer.cnsDeletionMap)),
+		"dryRun":           strconv.FormatBool(metadataSyncer.dryRun),
+	}
+	// Keep the last error and success of previous cycles
+	for _, key := range []string{"lastError", "lastErrorTime", "lastSuccessTime"} {
+		if value, ok := metadataSyncer.fullSyncStatus[key]; ok {
+			data[key] = value
+		}
+	}
+	if status.err != nil {
+		data["lastError"] = status.err.Error()
+		data["lastErrorTime"] = data["lastEndTime"]
+	}
+	if result == fullSyncSucceeded {
+		data["lastSuccessTime"] = data["lastEndTime"]
+	}
+	metadataSyncer.fullSyncStatus = data
+	klog.V(2).Infof("FullSync: %s in %s, %d volumes created, %d updated, %d deleted", result, data["lastDuration"], status.created, status.updated, status.deleted)
+	namespace := podNamespace()
+	if err := applyConfigMap(k8sclient, namespace, fullSyncStatusName, data); err != nil {
+		klog.Warningf("FullSync: failed to publish the status in %s/%s. Err: %v", namespace, fullSyncStatusName, err)
+	}
+}
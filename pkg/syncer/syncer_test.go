@@ -117,6 +117,7 @@ func TestSyncerWorkflows(t *testing.T) {
 		vcconfig:             cnsVCenterConfig,
 		virtualcentermanager: virtualCenterManager,
 		vcenter:              virtualCenter,
+		volumeManager:        volumeManager,
 	}
 
 	// Create the kubernetes client
@@ -130,8 +131,11 @@ func TestSyncerWorkflows(t *testing.T) {
 	metadataSyncer.k8sInformerManager.Listen()
 
 	// Initialize maps needed for full sync
-	cnsCreationMap = make(map[string]bool)
-	cnsDeletionMap = make(map[string]bool)
+	metadataSyncer.cnsCreationMap = make(map[string]bool)
+	metadataSyncer.cnsDeletionMap = make(map[string]int)
+	// Informer callbacks queue their CNS operations, run by the leader
+	metadataSyncer.initVolumeQueue()
+	metadataSyncer.setLeading(true)
 
 	runMetadataSyncerTest(t)
 	runFullSyncTest(t)
@@ -160,6 +164,17 @@ func TestSyncerWorkflows(t *testing.T) {
 		12. Verify pv delete workflow deletes pv metadata from vc
 */
 
+// syncVolumeQueue runs the CNS operations queued by the informer callbacks,
+// including the batched metadata updates.
+func syncVolumeQueue(metadataSyncer *MetadataSyncInformer) {
+	for metadataSyncer.volumeQueue.Len() > 0 {
+		for metadataSyncer.volumeQueue.Len() > 0 {
+			metadataSyncer.processNextVolume()
+		}
+		metadataSyncer.metadataBatcher.wait()
+	}
+}
+
 func runMetadataSyncerTest(t *testing.T) {
 	t.Log("Begin MetadataSyncer Test")
 
@@ -200,6 +215,7 @@ func runMetadataSyncerTest(t *testing.T) {
 	newPv := getPersistentVolumeSpec(volumeID.Id, v1.PersistentVolumeReclaimRetain, newLabel, v1.VolumeAvailable, "")
 
 	pvUpdated(oldPv, newPv, metadataSyncer)
+	syncVolumeQueue(metadataSyncer)
 
 	// Verify pv label of volume matches that of updated metadata
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
@@ -227,6 +243,7 @@ func runMetadataSyncerTest(t *testing.T) {
 	newPv = getPersistentVolumeSpec(volumeID.Id, v1.PersistentVolumeReclaimRetain, newLabel, v1.VolumeAvailable, "")
 
 	pvUpdated(oldPv, newPv, metadataSyncer)
+	syncVolumeQueue(metadataSyncer)
 
 	// Verify pv label of volume matches that of updated metadata
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
@@ -249,6 +266,7 @@ func runMetadataSyncerTest(t *testing.T) {
 	oldPvc := getPersistentVolumeClaimSpec(testNamespace, nil, pv.Name)
 	newPvc := getPersistentVolumeClaimSpec(testNamespace, newPVCLabel, pv.Name)
 	pvcUpdated(oldPvc, newPvc, metadataSyncer)
+	syncVolumeQueue(metadataSyncer)
 
 	// Verify pvc label of volume matches that of updated metadata
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
@@ -268,6 +286,7 @@ func runMetadataSyncerTest(t *testing.T) {
 	oldPod := getPodSpec(pvc.Name, v1.PodPending)
 	newPod := getPodSpec(pvc.Name, v1.PodRunning)
 	podUpdated(oldPod, newPod, metadataSyncer)
+	syncVolumeQueue(metadataSyncer)
 
 	// Verify pod name associated with volume matches updated pod name
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
@@ -279,6 +298,7 @@ func runMetadataSyncerTest(t *testing.T) {
 
 	// Test podDeleted workflow on VC
 	podDeleted(newPod, metadataSyncer)
+	syncVolumeQueue(metadataSyncer)
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
 		t.Fatal(err)
 	}
@@ -288,6 +308,7 @@ func runMetadataSyncerTest(t *testing.T) {
 
 	// Test pvcDelete workflow
 	pvcDeleted(newPvc, metadataSyncer)
+	syncVolumeQueue(metadataSyncer)
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
 		t.Fatal(err)
 	}
@@ -297,6 +318,7 @@ func runMetadataSyncerTest(t *testing.T) {
 
 	// Test pvDelete workflow
 	pvDeleted(newPv, metadataSyncer)
+	syncVolumeQueue(metadataSyncer)
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,92 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"k8s.io/klog"
+)
+
+const (
+	// FullSyncPath is the path of the endpoint of the health server
+	// requesting an immediate full sync with a POST request.
+	FullSyncPath = "/fullsync"
+	// envFullSyncToken is the environment variable holding the bearer token
+	// of FullSyncPath requests. The endpoint is disabled if it is not set.
+	envFullSyncToken = "FULL_SYNC_TOKEN"
+)
+
+// getFullSyncToken returns the bearer token set by FULL_SYNC_TOKEN.
+func getFullSyncToken() string {
+	return os.Getenv(envFullSyncToken)
+}
+
+// requestFullSync queues a full sync cycle, run by the leader once the
+// running cycle, if any, ends. It returns false if a cycle was already
+// queued, in which case the requests are coalesced.
+func (metadataSyncer *MetadataSyncInformer) requestFullSync() bool {
+	select {
+	case metadataSyncer.fullSyncRequests <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// dropFullSyncRequest drops the queued full sync cycle, if any.
+func (metadataSyncer *MetadataSyncInformer) dropFullSyncRequest() {
+	select {
+	case <-metadataSyncer.fullSyncRequests:
+		klog.V(2).Infof("FullSync: dropped the requested full sync")
+	default:
+	}
+}
+
+// fullSyncHandler returns the handler of FullSyncPath. It responds with 401
+// unless the request has the bearer token, with 202 once a full sync is
+// queued, and with 503 on a replica which isn't the leader.
+func (metadataSyncer *MetadataSyncInformer) fullSyncHandler(token string) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST to request a full sync", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			klog.Warningf("FullSync: rejected unauthorized request on %s by %s", FullSyncPath, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !metadataSyncer.isLeading() {
+			http.Error(w, "this replica is not the leader, request the full sync on the leader", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		if metadataSyncer.requestFullSync() {
+			klog.V(2).Infof("FullSync: requested on %s by %s", FullSyncPath, r.RemoteAddr)
+			_, _ = w.Write([]byte("full sync requested\n"))
+		} else {
+			_, _ = w.Write([]byte("full sync already pending\n"))
+		}
+	})
+}
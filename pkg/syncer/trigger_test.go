@@ -0,0 +1,94 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFullSyncRequest(t *testing.T) {
+	syncer, _ := newTestSyncer(t)
+	handler := syncer.fullSyncHandler("secret")
+	requestWithToken := func(method string, token string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, FullSyncPath, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	request := func(method string) int {
+		return requestWithToken(method, "secret")
+	}
+
+	if code := request(http.MethodGet); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected, got %d", code)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if code := requestWithToken(http.MethodPost, token); code != http.StatusUnauthorized {
+			t.Errorf("Expected request with token %q to be rejected, got %d", token, code)
+		}
+	}
+	if code := request(http.MethodPost); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected request on a standby replica to be rejected, got %d", code)
+	}
+	syncer.setLeading(true)
+	if code := request(http.MethodPost); code != http.StatusAccepted {
+		t.Errorf("Expected request on the leader to be accepted, got %d", code)
+	}
+	if syncer.requestFullSync() {
+		t.Errorf("Expected requests to be coalesced while a full sync is pending")
+	}
+
+	// A pending request is dropped when the leader stops leading
+	canceled, cancelLead := context.WithCancel(context.Background())
+	cancelLead()
+	syncer.lead(canceled, testclient.NewSimpleClientset())
+	if !syncer.requestFullSync() {
+		t.Errorf("Expected the pending full sync to be dropped when leadership is lost")
+	}
+
+	k8sclient := testclient.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		syncer.lead(ctx, k8sclient)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := k8sclient.CoreV1().ConfigMaps(podNamespace()).Get(fullSyncStatusName, metav1.GetOptions{}); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Requested full sync did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -18,10 +18,14 @@ package syncer
 
 import (
 	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/util/workqueue"
 
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
@@ -43,36 +47,70 @@ const (
 
 	// Env variable for FullSync interval
 	envFullSyncIntervalMinutes = "FULL_SYNC_INTERVAL_MINUTES"
-)
-
-var (
-	// Create a mapping of CNS volume to Pod name
-	// as this mapping does not exist in K8s
-	// in case a Pod entry needs to be deleted from CNS cache
-	cnsVolumeToPodMap map[string]string
-
-	// Create a mapping of CNS volume to Pvc name
-	cnsVolumeToPvcMap map[string]string
-
-	// Create a mapping of CNS volume to entity Namespace name
-	// Here entity can be either PVC or Pod - both will
-	// belong to the same namespace
-	cnsVolumeToEntityNamespaceMap map[string]string
-
-	// cnsDeletionMap tracks volumes that exist in CNS but not in K8s
-	// If a volume exists in this map across two fullsync cycles,
-	// the volume is deleted from CNS
-	cnsDeletionMap map[string]bool
-
-	// cnsCreationMap tracks volumes that exist in K8s but not in CNS
-	// If a volume exists in this map across two fullsync cycles,
-	// the volume is created in CNS
-	cnsCreationMap map[string]bool
-
-	// Metadata syncer and full sync share a global lock
-	// to mitigate race conditions related to
-	// static provisioning of volumes
-	volumeOperationsLock sync.Mutex
+	// Env variable for the maximum number of volumes deleted from CNS by a
+	// FullSync cycle
+	envFullSyncMaxDeletions = "FULL_SYNC_MAX_DELETIONS"
+	// Env variable for the maximum percentage of the CNS volumes of the
+	// cluster deleted by a FullSync cycle
+	envFullSyncMaxDeletionsPercent = "FULL_SYNC_MAX_DELETIONS_PERCENT"
+	// default maximum percentage of the CNS volumes deleted by a FullSync
+	// cycle
+	defaultFullSyncMaxDeletionsPercent = 50
+	// Env variable for the number of CNS volumes of the cluster from which
+	// on FULL_SYNC_MAX_DELETIONS_PERCENT applies
+	envFullSyncMaxDeletionsPercentMinVolumes = "FULL_SYNC_MAX_DELETIONS_PERCENT_MIN_VOLUMES"
+	// default number of CNS volumes from which on the percentage applies
+	defaultFullSyncMaxDeletionsPercentMinVolumes = 10
+	// Env variable for the number of consecutive FullSync cycles a volume
+	// must be missing in K8s before it is deleted from CNS
+	envFullSyncDeletionConfirmationCycles = "FULL_SYNC_DELETION_CONFIRMATION_CYCLES"
+	// default number of confirmation cycles before a volume is deleted
+	defaultDeletionConfirmationCycles = 2
+	// Env variable for the number of CNS operations a FullSync cycle runs
+	// in parallel
+	envFullSyncWorkers = "FULL_SYNC_WORKERS"
+	// default number of parallel FullSync operations
+	defaultFullSyncWorkers = 8
+	// fullSyncUpdateBatchSize is the number of volumes of each metadata
+	// update batch of FullSync
+	fullSyncUpdateBatchSize = 100
+	// fullSyncProgressInterval is the number of operations between two
+	// FullSync progress logs
+	fullSyncProgressInterval = 100
+
+	// Env variable for the number of workers running the CNS operations of
+	// the metadata syncer
+	envMetadataSyncWorkers = "METADATA_SYNC_WORKERS"
+	// default number of metadata syncer workers
+	defaultMetadataSyncWorkers = 4
+	// Env variable for the number of retries of a failed CNS operation of
+	// the metadata syncer before it is left to FullSync
+	envMetadataSyncMaxRetries = "METADATA_SYNC_MAX_RETRIES"
+	// default number of retries of a failed CNS operation
+	defaultMetadataSyncMaxRetries = 10
+	// Env variable for the maximum number of volumes whose metadata updates
+	// the metadata syncer submits in a single CNS task
+	envMetadataSyncBatchSize = "METADATA_SYNC_BATCH_SIZE"
+	// default number of volumes per metadata update batch
+	defaultMetadataSyncBatchSize = 50
+	// metadataBatchDelay is how long a metadata update waits for the updates
+	// of other volumes to share its batch
+	metadataBatchDelay = 100 * time.Millisecond
+	// Exponential backoff of the retries of failed CNS operations
+	volumeRetryBaseDelay = time.Second
+	volumeRetryMaxDelay  = 5 * time.Minute
+
+	// annDynamicallyProvisioned is the annotation of PVs set by the
+	// provisioner which created their volume
+	annDynamicallyProvisioned = "pv.kubernetes.io/provisioned-by"
+
+	// FullSyncProtectedAnnotation is the annotation of PVs full sync must
+	// never act on, when set to "true"
+	FullSyncProtectedAnnotation = "csi.vsphere.vmware.com/full-sync-protected"
+
+	// Names of the syncer specific health checks
+	syncerCheckName    = "syncer"
+	informersCheckName = "informers"
 )
 
 type (
@@ -82,13 +120,73 @@ type (
 	podMap = map[string]*v1.Pod
 )
 
+// fullSyncLimits are the safeguards of FullSync deletions. Zero values
+// disable the maximums and use the default confirmation cycles.
+type fullSyncLimits struct {
+	maxDeletions         int
+	maxDeletionsPercent  int
+	minVolumesForPercent int
+	confirmationCycles   int
+}
+
 // MetadataSyncInformer is the struct for metadata sync informer
 type MetadataSyncInformer struct {
+	// cfg is replaced by reloadConfig, read it with config()
 	cfg                  *cnsconfig.Config
+	cfgLock              sync.RWMutex
 	vcconfig             *cnsvsphere.VirtualCenterConfig
 	k8sInformerManager   *k8s.InformerManager
 	virtualcentermanager cnsvsphere.VirtualCenterManager
 	vcenter              *cnsvsphere.VirtualCenter
+	volumeManager        volumes.Manager
 	pvLister             corelisters.PersistentVolumeLister
 	pvcLister            corelisters.PersistentVolumeClaimLister
+	namespaceLister      corelisters.NamespaceLister
+	leaderElection       LeaderElectionConfig
+	leaderWatchDog       *leaderelection.HealthzAdaptor
+	orphanDetector       *orphanDetector
+	// dryRun is set if CNS operations are only logged and reported
+	dryRun bool
+	// fullSyncLimits are the safeguards of FullSync deletions
+	fullSyncLimits fullSyncLimits
+	// fullSyncWorkers is the number of CNS operations FullSync runs in
+	// parallel
+	fullSyncWorkers int
+	// fullSyncStatus is the last published FullSync status
+	fullSyncStatus map[string]string
+	// fullSyncRequests holds a FullSync requested on demand until it runs
+	fullSyncRequests chan struct{}
+	// leading is 1 while this replica is the leader, accessed atomically
+	leading int32
+
+	// cnsVolumeToPodMap maps CNS volumes to the Pod name, as this mapping
+	// does not exist in K8s, in case a Pod entry needs to be deleted from CNS
+	cnsVolumeToPodMap map[string]string
+	// cnsVolumeToPvcMap maps CNS volumes to the PVC name
+	cnsVolumeToPvcMap map[string]string
+	// cnsVolumeToEntityNamespaceMap maps CNS volumes to the namespace of
+	// their PVC and Pod entities
+	cnsVolumeToEntityNamespaceMap map[string]string
+	// cnsDeletionMap counts the consecutive full sync cycles a volume
+	// exists in CNS but not in K8s. Once the count reaches the confirmation
+	// cycles, the volume is deleted from CNS
+	cnsDeletionMap map[string]int
+	// cnsCreationMap tracks volumes that exist in K8s but not in CNS. If a
+	// volume exists in this map across two full sync cycles, the volume is
+	// created in CNS
+	cnsCreationMap map[string]bool
+	// volumeLocks are shared by the metadata syncer, full sync and the
+	// orphan detector to mitigate race conditions related to static
+	// provisioning of volumes
+	volumeLocks volumeLocks
+	// volumeQueue holds the IDs of the volumes with pending operations
+	volumeQueue workqueue.RateLimitingInterface
+	// volumeQueueMaxRetries is the number of retries of a failed operation
+	volumeQueueMaxRetries int
+	// pendingOperations are the operations of the volumes in volumeQueue
+	pendingOperations map[string][]volumeOperation
+	// pendingLock protects pendingOperations
+	pendingLock sync.Mutex
+	// metadataBatcher submits the metadata updates of the volume workers
+	metadataBatcher *metadataBatcher
 }
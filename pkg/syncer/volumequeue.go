@@ -0,0 +1,231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// volumeOperation is a CNS operation of the metadata syncer on a volume.
+type volumeOperation struct {
+	// key identifies the operation when coalescing: the entity of a
+	// metadata update, createVolumeOperation or deleteVolumeOperation
+	key string
+	// caller is the informer callback which queued the operation
+	caller string
+	// updateSpec is set for metadata updates
+	updateSpec *cnstypes.CnsVolumeMetadataUpdateSpec
+	// createSpec is set when the volume is created
+	createSpec *cnstypes.CnsVolumeCreateSpec
+	// deleteDisk is passed to DeleteVolume when the volume is deleted
+	deleteDisk bool
+}
+
+// metadataOperation returns the operation updating the metadata of an entity.
+func metadataOperation(caller string, updateSpec *cnstypes.CnsVolumeMetadataUpdateSpec) volumeOperation {
+	op := volumeOperation{caller: caller, updateSpec: updateSpec}
+	for _, metadata := range updateSpec.Metadata.EntityMetadata {
+		if entity, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata); ok {
+			op.key += fmt.Sprintf("%s/%s/%s", entity.EntityType, entity.Namespace, entity.EntityName)
+		}
+	}
+	return op
+}
+
+// initVolumeQueue creates the queue of the volumes with pending operations.
+// Failed operations are retried with exponential backoff, up to
+// METADATA_SYNC_MAX_RETRIES times.
+func (metadataSyncer *MetadataSyncInformer) initVolumeQueue() {
+	metadataSyncer.volumeQueue = workqueue.NewNamedRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(volumeRetryBaseDelay, volumeRetryMaxDelay), "volumes")
+	metadataSyncer.pendingOperations = make(map[string][]volumeOperation)
+	metadataSyncer.volumeQueueMaxRetries = getNonNegativeEnv(envMetadataSyncMaxRetries, defaultMetadataSyncMaxRetries, -1)
+	metadataSyncer.metadataBatcher = newMetadataBatcher(getNonNegativeEnv(envMetadataSyncBatchSize, defaultMetadataSyncBatchSize, -1),
+		metadataBatchDelay, metadataSyncer.updateVolumeMetadataBatch)
+}
+
+// getMetadataSyncWorkers returns the number of workers set by the
+// METADATA_SYNC_WORKERS environment variable, or the default.
+func getMetadataSyncWorkers() int {
+	workers := getNonNegativeEnv(envMetadataSyncWorkers, defaultMetadataSyncWorkers, -1)
+	if workers == 0 {
+		klog.Warningf("%s must be at least 1, will use the default %d workers", envMetadataSyncWorkers, defaultMetadataSyncWorkers)
+		workers = defaultMetadataSyncWorkers
+	}
+	return workers
+}
+
+// runVolumeWorkers processes the volume queue with the given number of
+// workers until stopCh is closed.
+func (metadataSyncer *MetadataSyncInformer) runVolumeWorkers(workers int, stopCh <-chan struct{}) {
+	klog.V(2).Infof("Starting %d metadata syncer workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() {
+			for metadataSyncer.processNextVolume() {
+			}
+		}, time.Second, stopCh)
+	}
+	go func() {
+		<-stopCh
+		metadataSyncer.volumeQueue.ShutDown()
+	}()
+}
+
+// enqueueVolumeOperation adds an operation to the pending operations of the
+// volume and queues the volume. Operations on the same volume are run in
+// order, by one worker at a time.
+func (metadataSyncer *MetadataSyncInformer) enqueueVolumeOperation(volumeID string, op volumeOperation) {
+	metadataSyncer.pendingLock.Lock()
+	metadataSyncer.pendingOperations[volumeID] = addVolumeOperation(metadataSyncer.pendingOperations[volumeID], op)
+	metadataSyncer.pendingLock.Unlock()
+	metadataSyncer.volumeQueue.Add(volumeID)
+}
+
+// addVolumeOperation returns the pending operations with op appended. A
+// pending operation with the same key is superseded by op, and deleting the
+// volume supersedes all pending operations, so rapid successive changes
+// result in a single CNS call.
+func addVolumeOperation(pending []volumeOperation, op volumeOperation) []volumeOperation {
+	if op.key == deleteVolumeOperation {
+		return []volumeOperation{op}
+	}
+	ops := make([]volumeOperation, 0, len(pending)+1)
+	for _, pendingOp := range pending {
+		if pendingOp.key != op.key {
+			ops = append(ops, pendingOp)
+		}
+	}
+	return append(ops, op)
+}
+
+// processNextVolume runs the pending operations of the next volume in the
+// queue. Trailing metadata updates are handed to the metadata batcher, which
+// finishes processing the volume once its batch is submitted. It returns
+// false once the queue is shut down.
+func (metadataSyncer *MetadataSyncInformer) processNextVolume() bool {
+	key, quit := metadataSyncer.volumeQueue.Get()
+	if quit {
+		return false
+	}
+	volumeID := key.(string)
+
+	metadataSyncer.pendingLock.Lock()
+	ops := metadataSyncer.pendingOperations[volumeID]
+	delete(metadataSyncer.pendingOperations, volumeID)
+	metadataSyncer.pendingLock.Unlock()
+
+	if !metadataSyncer.isLeading() {
+		// The next leader reconciles the volume in its first full sync
+		klog.V(3).Infof("Dropping %d operations on volume %s, metadata syncer is not the leader", len(ops), volumeID)
+		metadataSyncer.volumeQueue.Forget(key)
+		metadataSyncer.volumeQueue.Done(key)
+		return true
+	}
+	for i, op := range ops {
+		if onlyMetadataUpdates(ops[i:]) {
+			metadataSyncer.metadataBatcher.add(metadataUpdate{volumeID: volumeID, ops: ops[i:]})
+			return true
+		}
+		if err := metadataSyncer.runVolumeOperation(volumeID, op); err != nil {
+			metadataSyncer.retryVolumeOperations(volumeID, ops[i:], err)
+			metadataSyncer.volumeQueue.Done(key)
+			return true
+		}
+	}
+	metadataSyncer.volumeQueue.Forget(key)
+	metadataSyncer.volumeQueue.Done(key)
+	return true
+}
+
+// onlyMetadataUpdates returns true if ops are metadata updates only.
+func onlyMetadataUpdates(ops []volumeOperation) bool {
+	for _, op := range ops {
+		if op.updateSpec == nil {
+			return false
+		}
+	}
+	return len(ops) > 0
+}
+
+// runVolumeOperation runs a single operation on CNS.
+func (metadataSyncer *MetadataSyncInformer) runVolumeOperation(volumeID string, op volumeOperation) error {
+	switch {
+	case op.createSpec != nil:
+		metadataSyncer.volumeLocks.lock(volumeID)
+		defer metadataSyncer.volumeLocks.unlock(volumeID)
+		// Full sync or an earlier event may have registered the volume
+		queryResult, err := metadataSyncer.volumeManager.QueryVolume(cnstypes.CnsQueryFilter{
+			VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+		})
+		if err != nil {
+			klog.Errorf("%s: QueryVolume failed for volume %s with err %v", op.caller, volumeID, err)
+			return err
+		}
+		if len(queryResult.Volumes) > 0 {
+			klog.V(4).Infof("%s: volume %s is already registered in CNS", op.caller, volumeID)
+			return nil
+		}
+		klog.V(4).Infof("%s: vSphere provisioner creating volume %s with create spec %+v", op.caller, op.createSpec.Name, spew.Sdump(op.createSpec))
+		if _, err := metadataSyncer.volumeManager.CreateVolume(op.createSpec); err != nil {
+			klog.Errorf("%s: Failed to create disk %s with error %+v", op.caller, op.createSpec.Name, err)
+			return err
+		}
+	case op.key == deleteVolumeOperation:
+		metadataSyncer.volumeLocks.lock(volumeID)
+		defer metadataSyncer.volumeLocks.unlock(volumeID)
+		klog.V(4).Infof("%s: vSphere provisioner deleting volume %s with delete disk %v", op.caller, volumeID, op.deleteDisk)
+		if err := metadataSyncer.volumeManager.DeleteVolume(volumeID, op.deleteDisk); err != nil {
+			klog.Errorf("%s: Failed to delete disk %s with error %+v", op.caller, volumeID, err)
+			return err
+		}
+	default:
+		klog.V(4).Infof("%s: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", op.caller, volumeID, spew.Sdump(op.updateSpec))
+		if err := metadataSyncer.volumeManager.UpdateVolumeMetadata(op.updateSpec); err != nil {
+			klog.Errorf("%s: UpdateVolumeMetadata failed for volume %s with err %v", op.caller, volumeID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// retryVolumeOperations queues the volume again with backoff, with the failed
+// operation and the ones after it ahead of the operations queued meanwhile.
+// Once the retries are exhausted, the operations are left to full sync.
+func (metadataSyncer *MetadataSyncInformer) retryVolumeOperations(volumeID string, ops []volumeOperation, err error) {
+	retries := metadataSyncer.volumeQueue.NumRequeues(volumeID)
+	if retries >= metadataSyncer.volumeQueueMaxRetries {
+		klog.Errorf("Giving up %d operations on volume %s after %d retries, full sync will reconcile the volume. Last err: %v",
+			len(ops), volumeID, retries, err)
+		metadataSyncer.volumeQueue.Forget(volumeID)
+		return
+	}
+	metadataSyncer.pendingLock.Lock()
+	for _, op := range metadataSyncer.pendingOperations[volumeID] {
+		ops = addVolumeOperation(ops, op)
+	}
+	metadataSyncer.pendingOperations[volumeID] = ops
+	metadataSyncer.pendingLock.Unlock()
+	klog.Warningf("Retrying %d operations on volume %s, attempt %d. Err: %v", len(ops), volumeID, retries+1, err)
+	metadataSyncer.volumeQueue.AddRateLimited(volumeID)
+}
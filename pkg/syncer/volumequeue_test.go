@@ -0,0 +1,166 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume/fake"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestVolumeQueue(t *testing.T) {
+	fakeCns := fake.NewManager()
+	syncer := NewInformer()
+	syncer.volumeManager = fakeCns
+	syncer.volumeQueue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, 10*time.Millisecond))
+	syncer.volumeQueueMaxRetries = 2
+	syncer.setLeading(true)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	volumeID, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{Name: "pv-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(entityType cnstypes.CnsKubernetesEntityType, name string, labels map[string]string) volumeOperation {
+		metadata := cnsvsphere.GetCnsKubernetesEntityMetaData(name, labels, false, string(entityType), testNamespace)
+		return metadataOperation("test", &cnstypes.CnsVolumeMetadataUpdateSpec{
+			VolumeId: *volumeID,
+			Metadata: cnstypes.CnsVolumeMetadata{EntityMetadata: []cnstypes.BaseCnsEntityMetadata{metadata}},
+		})
+	}
+	waitFor := func(condition func() bool) {
+		if err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+			return condition(), nil
+		}); err != nil {
+			t.Fatalf("Timed out waiting for the volume queue: %v", err)
+		}
+	}
+	idle := func() bool {
+		syncer.pendingLock.Lock()
+		defer syncer.pendingLock.Unlock()
+		return len(syncer.pendingOperations) == 0 && syncer.volumeQueue.Len() == 0 && syncer.volumeQueue.NumRequeues(volumeID.Id) == 0
+	}
+
+	// Successive changes of the PVC are coalesced, the updates of the volume
+	// are merged in a single spec and a transient failure is retried
+	syncer.enqueueVolumeOperation(volumeID.Id, update(cnstypes.CnsKubernetesEntityTypePVC, "pvc-1", map[string]string{"app": "old"}))
+	syncer.enqueueVolumeOperation(volumeID.Id, update(cnstypes.CnsKubernetesEntityTypePOD, "pod-1", nil))
+	syncer.enqueueVolumeOperation(volumeID.Id, update(cnstypes.CnsKubernetesEntityTypePVC, "pvc-1", map[string]string{"app": "new"}))
+	if ops := syncer.pendingOperations[volumeID.Id]; len(ops) != 2 {
+		t.Fatalf("Expected 2 pending operations after coalescing, got %d", len(ops))
+	}
+	fakeCns.InjectFault(fake.UpdateVolumeMetadataBatch, errors.New("vCenter is unavailable"), 1)
+	syncer.runVolumeWorkers(2, stopCh)
+	waitFor(func() bool { return fakeCns.Calls(fake.UpdateVolumeMetadataBatch) == 2 && idle() })
+	vol, _ := fakeCns.Volume(volumeID.Id)
+	if len(vol.Metadata.EntityMetadata) != 2 {
+		t.Fatalf("Expected the PVC and pod entities on the volume, got %+v", vol.Metadata.EntityMetadata)
+	}
+	for _, entity := range vol.Metadata.EntityMetadata {
+		entity := entity.(*cnstypes.CnsKubernetesEntityMetadata)
+		if entity.EntityName == "pvc-1" && (len(entity.Labels) != 1 || entity.Labels[0].Value != "new") {
+			t.Errorf("Expected the latest PVC labels on the volume, got %+v", entity.Labels)
+		}
+	}
+
+	// Retries are bounded
+	fakeCns.InjectFault(fake.UpdateVolumeMetadataBatch, errors.New("vCenter is unavailable"), 10)
+	syncer.enqueueVolumeOperation(volumeID.Id, update(cnstypes.CnsKubernetesEntityTypePV, "pv-1", nil))
+	waitFor(func() bool { return fakeCns.Calls(fake.UpdateVolumeMetadataBatch) == 5 && idle() })
+	fakeCns.ClearFaults()
+
+	// Deleting the volume supersedes its pending operations, and replicas
+	// which are not leading do not run operations
+	deleteOp := volumeOperation{key: deleteVolumeOperation, caller: "test"}
+	if ops := addVolumeOperation([]volumeOperation{update(cnstypes.CnsKubernetesEntityTypePV, "pv-1", nil)}, deleteOp); len(ops) != 1 {
+		t.Fatalf("Expected the deletion to supersede pending operations, got %d", len(ops))
+	}
+	syncer.setLeading(false)
+	syncer.enqueueVolumeOperation(volumeID.Id, deleteOp)
+	waitFor(idle)
+	if _, ok := fakeCns.Volume(volumeID.Id); !ok {
+		t.Errorf("Expected the volume not to be deleted by a replica which is not leading")
+	}
+}
+
+func TestMetadataBatching(t *testing.T) {
+	fakeCns := fake.NewManager()
+	syncer := NewInformer()
+	syncer.volumeManager = fakeCns
+	syncer.volumeQueue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, 10*time.Millisecond))
+	syncer.metadataBatcher = newMetadataBatcher(2, time.Hour, syncer.updateVolumeMetadataBatch)
+	syncer.setLeading(true)
+
+	var volumeIDs []string
+	for _, name := range []string{"pv-1", "pv-2", "pv-3"} {
+		volumeID, err := fakeCns.CreateVolume(&cnstypes.CnsVolumeCreateSpec{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, volumeID.Id)
+		metadata := cnsvsphere.GetCnsKubernetesEntityMetaData(name, map[string]string{"app": "db"}, false, string(cnstypes.CnsKubernetesEntityTypePV), "")
+		syncer.enqueueVolumeOperation(volumeID.Id, metadataOperation("test", &cnstypes.CnsVolumeMetadataUpdateSpec{
+			VolumeId: *volumeID,
+			Metadata: cnstypes.CnsVolumeMetadata{EntityMetadata: []cnstypes.BaseCnsEntityMetadata{metadata}},
+		}))
+	}
+	updated := func(volumeID string) bool {
+		vol, _ := fakeCns.Volume(volumeID)
+		return len(vol.Metadata.EntityMetadata) == 1
+	}
+
+	// The updates are submitted once a batch is full, and a fault of a
+	// single volume only fails its update
+	fakeCns.InjectVolumeFault(volumeIDs[0], errors.New("The object or item referred to could not be found."), 1)
+	for syncer.volumeQueue.Len() > 0 {
+		syncer.processNextVolume()
+	}
+	if calls := fakeCns.Calls(fake.UpdateVolumeMetadataBatch); calls != 1 {
+		t.Fatalf("Expected a full batch to be submitted, got %d calls", calls)
+	}
+	syncer.metadataBatcher.wait()
+	if calls := fakeCns.Calls(fake.UpdateVolumeMetadataBatch); calls != 2 {
+		t.Fatalf("Expected the partial batch to be submitted, got %d calls", calls)
+	}
+	if updated(volumeIDs[0]) || !updated(volumeIDs[1]) || !updated(volumeIDs[2]) {
+		t.Fatalf("Expected the metadata of all volumes but the failed one to be updated")
+	}
+	if retries := syncer.volumeQueue.NumRequeues(volumeIDs[0]); retries != 1 {
+		t.Fatalf("Expected the failed volume to be retried, got %d retries", retries)
+	}
+
+	if err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		for syncer.volumeQueue.Len() > 0 {
+			syncer.processNextVolume()
+		}
+		syncer.metadataBatcher.wait()
+		return updated(volumeIDs[0]), nil
+	}); err != nil {
+		t.Fatalf("Timed out waiting for the retry of the failed volume: %v", err)
+	}
+	if calls := fakeCns.Calls(fake.UpdateVolumeMetadataBatch); calls != 3 {
+		t.Errorf("Expected the failed volume alone to be retried, got %d calls", calls)
+	}
+}